@@ -0,0 +1,90 @@
+// Command rotate-storage-keys gives workspaces new key-encryption keys for
+// their stored audience files and rewraps the files' data keys with them.
+// The files themselves are not re-encrypted, and old keys stay in the KMS so
+// nothing becomes unreadable partway through.
+//
+//	go run ./cmd/rotate-storage-keys [-workspace id]
+//
+// Without -workspace every workspace is rotated. It needs STORAGE_ENCRYPTION
+// to be set, and exits with status 1 if any workspace fails.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"main-server/config"
+	"main-server/services"
+
+	_ "github.com/lib/pq"
+)
+
+func main() {
+	workspace := flag.String("workspace", "", "rotate only this workspace's keys")
+	flag.Parse()
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal("Failed to load configuration")
+	}
+
+	storage, err := services.OpenStorage(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rotator, ok := storage.(services.KeyRotator)
+	if !ok {
+		log.Fatal("Storage is not encrypted; set STORAGE_ENCRYPTION")
+	}
+
+	ctx := context.Background()
+	workspaces := []string{*workspace}
+	if *workspace == "" {
+		if workspaces, err = allWorkspaces(ctx, cfg); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	failed := 0
+	for _, id := range workspaces {
+		version, n, err := rotator.RotateKeys(ctx, id)
+		if err != nil {
+			failed++
+			fmt.Printf("workspace %s: FAILED: %v\n", id, err)
+			continue
+		}
+		fmt.Printf("workspace %s: key version %s, %d data keys rewrapped\n", id, version, n)
+	}
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func allWorkspaces(ctx context.Context, cfg *config.Config) ([]string, error) {
+	db, err := sql.Open("postgres", cfg.Database.ConnString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, `SELECT id::text FROM workspaces ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query workspaces: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -1,8 +1,14 @@
 package config
 
 import (
+	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -17,6 +23,101 @@ type Config struct {
 	Database    *DatabaseConfig
 	BaseURL     string
 	UploadDir   string
+
+	// Where audience files are stored: "local" (under UploadDir) or "s3"
+	StorageBackend string
+	S3Bucket       string
+	S3Region       string
+
+	// Signs the URLs local storage hands out for direct uploads and
+	// downloads, and audience file download links, which are valid for
+	// DownloadLinkTTL. Defaults to SessionKey.
+	StorageSigningKey string
+	DownloadLinkTTL   time.Duration
+
+	// S3-compatible servers such as MinIO need an endpoint and usually
+	// path-style addressing
+	S3Endpoint       string
+	S3ForcePathStyle bool
+
+	// Server-side encryption for S3 objects: "", "AES256" or "aws:kms"
+	S3SSE         string
+	S3SSEKMSKeyID string
+
+	// Client-side encryption of stored files: "" for none or "local", which
+	// keeps each workspace's key-encryption keys in StorageKeysDir, sealed
+	// with StorageMasterKey, a base64 32-byte key
+	StorageEncryption string
+	StorageKeysDir    string
+	StorageMasterKey  string
+
+	// Layers wrapped around the backend, outermost first, from "logging",
+	// "metrics", "retry" and "cache". Logging marks operations slower than
+	// StorageLogSlow; retry makes up to StorageRetryAttempts attempts,
+	// backing off from StorageRetryBaseDelay; the cache keeps up to
+	// StorageCacheSizeMB of downloads in StorageCacheDir
+	StorageLayers         string
+	StorageLogSlow        time.Duration
+	StorageRetryAttempts  int
+	StorageRetryBaseDelay time.Duration
+	StorageCacheDir       string
+	StorageCacheSizeMB    int
+
+	// Resumable uploads: the part size browsers send, the largest file
+	// accepted, and how long an upload may sit idle before it is discarded
+	UploadPartSizeMB int
+	UploadMaxSizeMB  int
+	UploadSessionTTL time.Duration
+
+	// Direct uploads send files no larger than DirectUploadMaxSizeMB straight
+	// to storage with a presigned request, valid for DirectUploadExpiry
+	DirectUploadMaxSizeMB int
+	DirectUploadExpiry    time.Duration
+
+	// Malware scanner uploads are checked with: "" for none or "clamav",
+	// reached at ClamAVAddr, a host:port or unix socket path
+	MalwareScanner string
+	ClamAVAddr     string
+	ClamAVTimeout  time.Duration
+
+	// How often stored audience file contents nothing refers to are removed
+	BlobCollectionInterval time.Duration
+
+	// How long deleted audience files stay in the trash, and how often
+	// retention policies are applied and the trash is emptied
+	AudienceTrashTTL          time.Duration
+	AudienceLifecycleInterval time.Duration
+
+	// How long a super admin's impersonation session lasts
+	ImpersonationTTL time.Duration
+
+	// Audit events are buffered in memory and written to audit_logs in
+	// batches of AuditBatchSize, at least every AuditFlushInterval
+	AuditQueueSize     int
+	AuditBatchSize     int
+	AuditFlushInterval time.Duration
+
+	// Base64 Ed25519 seed used to sign audit chain checkpoints, and how often
+	// they are taken. Checkpoints are skipped when no key is set.
+	AuditSigningKey         string
+	AuditCheckpointInterval time.Duration
+
+	// How often the retention job archives expired audit logs to storage.
+	// Rows without a company are kept for AuditPlatformRetentionDays, where
+	// 0 keeps them forever.
+	AuditRetentionInterval     time.Duration
+	AuditPlatformRetentionDays int
+
+	// Live audit streams allowed at once
+	AuditStreamMaxSubscribers int
+
+	// YAML file with the security alert rules and notifiers
+	AlertRulesFile string
+
+	// Proxies believed about the client's IP address, and the one header
+	// they set it in: Forwarded, X-Forwarded-For or X-Real-IP
+	TrustedProxies     []*net.IPNet
+	TrustedProxyHeader string
 }
 
 type DatabaseConfig struct {
@@ -28,6 +129,12 @@ type DatabaseConfig struct {
 	SSLMode  string
 }
 
+// ConnString is the lib/pq connection string for d.
+func (d *DatabaseConfig) ConnString() string {
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		d.Host, d.Port, d.User, d.Password, d.Name, d.SSLMode)
+}
+
 func Load() (*Config, error) {
 	env := os.Getenv("GO_ENV")
 	if env == "" {
@@ -50,22 +157,146 @@ func Load() (*Config, error) {
 
 	debug := getEnv("DEBUG", "true") == "true"
 
+	trustedProxies, err := parseCIDRList(getEnv("TRUSTED_PROXIES", "127.0.0.1/32,::1/128"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+	}
+	trustedProxyHeader := http.CanonicalHeaderKey(getEnv("TRUSTED_PROXY_HEADER", "X-Forwarded-For"))
+	switch trustedProxyHeader {
+	case "Forwarded", "X-Forwarded-For", "X-Real-Ip":
+	default:
+		return nil, fmt.Errorf("invalid TRUSTED_PROXY_HEADER %q: must be Forwarded, X-Forwarded-For or X-Real-IP", trustedProxyHeader)
+	}
+
+	sessionKey := getEnv("SESSION_KEY", "default-dev-key")
+
 	return &Config{
 		Port:        getEnv("PORT", "8080"),
 		Environment: getEnv("ENVIRONMENT", env),
 		Version:     getEnv("VERSION", "1.0.0"),
-		SessionKey:  getEnv("SESSION_KEY", "default-dev-key"),
+		SessionKey:  sessionKey,
 		Debug:       debug,
 		LogLevel:    getEnv("LOG_LEVEL", "debug"),
 		Database:    dbConfig,
 		BaseURL:     getEnv("BASE_URL", "http://localhost:8080"),
 		UploadDir:   getEnv("UPLOAD_DIR", "./uploads"),
+
+		StorageBackend: getEnv("STORAGE_BACKEND", "local"),
+		S3Bucket:       getEnv("S3_BUCKET", ""),
+		S3Region:       getEnv("AWS_REGION", "us-east-1"),
+
+		StorageSigningKey: getEnv("STORAGE_SIGNING_KEY", sessionKey),
+		DownloadLinkTTL:   getDurationEnv("DOWNLOAD_LINK_TTL", 15*time.Minute),
+
+		S3Endpoint:       getEnv("S3_ENDPOINT", ""),
+		S3ForcePathStyle: getEnv("S3_FORCE_PATH_STYLE", "false") == "true",
+		S3SSE:            getEnv("S3_SSE", ""),
+		S3SSEKMSKeyID:    getEnv("S3_SSE_KMS_KEY_ID", ""),
+
+		StorageEncryption: getEnv("STORAGE_ENCRYPTION", ""),
+		StorageKeysDir:    getEnv("STORAGE_KEYS_DIR", "./keys"),
+		StorageMasterKey:  getEnv("STORAGE_MASTER_KEY", ""),
+
+		StorageLayers:         getEnv("STORAGE_LAYERS", "logging,metrics,retry"),
+		StorageLogSlow:        getDurationEnv("STORAGE_LOG_SLOW", time.Second),
+		StorageRetryAttempts:  getIntEnv("STORAGE_RETRY_ATTEMPTS", 3),
+		StorageRetryBaseDelay: getDurationEnv("STORAGE_RETRY_BASE_DELAY", 100*time.Millisecond),
+		StorageCacheDir:       getEnv("STORAGE_CACHE_DIR", "./cache"),
+		StorageCacheSizeMB:    getIntEnv("STORAGE_CACHE_SIZE_MB", 1024),
+
+		UploadPartSizeMB: getIntEnv("UPLOAD_PART_SIZE_MB", 8),
+		UploadMaxSizeMB:  getIntEnv("UPLOAD_MAX_SIZE_MB", 10240),
+		UploadSessionTTL: getDurationEnv("UPLOAD_SESSION_TTL", 24*time.Hour),
+
+		DirectUploadMaxSizeMB: getIntEnv("DIRECT_UPLOAD_MAX_SIZE_MB", 100),
+		DirectUploadExpiry:    getDurationEnv("DIRECT_UPLOAD_EXPIRY", time.Hour),
+
+		MalwareScanner: getEnv("MALWARE_SCANNER", ""),
+		ClamAVAddr:     getEnv("CLAMAV_ADDR", "localhost:3310"),
+		ClamAVTimeout:  getDurationEnv("CLAMAV_TIMEOUT", 2*time.Minute),
+
+		BlobCollectionInterval: getDurationEnv("BLOB_COLLECTION_INTERVAL", 24*time.Hour),
+
+		AudienceTrashTTL:          getDurationEnv("AUDIENCE_TRASH_TTL", 30*24*time.Hour),
+		AudienceLifecycleInterval: getDurationEnv("AUDIENCE_LIFECYCLE_INTERVAL", time.Hour),
+
+		ImpersonationTTL: getDurationEnv("IMPERSONATION_TTL", 30*time.Minute),
+
+		AuditQueueSize:     getIntEnv("AUDIT_QUEUE_SIZE", 10000),
+		AuditBatchSize:     getIntEnv("AUDIT_BATCH_SIZE", 100),
+		AuditFlushInterval: getDurationEnv("AUDIT_FLUSH_INTERVAL", time.Second),
+
+		AuditSigningKey:         getEnv("AUDIT_SIGNING_KEY", ""),
+		AuditCheckpointInterval: getDurationEnv("AUDIT_CHECKPOINT_INTERVAL", time.Hour),
+
+		AuditRetentionInterval:     getDurationEnv("AUDIT_RETENTION_INTERVAL", 24*time.Hour),
+		AuditPlatformRetentionDays: getIntEnv("AUDIT_PLATFORM_RETENTION_DAYS", 365),
+
+		AuditStreamMaxSubscribers: getIntEnv("AUDIT_STREAM_MAX_SUBSCRIBERS", 20),
+
+		AlertRulesFile: getEnv("ALERT_RULES_FILE", "./alert_rules.yaml"),
+
+		TrustedProxies:     trustedProxies,
+		TrustedProxyHeader: trustedProxyHeader,
 	}, nil
 }
 
+// parseCIDRList parses comma-separated CIDR ranges. A bare address is a
+// range of one.
+func parseCIDRList(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
 	}
 	return defaultValue
 }
+
+func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration for %s: %q, using %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
+func getIntEnv(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid number for %s: %q, using %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
@@ -0,0 +1,21 @@
+-- Bulk user imports
+CREATE TABLE user_imports (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER REFERENCES companies(id) ON DELETE CASCADE,
+    created_by INTEGER REFERENCES users(id),
+    original_filename VARCHAR(255) NOT NULL,
+    status VARCHAR(50) NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'queued', 'processing', 'completed', 'failed')),
+    total_rows INTEGER NOT NULL DEFAULT 0,
+    accepted_rows INTEGER NOT NULL DEFAULT 0,
+    rejected_rows INTEGER NOT NULL DEFAULT 0,
+    invited_rows INTEGER NOT NULL DEFAULT 0,
+    report JSONB NOT NULL DEFAULT '[]',
+    error_message TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    committed_at TIMESTAMP,
+    completed_at TIMESTAMP
+);
+
+CREATE INDEX idx_user_imports_company ON user_imports(company_id);
+CREATE INDEX idx_invitations_company ON invitations(company_id);
@@ -0,0 +1,27 @@
+-- Company-defined role templates (named bundles of capabilities)
+CREATE TABLE role_templates (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER REFERENCES companies(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    capabilities TEXT[] NOT NULL DEFAULT '{}',
+    created_by INTEGER REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(company_id, name)
+);
+
+-- A user with a template gets its capabilities instead of the role defaults
+ALTER TABLE users ADD COLUMN role_template_id INTEGER REFERENCES role_templates(id) ON DELETE SET NULL;
+
+-- Per-user grants (granted = true) and revocations (granted = false)
+CREATE TABLE user_permission_overrides (
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    capability VARCHAR(50) NOT NULL,
+    granted BOOLEAN NOT NULL,
+    granted_by INTEGER REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, capability)
+);
+
+CREATE INDEX idx_role_templates_company ON role_templates(company_id);
+CREATE INDEX idx_users_role_template ON users(role_template_id);
@@ -0,0 +1,19 @@
+-- Support sessions where a super admin acts as another user
+CREATE TABLE impersonation_sessions (
+    id SERIAL PRIMARY KEY,
+    impersonator_id INTEGER REFERENCES users(id) NOT NULL,
+    user_id INTEGER REFERENCES users(id) NOT NULL,
+    reason TEXT NOT NULL,
+    ip_address VARCHAR(45),
+    started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    ended_at TIMESTAMP
+);
+
+-- Audit rows written during an impersonation carry the real identity too
+ALTER TABLE audit_logs ADD COLUMN impersonator_id INTEGER REFERENCES users(id);
+ALTER TABLE audit_logs ADD COLUMN impersonation_session_id INTEGER REFERENCES impersonation_sessions(id);
+
+CREATE INDEX idx_impersonation_sessions_impersonator ON impersonation_sessions(impersonator_id);
+CREATE INDEX idx_impersonation_sessions_user ON impersonation_sessions(user_id);
+CREATE INDEX idx_audit_logs_impersonator ON audit_logs(impersonator_id);
@@ -0,0 +1,101 @@
+-- Row-level security for tenant data.
+--
+-- Requests with a signed-in user run on a connection where the application
+-- has set app.user_id, app.company_id, app.workspace_id and app.role (see
+-- database.BindTenant) and switched to the app_tenant role. The policies
+-- below filter every tenant table by those settings. Background jobs and
+-- unauthenticated requests keep the owner role and are not filtered.
+--
+-- Tables added by later migrations that carry a company_id should enable
+-- RLS with the same tenant_isolation policy.
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = 'app_tenant') THEN
+        CREATE ROLE app_tenant NOLOGIN NOBYPASSRLS;
+    END IF;
+END
+$$;
+
+GRANT app_tenant TO CURRENT_USER;
+GRANT USAGE ON SCHEMA public TO app_tenant;
+GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO app_tenant;
+GRANT USAGE, SELECT ON ALL SEQUENCES IN SCHEMA public TO app_tenant;
+ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO app_tenant;
+ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT USAGE, SELECT ON SEQUENCES TO app_tenant;
+
+CREATE OR REPLACE FUNCTION app_current_user() RETURNS integer AS $$
+    SELECT NULLIF(current_setting('app.user_id', true), '')::integer
+$$ LANGUAGE sql STABLE;
+
+CREATE OR REPLACE FUNCTION app_current_company() RETURNS integer AS $$
+    SELECT NULLIF(current_setting('app.company_id', true), '')::integer
+$$ LANGUAGE sql STABLE;
+
+CREATE OR REPLACE FUNCTION app_current_workspace() RETURNS integer AS $$
+    SELECT NULLIF(current_setting('app.workspace_id', true), '')::integer
+$$ LANGUAGE sql STABLE;
+
+CREATE OR REPLACE FUNCTION app_current_role() RETURNS text AS $$
+    SELECT NULLIF(current_setting('app.role', true), '')
+$$ LANGUAGE sql STABLE;
+
+-- Mirrors models.User.CanAccessCompany. Unknown or missing roles see nothing.
+CREATE OR REPLACE FUNCTION app_can_access_company(target integer) RETURNS boolean AS $$
+    SELECT CASE app_current_role()
+        WHEN 'super_admin' THEN true
+        WHEN 'workspace_admin' THEN EXISTS (
+            SELECT 1 FROM companies WHERE id = target AND workspace_id = app_current_workspace()
+        )
+        WHEN 'company_admin' THEN target = app_current_company()
+        WHEN 'user' THEN target = app_current_company()
+        ELSE false
+    END
+$$ LANGUAGE sql STABLE;
+
+ALTER TABLE users ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON users
+    USING (id = app_current_user() OR app_can_access_company(company_id))
+    WITH CHECK (app_can_access_company(company_id));
+
+ALTER TABLE audience_files ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON audience_files
+    USING (app_can_access_company(company_id))
+    WITH CHECK (app_can_access_company(company_id));
+
+ALTER TABLE destinations ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON destinations
+    USING (app_can_access_company(company_id))
+    WITH CHECK (app_can_access_company(company_id));
+
+ALTER TABLE campaigns ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON campaigns
+    USING (app_can_access_company(company_id))
+    WITH CHECK (app_can_access_company(company_id));
+
+ALTER TABLE invitations ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON invitations
+    USING (app_can_access_company(company_id))
+    WITH CHECK (app_can_access_company(company_id));
+
+ALTER TABLE user_imports ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON user_imports
+    USING (app_can_access_company(company_id))
+    WITH CHECK (app_can_access_company(company_id));
+
+ALTER TABLE role_templates ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON role_templates
+    USING (app_can_access_company(company_id))
+    WITH CHECK (app_can_access_company(company_id));
+
+-- Audit rows without a company are platform-level and visible to super admins
+ALTER TABLE audit_logs ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON audit_logs
+    USING (app_can_access_company(company_id) OR (company_id IS NULL AND app_current_role() = 'super_admin'))
+    WITH CHECK (company_id IS NULL OR app_can_access_company(company_id));
+
+-- Overrides follow the visibility of the user they belong to
+ALTER TABLE user_permission_overrides ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON user_permission_overrides
+    USING (EXISTS (SELECT 1 FROM users u WHERE u.id = user_id))
+    WITH CHECK (EXISTS (SELECT 1 FROM users u WHERE u.id = user_id));
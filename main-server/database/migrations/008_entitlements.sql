@@ -0,0 +1,22 @@
+-- Plan presets live in code (models.PlanPresets); workspaces pick one and
+-- workspaces.features holds workspace-wide defaults on top of it.
+ALTER TABLE workspaces ADD COLUMN plan VARCHAR(50) NOT NULL DEFAULT 'basic'
+    CHECK (plan IN ('basic', 'premium', 'business', 'enterprise'));
+
+-- Per-company overrides, applied last. Only the keys present are changed.
+ALTER TABLE companies ADD COLUMN features JSONB NOT NULL DEFAULT '{}';
+
+-- Metered usage per company and month, e.g. rows exported
+CREATE TABLE usage_counters (
+    company_id INTEGER REFERENCES companies(id) ON DELETE CASCADE,
+    metric VARCHAR(100) NOT NULL,
+    period_start DATE NOT NULL,
+    value BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (company_id, metric, period_start)
+);
+
+ALTER TABLE usage_counters ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON usage_counters
+    USING (app_can_access_company(company_id))
+    WITH CHECK (app_can_access_company(company_id));
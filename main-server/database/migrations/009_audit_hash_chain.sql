@@ -0,0 +1,140 @@
+-- Tamper-evident audit log.
+--
+-- Every audit_logs row belongs to a chain: one per company, plus chain 0 for
+-- rows without a company. On insert, audit_logs_chain() numbers the row
+-- within its chain and stores
+--
+--     row_hash = sha256(prev_hash || audit_log_payload(row))
+--
+-- where prev_hash is the row_hash of the previous row in the chain (empty
+-- for the first). Editing or removing a row breaks every hash after it.
+-- audit_checkpoints holds the head of each chain signed with the
+-- application's Ed25519 key, so the chain cannot simply be recomputed
+-- either. cmd/verify-audit checks both.
+
+ALTER TABLE audit_logs ADD COLUMN chain_seq BIGINT;
+ALTER TABLE audit_logs ADD COLUMN prev_hash BYTEA;
+ALTER TABLE audit_logs ADD COLUMN row_hash BYTEA;
+
+CREATE TABLE audit_chain_heads (
+    chain_id INTEGER PRIMARY KEY, -- company_id, or 0
+    chain_seq BIGINT NOT NULL,
+    row_hash BYTEA NOT NULL
+);
+
+CREATE TABLE audit_checkpoints (
+    id SERIAL PRIMARY KEY,
+    chain_id INTEGER NOT NULL,
+    chain_seq BIGINT NOT NULL,
+    row_hash BYTEA NOT NULL,
+    key_id VARCHAR(16) NOT NULL,
+    signature BYTEA NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX idx_audit_logs_chain ON audit_logs(COALESCE(company_id, 0), chain_seq);
+CREATE INDEX idx_audit_checkpoints_chain ON audit_checkpoints(chain_id, chain_seq);
+
+-- The hashed form of a row. services.AuditChainService recomputes hashes
+-- from this, so changing it invalidates every existing chain.
+CREATE OR REPLACE FUNCTION audit_log_payload(a audit_logs) RETURNS text AS $$
+    SELECT concat_ws('|',
+        a.id,
+        a.chain_seq,
+        COALESCE(a.user_id::text, ''),
+        a.action,
+        COALESCE(a.entity_type, ''),
+        COALESCE(a.entity_id::text, ''),
+        COALESCE(a.company_id::text, ''),
+        COALESCE(a.workspace_id::text, ''),
+        COALESCE(a.changes::text, ''),
+        COALESCE(a.ip_address, ''),
+        COALESCE(a.user_agent, ''),
+        to_char(a.created_at, 'YYYY-MM-DD"T"HH24:MI:SS.US'),
+        COALESCE(a.impersonator_id::text, ''),
+        COALESCE(a.impersonation_session_id::text, '')
+    )
+$$ LANGUAGE sql STABLE;
+
+-- Runs as the owner so app_tenant needs no access to audit_chain_heads.
+-- Locking the head row serialises inserts within a chain.
+CREATE OR REPLACE FUNCTION audit_logs_chain() RETURNS trigger AS $$
+DECLARE
+    head audit_chain_heads%ROWTYPE;
+BEGIN
+    IF NEW.created_at IS NULL THEN
+        NEW.created_at := CURRENT_TIMESTAMP;
+    END IF;
+
+    INSERT INTO audit_chain_heads (chain_id, chain_seq, row_hash)
+    VALUES (COALESCE(NEW.company_id, 0), 0, ''::bytea)
+    ON CONFLICT (chain_id) DO NOTHING;
+
+    SELECT * INTO head FROM audit_chain_heads
+    WHERE chain_id = COALESCE(NEW.company_id, 0)
+    FOR UPDATE;
+
+    NEW.chain_seq := head.chain_seq + 1;
+    NEW.prev_hash := head.row_hash;
+    NEW.row_hash := sha256(NEW.prev_hash || convert_to(audit_log_payload(NEW), 'UTF8'));
+
+    UPDATE audit_chain_heads
+    SET chain_seq = NEW.chain_seq, row_hash = NEW.row_hash
+    WHERE chain_id = head.chain_id;
+
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql SECURITY DEFINER SET search_path = public;
+
+-- Chain the rows written before this migration, oldest first.
+DO $$
+DECLARE
+    r audit_logs%ROWTYPE;
+    head audit_chain_heads%ROWTYPE;
+BEGIN
+    FOR r IN SELECT * FROM audit_logs ORDER BY created_at, id LOOP
+        INSERT INTO audit_chain_heads (chain_id, chain_seq, row_hash)
+        VALUES (COALESCE(r.company_id, 0), 0, ''::bytea)
+        ON CONFLICT (chain_id) DO NOTHING;
+
+        SELECT * INTO head FROM audit_chain_heads WHERE chain_id = COALESCE(r.company_id, 0);
+
+        r.chain_seq := head.chain_seq + 1;
+        r.prev_hash := head.row_hash;
+        r.row_hash := sha256(r.prev_hash || convert_to(audit_log_payload(r), 'UTF8'));
+
+        UPDATE audit_logs SET chain_seq = r.chain_seq, prev_hash = r.prev_hash, row_hash = r.row_hash
+        WHERE id = r.id;
+        UPDATE audit_chain_heads SET chain_seq = r.chain_seq, row_hash = r.row_hash
+        WHERE chain_id = head.chain_id;
+    END LOOP;
+END
+$$;
+
+ALTER TABLE audit_logs ALTER COLUMN chain_seq SET NOT NULL;
+ALTER TABLE audit_logs ALTER COLUMN prev_hash SET NOT NULL;
+ALTER TABLE audit_logs ALTER COLUMN row_hash SET NOT NULL;
+
+CREATE TRIGGER audit_logs_chain
+    BEFORE INSERT ON audit_logs
+    FOR EACH ROW EXECUTE FUNCTION audit_logs_chain();
+
+-- The log is append-only, for the owner role as well as app_tenant.
+CREATE OR REPLACE FUNCTION audit_logs_immutable() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_logs is append-only: % is not allowed', TG_OP
+        USING ERRCODE = 'insufficient_privilege';
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_logs_immutable
+    BEFORE UPDATE OR DELETE ON audit_logs
+    FOR EACH ROW EXECUTE FUNCTION audit_logs_immutable();
+
+CREATE TRIGGER audit_logs_no_truncate
+    BEFORE TRUNCATE ON audit_logs
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_logs_immutable();
+
+REVOKE UPDATE, DELETE, TRUNCATE ON audit_logs FROM app_tenant;
+REVOKE ALL ON audit_chain_heads FROM app_tenant;
+REVOKE INSERT, UPDATE, DELETE, TRUNCATE ON audit_checkpoints FROM app_tenant;
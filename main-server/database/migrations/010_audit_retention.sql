@@ -0,0 +1,97 @@
+-- Audit retention and archival.
+--
+-- services.AuditRetentionService moves audit_logs rows older than each
+-- workspace's audit_retention_days to gzipped NDJSON in storage, records
+-- the archive here, then deletes the rows. Archives can be restored into
+-- archived_audit_logs, which the application can only read. Rows without
+-- a company (chain 0) are archived on their own, with no workspace.
+
+CREATE TABLE audit_archives (
+    id SERIAL PRIMARY KEY,
+    workspace_id INTEGER REFERENCES workspaces(id),
+    status VARCHAR(20) NOT NULL DEFAULT 'archiving'
+        CHECK (status IN ('archiving', 'completed', 'failed')),
+    storage_key TEXT NOT NULL,
+    cutoff TIMESTAMP NOT NULL,
+    row_count INTEGER NOT NULL DEFAULT 0,
+    oldest_at TIMESTAMP,
+    newest_at TIMESTAMP,
+    size_bytes BIGINT NOT NULL DEFAULT 0,
+    sha256 VARCHAR(64),
+    -- Per chain: the first and last chain_seq archived and the last row_hash
+    chains JSONB NOT NULL DEFAULT '[]',
+    error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP,
+
+    -- Set while the archive is restored for an investigation
+    restored_by INTEGER REFERENCES users(id),
+    restored_at TIMESTAMP,
+    restore_expires_at TIMESTAMP
+);
+
+CREATE INDEX idx_audit_archives_workspace ON audit_archives(workspace_id, created_at);
+
+-- The last row removed from each chain, so cmd/verify-audit can check the
+-- remaining rows still link to it.
+CREATE TABLE audit_chain_anchors (
+    chain_id INTEGER PRIMARY KEY,
+    chain_seq BIGINT NOT NULL,
+    row_hash BYTEA NOT NULL,
+    archive_id INTEGER REFERENCES audit_archives(id),
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Restored rows, exactly as archived
+CREATE TABLE archived_audit_logs (
+    archive_id INTEGER REFERENCES audit_archives(id) ON DELETE CASCADE NOT NULL,
+    id INTEGER NOT NULL,
+    user_id INTEGER,
+    action VARCHAR(100) NOT NULL,
+    entity_type VARCHAR(50),
+    entity_id INTEGER,
+    company_id INTEGER,
+    workspace_id INTEGER,
+    changes JSONB,
+    ip_address VARCHAR(45),
+    user_agent TEXT,
+    created_at TIMESTAMP,
+    impersonator_id INTEGER,
+    impersonation_session_id INTEGER,
+    chain_seq BIGINT,
+    prev_hash BYTEA,
+    row_hash BYTEA,
+    PRIMARY KEY (archive_id, id)
+);
+
+CREATE INDEX idx_archived_audit_logs_created ON archived_audit_logs(archive_id, created_at);
+
+ALTER TABLE audit_archives ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON audit_archives
+    USING (app_current_role() = 'super_admin'
+        OR (app_current_role() = 'workspace_admin' AND workspace_id = app_current_workspace()))
+    WITH CHECK (app_current_role() = 'super_admin'
+        OR (app_current_role() = 'workspace_admin' AND workspace_id = app_current_workspace()));
+
+ALTER TABLE archived_audit_logs ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON archived_audit_logs
+    USING (app_can_access_company(company_id) OR (company_id IS NULL AND app_current_role() = 'super_admin'))
+    WITH CHECK (false);
+
+REVOKE INSERT, UPDATE, DELETE, TRUNCATE ON archived_audit_logs FROM app_tenant;
+REVOKE ALL ON audit_chain_anchors FROM app_tenant;
+
+-- Retention is the one thing allowed to delete audit rows. It runs as the
+-- owner role and sets app.audit_retention for the deleting transaction.
+CREATE OR REPLACE FUNCTION audit_logs_immutable() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE'
+        AND current_setting('app.audit_retention', true) = 'on'
+        AND current_user <> 'app_tenant' THEN
+        RETURN OLD;
+    END IF;
+
+    RAISE EXCEPTION 'audit_logs is append-only: % is not allowed', TG_OP
+        USING ERRCODE = 'insufficient_privilege';
+END
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,14 @@
+-- Announce new audit log rows to services.AuditStream, which serves the live
+-- audit event stream. The payload is only the row ID: notifications are
+-- limited to 8000 bytes, and listeners load the row themselves.
+
+CREATE OR REPLACE FUNCTION audit_logs_notify() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('audit_logs', NEW.id::text);
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_logs_notify
+    AFTER INSERT ON audit_logs
+    FOR EACH ROW EXECUTE FUNCTION audit_logs_notify();
@@ -0,0 +1,46 @@
+-- Security alerts raised by services.AlertService from the rules in
+-- ALERT_RULES_FILE.
+
+CREATE TABLE security_alerts (
+    id BIGSERIAL PRIMARY KEY,
+    rule VARCHAR(100) NOT NULL,
+    severity VARCHAR(20) NOT NULL CHECK (severity IN ('low', 'medium', 'high', 'critical')),
+    message TEXT NOT NULL,
+    -- The value the rule grouped events by, e.g. the IP address of a burst
+    -- of failed logins. Alerts with the same rule and key are suppressed for
+    -- the rule's cooldown.
+    group_key TEXT NOT NULL DEFAULT '',
+    company_id INTEGER REFERENCES companies(id),
+    workspace_id INTEGER REFERENCES workspaces(id),
+    event_ids BIGINT[] NOT NULL DEFAULT '{}',
+    status VARCHAR(20) NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'acknowledged')),
+    acknowledged_by INTEGER REFERENCES users(id),
+    acknowledged_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_security_alerts_created ON security_alerts(created_at DESC);
+CREATE INDEX idx_security_alerts_rule_key ON security_alerts(rule, group_key, created_at);
+
+-- Networks each subject has signed in from, for new_network rules
+CREATE TABLE alert_known_networks (
+    rule VARCHAR(100) NOT NULL,
+    subject TEXT NOT NULL,
+    network CIDR NOT NULL,
+    first_seen TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_seen TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (rule, subject, network)
+);
+
+-- Alerts without a company (e.g. failed logins for unknown emails) are only
+-- visible to super admins and, when they carry one, admins of the workspace.
+ALTER TABLE security_alerts ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON security_alerts
+    USING (app_can_access_company(company_id)
+        OR (company_id IS NULL AND (app_current_role() = 'super_admin'
+            OR (app_current_role() = 'workspace_admin' AND workspace_id = app_current_workspace()))))
+    WITH CHECK (app_can_access_company(company_id)
+        OR (company_id IS NULL AND (app_current_role() = 'super_admin'
+            OR (app_current_role() = 'workspace_admin' AND workspace_id = app_current_workspace()))));
+
+REVOKE ALL ON alert_known_networks FROM app_tenant;
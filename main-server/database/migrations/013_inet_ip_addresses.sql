@@ -0,0 +1,52 @@
+-- Store client IP addresses as INET so they can be searched by range.
+--
+-- audit_logs rows are hash-chained over their IP address text, and rows
+-- written before this migration may hold values that do not survive a cast
+-- (a whole X-Forwarded-For list, a port, a non-canonical IPv6 spelling). The
+-- original text moves to legacy_ip_address, which the chain payload prefers,
+-- so existing hashes still verify.
+
+-- NULL instead of an error for values that are not an address
+CREATE OR REPLACE FUNCTION try_inet(value text) RETURNS inet AS $$
+BEGIN
+    RETURN NULLIF(btrim(value), '')::inet;
+EXCEPTION WHEN others THEN
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql IMMUTABLE;
+
+ALTER TABLE audit_logs RENAME COLUMN ip_address TO legacy_ip_address;
+ALTER TABLE audit_logs ADD COLUMN ip_address INET;
+
+ALTER TABLE audit_logs DISABLE TRIGGER audit_logs_immutable;
+UPDATE audit_logs SET ip_address = try_inet(legacy_ip_address) WHERE legacy_ip_address IS NOT NULL;
+ALTER TABLE audit_logs ENABLE TRIGGER audit_logs_immutable;
+
+CREATE INDEX idx_audit_logs_ip ON audit_logs USING gist (ip_address inet_ops);
+
+CREATE OR REPLACE FUNCTION audit_log_payload(a audit_logs) RETURNS text AS $$
+    SELECT concat_ws('|',
+        a.id,
+        a.chain_seq,
+        COALESCE(a.user_id::text, ''),
+        a.action,
+        COALESCE(a.entity_type, ''),
+        COALESCE(a.entity_id::text, ''),
+        COALESCE(a.company_id::text, ''),
+        COALESCE(a.workspace_id::text, ''),
+        COALESCE(a.changes::text, ''),
+        COALESCE(a.legacy_ip_address, host(a.ip_address), ''),
+        COALESCE(a.user_agent, ''),
+        to_char(a.created_at, 'YYYY-MM-DD"T"HH24:MI:SS.US'),
+        COALESCE(a.impersonator_id::text, ''),
+        COALESCE(a.impersonation_session_id::text, '')
+    )
+$$ LANGUAGE sql STABLE;
+
+-- Restored rows keep the text that was archived
+ALTER TABLE archived_audit_logs RENAME COLUMN ip_address TO legacy_ip_address;
+ALTER TABLE archived_audit_logs ADD COLUMN ip_address INET;
+UPDATE archived_audit_logs SET ip_address = try_inet(legacy_ip_address);
+
+ALTER TABLE impersonation_sessions
+    ALTER COLUMN ip_address TYPE INET USING try_inet(ip_address);
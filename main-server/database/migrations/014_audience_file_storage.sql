@@ -0,0 +1,6 @@
+-- Audience files are stored under generated keys
+-- ({workspace}/{company}/{uuid}) in the configured storage backend, so the
+-- key identifies exactly one file.
+CREATE UNIQUE INDEX idx_audience_files_storage_path ON audience_files(storage_path);
+
+ALTER TABLE audience_files ADD COLUMN content_type VARCHAR(255);
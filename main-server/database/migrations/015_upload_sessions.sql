@@ -0,0 +1,51 @@
+-- Resumable uploads of large audience files. A session is opened with the
+-- file's size, its parts are uploaded (and retried) in any order, and
+-- completing it registers the audience file. Sessions with no activity
+-- before expires_at are aborted by services.ResumableUploadService.
+
+CREATE TABLE upload_sessions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    company_id INTEGER NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+    created_by INTEGER REFERENCES users(id),
+    filename VARCHAR(255) NOT NULL,
+    content_type VARCHAR(255),
+    total_size BIGINT NOT NULL CHECK (total_size > 0),
+    part_size BIGINT NOT NULL,
+    part_count INTEGER NOT NULL,
+    storage_key VARCHAR(500) NOT NULL UNIQUE,
+    storage_upload_id VARCHAR(1024) NOT NULL,
+    -- SHA-256 state after the first hashed_parts parts, kept while parts
+    -- arrive in order so completing needn't read the file back
+    hash_state BYTEA,
+    hashed_parts INTEGER NOT NULL DEFAULT 0,
+    status VARCHAR(20) NOT NULL DEFAULT 'active'
+        CHECK (status IN ('active', 'completed', 'aborted', 'expired')),
+    audience_file_id INTEGER REFERENCES audience_files(id) ON DELETE SET NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP
+);
+
+CREATE INDEX idx_upload_sessions_expiry ON upload_sessions(expires_at) WHERE status = 'active';
+
+CREATE TABLE upload_parts (
+    session_id UUID NOT NULL REFERENCES upload_sessions(id) ON DELETE CASCADE,
+    part_number INTEGER NOT NULL,
+    company_id INTEGER NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    size BIGINT NOT NULL,
+    sha256 VARCHAR(64) NOT NULL,
+    etag VARCHAR(255) NOT NULL,
+    uploaded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (session_id, part_number)
+);
+
+ALTER TABLE upload_sessions ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON upload_sessions
+    USING (app_can_access_company(company_id))
+    WITH CHECK (app_can_access_company(company_id));
+
+ALTER TABLE upload_parts ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON upload_parts
+    USING (app_can_access_company(company_id))
+    WITH CHECK (app_can_access_company(company_id));
@@ -0,0 +1,29 @@
+-- Audience files uploaded by the browser straight to storage with a
+-- presigned request. The upload is recorded when the request is signed and
+-- becomes an audience file when the client reports it finished and the
+-- stored object checks out. Objects of uploads never completed are removed
+-- by services.DirectUploadService.
+
+CREATE TABLE direct_uploads (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    company_id INTEGER NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+    created_by INTEGER REFERENCES users(id),
+    filename VARCHAR(255) NOT NULL,
+    content_type VARCHAR(255) NOT NULL,
+    size BIGINT NOT NULL CHECK (size > 0),
+    storage_key VARCHAR(500) NOT NULL UNIQUE,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'completed', 'failed', 'expired')),
+    audience_file_id INTEGER REFERENCES audience_files(id) ON DELETE SET NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP
+);
+
+CREATE INDEX idx_direct_uploads_expiry ON direct_uploads(expires_at) WHERE status = 'pending';
+
+ALTER TABLE direct_uploads ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON direct_uploads
+    USING (app_can_access_company(company_id))
+    WITH CHECK (app_can_access_company(company_id));
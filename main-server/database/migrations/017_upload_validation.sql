@@ -0,0 +1,13 @@
+-- New audience files are stored under a quarantine/ prefix with status
+-- 'quarantined' until services.IngestService has checked them. Files that
+-- pass are moved out of quarantine and become 'ready'; the rest become
+-- 'rejected', with the reason shown to the uploader, and their object is
+-- removed.
+
+ALTER TABLE audience_files ADD COLUMN detected_type VARCHAR(20);
+ALTER TABLE audience_files ADD COLUMN rejection_reason TEXT;
+-- Set while a worker checks the file, so a crashed check is retried
+ALTER TABLE audience_files ADD COLUMN validation_started_at TIMESTAMP;
+ALTER TABLE audience_files ADD COLUMN validated_at TIMESTAMP;
+
+CREATE INDEX idx_audience_files_quarantined ON audience_files(created_at) WHERE status = 'quarantined';
@@ -0,0 +1,31 @@
+-- Audience file contents are stored once per company. Each distinct SHA-256
+-- gets an audience_blobs row and a content-addressed object,
+-- {workspace}/{company}/{sha256}; every audience file with that content
+-- points at it, and ref_count counts them. Blobs nothing refers to any more
+-- are removed with their object by services.BlobCollector.
+
+CREATE TABLE audience_blobs (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    sha256 VARCHAR(64) NOT NULL,
+    size BIGINT NOT NULL,
+    storage_key VARCHAR(500) NOT NULL UNIQUE,
+    detected_type VARCHAR(20),
+    ref_count INTEGER NOT NULL DEFAULT 0 CHECK (ref_count >= 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    -- When ref_count last dropped to zero
+    unreferenced_at TIMESTAMP,
+    UNIQUE (company_id, sha256)
+);
+
+CREATE INDEX idx_audience_blobs_unreferenced ON audience_blobs(unreferenced_at) WHERE ref_count = 0;
+
+ALTER TABLE audience_blobs ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON audience_blobs
+    USING (app_can_access_company(company_id))
+    WITH CHECK (app_can_access_company(company_id));
+
+-- Files uploaded before this migration keep their own object and no blob
+ALTER TABLE audience_files ADD COLUMN blob_id INTEGER REFERENCES audience_blobs(id);
+CREATE INDEX idx_audience_files_blob ON audience_files(blob_id);
+CREATE INDEX idx_audience_files_hash ON audience_files(company_id, file_hash);
@@ -0,0 +1,19 @@
+-- Audience files are deleted in two steps. Moving a file to the trash sets
+-- deleted_at, by a user (deleted_by) or by its workspace's retention policy
+-- (deleted_by NULL); it can be restored until services.AudienceLifecycleService
+-- purges it. Purged files keep their row, for the audit log and campaigns
+-- that used them, but give up their blob reference and stored object.
+
+ALTER TABLE audience_files ADD COLUMN deleted_at TIMESTAMP;
+ALTER TABLE audience_files ADD COLUMN deleted_by INTEGER REFERENCES users(id);
+ALTER TABLE audience_files ADD COLUMN purged_at TIMESTAMP;
+
+CREATE INDEX idx_audience_files_trash ON audience_files(deleted_at) WHERE deleted_at IS NOT NULL AND purged_at IS NULL;
+
+-- Since 018 every file with the same contents has its blob's key, so the
+-- path is no longer unique
+DROP INDEX idx_audience_files_storage_path;
+CREATE INDEX idx_audience_files_storage_path ON audience_files(storage_path);
+
+-- Retention looks up each file's last campaign
+CREATE INDEX idx_campaigns_audience_file ON campaigns(audience_file_id);
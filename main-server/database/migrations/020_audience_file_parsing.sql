@@ -0,0 +1,23 @@
+-- Ready audience files are parsed by services.AudienceSchemaService: their
+-- encoding, delimiter, header row and columns are detected
+-- (detected_schema), a user confirms which identifier each column holds
+-- (column_mapping), and the file is processed with that mapping, setting
+-- processed_at. parse_queued_at is when the current step was queued, so a
+-- job for a mapping that has since changed cannot finish, and
+-- parse_started_at when a worker claimed it.
+
+ALTER TABLE audience_files ADD COLUMN parse_status VARCHAR(20);
+ALTER TABLE audience_files ADD COLUMN parse_error TEXT;
+ALTER TABLE audience_files ADD COLUMN parse_queued_at TIMESTAMP;
+ALTER TABLE audience_files ADD COLUMN parse_started_at TIMESTAMP;
+ALTER TABLE audience_files ADD COLUMN detected_schema JSONB;
+ALTER TABLE audience_files ADD COLUMN column_mapping JSONB;
+ALTER TABLE audience_files ADD COLUMN row_count INTEGER;
+ALTER TABLE audience_files ADD COLUMN identified_rows INTEGER;
+
+CREATE INDEX idx_audience_files_parsing ON audience_files(parse_queued_at) WHERE parse_status IN ('detecting', 'processing');
+
+-- Files that were ready before parsing existed are picked up by the sweep
+UPDATE audience_files
+SET parse_status = 'detecting', parse_queued_at = CURRENT_TIMESTAMP
+WHERE status = 'ready' AND purged_at IS NULL;
@@ -0,0 +1,29 @@
+-- Processed audience files are prepared for each ad platform by
+-- services.AudienceSchemaService: a gzipped CSV of the rows the platform can
+-- match, with their identifiers normalized and hashed the way it takes
+-- them, stored at
+-- {workspace}/{company}/outputs/{file}/{processing}/{platform}.csv.gz.
+-- Each processing replaces the file's rows; objects no row refers to any
+-- more are removed by services.BlobCollector.
+
+CREATE TABLE audience_file_outputs (
+    id SERIAL PRIMARY KEY,
+    audience_file_id INTEGER NOT NULL REFERENCES audience_files(id) ON DELETE CASCADE,
+    company_id INTEGER NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    platform VARCHAR(50) NOT NULL REFERENCES platforms(slug),
+    storage_key VARCHAR(500) NOT NULL UNIQUE,
+    row_count INTEGER NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (audience_file_id, platform)
+);
+
+ALTER TABLE audience_file_outputs ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON audience_file_outputs
+    USING (app_can_access_company(company_id))
+    WITH CHECK (app_can_access_company(company_id));
+
+-- Files processed before their identifiers were normalized are processed
+-- again
+UPDATE audience_files
+SET parse_status = 'processing', parse_queued_at = CURRENT_TIMESTAMP, processed_at = NULL
+WHERE parse_status = 'processed' AND purged_at IS NULL;
@@ -0,0 +1,168 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"sync"
+
+	"main-server/tenant"
+)
+
+// Querier is the subset of *sql.DB and *sql.Conn used by the services, so
+// they can run on either a pooled or a tenant-bound connection.
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// TenantRole is the database role tenant-bound connections switch to. It is
+// subject to row-level security, unlike the owner role the pool connects as.
+const TenantRole = "app_tenant"
+
+type connKey struct{}
+
+// boundConn is a request's tenant-bound connection. WithoutTenant swaps it
+// for a new one around work that does not need the database.
+type boundConn struct {
+	db *sql.DB
+	t  *tenant.Context
+
+	mu   sync.Mutex
+	conn *sql.Conn
+	// Whether conn still carries the tenant and has yet to be released
+	bound bool
+}
+
+const setTenantSQL = `
+	SELECT set_config('app.user_id', $1, false),
+	       set_config('app.company_id', $2, false),
+	       set_config('app.workspace_id', $3, false),
+	       set_config('app.role', $4, false)
+`
+
+// BindTenant reserves a connection for the rest of the request, sets the
+// session variables the row-level security policies in
+// 007_row_level_security.sql filter on, and switches to TenantRole. Every
+// query made through Conn with the returned context runs on that connection.
+// release must be called when the request is done; it resets the role and
+// variables before the connection goes back to the pool. It may be called
+// more than once, and ReleaseTenant calls it early.
+func BindTenant(ctx context.Context, db *sql.DB, t *tenant.Context) (context.Context, func(), error) {
+	b := &boundConn{db: db, t: t}
+	if err := b.bind(ctx); err != nil {
+		return ctx, nil, err
+	}
+	return context.WithValue(ctx, connKey{}, b), b.release, nil
+}
+
+func (b *boundConn) bind(ctx context.Context) error {
+	conn, err := b.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to reserve connection: %w", err)
+	}
+
+	_, err = conn.ExecContext(ctx, setTenantSQL, b.t.UserID(), b.t.CompanyID, b.t.WorkspaceID, b.t.Role())
+	if err == nil {
+		_, err = conn.ExecContext(ctx, "SET ROLE "+TenantRole)
+	}
+	if err != nil {
+		discard(conn)
+		return fmt.Errorf("failed to set tenant: %w", err)
+	}
+
+	b.mu.Lock()
+	b.conn, b.bound = conn, true
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *boundConn) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.bound {
+		return
+	}
+	b.bound = false
+
+	// Use a fresh context: the request's may already be cancelled.
+	ctx := context.Background()
+	_, err := b.conn.ExecContext(ctx, "RESET ROLE")
+	if err == nil {
+		_, err = b.conn.ExecContext(ctx, setTenantSQL, "", "", "", "")
+	}
+	if err != nil {
+		log.Printf("failed to reset tenant on connection, discarding it: %v", err)
+		discard(b.conn)
+		return
+	}
+	b.conn.Close()
+}
+
+// ReleaseTenant gives ctx's tenant-bound connection back to the pool before
+// the request is done, for requests that have finished with the database but
+// go on for a long time, such as event streams and downloads. Queries
+// through Conn with ctx fail afterwards rather than run on the pool outside
+// row-level security.
+func ReleaseTenant(ctx context.Context) {
+	if b, ok := ctx.Value(connKey{}).(*boundConn); ok {
+		b.release()
+	}
+}
+
+// WithoutTenant gives ctx's tenant-bound connection back to the pool while
+// fn runs and binds a new one for the rest of the request afterwards, so
+// that streaming a file to storage does not hold a connection for as long
+// as the transfer takes. fn must not query through ctx. Without a tenant,
+// fn just runs.
+func WithoutTenant(ctx context.Context, fn func() error) error {
+	b, ok := ctx.Value(connKey{}).(*boundConn)
+	if !ok {
+		return fn()
+	}
+
+	b.release()
+	err := fn()
+	if bindErr := b.bind(ctx); err == nil {
+		err = bindErr
+	}
+	return err
+}
+
+// discard closes conn and keeps it out of the pool, so session state that
+// could not be reset never leaks into another request.
+func discard(conn *sql.Conn) {
+	conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	conn.Close()
+}
+
+// Conn returns the tenant-bound connection for ctx, or db itself for
+// requests without a tenant and for background work.
+func Conn(ctx context.Context, db *sql.DB) Querier {
+	if b, ok := ctx.Value(connKey{}).(*boundConn); ok {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.conn
+	}
+	return db
+}
+
+// WithTx runs fn in a transaction on Conn(ctx, db), committing when fn
+// returns nil and rolling back otherwise.
+func WithTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := Conn(ctx, db).BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	"main-server/services"
+)
+
+// AlertHandler shows security alerts and lets admins acknowledge them. Which
+// alerts a viewer sees is decided by row-level security.
+type AlertHandler struct {
+	alerts *services.AlertService
+}
+
+func NewAlertHandler(alerts *services.AlertService) *AlertHandler {
+	return &AlertHandler{alerts: alerts}
+}
+
+// Index renders the alerts page.
+func (h *AlertHandler) Index(c echo.Context) error {
+	f, err := alertFilter(c)
+	if err != nil {
+		return err
+	}
+
+	alerts, err := h.alerts.List(c.Request().Context(), f)
+	if err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusOK, "alerts.html", pageData(c, map[string]interface{}{
+		"Title":  "Security Alerts",
+		"Alerts": alerts,
+		"Filter": c.QueryParams(),
+	}))
+}
+
+// List returns alerts as JSON.
+func (h *AlertHandler) List(c echo.Context) error {
+	f, err := alertFilter(c)
+	if err != nil {
+		return err
+	}
+
+	alerts, err := h.alerts.List(c.Request().Context(), f)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, alerts)
+}
+
+// Acknowledge marks an alert as handled. Forms are redirected back to the
+// alerts page.
+func (h *AlertHandler) Acknowledge(c echo.Context) error {
+	actor, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid alert ID")
+	}
+
+	alert, err := h.alerts.Acknowledge(c.Request().Context(), id, actor)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Alert not found")
+	}
+
+	if c.Request().Header.Get(echo.HeaderContentType) == echo.MIMEApplicationForm {
+		return c.Redirect(http.StatusSeeOther, "/app/alerts")
+	}
+	return c.JSON(http.StatusOK, alert)
+}
+
+func alertFilter(c echo.Context) (services.AlertFilter, error) {
+	f := services.AlertFilter{
+		Status:   c.QueryParam("status"),
+		Severity: c.QueryParam("severity"),
+		Rule:     c.QueryParam("rule"),
+	}
+	if raw := c.QueryParam("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil {
+			return f, echo.NewHTTPError(http.StatusBadRequest, "Invalid limit")
+		}
+		f.Limit = limit
+	}
+	return f, nil
+}
@@ -1,45 +0,0 @@
-package handlers
-
-import (
-	"main-server/services"
-	"net/http"
-
-	"github.com/labstack/echo/v4"
-)
-
-type AuditHandler struct {
-	services *services.Container
-}
-
-func NewAuditHandler(services *services.Container) *AuditHandler {
-	return &AuditHandler{
-		services: services,
-	}
-}
-
-func (audit *AuditHandler) LogAudit(msg, user, route string) error {
-	return nil
-}
-
-func (audit *AuditHandler) auditHandler(c echo.Context) error {
-	// Example audit events for testing
-	switch c.Request().Method {
-	case "GET":
-		audit.LogAudit("audit_page_view", "user123", "/audit")
-		html := `
-			<h1>Audit Event Generated</h1>
-			<p>Check Prometheus metrics at <a href="/metrics">/metrics</a></p>
-			<p>Or send a POST request to generate a different audit event.</p>
-		`
-		return c.HTML(http.StatusOK, html)
-
-	case "POST":
-		audit.LogAudit("user_action", "user456", "form_submit")
-		return c.JSON(http.StatusOK, map[string]string{
-			"message": "Audit event logged",
-			"type":    "user_action",
-		})
-	}
-
-	return c.String(http.StatusMethodNotAllowed, "Method not allowed")
-}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	"main-server/models"
+	"main-server/services"
+)
+
+// AuditArchiveHandler lists the archives made by the retention job and
+// restores them for investigations. Only workspace and super admins manage
+// archives; once restored, anyone who can see the rows can search them in the
+// audit log with archive_id.
+type AuditArchiveHandler struct {
+	retention *services.AuditRetentionService
+}
+
+func NewAuditArchiveHandler(retention *services.AuditRetentionService) *AuditArchiveHandler {
+	return &AuditArchiveHandler{retention: retention}
+}
+
+// List returns the archives of the admin's workspace, or of every workspace
+// for super admins.
+func (h *AuditArchiveHandler) List(c echo.Context) error {
+	actor, err := archiveAdmin(c)
+	if err != nil {
+		return err
+	}
+
+	workspaceID := c.QueryParam("workspace_id")
+	if actor.Role == models.RoleWorkspaceAdmin {
+		workspaceID = actor.WorkspaceID
+	}
+
+	archives, err := h.retention.ListArchives(c.Request().Context(), workspaceID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, archives)
+}
+
+// Restore loads an archive back for services.AuditRestoreTTL.
+func (h *AuditArchiveHandler) Restore(c echo.Context) error {
+	actor, archive, err := h.archive(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	if err := h.retention.Restore(ctx, archive, actor.ID); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if archive, err = h.retention.GetArchive(ctx, archive.ID); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, archive)
+}
+
+// Release removes a restored archive's rows before they expire.
+func (h *AuditArchiveHandler) Release(c echo.Context) error {
+	_, archive, err := h.archive(c)
+	if err != nil {
+		return err
+	}
+
+	if err := h.retention.Release(c.Request().Context(), archive); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h *AuditArchiveHandler) archive(c echo.Context) (*models.User, *models.AuditArchive, error) {
+	actor, err := archiveAdmin(c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid archive ID")
+	}
+
+	archive, err := h.retention.GetArchive(c.Request().Context(), id)
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusNotFound, "Archive not found")
+	}
+	if actor.Role == models.RoleWorkspaceAdmin && archive.WorkspaceID != actor.WorkspaceID {
+		return nil, nil, echo.NewHTTPError(http.StatusNotFound, "Archive not found")
+	}
+
+	return actor, archive, nil
+}
+
+func archiveAdmin(c echo.Context) (*models.User, error) {
+	actor, err := currentUser(c)
+	if err != nil {
+		return nil, err
+	}
+	if actor.Role != models.RoleSuperAdmin && actor.Role != models.RoleWorkspaceAdmin {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "Access denied")
+	}
+	return actor, nil
+}
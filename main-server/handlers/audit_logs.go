@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	customMiddleware "main-server/middleware"
+	"main-server/models"
+	"main-server/services"
+)
+
+// How often an idle audit stream sends a comment, so proxies keep the
+// connection open.
+const auditStreamHeartbeat = 25 * time.Second
+
+// AuditLogHandler serves the audit log viewer, its JSON API, exports and the
+// live event stream.
+// Company admins see their company's events, workspace admins their
+// workspace's and super admins everything.
+type AuditLogHandler struct {
+	users        *services.CompanyUserService
+	audit        *services.AuditService
+	entitlements *services.EntitlementService
+	stream       *services.AuditStream
+}
+
+func NewAuditLogHandler(users *services.CompanyUserService, audit *services.AuditService, entitlements *services.EntitlementService, stream *services.AuditStream) *AuditLogHandler {
+	return &AuditLogHandler{
+		users:        users,
+		audit:        audit,
+		entitlements: entitlements,
+		stream:       stream,
+	}
+}
+
+// Index renders the audit log screen.
+func (h *AuditLogHandler) Index(c echo.Context) error {
+	f, err := h.filter(c)
+	if err != nil {
+		return err
+	}
+
+	page, err := h.audit.Search(c.Request().Context(), f)
+	if errors.Is(err, services.ErrInvalidAuditCursor) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid cursor")
+	}
+	if err != nil {
+		return err
+	}
+
+	nextURL := ""
+	if page.NextCursor != "" {
+		q := c.QueryParams()
+		q.Set("cursor", page.NextCursor)
+		nextURL = "/app/audit?" + q.Encode()
+	}
+
+	exportQuery := url.Values{}
+	for k, v := range c.QueryParams() {
+		if k != "cursor" && k != "limit" {
+			exportQuery[k] = v
+		}
+	}
+
+	return c.Render(http.StatusOK, "audit.html", pageData(c, map[string]interface{}{
+		"Title":       "Audit Log",
+		"Events":      page.Events,
+		"Filter":      c.QueryParams(),
+		"NextURL":     nextURL,
+		"ExportQuery": exportQuery.Encode(),
+	}))
+}
+
+// Events returns a page of events as JSON. Pass next_cursor back as cursor
+// for the following page.
+func (h *AuditLogHandler) Events(c echo.Context) error {
+	f, err := h.filter(c)
+	if err != nil {
+		return err
+	}
+
+	page, err := h.audit.Search(c.Request().Context(), f)
+	if errors.Is(err, services.ErrInvalidAuditCursor) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid cursor")
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, page)
+}
+
+// History returns one entity's events, oldest first.
+func (h *AuditLogHandler) History(c echo.Context) error {
+	f, err := h.filter(c)
+	if err != nil {
+		return err
+	}
+
+	events, err := h.audit.History(c.Request().Context(), f, c.Param("type"), c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"entity_type": c.Param("type"),
+		"entity_id":   c.Param("id"),
+		"events":      events,
+	})
+}
+
+// Export streams every matching event as CSV or NDJSON.
+func (h *AuditLogHandler) Export(c echo.Context) error {
+	f, err := h.filter(c)
+	if err != nil {
+		return err
+	}
+
+	format := c.QueryParam("format")
+	if format == "" {
+		format = services.AuditExportCSV
+	}
+	contentType := "text/csv; charset=utf-8"
+	switch format {
+	case services.AuditExportCSV:
+	case services.AuditExportNDJSON:
+		contentType = "application/x-ndjson"
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "format must be csv or ndjson")
+	}
+
+	filename := fmt.Sprintf("audit-log-%s.%s", time.Now().Format("20060102"), format)
+	c.Response().Header().Set(echo.HeaderContentType, contentType)
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	c.Response().WriteHeader(http.StatusOK)
+
+	ctx := c.Request().Context()
+	exported, err := h.audit.ExportAuditLog(ctx, f, format, c.Response())
+	if err != nil {
+		return err
+	}
+
+	if f.CompanyID == "" {
+		return nil
+	}
+	return h.entitlements.RecordUsage(ctx, f.CompanyID, services.UsageExportedRows, int64(exported))
+}
+
+// Live renders a page that follows the event stream with the same filters.
+func (h *AuditLogHandler) Live(c echo.Context) error {
+	if _, err := h.filter(c); err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusOK, "audit_live.html", pageData(c, map[string]interface{}{
+		"Title":       "Live Audit Events",
+		"StreamQuery": c.QueryParams().Encode(),
+	}))
+}
+
+// Stream sends new events matching the filters as server-sent events until
+// the client disconnects. Each event's id is its audit_logs ID. The
+// request's tenant connection is given back once the stream starts.
+func (h *AuditLogHandler) Stream(c echo.Context) error {
+	f, err := h.filter(c)
+	if err != nil {
+		return err
+	}
+	if f.ArchiveID != "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Restored archives cannot be streamed")
+	}
+
+	sub, err := h.stream.Subscribe(f)
+	if errors.Is(err, services.ErrTooManyAuditStreams) || errors.Is(err, services.ErrAuditStreamClosed) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Too many audit streams are open, try again later")
+	}
+	if err != nil {
+		return err
+	}
+	defer h.stream.Unsubscribe(sub)
+
+	// The filter is resolved and events come from the stream, so the
+	// connection is not held for as long as the client stays connected
+	customMiddleware.ReleaseTenant(c)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	heartbeat := time.NewTicker(auditStreamHeartbeat)
+	defer heartbeat.Stop()
+
+	ctx := c.Request().Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case e, ok := <-sub.Events():
+			if !ok {
+				return nil
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(res, "id: %d\nevent: audit\ndata: %s\n\n", e.ID, data); err != nil {
+				return nil
+			}
+			res.Flush()
+
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(res, ": keepalive\n\n"); err != nil {
+				return nil
+			}
+			res.Flush()
+		}
+	}
+}
+
+// filter builds the search from the query string, scoped to what the viewer
+// may see.
+func (h *AuditLogHandler) filter(c echo.Context) (services.AuditFilter, error) {
+	var f services.AuditFilter
+
+	actor, err := currentUser(c)
+	if err != nil {
+		return f, err
+	}
+
+	companyID := c.QueryParam("company_id")
+	switch actor.Role {
+	case models.RoleSuperAdmin:
+		f.CompanyID = companyID
+		f.WorkspaceID = c.QueryParam("workspace_id")
+	case models.RoleWorkspaceAdmin:
+		f.WorkspaceID = actor.WorkspaceID
+		if companyID != "" {
+			if err := authorizeCompany(c, h.users, actor, companyID); err != nil {
+				return f, err
+			}
+			f.CompanyID = companyID
+		}
+	default:
+		if actor.CompanyID == "" {
+			return f, echo.NewHTTPError(http.StatusForbidden, "Access denied")
+		}
+		f.CompanyID = actor.CompanyID
+	}
+
+	f.ActorID = c.QueryParam("actor_id")
+	f.Action = c.QueryParam("action")
+	f.EntityType = c.QueryParam("entity_type")
+	f.EntityID = c.QueryParam("entity_id")
+	f.IPAddress = c.QueryParam("ip")
+	if f.IPAddress != "" {
+		if _, err := services.ParseIPFilter(f.IPAddress); err != nil {
+			return f, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+	f.ArchiveID = c.QueryParam("archive_id")
+	f.Cursor = c.QueryParam("cursor")
+
+	if raw := c.QueryParam("limit"); raw != "" {
+		if f.Limit, err = strconv.Atoi(raw); err != nil {
+			return f, echo.NewHTTPError(http.StatusBadRequest, "Invalid limit")
+		}
+	}
+	if f.From, err = parseAuditTime(c.QueryParam("from"), false); err != nil {
+		return f, err
+	}
+	if f.To, err = parseAuditTime(c.QueryParam("to"), true); err != nil {
+		return f, err
+	}
+
+	return f, nil
+}
+
+// parseAuditTime accepts RFC 3339 timestamps or plain dates. A plain "to"
+// date includes the whole day.
+func parseAuditTime(raw string, endOfDay bool) (*time.Time, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse("2006-01-02", raw)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid date %q", raw))
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return &t, nil
+}
@@ -2,24 +2,32 @@ package handlers
 
 import (
 	"database/sql"
+	"encoding/json"
+	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 
 	"main-server/config"
+	customMiddleware "main-server/middleware"
+	"main-server/models"
 	"main-server/services"
 )
 
 type AuthHandler struct {
 	db     *sql.DB
 	config *config.Config
+	audit  *services.AuditQueue
 }
 
-func NewAuthHandler(db *sql.DB, config *config.Config) *AuthHandler {
+func NewAuthHandler(db *sql.DB, config *config.Config, audit *services.AuditQueue) *AuthHandler {
 	return &AuthHandler{
 		db:     db,
 		config: config,
+		audit:  audit,
 	}
 }
 
@@ -28,7 +36,7 @@ func NewAuthHandler(db *sql.DB, config *config.Config) *AuthHandler {
 // Add this method - shows splash page with login form
 func (h *AuthHandler) ShowSplash(c echo.Context) error {
 	// Check if already logged in
-	if user := h.getCurrentUser(c); user != nil {
+	if user := customMiddleware.CurrentUser(c); user != nil {
 		return c.Redirect(http.StatusFound, "/dashboard")
 	}
 
@@ -93,24 +101,6 @@ func (h *AuthHandler) saveUserSession(c echo.Context, user *services.User) error
 	return sess.Save(c.Request(), c.Response())
 }
 
-func (h *AuthHandler) getCurrentUser(c echo.Context) *services.User {
-	sess, err := session.Get("session", c)
-	if err != nil {
-		return nil
-	}
-
-	loggedIn, ok := sess.Values["logged_in"].(bool)
-	if !ok || !loggedIn {
-		return nil
-	}
-
-	return &services.User{
-		ID:    sess.Values["user_id"].(string),
-		Email: sess.Values["user_email"].(string),
-		Name:  sess.Values["user_name"].(string),
-	}
-}
-
 func (h *AuthHandler) Logout(c echo.Context) error {
 	// Clear local session
 	h.clearUserSession(c)
@@ -128,15 +118,15 @@ func (h *AuthHandler) clearUserSession(c echo.Context) error {
 
 // UPDATE existing Dashboard method - change redirect target
 func (h *AuthHandler) Dashboard(c echo.Context) error {
-	user := h.getCurrentUser(c) // Use our helper instead of service
+	user := customMiddleware.CurrentUser(c) // Loaded once per request by LoadTenant
 	if user == nil {
 		return c.Redirect(http.StatusFound, "/") // CHANGED from /auth/login
 	}
 
-	data := map[string]interface{}{
+	data := pageData(c, map[string]interface{}{
 		"Title": "Dashboard",
 		"User":  user,
-	}
+	})
 
 	return c.Render(http.StatusOK, "dashboard.html", data)
 }
@@ -160,15 +150,37 @@ func (h *AuthHandler) Login(c echo.Context) error {
 		}
 
 		h.saveUserSession(c, user)
+		h.recordLogin(c, models.AuditLoginSucceeded, user.ID, email)
 		return c.Redirect(http.StatusFound, "/app/dashboard")
 	}
 
+	h.recordLogin(c, models.AuditLoginFailed, "", email)
 	return c.Render(http.StatusOK, "login.html", map[string]interface{}{
 		"Title": "Login",
 		"Error": "Invalid credentials",
 	})
 }
 
+// recordLogin queues a sign-in attempt for the audit log, where the alert
+// rules see it. There is no tenant yet, so the request details are set here.
+func (h *AuthHandler) recordLogin(c echo.Context, action, userID, email string) {
+	changes, _ := json.Marshal(models.AuditChanges{
+		Metadata: map[string]interface{}{"email": strings.ToLower(strings.TrimSpace(email))},
+	})
+
+	err := h.audit.Enqueue(&models.AuditLog{
+		UserID:    userID,
+		Action:    action,
+		Changes:   changes,
+		IPAddress: c.RealIP(),
+		UserAgent: c.Request().UserAgent(),
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		log.Printf("failed to queue %s audit event: %v", action, err)
+	}
+}
+
 func (h *AuthHandler) ShowRegister(c echo.Context) error {
 	return c.Render(http.StatusOK, "register.html", map[string]interface{}{
 		"Title": "Register",
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	customMiddleware "main-server/middleware"
+	"main-server/models"
+	"main-server/services"
+)
+
+// DirectUploadHandler exposes services.DirectUploadService:
+//
+//	POST /app/upload/direct                {filename, content_type, size}
+//	POST /app/upload/direct/:id/complete   the new audience file
+//
+// The first returns the upload with the presigned request the browser sends
+// to storage, and the browser calls the second once that has succeeded.
+type DirectUploadHandler struct {
+	uploads *services.DirectUploadService
+}
+
+func NewDirectUploadHandler(uploads *services.DirectUploadService) *DirectUploadHandler {
+	return &DirectUploadHandler{uploads: uploads}
+}
+
+type directUploadResponse struct {
+	*models.DirectUpload
+	Request *services.PresignedUpload `json:"request"`
+}
+
+func (h *DirectUploadHandler) Init(c echo.Context) error {
+	actor, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+	t := customMiddleware.Tenant(c)
+	if t.CompanyID == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "Audience files belong to a company")
+	}
+
+	var req initUploadRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+
+	upload, request, err := h.uploads.Init(c.Request().Context(), actor, t.WorkspaceID, t.CompanyID,
+		req.Filename, req.ContentType, req.Size)
+	if err != nil {
+		return uploadError(err)
+	}
+	return c.JSON(http.StatusCreated, directUploadResponse{DirectUpload: upload, Request: request})
+}
+
+func (h *DirectUploadHandler) Complete(c echo.Context) error {
+	t := customMiddleware.Tenant(c)
+	if t == nil || t.User == nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Not signed in")
+	}
+
+	upload, err := h.uploads.Get(c.Request().Context(), c.Param("id"))
+	if err != nil || upload.CompanyID != t.CompanyID {
+		return echo.NewHTTPError(http.StatusNotFound, "Upload not found")
+	}
+
+	f, err := h.uploads.Complete(c.Request().Context(), upload)
+	if err != nil {
+		return uploadError(err)
+	}
+	return c.JSON(http.StatusOK, f)
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"main-server/services"
+)
+
+type EntitlementHandler struct {
+	users        *services.CompanyUserService
+	entitlements *services.EntitlementService
+}
+
+func NewEntitlementHandler(users *services.CompanyUserService, entitlements *services.EntitlementService) *EntitlementHandler {
+	return &EntitlementHandler{
+		users:        users,
+		entitlements: entitlements,
+	}
+}
+
+// Show returns a company's plan, resolved features and this month's usage.
+func (h *EntitlementHandler) Show(c echo.Context) error {
+	_, companyID, err := resolveCompany(c, h.users)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	ent, err := h.entitlements.Resolve(ctx, companyID)
+	if err != nil {
+		return err
+	}
+	usage, err := h.entitlements.Usage(ctx, companyID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"plan":     ent.Plan,
+		"features": ent.Features,
+		"usage":    usage,
+	})
+}
@@ -21,9 +21,6 @@ func NewHomeHandler(db *sql.DB, config *config.Config) *HomeHandler {
 	}
 }
 func (h *HomeHandler) Home(c echo.Context) error {
-	// Log audit event for page access
-	// h.services.AuditService.LogEvent("page_access", "user123", "/", "home_page_view")
-
 	// Data to pass to the template
 	data := map[string]interface{}{
 		"Title":       "Home",
@@ -32,7 +29,7 @@ func (h *HomeHandler) Home(c echo.Context) error {
 		"Links": []map[string]string{
 			{"URL": "/health", "Text": "Health Check"},
 			{"URL": "/metrics", "Text": "Prometheus Metrics"},
-			{"URL": "/audit", "Text": "Generate Audit Event"},
+			{"URL": "/app/audit/live", "Text": "Live Audit Events"},
 			{"URL": "/destinations", "Text": "Destinations"},
 		},
 	}
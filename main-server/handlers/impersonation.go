@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+
+	customMiddleware "main-server/middleware"
+	"main-server/services"
+)
+
+type ImpersonationHandler struct {
+	impersonation *services.ImpersonationService
+}
+
+func NewImpersonationHandler(impersonation *services.ImpersonationService) *ImpersonationHandler {
+	return &ImpersonationHandler{
+		impersonation: impersonation,
+	}
+}
+
+// Start lets a super admin act as the user in the URL until the session
+// expires or they stop it.
+func (h *ImpersonationHandler) Start(c echo.Context) error {
+	actor, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+	if customMiddleware.Impersonation(c) != nil {
+		return echo.NewHTTPError(http.StatusConflict, "Stop the current impersonation first")
+	}
+
+	imp, target, err := h.impersonation.Start(c.Request().Context(), actor, c.Param("id"), c.FormValue("reason"), c.RealIP())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	}
+
+	sess, err := session.Get("session", c)
+	if err != nil {
+		return err
+	}
+	sess.Values["user_id"] = target.ID
+	sess.Values[customMiddleware.SessionImpersonatorID] = actor.ID
+	sess.Values[customMiddleware.SessionImpersonationID] = imp.ID
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return err
+	}
+
+	return c.Redirect(http.StatusFound, "/app/dashboard")
+}
+
+// Stop ends the active impersonation and returns the super admin to their
+// own identity.
+func (h *ImpersonationHandler) Stop(c echo.Context) error {
+	imp := customMiddleware.Impersonation(c)
+	if imp == nil {
+		return c.Redirect(http.StatusFound, "/app/dashboard")
+	}
+
+	if err := h.impersonation.End(c.Request().Context(), imp.ID, c.RealIP()); err != nil {
+		return err
+	}
+
+	sess, err := session.Get("session", c)
+	if err != nil {
+		return err
+	}
+	sess.Values["user_id"] = imp.ImpersonatorID
+	delete(sess.Values, customMiddleware.SessionImpersonatorID)
+	delete(sess.Values, customMiddleware.SessionImpersonationID)
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return err
+	}
+
+	return c.Redirect(http.StatusFound, "/app/dashboard")
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"html/template"
+
+	"github.com/labstack/echo/v4"
+
+	customMiddleware "main-server/middleware"
+	"main-server/models"
+	"main-server/tenant"
+)
+
+// pageData adds the values the layout needs on every page, the signed-in
+// user, the tenant and any active impersonation, to a template's data.
+func pageData(c echo.Context, data map[string]interface{}) map[string]interface{} {
+	if user := customMiddleware.CurrentUser(c); user != nil {
+		data["CurrentUser"] = user
+	}
+	if t := customMiddleware.Tenant(c); t != nil {
+		data["Tenant"] = t
+	}
+	if imp := customMiddleware.Impersonation(c); imp != nil {
+		data["Impersonation"] = imp
+	}
+	return data
+}
+
+// TemplateFuncs are the helpers available to every template.
+//
+//	{{if hasFeature .Tenant "bulk_export"}}...{{end}}
+func TemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"hasFeature": func(t *tenant.Context, feature string) bool {
+			return t.HasFeature(models.Feature(feature))
+		},
+	}
+}
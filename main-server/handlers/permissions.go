@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	"main-server/models"
+	"main-server/services"
+)
+
+type PermissionHandler struct {
+	users *services.CompanyUserService
+	perms *services.PermissionService
+}
+
+func NewPermissionHandler(users *services.CompanyUserService, perms *services.PermissionService) *PermissionHandler {
+	return &PermissionHandler{
+		users: users,
+		perms: perms,
+	}
+}
+
+type userPermissions struct {
+	ID             string                      `json:"id"`
+	Email          string                      `json:"email"`
+	Name           string                      `json:"name"`
+	Role           string                      `json:"role"`
+	RoleTemplateID *int                        `json:"role_template_id"`
+	Capabilities   []models.Capability         `json:"capabilities"`
+	Overrides      []models.PermissionOverride `json:"overrides"`
+}
+
+// List returns the capabilities, role templates and each user's effective
+// permissions for a company.
+func (h *PermissionHandler) List(c echo.Context) error {
+	_, companyID, err := resolveCompany(c, h.users)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	templates, err := h.perms.ListTemplates(ctx, companyID)
+	if err != nil {
+		return err
+	}
+
+	roster, err := h.users.ListCompanyUsers(ctx, companyID)
+	if err != nil {
+		return err
+	}
+
+	var users []userPermissions
+	for _, cu := range roster {
+		if !cu.IsActive {
+			continue
+		}
+		user, err := h.users.GetUser(ctx, cu.ID)
+		if err != nil {
+			return err
+		}
+		perms, err := h.perms.Effective(ctx, user)
+		if err != nil {
+			return err
+		}
+		overrides, err := h.perms.Overrides(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		users = append(users, userPermissions{
+			ID:             user.ID,
+			Email:          user.Email,
+			Name:           user.Name,
+			Role:           user.Role,
+			RoleTemplateID: user.RoleTemplateID,
+			Capabilities:   perms.List(),
+			Overrides:      overrides,
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"capabilities": models.AllCapabilities,
+		"templates":    templates,
+		"users":        users,
+	})
+}
+
+// SetUserPermission grants, revokes or resets one capability for a user.
+// The state form value is "grant", "revoke" or "inherit".
+func (h *PermissionHandler) SetUserPermission(c echo.Context) error {
+	actor, target, err := h.loadTarget(c)
+	if err != nil {
+		return err
+	}
+
+	capability := models.Capability(c.FormValue("capability"))
+	if !models.ValidCapability(capability) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown capability")
+	}
+	if !actor.Can(capability) {
+		return echo.NewHTTPError(http.StatusForbidden, "You cannot delegate a capability you do not hold")
+	}
+
+	ctx := c.Request().Context()
+	switch c.FormValue("state") {
+	case "grant":
+		err = h.perms.SetOverride(ctx, target, capability, true, actor.ID)
+	case "revoke":
+		err = h.perms.SetOverride(ctx, target, capability, false, actor.ID)
+	case "inherit":
+		err = h.perms.ClearOverride(ctx, target, capability)
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "state must be grant, revoke or inherit")
+	}
+	if err != nil {
+		return err
+	}
+
+	return h.respondWithUser(c, target)
+}
+
+// AssignTemplate sets a user's role template. An empty template_id clears it.
+func (h *PermissionHandler) AssignTemplate(c echo.Context) error {
+	_, target, err := h.loadTarget(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	var templateID *int
+	if raw := c.FormValue("template_id"); raw != "" {
+		id, err := strconv.Atoi(raw)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid template ID")
+		}
+		tmpl, err := h.perms.GetTemplate(ctx, id)
+		if err != nil || tmpl.CompanyID != target.CompanyID {
+			return echo.NewHTTPError(http.StatusNotFound, "Role template not found")
+		}
+		templateID = &tmpl.ID
+	}
+
+	if err := h.perms.AssignTemplate(ctx, target, templateID); err != nil {
+		return err
+	}
+	target.RoleTemplateID = templateID
+
+	return h.respondWithUser(c, target)
+}
+
+// CreateTemplate adds a role template to the actor's company.
+func (h *PermissionHandler) CreateTemplate(c echo.Context) error {
+	actor, companyID, err := resolveCompany(c, h.users)
+	if err != nil {
+		return err
+	}
+
+	tmpl := &models.RoleTemplate{CompanyID: companyID}
+	if err := h.saveTemplate(c, actor, tmpl); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusCreated, tmpl)
+}
+
+// UpdateTemplate renames a role template or changes its capabilities.
+func (h *PermissionHandler) UpdateTemplate(c echo.Context) error {
+	actor, tmpl, err := h.loadTemplate(c)
+	if err != nil {
+		return err
+	}
+
+	if err := h.saveTemplate(c, actor, tmpl); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, tmpl)
+}
+
+// DeleteTemplate removes a role template.
+func (h *PermissionHandler) DeleteTemplate(c echo.Context) error {
+	_, tmpl, err := h.loadTemplate(c)
+	if err != nil {
+		return err
+	}
+
+	if err := h.perms.DeleteTemplate(c.Request().Context(), tmpl.ID); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h *PermissionHandler) saveTemplate(c echo.Context, actor *models.User, tmpl *models.RoleTemplate) error {
+	form, err := c.FormParams()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid form")
+	}
+
+	tmpl.Name = form.Get("name")
+	tmpl.Capabilities = form["capabilities"]
+	for _, raw := range tmpl.Capabilities {
+		if !actor.Can(models.Capability(raw)) {
+			return echo.NewHTTPError(http.StatusForbidden, "You cannot delegate a capability you do not hold")
+		}
+	}
+
+	if err := h.perms.SaveTemplate(c.Request().Context(), tmpl, actor.ID); err != nil {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+	}
+
+	return nil
+}
+
+func (h *PermissionHandler) loadTemplate(c echo.Context) (*models.User, *models.RoleTemplate, error) {
+	actor, err := currentUser(c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid template ID")
+	}
+
+	tmpl, err := h.perms.GetTemplate(c.Request().Context(), id)
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusNotFound, "Role template not found")
+	}
+	if err := authorizeCompany(c, h.users, actor, tmpl.CompanyID); err != nil {
+		return nil, nil, err
+	}
+
+	return actor, tmpl, nil
+}
+
+// loadTarget returns the acting admin and the user named in the URL. Admins
+// can change the permissions of users at their own level or below, but never
+// their own.
+func (h *PermissionHandler) loadTarget(c echo.Context) (*models.User, *models.User, error) {
+	actor, err := currentUser(c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	target, err := h.users.GetUser(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return nil, nil, echo.NewHTTPError(http.StatusNotFound, "User not found")
+	}
+	if err := authorizeCompany(c, h.users, actor, target.CompanyID); err != nil {
+		return nil, nil, err
+	}
+	if target.ID == actor.ID {
+		return nil, nil, echo.NewHTTPError(http.StatusForbidden, "You cannot change your own permissions")
+	}
+	if !actor.CanAssignRole(target.Role) {
+		return nil, nil, echo.NewHTTPError(http.StatusForbidden, "Access denied")
+	}
+
+	return actor, target, nil
+}
+
+func (h *PermissionHandler) respondWithUser(c echo.Context, user *models.User) error {
+	ctx := c.Request().Context()
+	perms, err := h.perms.Effective(ctx, user)
+	if err != nil {
+		return err
+	}
+	overrides, err := h.perms.Overrides(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, userPermissions{
+		ID:             user.ID,
+		Email:          user.Email,
+		Name:           user.Name,
+		Role:           user.Role,
+		RoleTemplateID: user.RoleTemplateID,
+		Capabilities:   perms.List(),
+		Overrides:      overrides,
+	})
+}
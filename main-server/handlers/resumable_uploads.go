@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	customMiddleware "main-server/middleware"
+	"main-server/models"
+	"main-server/services"
+)
+
+// ResumableUploadHandler exposes services.ResumableUploadService:
+//
+//	POST   /app/upload/sessions                 {filename, content_type, size}
+//	GET    /app/upload/sessions/:id             session with received parts
+//	PUT    /app/upload/sessions/:id/parts/:n    raw part, X-Part-SHA256 header
+//	POST   /app/upload/sessions/:id/complete    the new audience file
+//	DELETE /app/upload/sessions/:id             abort
+//
+// A client resumes by fetching the session and sending the parts it lacks.
+type ResumableUploadHandler struct {
+	uploads *services.ResumableUploadService
+}
+
+func NewResumableUploadHandler(uploads *services.ResumableUploadService) *ResumableUploadHandler {
+	return &ResumableUploadHandler{uploads: uploads}
+}
+
+// Page renders the upload page, which drives the protocol from the browser
+// and shows progress.
+func (h *ResumableUploadHandler) Page(c echo.Context) error {
+	return c.Render(http.StatusOK, "audience_upload.html", pageData(c, map[string]interface{}{
+		"Title": "Upload Audience File",
+	}))
+}
+
+type initUploadRequest struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+func (h *ResumableUploadHandler) Init(c echo.Context) error {
+	actor, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+	t := customMiddleware.Tenant(c)
+	if t.CompanyID == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "Audience files belong to a company")
+	}
+
+	var req initUploadRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+
+	session, err := h.uploads.Init(c.Request().Context(), actor, t.WorkspaceID, t.CompanyID,
+		req.Filename, req.ContentType, req.Size)
+	if err != nil {
+		return uploadError(err)
+	}
+	return c.JSON(http.StatusCreated, session)
+}
+
+func (h *ResumableUploadHandler) Status(c echo.Context) error {
+	session, err := h.session(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, session)
+}
+
+func (h *ResumableUploadHandler) PutPart(c echo.Context) error {
+	session, err := h.session(c)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(c.Param("n"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid part number")
+	}
+
+	part, err := h.uploads.PutPart(c.Request().Context(), session, n, c.Request().Body, c.Request().Header.Get("X-Part-SHA256"))
+	if err != nil {
+		return uploadError(err)
+	}
+	return c.JSON(http.StatusOK, part)
+}
+
+func (h *ResumableUploadHandler) Complete(c echo.Context) error {
+	session, err := h.session(c)
+	if err != nil {
+		return err
+	}
+
+	f, err := h.uploads.Complete(c.Request().Context(), session)
+	if err != nil {
+		return uploadError(err)
+	}
+	return c.JSON(http.StatusOK, f)
+}
+
+func (h *ResumableUploadHandler) Abort(c echo.Context) error {
+	session, err := h.session(c)
+	if err != nil {
+		return err
+	}
+
+	if err := h.uploads.Abort(c.Request().Context(), session); err != nil {
+		return uploadError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// session loads the session in the URL if it belongs to the company the
+// user is acting as.
+func (h *ResumableUploadHandler) session(c echo.Context) (*models.UploadSession, error) {
+	t := customMiddleware.Tenant(c)
+	if t == nil || t.User == nil {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "Not signed in")
+	}
+
+	session, err := h.uploads.Get(c.Request().Context(), c.Param("id"))
+	if err != nil || session.CompanyID != t.CompanyID {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Upload session not found")
+	}
+	return session, nil
+}
+
+func uploadError(err error) error {
+	var quota *services.EntitlementError
+	switch {
+	case errors.As(err, &quota):
+		return echo.NewHTTPError(quota.Status, quota)
+	case errors.Is(err, services.ErrUploadTooLarge):
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, err.Error())
+	case errors.Is(err, services.ErrUploadSessionClosed):
+		return echo.NewHTTPError(http.StatusGone, err.Error())
+	case errors.Is(err, services.ErrInvalidUpload), errors.Is(err, services.ErrInvalidPart):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, services.ErrMultipartUnsupported), errors.Is(err, services.ErrDirectUploadUnsupported):
+		return echo.NewHTTPError(http.StatusNotImplemented, err.Error())
+	}
+	return err
+}
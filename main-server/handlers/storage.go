@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"main-server/services"
+)
+
+// StorageHandler serves the signed URLs LocalStorage hands out, standing in
+// for S3's presigned requests in development:
+//
+//	GET /storage/object?key=…&expires=…&signature=…
+//	PUT /storage/object?key=…&expires=…&content-type=…&size=…&signature=…
+//
+// The signature is the only authorization, so the routes sit outside /app.
+type StorageHandler struct {
+	storage *services.LocalStorage
+}
+
+func NewStorageHandler(storage *services.LocalStorage) *StorageHandler {
+	return &StorageHandler{storage: storage}
+}
+
+func (h *StorageHandler) Get(c echo.Context) error {
+	key, err := h.storage.VerifyDownload(c.QueryParams())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusForbidden, "Invalid or expired link")
+	}
+
+	ctx := c.Request().Context()
+	info, err := h.storage.Stat(ctx, key)
+	if errors.Is(err, services.ErrObjectNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	if err != nil {
+		return err
+	}
+	r, err := h.storage.Download(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// LocalStorage hands out files, so ranges and conditional requests work
+	if rs, ok := r.(io.ReadSeeker); ok {
+		http.ServeContent(c.Response(), c.Request(), "", info.ModTime, rs)
+		return nil
+	}
+	return c.Stream(http.StatusOK, echo.MIMEOctetStream, r)
+}
+
+// Put stores the request body if it meets the signed conditions: exactly
+// the signed size, sent with the signed content type.
+func (h *StorageHandler) Put(c echo.Context) error {
+	key, cond, err := h.storage.VerifyUpload(c.QueryParams())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusForbidden, "Invalid or expired upload URL")
+	}
+
+	req := c.Request()
+	if req.Header.Get(echo.HeaderContentType) != cond.ContentType {
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("Content-Type must be %s", cond.ContentType))
+	}
+	if req.ContentLength < 0 {
+		return echo.NewHTTPError(http.StatusLengthRequired, "Content-Length is required")
+	}
+	if req.ContentLength != cond.Size {
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("The upload must be %d bytes", cond.Size))
+	}
+
+	body := &exactReader{r: req.Body, remaining: cond.Size}
+	if err := h.storage.Upload(req.Context(), body, key); err != nil {
+		if errors.Is(err, errSizeMismatch) {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("The upload must be %d bytes", cond.Size))
+		}
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+var errSizeMismatch = errors.New("body does not match its Content-Length")
+
+// exactReader fails unless r holds exactly remaining bytes, so a short or
+// long body never replaces the stored object.
+type exactReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > e.remaining+1 {
+		p = p[:e.remaining+1]
+	}
+	n, err := e.r.Read(p)
+	e.remaining -= int64(n)
+	switch {
+	case e.remaining < 0:
+		return n, errSizeMismatch
+	case err == io.EOF && e.remaining > 0:
+		return n, errSizeMismatch
+	}
+	return n, err
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	customMiddleware "main-server/middleware"
+	"main-server/services"
+)
+
+// TrashHandler deletes the audience files of the company the user is acting
+// as, through the trash, and reports how much of the company's storage
+// quota they use:
+//
+//	DELETE /app/uploads/:id          moves a file to the trash
+//	GET    /app/trash                files in the trash, with purge_at
+//	POST   /app/trash/:id/restore    takes a file back out
+//	DELETE /app/trash/:id            purges a file for good
+//	GET    /app/storage/usage        bytes stored against the quota
+type TrashHandler struct {
+	lifecycle *services.AudienceLifecycleService
+}
+
+func NewTrashHandler(lifecycle *services.AudienceLifecycleService) *TrashHandler {
+	return &TrashHandler{lifecycle: lifecycle}
+}
+
+func (h *TrashHandler) Trash(c echo.Context) error {
+	actor, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+	companyID, id, err := trashFile(c)
+	if err != nil {
+		return err
+	}
+
+	f, err := h.lifecycle.Trash(c.Request().Context(), actor, companyID, id)
+	if err != nil {
+		return lifecycleError(err)
+	}
+	return c.JSON(http.StatusOK, f)
+}
+
+func (h *TrashHandler) List(c echo.Context) error {
+	companyID, err := trashCompany(c)
+	if err != nil {
+		return err
+	}
+
+	files, err := h.lifecycle.ListTrash(c.Request().Context(), companyID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, files)
+}
+
+func (h *TrashHandler) Restore(c echo.Context) error {
+	companyID, id, err := trashFile(c)
+	if err != nil {
+		return err
+	}
+
+	f, err := h.lifecycle.Restore(c.Request().Context(), companyID, id)
+	if err != nil {
+		return lifecycleError(err)
+	}
+	return c.JSON(http.StatusOK, f)
+}
+
+func (h *TrashHandler) Purge(c echo.Context) error {
+	companyID, id, err := trashFile(c)
+	if err != nil {
+		return err
+	}
+
+	if err := h.lifecycle.Purge(c.Request().Context(), companyID, id); err != nil {
+		return lifecycleError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h *TrashHandler) Usage(c echo.Context) error {
+	companyID, err := trashCompany(c)
+	if err != nil {
+		return err
+	}
+
+	usage, err := h.lifecycle.Usage(c.Request().Context(), companyID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, usage)
+}
+
+// trashCompany returns the company the user is acting as. Workspace and
+// super admins must be acting as one, as they are for uploads.
+func trashCompany(c echo.Context) (string, error) {
+	t := customMiddleware.Tenant(c)
+	if t == nil || t.User == nil {
+		return "", echo.NewHTTPError(http.StatusUnauthorized, "Not signed in")
+	}
+	if t.CompanyID == "" {
+		return "", echo.NewHTTPError(http.StatusForbidden, "Audience files belong to a company")
+	}
+	return t.CompanyID, nil
+}
+
+func trashFile(c echo.Context) (string, int, error) {
+	companyID, err := trashCompany(c)
+	if err != nil {
+		return "", 0, err
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return "", 0, echo.NewHTTPError(http.StatusBadRequest, "Invalid file ID")
+	}
+	return companyID, id, nil
+}
+
+func lifecycleError(err error) error {
+	switch {
+	case errors.Is(err, services.ErrAudienceFileNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	case errors.Is(err, services.ErrAudienceFileBusy),
+		errors.Is(err, services.ErrAudienceFileTrashed),
+		errors.Is(err, services.ErrNotInTrash):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	return err
+}
@@ -1,27 +1,54 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
-	"io"
+	"mime"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
+	"strconv"
 
 	"github.com/labstack/echo/v4"
+
+	customMiddleware "main-server/middleware"
+	"main-server/models"
+	"main-server/services"
 )
 
+// UploadHandler accepts audience file uploads for the signed-in user's
+// company and serves them back to users of that company only, through
+// signed download links, once they are out of quarantine:
+//
+//	GET  /app/uploads/:id/status     the file's record, to poll while it is checked and parsed
+//	GET  /app/uploads/:id/schema     the detected columns, with the first rows and platforms prepared for
+//	PUT  /app/uploads/:id/mapping    {mapping, has_header, country} confirms the columns
+//	POST /app/uploads/:id/link       {url, expires_at}
+//	GET  /app/uploads/:id            redirects to a new link
+//	GET  /app/uploads/:id/download   the file, given a link's query
+//
+// Files in the trash are gone as far as these routes are concerned; see
+// TrashHandler.
 type UploadHandler struct {
-	uploadDir string
+	files   *services.AudienceFileService
+	schemas *services.AudienceSchemaService
 }
 
-func NewUploadHandler(uploadDir string) *UploadHandler {
+func NewUploadHandler(files *services.AudienceFileService, schemas *services.AudienceSchemaService) *UploadHandler {
 	return &UploadHandler{
-		uploadDir: uploadDir,
+		files:   files,
+		schemas: schemas,
 	}
 }
 
 func (h *UploadHandler) Upload(c echo.Context) error {
+	actor, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+	t := customMiddleware.Tenant(c)
+	if t.CompanyID == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "Audience files belong to a company")
+	}
+
 	// Get the file from form
 	file, err := c.FormFile("file")
 	if err != nil {
@@ -39,56 +66,224 @@ func (h *UploadHandler) Upload(c echo.Context) error {
 	}
 	defer src.Close()
 
-	// Create destination file path
-	filename := file.Filename
-	dst := filepath.Join(h.uploadDir, filename)
-
-	// Create the destination file
-	out, err := os.Create(dst)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Failed to create file",
-		})
+	f, err := h.files.Upload(c.Request().Context(), actor, t.WorkspaceID, t.CompanyID,
+		file.Filename, file.Header.Get(echo.HeaderContentType), src)
+	var quota *services.EntitlementError
+	if errors.As(err, &quota) {
+		return echo.NewHTTPError(quota.Status, quota)
 	}
-	defer out.Close()
-
-	// Copy file contents
-	_, err = io.Copy(out, src)
 	if err != nil {
+		c.Logger().Errorf("audience file upload: %v", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{
 			"error": "Failed to save file",
 		})
 	}
 
 	return c.JSON(http.StatusOK, map[string]interface{}{
-		"message":  "File uploaded successfully",
-		"filename": filename,
-		"url":      fmt.Sprintf("/uploads/%s", filename),
+		"message": "File uploaded successfully",
+		"file":    f,
+		"url":     fmt.Sprintf("/app/uploads/%d", f.ID),
 	})
 }
 
+// Status returns an audience file's record. New files are quarantined
+// until they have been checked, then ready or rejected with a reason.
+func (h *UploadHandler) Status(c echo.Context) error {
+	f, err := h.file(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, f)
+}
+
+type schemaResponse struct {
+	File            *models.AudienceFile        `json:"file"`
+	Preview         [][]string                  `json:"preview"`
+	IdentifierTypes []string                    `json:"identifier_types"`
+	Outputs         []models.AudienceFileOutput `json:"outputs"`
+}
+
+// Schema returns a ready file's record, with its detected columns and
+// suggested mapping, its first rows to confirm them against, and once it
+// has been processed, the platforms it was prepared for.
+func (h *UploadHandler) Schema(c echo.Context) error {
+	f, err := h.readyFile(c)
+	if err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	preview, err := h.schemas.Preview(ctx, f)
+	if err != nil {
+		return mappingError(err)
+	}
+	outputs, err := h.schemas.Outputs(ctx, f.ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, schemaResponse{File: f, Preview: preview, IdentifierTypes: models.IdentifierTypes, Outputs: outputs})
+}
+
+type mappingRequest struct {
+	Mapping models.ColumnMapping `json:"mapping"`
+	// Whether the first row is a header; left out, as detected
+	HasHeader *bool `json:"has_header"`
+	// Where rows without a country column value are; left out, unchanged
+	Country string `json:"country"`
+}
+
+// Mapping confirms or fixes which identifier each column of a ready file
+// holds, and queues the file to be processed with it.
+func (h *UploadHandler) Mapping(c echo.Context) error {
+	f, err := h.readyFile(c)
+	if err != nil {
+		return err
+	}
+	if f.Schema == nil {
+		return mappingError(services.ErrMappingNotReady)
+	}
+
+	var req mappingRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+	hasHeader := f.Schema.HasHeader
+	if req.HasHeader != nil {
+		hasHeader = *req.HasHeader
+	}
+
+	ctx := c.Request().Context()
+	if err := h.schemas.ConfirmMapping(ctx, f, req.Mapping, hasHeader, req.Country); err != nil {
+		return mappingError(err)
+	}
+	if f, err = h.files.Get(ctx, f.ID); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusAccepted, f)
+}
+
+func mappingError(err error) error {
+	switch {
+	case errors.Is(err, services.ErrInvalidMapping):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, services.ErrMappingNotReady):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	case errors.Is(err, services.ErrAudienceFileNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	var formatErr *services.AudienceFormatError
+	if errors.As(err, &formatErr) {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "This file cannot be parsed: "+formatErr.Reason)
+	}
+	return err
+}
+
+// Link returns a signed, expiring link for the signed-in user to download
+// an audience file of the company they are acting as.
+func (h *UploadHandler) Link(c echo.Context) error {
+	f, err := h.readyFile(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, h.files.DownloadLink(f, customMiddleware.Tenant(c).User.ID))
+}
+
+// Serve redirects to a fresh download link, so plain links to a file keep
+// working for users who may download it.
 func (h *UploadHandler) Serve(c echo.Context) error {
-	// Get filename from URL parameter
-	filename := c.Param("*")
+	f, err := h.readyFile(c)
+	if err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusFound, h.files.DownloadLink(f, customMiddleware.Tenant(c).User.ID).URL)
+}
 
-	// Clean the filename to prevent directory traversal
-	filename = filepath.Clean(filename)
-	if strings.Contains(filename, "..") {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "Invalid filename",
-		})
+// Download sends an audience file as an attachment under its original name,
+// given a valid link for it. Range and conditional requests are answered
+// from the stored object without reading the rest of it, and every request
+// is audited before anything is sent.
+func (h *UploadHandler) Download(c echo.Context) error {
+	f, err := h.readyFile(c)
+	if err != nil {
+		return err
+	}
+	t := customMiddleware.Tenant(c)
+	if err := h.files.VerifyDownloadLink(f, t.User.ID, c.QueryParams()); err != nil {
+		return echo.NewHTTPError(http.StatusForbidden, "This download link is invalid or has expired")
+	}
+
+	req := c.Request()
+	body, err := h.files.Reader(req.Context(), f)
+	if errors.Is(err, services.ErrObjectNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	if err != nil {
+		return err
 	}
+	defer body.Close()
 
-	// Build full file path
-	filePath := filepath.Join(h.uploadDir, filename)
+	if err := h.files.RecordDownload(req.Context(), f, req.Header.Get("Range")); err != nil {
+		return err
+	}
+	// Sending the file does not need the database and can take a while
+	customMiddleware.ReleaseTenant(c)
 
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return c.JSON(http.StatusNotFound, map[string]string{
-			"error": "File not found",
-		})
+	contentType := f.ContentType
+	if contentType == "" {
+		contentType = echo.MIMEOctetStream
+	}
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, contentType)
+	header.Set(echo.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{
+		"filename": f.OriginalFilename,
+	}))
+	// The content hash makes If-Range safe across re-uploads
+	if f.FileHash != "" {
+		header.Set("ETag", `"`+f.FileHash+`"`)
+	}
+	header.Set("Cache-Control", "private, no-store")
+	http.ServeContent(c.Response(), req, "", f.CreatedAt, body)
+	return nil
+}
+
+func (h *UploadHandler) file(c echo.Context) (*models.AudienceFile, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid file ID")
+	}
+
+	t := customMiddleware.Tenant(c)
+	if t == nil || t.User == nil {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "Not signed in")
+	}
+
+	// Row-level security already hides other companies' files from company
+	// users; workspace and super admins must be acting as the company too.
+	f, err := h.files.Get(c.Request().Context(), id)
+	if err != nil || f.CompanyID != t.CompanyID {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "File not found")
 	}
 
-	// Serve the file
-	return c.File(filePath)
+	return f, nil
+}
+
+// readyFile is file for files that may be downloaded: quarantined ones
+// have not been checked yet, and rejected, trashed and purged ones are gone.
+func (h *UploadHandler) readyFile(c echo.Context) (*models.AudienceFile, error) {
+	f, err := h.file(c)
+	if err != nil {
+		return nil, err
+	}
+	if f.DeletedAt != nil {
+		return nil, echo.NewHTTPError(http.StatusGone, "This file has been deleted")
+	}
+	switch f.Status {
+	case models.AudienceFileReady:
+		return f, nil
+	case models.AudienceFileQuarantined:
+		return nil, echo.NewHTTPError(http.StatusConflict, "This file is still being checked")
+	case models.AudienceFileRejected:
+		return nil, echo.NewHTTPError(http.StatusConflict, "This file was rejected: "+f.RejectionReason)
+	default:
+		return nil, echo.NewHTTPError(http.StatusConflict, "This file cannot be downloaded")
+	}
 }
@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	customMiddleware "main-server/middleware"
+	"main-server/models"
+	"main-server/services"
+)
+
+// maxImportFileSize bounds the size of an uploaded user CSV.
+const maxImportFileSize = 5 << 20
+
+type UserAdminHandler struct {
+	users   *services.CompanyUserService
+	imports *services.UserImportService
+}
+
+func NewUserAdminHandler(users *services.CompanyUserService, imports *services.UserImportService) *UserAdminHandler {
+	return &UserAdminHandler{
+		users:   users,
+		imports: imports,
+	}
+}
+
+// ImportPreview validates an uploaded CSV and returns the dry-run report.
+// Nothing is created until the import is committed.
+func (h *UserAdminHandler) ImportPreview(c echo.Context) error {
+	actor, companyID, err := resolveCompany(c, h.users)
+	if err != nil {
+		return err
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "No file provided",
+		})
+	}
+	if file.Size > maxImportFileSize {
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{
+			"error": fmt.Sprintf("File is larger than %d MB", maxImportFileSize>>20),
+		})
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Failed to open file",
+		})
+	}
+	defer src.Close()
+
+	imp, err := h.imports.Preview(c.Request().Context(), actor, companyID, file.Filename, src)
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, imp)
+}
+
+// ImportStatus returns an import with its per-row report and progress.
+func (h *UserAdminHandler) ImportStatus(c echo.Context) error {
+	imp, err := h.loadImport(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, imp)
+}
+
+// ImportCommit sends invitations for the accepted rows of a dry run.
+func (h *UserAdminHandler) ImportCommit(c echo.Context) error {
+	imp, err := h.loadImport(c)
+	if err != nil {
+		return err
+	}
+
+	actor, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	imp, err = h.imports.Commit(c.Request().Context(), actor, imp.ID)
+	if err != nil {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusAccepted, imp)
+}
+
+// Export sends the company's user roster as CSV. The roster is built before
+// anything is sent, so a failed query is an error response rather than a
+// truncated file.
+func (h *UserAdminHandler) Export(c echo.Context) error {
+	_, companyID, err := resolveCompany(c, h.users)
+	if err != nil {
+		return err
+	}
+
+	var roster bytes.Buffer
+	if err := h.imports.Export(c.Request().Context(), companyID, &roster); err != nil {
+		return err
+	}
+
+	filename := fmt.Sprintf("users-%s-%s.csv", companyID, time.Now().Format("20060102"))
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	return c.Blob(http.StatusOK, "text/csv; charset=utf-8", roster.Bytes())
+}
+
+// Disable stops a user from signing in.
+func (h *UserAdminHandler) Disable(c echo.Context) error {
+	return h.setActive(c, false)
+}
+
+// Enable lets a disabled user sign in again.
+func (h *UserAdminHandler) Enable(c echo.Context) error {
+	return h.setActive(c, true)
+}
+
+func (h *UserAdminHandler) setActive(c echo.Context, active bool) error {
+	actor, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	target, err := h.users.FindUser(ctx, c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found")
+	}
+	if err := authorizeCompany(c, h.users, actor, target.CompanyID); err != nil {
+		return err
+	}
+	if target.ID == actor.ID {
+		return echo.NewHTTPError(http.StatusForbidden, "You cannot disable yourself")
+	}
+	if !actor.CanAssignRole(target.Role) {
+		return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+	}
+
+	if err := h.users.SetActive(ctx, target, active); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, target)
+}
+
+func (h *UserAdminHandler) loadImport(c echo.Context) (*models.UserImport, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid import ID")
+	}
+
+	actor, err := currentUser(c)
+	if err != nil {
+		return nil, err
+	}
+
+	imp, err := h.imports.Get(c.Request().Context(), id)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Import not found")
+	}
+	if err := authorizeCompany(c, h.users, actor, imp.CompanyID); err != nil {
+		return nil, err
+	}
+
+	return imp, nil
+}
+
+// resolveCompany returns the acting admin and the company they are working
+// on. Company admins always act on their own company; workspace and super
+// admins pick one with the company_id parameter.
+func resolveCompany(c echo.Context, users *services.CompanyUserService) (*models.User, string, error) {
+	actor, err := currentUser(c)
+	if err != nil {
+		return nil, "", err
+	}
+
+	companyID := actor.CompanyID
+	if actor.Role == models.RoleWorkspaceAdmin || actor.Role == models.RoleSuperAdmin {
+		companyID = c.FormValue("company_id")
+	}
+	if companyID == "" {
+		return nil, "", echo.NewHTTPError(http.StatusBadRequest, "company_id is required")
+	}
+
+	if err := authorizeCompany(c, users, actor, companyID); err != nil {
+		return nil, "", err
+	}
+
+	return actor, companyID, nil
+}
+
+// authorizeCompany checks that actor may administer users of companyID.
+func authorizeCompany(c echo.Context, users *services.CompanyUserService, actor *models.User, companyID string) error {
+	if !actor.CanManageUsers() || !actor.CanAccessCompany(companyID) {
+		return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+	}
+
+	if actor.Role == models.RoleWorkspaceAdmin {
+		_, workspaceID, err := users.GetCompany(c.Request().Context(), companyID)
+		if err != nil || workspaceID != actor.WorkspaceID {
+			return echo.NewHTTPError(http.StatusForbidden, "Access denied")
+		}
+	}
+
+	return nil
+}
+
+// currentUser returns the signed-in user loaded by LoadTenant.
+func currentUser(c echo.Context) (*models.User, error) {
+	user := customMiddleware.CurrentUser(c)
+	if user == nil {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "Not signed in")
+	}
+	return user, nil
+}
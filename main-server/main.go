@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -9,7 +11,13 @@ import (
 	"main-server/config"
 	"main-server/handlers"
 	customMiddleware "main-server/middleware"
+	"main-server/models"
+	"main-server/services"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo-contrib/session"
@@ -23,6 +31,9 @@ type App struct {
 	db     *sql.DB
 	echo   *echo.Echo
 	config *config.Config
+
+	// Cancels periodic background work such as audit checkpoints
+	stopBackground context.CancelFunc
 }
 
 var store *sessions.CookieStore
@@ -47,16 +58,7 @@ func main() {
 		log.Fatal("Failed to create upload directory:", err)
 	}
 
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
-		cfg.Database.Host,
-		cfg.Database.Port,
-		cfg.Database.User,
-		cfg.Database.Password,
-		cfg.Database.Name,
-		cfg.Database.SSLMode,
-	)
-
-	db, err := sql.Open("postgres", connStr)
+	db, err := sql.Open("postgres", cfg.Database.ConnString())
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
@@ -71,6 +73,8 @@ func main() {
 
 	// Initialize Echo
 	e := echo.New()
+	e.IPExtractor = customMiddleware.ClientIPExtractor(cfg.TrustedProxies, cfg.TrustedProxyHeader)
+	e.Use(middleware.RequestID())
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 	e.Use(middleware.CORS())
@@ -78,7 +82,7 @@ func main() {
 
 	// Template Renderer
 	renderer := &TemplateRenderer{
-		templates: template.Must(template.ParseGlob("templates/*.html")),
+		templates: template.Must(template.New("").Funcs(handlers.TemplateFuncs()).ParseGlob("templates/*.html")),
 	}
 	e.Renderer = renderer
 
@@ -89,14 +93,102 @@ func main() {
 	}
 
 	// In setupRoutes() function
-	authHandler := handlers.NewAuthHandler(db, cfg)
 	homeHandler := handlers.NewHomeHandler(db, cfg)
-	uploadHandler := handlers.NewUploadHandler(cfg.UploadDir) // New local upload handler
+	storage := openStorage(cfg)
+
+	// Background jobs and user administration
+	jobs := services.NewJobQueue(2, 100)
+	auditQueue := services.NewAuditQueue(db, cfg.AuditQueueSize, cfg.AuditBatchSize, cfg.AuditFlushInterval)
+	authHandler := handlers.NewAuthHandler(db, cfg, auditQueue)
+
+	// Signed checkpoints of the audit hash chains
+	background, stopBackground := context.WithCancel(context.Background())
+	app.stopBackground = stopBackground
+	if cfg.AuditSigningKey != "" {
+		key, err := services.ParseAuditSigningKey(cfg.AuditSigningKey)
+		if err != nil {
+			log.Fatal("Invalid AUDIT_SIGNING_KEY:", err)
+		}
+		go services.NewAuditChainService(db, key).RunCheckpoints(background, cfg.AuditCheckpointInterval)
+	} else {
+		log.Println("AUDIT_SIGNING_KEY is not set; audit checkpoints are disabled")
+	}
+	audit := services.NewAuditService(db)
+	companyUsers := services.NewCompanyUserService(db, audit)
+	invitations := services.NewInvitationService(db, services.LogMailer{}, audit, cfg.BaseURL)
+	entitlements := services.NewEntitlementService(db, companyUsers)
+
+	// New audience files wait in quarantine until they have been checked,
+	// then are parsed and mapped. Both steps read whole files, so they run
+	// on their own queue where large files cannot hold up invitation mail
+	audienceJobs := services.NewJobQueue(2, 1000)
+	audienceSchemas := services.NewAudienceSchemaService(db, storage, audit, audienceJobs)
+	go audienceSchemas.RunEvery(background)
+	ingest := services.NewIngestService(db, storage, services.NewUploadValidator(malwareScanner(cfg)),
+		entitlements, audienceSchemas, audienceJobs, int64(cfg.UploadMaxSizeMB)<<20)
+	go ingest.RunEvery(background)
+	go services.NewBlobCollector(db, storage).RunEvery(background, cfg.BlobCollectionInterval)
+	audienceFiles := services.NewAudienceFileService(db, storage, ingest, entitlements, audit, []byte(cfg.StorageSigningKey), cfg.DownloadLinkTTL)
+	uploadHandler := handlers.NewUploadHandler(audienceFiles, audienceSchemas)
+
+	// Retention, the trash and storage quotas for audience files
+	audienceLifecycle := services.NewAudienceLifecycleService(db, storage, entitlements, audit, cfg.AudienceTrashTTL)
+	go audienceLifecycle.RunEvery(background, cfg.AudienceLifecycleInterval)
+	trashHandler := handlers.NewTrashHandler(audienceLifecycle)
+	entitlementHandler := handlers.NewEntitlementHandler(companyUsers, entitlements)
+	userImports := services.NewUserImportService(db, companyUsers, invitations, entitlements, audit, jobs)
+	userAdminHandler := handlers.NewUserAdminHandler(companyUsers, userImports)
+	permissions := services.NewPermissionService(db, audit)
+	permissionHandler := handlers.NewPermissionHandler(companyUsers, permissions)
+	auditStream := services.NewAuditStream(db, cfg.Database.ConnString(), cfg.AuditStreamMaxSubscribers)
+	go func() {
+		if err := auditStream.Run(background); err != nil {
+			log.Printf("Audit event stream stopped: %v", err)
+		}
+	}()
+	e.Server.RegisterOnShutdown(auditStream.Close)
+	auditLogHandler := handlers.NewAuditLogHandler(companyUsers, audit, entitlements, auditStream)
+	retention := services.NewAuditRetentionService(db, storage, entitlements, audit, cfg.AuditPlatformRetentionDays)
+	go retention.RunEvery(background, cfg.AuditRetentionInterval)
+	auditArchiveHandler := handlers.NewAuditArchiveHandler(retention)
+
+	// Security alerts from the rules file, evaluated against the audit stream
+	alertRules, alertNotifiers := loadAlertRules(cfg)
+	alerts := services.NewAlertService(db, alertRules, alertNotifiers, audit)
+	if len(alertRules) > 0 {
+		go func() {
+			if err := alerts.Run(background, auditStream); err != nil {
+				log.Printf("Security alerting stopped: %v", err)
+			}
+		}()
+	}
+	alertHandler := handlers.NewAlertHandler(alerts)
+
+	// Resumable uploads of large audience files
+	resumableUploads := services.NewResumableUploadService(db, storage, ingest, entitlements,
+		int64(cfg.UploadPartSizeMB)<<20, int64(cfg.UploadMaxSizeMB)<<20, cfg.UploadSessionTTL)
+	go resumableUploads.RunEvery(background)
+	resumableUploadHandler := handlers.NewResumableUploadHandler(resumableUploads)
+
+	// Uploads the browser sends straight to storage
+	directUploads := services.NewDirectUploadService(db, storage, ingest, entitlements,
+		int64(min(cfg.DirectUploadMaxSizeMB, cfg.UploadMaxSizeMB))<<20, cfg.DirectUploadExpiry)
+	go directUploads.RunEvery(background)
+	directUploadHandler := handlers.NewDirectUploadHandler(directUploads)
+	impersonation := services.NewImpersonationService(db, companyUsers, cfg.ImpersonationTTL)
+	impersonationHandler := handlers.NewImpersonationHandler(impersonation)
 
 	// Simplified routes
 	e.GET("/", homeHandler.Home)
 	e.GET("/health", homeHandler.Health)
 
+	// Signed URLs for local storage, which has no server of its own
+	if local, ok := services.BaseStorage(storage).(*services.LocalStorage); ok {
+		storageHandler := handlers.NewStorageHandler(local)
+		e.GET("/storage/object", storageHandler.Get)
+		e.PUT("/storage/object", storageHandler.Put)
+	}
+
 	// Auth routes
 	auth := e.Group("/auth")
 	auth.GET("/login", authHandler.ShowLogin)
@@ -108,22 +200,177 @@ func main() {
 	// Protected routes
 	protected := e.Group("/app")
 	protected.Use(customMiddleware.RequireAuth())
+	protected.Use(customMiddleware.LoadTenant(db, companyUsers, permissions, entitlements, impersonation))
+	protected.Use(customMiddleware.Audit(auditQueue))
 	protected.GET("/dashboard", authHandler.Dashboard)
-	protected.POST("/upload", uploadHandler.Upload)
-	protected.GET("/uploads/*", uploadHandler.Serve) // Serve uploaded files
+	protected.POST("/upload", uploadHandler.Upload, customMiddleware.RequireCapability(models.CapUploadAudiences),
+		middleware.BodyLimit("64M"))
+	protected.GET("/uploads/:id/status", uploadHandler.Status)
+	protected.GET("/uploads/:id/schema", uploadHandler.Schema)
+	protected.PUT("/uploads/:id/mapping", uploadHandler.Mapping, customMiddleware.RequireCapability(models.CapUploadAudiences))
+	protected.GET("/uploads/:id", uploadHandler.Serve)
+	protected.POST("/uploads/:id/link", uploadHandler.Link)
+	protected.GET("/uploads/:id/download", uploadHandler.Download)
+	protected.DELETE("/uploads/:id", trashHandler.Trash, customMiddleware.RequireCapability(models.CapUploadAudiences))
+
+	// Deleted audience files, until they are purged, and storage usage
+	trash := protected.Group("/trash", customMiddleware.RequireCapability(models.CapUploadAudiences))
+	trash.GET("", trashHandler.List)
+	trash.POST("/:id/restore", trashHandler.Restore)
+	trash.DELETE("/:id", trashHandler.Purge)
+	protected.GET("/storage/usage", trashHandler.Usage)
+
+	// Resumable uploads for files too large for a single request
+	uploadSessions := protected.Group("/upload/sessions", customMiddleware.RequireCapability(models.CapUploadAudiences))
+	uploadSessions.POST("", resumableUploadHandler.Init)
+	uploadSessions.GET("/:id", resumableUploadHandler.Status)
+	uploadSessions.PUT("/:id/parts/:n", resumableUploadHandler.PutPart)
+	uploadSessions.POST("/:id/complete", resumableUploadHandler.Complete)
+	uploadSessions.DELETE("/:id", resumableUploadHandler.Abort)
+	// Direct uploads of files small enough to send in one request
+	directUploadRoutes := protected.Group("/upload/direct", customMiddleware.RequireCapability(models.CapUploadAudiences))
+	directUploadRoutes.POST("", directUploadHandler.Init)
+	directUploadRoutes.POST("/:id/complete", directUploadHandler.Complete)
+	protected.GET("/audiences/upload", resumableUploadHandler.Page, customMiddleware.RequireCapability(models.CapUploadAudiences))
+
+	// Bulk user import (dry run, then commit) and roster export
+	protected.POST("/users/import", userAdminHandler.ImportPreview)
+	protected.GET("/users/import/:id", userAdminHandler.ImportStatus)
+	protected.POST("/users/import/:id/commit", userAdminHandler.ImportCommit)
+	protected.GET("/users/export", userAdminHandler.Export,
+		customMiddleware.RequireCapability(models.CapExportData),
+		customMiddleware.RequireFeature(entitlements, models.FeatureBulkExport))
+
+	// Plan, features and usage for the current company
+	protected.GET("/entitlements", entitlementHandler.Show)
+
+	// Audit log viewer, API, exports and live stream
+	auditLogs := protected.Group("/audit", customMiddleware.RequireCapability(models.CapViewAuditLog))
+	auditLogs.GET("", auditLogHandler.Index)
+	auditLogs.GET("/live", auditLogHandler.Live)
+	auditLogs.GET("/stream", auditLogHandler.Stream)
+	auditLogs.GET("/events", auditLogHandler.Events)
+	auditLogs.GET("/entities/:type/:id", auditLogHandler.History)
+	auditLogs.GET("/export", auditLogHandler.Export, customMiddleware.RequireFeature(entitlements, models.FeatureBulkExport))
+	auditLogs.GET("/archives", auditArchiveHandler.List)
+	auditLogs.POST("/archives/:id/restore", auditArchiveHandler.Restore)
+	auditLogs.DELETE("/archives/:id/restore", auditArchiveHandler.Release)
+
+	// Security alerts
+	alertRoutes := protected.Group("/alerts", customMiddleware.RequireCapability(models.CapViewAuditLog))
+	alertRoutes.GET("", alertHandler.Index)
+	alertRoutes.GET("/events", alertHandler.List)
+	alertRoutes.POST("/:id/acknowledge", alertHandler.Acknowledge)
+
+	// Sensitive actions are unavailable while impersonating. Password and MFA
+	// changes belong in this group.
+	sensitive := protected.Group("", customMiddleware.BlockWhileImpersonating())
+
+	// Disabling and re-enabling users
+	sensitive.POST("/users/:id/disable", userAdminHandler.Disable)
+	sensitive.POST("/users/:id/enable", userAdminHandler.Enable)
+
+	// Per-user capabilities and company role templates
+	protected.GET("/permissions", permissionHandler.List)
+	sensitive.POST("/users/:id/permissions", permissionHandler.SetUserPermission)
+	sensitive.PUT("/users/:id/role-template", permissionHandler.AssignTemplate)
+	sensitive.POST("/role-templates", permissionHandler.CreateTemplate)
+	sensitive.PUT("/role-templates/:id", permissionHandler.UpdateTemplate)
+	sensitive.DELETE("/role-templates/:id", permissionHandler.DeleteTemplate)
+
+	// Super admin impersonation
+	sensitive.POST("/admin/users/:id/impersonate", impersonationHandler.Start)
+	protected.POST("/impersonation/stop", impersonationHandler.Stop)
 
 	// Metrics endpoint (keep this)
 	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
 
 	fmt.Printf("Server starting on port %s\n", cfg.Port)
-	fmt.Printf("Upload directory: %s\n", cfg.UploadDir)
+	fmt.Printf("Storage backend: %s\n", cfg.StorageBackend)
 	fmt.Printf("Metrics: http://localhost:%s/metrics\n", cfg.Port)
 
-	e.Logger.Fatal(e.Start(":" + cfg.Port))
+	go func() {
+		if err := e.Start(":" + cfg.Port); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Fatal(err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	<-quit
 
-	defer app.Shutdown()
+	app.Shutdown(auditQueue, jobs, audienceJobs)
 }
 
-func (app *App) Shutdown() {
+// Shutdown stops taking requests, then drains the background queues so no
+// audit events or invitations are lost, before closing the database.
+func (app *App) Shutdown(auditQueue *services.AuditQueue, queues ...*services.JobQueue) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	if err := app.echo.Shutdown(ctx); err != nil {
+		log.Printf("Server shutdown: %v", err)
+	}
+	// The background loops queue jobs of their own, so they stop first
+	app.stopBackground()
+	for _, jobs := range queues {
+		if err := jobs.Shutdown(ctx); err != nil {
+			log.Printf("Job queue shutdown: %v", err)
+		}
+	}
+	if err := auditQueue.Shutdown(ctx); err != nil {
+		log.Printf("Audit queue shutdown: %v", err)
+	}
+
 	app.db.Close()
 }
+
+// loadAlertRules reads ALERT_RULES_FILE. Alerting is disabled, not fatal,
+// when the file is missing; an invalid file stops the server.
+func loadAlertRules(cfg *config.Config) ([]services.AlertRule, []services.AlertNotifier) {
+	alertConfig, err := services.LoadAlertConfig(cfg.AlertRulesFile)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("No alert rules at %s; security alerting is disabled", cfg.AlertRulesFile)
+		return nil, nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	notifiers, err := services.BuildAlertNotifiers(alertConfig.Notifiers, services.LogMailer{}, cfg.BaseURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return alertConfig.Rules, notifiers
+}
+
+// openStorage returns the StorageBackend selected by STORAGE_BACKEND, and
+// stops the server if it cannot be set up.
+func openStorage(cfg *config.Config) services.StorageBackend {
+	storage, err := services.OpenStorage(cfg)
+	if err != nil {
+		log.Fatal("Failed to set up storage:", err)
+	}
+	return storage
+}
+
+// malwareScanner returns the configured scanner, or nil to check uploads
+// without one.
+func malwareScanner(cfg *config.Config) services.MalwareScanner {
+	switch cfg.MalwareScanner {
+	case "":
+		log.Println("MALWARE_SCANNER is not set; uploads are not scanned for malware")
+		return nil
+	case "clamav":
+		scanner := services.NewClamAVScanner(cfg.ClamAVAddr, cfg.ClamAVTimeout)
+		// Files wait in quarantine while clamd is down, so this is no reason
+		// not to start
+		if err := scanner.Ping(context.Background()); err != nil {
+			log.Printf("clamd at %s is not answering: %v", cfg.ClamAVAddr, err)
+		}
+		return scanner
+	default:
+		log.Fatalf("Unknown MALWARE_SCANNER %q", cfg.MalwareScanner)
+		return nil
+	}
+}
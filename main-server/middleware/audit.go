@@ -2,85 +2,85 @@ package middleware
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
-	"net/http/httptest"
 	"time"
 
 	"main-server/models"
+	"main-server/services"
 
-	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
 )
 
-type AuditLog struct {
-	UserID      string          `db:"user_id"`
-	Action      string          `db:"action"`
-	EntityType  string          `db:"entity_type"`
-	EntityID    string          `db:"entity_id"`
-	CompanyID   string          `db:"company_id"`
-	WorkspaceID string          `db:"workspace_id"`
-	Changes     json.RawMessage `db:"changes"`
-	IPAddress   string          `db:"ip_address"`
-	UserAgent   string          `db:"user_agent"`
-	CreatedAt   time.Time       `db:"created_at"`
-}
-
-func AuditMiddleware(db *sqlx.DB) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Only audit state-changing requests
-			if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
-				next.ServeHTTP(w, r)
-				return
+// Audit records every successful state-changing request by a signed-in user.
+// It must run after LoadTenant. The response is streamed as normal; the
+// event is built from the request and status only and handed to queue, which
+// writes it in the background.
+func Audit(queue *services.AuditQueue) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if req.Method == http.MethodGet || req.Method == http.MethodHead || req.Method == http.MethodOptions {
+				return next(c)
 			}
 
-			// Capture response
-			rec := httptest.NewRecorder()
-			next.ServeHTTP(rec, r)
+			err := next(c)
 
-			// Log if successful
-			if rec.Code < 400 {
-				go logAudit(db, r)
+			if status := responseStatus(c, err); status < 400 {
+				if event := auditEvent(c, status); event != nil {
+					if qerr := queue.Enqueue(event); qerr != nil {
+						log.Printf("audit event dropped for %s: %v", event.Action, qerr)
+					}
+				}
 			}
 
-			// Copy response to original writer
-			for k, v := range rec.Header() {
-				w.Header()[k] = v
-			}
-			w.WriteHeader(rec.Code)
-			w.Write(rec.Body.Bytes())
-		})
+			return err
+		}
 	}
 }
 
-func logAudit(db *sqlx.DB, r *http.Request) {
-	user, _ := r.Context().Value("user").(*models.User)
-	if user == nil {
-		return
+// responseStatus is the status the client will see. When the handler
+// returned an error the response has not been written yet, so the status
+// comes from the error.
+func responseStatus(c echo.Context, err error) int {
+	if err == nil {
+		return c.Response().Status
 	}
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return he.Code
+	}
+	return http.StatusInternalServerError
+}
 
-	action := r.Method + " " + r.URL.Path
-
-	log := AuditLog{
-		UserID:    user.ID,
-		Action:    action,
-		CompanyID: user.CompanyID,
-		IPAddress: getClientIP(r),
-		UserAgent: r.UserAgent(),
-		CreatedAt: time.Now(),
+func auditEvent(c echo.Context, status int) *models.AuditLog {
+	t := Tenant(c)
+	if t == nil || t.User == nil {
+		return nil
 	}
 
-	_, _ = db.NamedExec(`
-        INSERT INTO audit_logs (user_id, action, company_id, ip_address, user_agent, created_at)
-        VALUES (:user_id, :action, :company_id, :ip_address, :user_agent, :created_at)
-    `, log)
-}
+	req := c.Request()
+	changes, _ := json.Marshal(map[string]interface{}{
+		"path":       req.URL.Path,
+		"status":     status,
+		"request_id": c.Response().Header().Get(echo.HeaderXRequestID),
+	})
 
-func getClientIP(r *http.Request) string {
-	if ip := r.Header.Get("X-Real-IP"); ip != "" {
-		return ip
+	event := &models.AuditLog{
+		UserID:      t.User.ID,
+		Action:      req.Method + " " + c.Path(),
+		CompanyID:   t.CompanyID,
+		WorkspaceID: t.WorkspaceID,
+		Changes:     changes,
+		IPAddress:   c.RealIP(),
+		UserAgent:   req.UserAgent(),
+		CreatedAt:   time.Now(),
 	}
-	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
-		return ip
+	if imp := t.Impersonation; imp != nil {
+		event.ImpersonatorID = &imp.ImpersonatorID
+		event.ImpersonationSessionID = &imp.ID
 	}
-	return r.RemoteAddr
+
+	return event
 }
@@ -1,13 +1,9 @@
 package middleware
 
 import (
-	"context"
 	"net/http"
 
-	"main-server/models"
-
 	"github.com/gorilla/sessions"
-	"github.com/jmoiron/sqlx"
 
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
@@ -31,35 +27,6 @@ func AuthMiddleware(store *sessions.CookieStore) func(http.Handler) http.Handler
 	}
 }
 
-func LoadContextMiddleware(db *sqlx.DB) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			session, _ := r.Context().Value("session").(*sessions.Session)
-			if session == nil {
-				next.ServeHTTP(w, r)
-				return
-			}
-
-			if userID, ok := session.Values["user_id"].(int); ok {
-				var user models.User
-				err := db.Get(&user, `
-                    SELECT u.*, c.workspace_id 
-                    FROM users u 
-                    JOIN companies c ON u.company_id = c.id 
-                    WHERE u.id = $1 AND u.is_active = true
-                `, userID)
-
-				if err == nil {
-					ctx := context.WithValue(r.Context(), "user", &user)
-					r = r.WithContext(ctx)
-				}
-			}
-
-			next.ServeHTTP(w, r)
-		})
-	}
-}
-
 func RequireAuth() echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
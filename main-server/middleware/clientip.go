@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ClientIPExtractor returns an echo.IPExtractor, and so the value of
+// c.RealIP(), that only believes the forwarding header the trusted proxies
+// set: Forwarded, X-Forwarded-For or X-Real-IP. The others are ignored, as a
+// proxy that does not set them passes on whatever the client sent.
+//
+// The connection's peer is the starting point. While the address in hand is
+// a trusted proxy, the next hop to the left in the header is taken; the
+// first untrusted address is the client. Hops a client prepends itself are
+// never reached, because a trusted proxy appends the address it actually saw
+// to the right of them. X-Real-IP holds one address, which a trusted peer is
+// believed about.
+//
+// The result is always a canonical address, IPv4-mapped IPv6 addresses are
+// reduced to IPv4, and it is empty only if the peer address is unusable.
+func ClientIPExtractor(trusted []*net.IPNet, header string) echo.IPExtractor {
+	header = http.CanonicalHeaderKey(header)
+	isTrusted := func(ip net.IP) bool {
+		for _, network := range trusted {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(req *http.Request) string {
+		client := parseHop(req.RemoteAddr)
+		if client == nil {
+			return ""
+		}
+		if !isTrusted(client) {
+			return client.String()
+		}
+
+		if header == echo.HeaderXRealIP {
+			if ip := parseHop(req.Header.Get(echo.HeaderXRealIP)); ip != nil {
+				return ip.String()
+			}
+			return client.String()
+		}
+
+		hops := forwardedFor(req.Header, header)
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := parseHop(hops[i])
+			if ip == nil {
+				// An obfuscated or garbled hop: the last address we can
+				// vouch for is the proxy that reported it.
+				break
+			}
+			client = ip
+			if !isTrusted(ip) {
+				break
+			}
+		}
+		return client.String()
+	}
+}
+
+// forwardedFor lists the client addresses recorded by proxies in header,
+// the RFC 7239 Forwarded header or X-Forwarded-For, oldest first. Repeated
+// headers are read in order.
+func forwardedFor(h http.Header, header string) []string {
+	var hops []string
+	if header == "Forwarded" {
+		for _, value := range h.Values("Forwarded") {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(key, "for") {
+						hops = append(hops, strings.Trim(value, `"`))
+					}
+				}
+			}
+		}
+		return hops
+	}
+
+	for _, value := range h.Values(header) {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// parseHop parses an address as it appears in RemoteAddr or a forwarding
+// header: bare, with a port, or as a bracketed IPv6 address.
+func parseHop(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	if strings.HasPrefix(s, "[") != strings.HasSuffix(s, "]") {
+		return nil
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+
+	// Drop an IPv6 zone, which INET cannot store
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		s = s[:i]
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
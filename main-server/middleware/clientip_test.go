@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestClientIPExtractor(t *testing.T) {
+	var trusted []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "fd00::/8"} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trusted = append(trusted, network)
+	}
+
+	tests := []struct {
+		name    string
+		header  string
+		peer    string
+		headers map[string][]string
+		want    string
+	}{
+		{
+			name: "untrusted peer", header: echo.HeaderXForwardedFor, peer: "203.0.113.5:4711",
+			headers: map[string][]string{echo.HeaderXForwardedFor: {"198.51.100.7"}},
+			want:    "203.0.113.5",
+		},
+		{
+			name: "trusted peer without a header", header: echo.HeaderXForwardedFor, peer: "10.0.0.1:4711",
+			want: "10.0.0.1",
+		},
+		{
+			name: "spoofed leftmost entry", header: echo.HeaderXForwardedFor, peer: "10.0.0.1:4711",
+			headers: map[string][]string{echo.HeaderXForwardedFor: {"6.6.6.6, 198.51.100.7"}},
+			want:    "198.51.100.7",
+		},
+		{
+			name: "spoofed entry behind two proxies", header: echo.HeaderXForwardedFor, peer: "10.0.0.1:4711",
+			headers: map[string][]string{echo.HeaderXForwardedFor: {"6.6.6.6", "198.51.100.7, 10.0.0.2"}},
+			want:    "198.51.100.7",
+		},
+		{
+			name: "all hops trusted", header: echo.HeaderXForwardedFor, peer: "10.0.0.1:4711",
+			headers: map[string][]string{echo.HeaderXForwardedFor: {"10.0.0.3, 10.0.0.2"}},
+			want:    "10.0.0.3",
+		},
+		{
+			name: "garbled hop", header: echo.HeaderXForwardedFor, peer: "10.0.0.1:4711",
+			headers: map[string][]string{echo.HeaderXForwardedFor: {"198.51.100.7, not-an-ip"}},
+			want:    "10.0.0.1",
+		},
+		{
+			name: "IPv4-mapped peer", header: echo.HeaderXForwardedFor, peer: "[::ffff:10.0.0.1]:4711",
+			headers: map[string][]string{echo.HeaderXForwardedFor: {"::ffff:198.51.100.7"}},
+			want:    "198.51.100.7",
+		},
+		{
+			name: "other headers ignored", header: echo.HeaderXForwardedFor, peer: "10.0.0.1:4711",
+			headers: map[string][]string{"Forwarded": {"for=198.51.100.7"}, echo.HeaderXRealIP: {"198.51.100.8"}},
+			want:    "10.0.0.1",
+		},
+		{
+			name: "Forwarded with a spoofed leftmost element", header: "Forwarded", peer: "10.0.0.1:4711",
+			headers: map[string][]string{"Forwarded": {"for=6.6.6.6, for=198.51.100.7;proto=https"}},
+			want:    "198.51.100.7",
+		},
+		{
+			name: "Forwarded quoted IPv6 with a port", header: "Forwarded", peer: "[fd00::1]:4711",
+			headers: map[string][]string{"Forwarded": {`for="[2001:db8::1]:4711";by=10.0.0.1`}},
+			want:    "2001:db8::1",
+		},
+		{
+			name: "Forwarded all hops trusted", header: "Forwarded", peer: "10.0.0.1:4711",
+			headers: map[string][]string{"Forwarded": {`for=10.0.0.3, for="[fd00::2]"`}},
+			want:    "10.0.0.3",
+		},
+		{
+			name: "Forwarded obfuscated identifier", header: "Forwarded", peer: "10.0.0.1:4711",
+			headers: map[string][]string{"Forwarded": {"for=198.51.100.7, for=_hidden"}},
+			want:    "10.0.0.1",
+		},
+		{
+			name: "Forwarded unknown", header: "Forwarded", peer: "10.0.0.1:4711",
+			headers: map[string][]string{"Forwarded": {"for=unknown"}},
+			want:    "10.0.0.1",
+		},
+		{
+			name: "Forwarded unterminated IPv6", header: "Forwarded", peer: "10.0.0.1:4711",
+			headers: map[string][]string{"Forwarded": {`for="[2001:db8::1"`}},
+			want:    "10.0.0.1",
+		},
+		{
+			name: "Forwarded from an untrusted peer", header: "Forwarded", peer: "203.0.113.5:4711",
+			headers: map[string][]string{"Forwarded": {"for=198.51.100.7"}},
+			want:    "203.0.113.5",
+		},
+		{
+			name: "X-Real-IP from a trusted peer", header: echo.HeaderXRealIP, peer: "10.0.0.1:4711",
+			headers: map[string][]string{echo.HeaderXRealIP: {"198.51.100.7"}},
+			want:    "198.51.100.7",
+		},
+		{
+			name: "X-Real-IP from an untrusted peer", header: echo.HeaderXRealIP, peer: "203.0.113.5:4711",
+			headers: map[string][]string{echo.HeaderXRealIP: {"198.51.100.7"}},
+			want:    "203.0.113.5",
+		},
+		{
+			name: "unusable peer", header: echo.HeaderXForwardedFor, peer: "somewhere",
+			headers: map[string][]string{echo.HeaderXForwardedFor: {"198.51.100.7"}},
+			want:    "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.peer
+			for name, values := range tt.headers {
+				for _, v := range values {
+					req.Header.Add(name, v)
+				}
+			}
+			if got := ClientIPExtractor(trusted, tt.header)(req); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"net/http"
+
+	"main-server/models"
+	"main-server/services"
+
+	"github.com/labstack/echo/v4"
+)
+
+// RequireFeature blocks routes the tenant's plan does not include. The
+// response is 402 when upgrading would unlock the feature and 403 when it has
+// been switched off for the company, with a JSON body naming the feature.
+func RequireFeature(entitlements *services.EntitlementService, feature models.Feature) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			t := Tenant(c)
+			if t == nil || t.User == nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Not signed in")
+			}
+			if t.HasFeature(feature) {
+				return next(c)
+			}
+
+			ent := t.Entitlements
+			if ent == nil {
+				ent = &models.Entitlements{}
+			}
+			if err := entitlements.CheckFeature(ent, feature); err != nil {
+				return entitlementHTTPError(err)
+			}
+			return next(c)
+		}
+	}
+}
+
+// entitlementHTTPError turns an *EntitlementError into a JSON HTTP error and
+// passes other errors through.
+func entitlementHTTPError(err error) error {
+	if ee, ok := err.(*services.EntitlementError); ok {
+		return echo.NewHTTPError(ee.Status, ee)
+	}
+	return err
+}
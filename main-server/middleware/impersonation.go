@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"main-server/models"
+	"main-server/services"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+)
+
+// Session keys used while a super admin is impersonating someone. user_id
+// holds the impersonated user for the duration.
+const (
+	SessionImpersonationID = "impersonation_id"
+	SessionImpersonatorID  = "impersonator_id"
+)
+
+// resolveImpersonation checks the session for an impersonation. An active one
+// is returned with its super admin loaded; an expired or ended one is closed
+// and the session switched back to the super admin, whose ID is returned in
+// place of userID.
+func resolveImpersonation(c echo.Context, sess *sessions.Session, users *services.CompanyUserService, impersonation *services.ImpersonationService, userID string) (*models.ImpersonationSession, string, error) {
+	impID, ok := sess.Values[SessionImpersonationID].(int)
+	if !ok {
+		return nil, userID, nil
+	}
+
+	ctx := c.Request().Context()
+	imp, err := impersonation.Get(ctx, impID)
+	if err == nil && imp.Active(time.Now()) {
+		imp.Impersonator, err = users.GetUser(ctx, imp.ImpersonatorID)
+		if err == nil {
+			return imp, userID, nil
+		}
+	}
+
+	if err := impersonation.End(ctx, impID, c.RealIP()); err != nil {
+		c.Logger().Errorf("failed to end impersonation %d: %v", impID, err)
+	}
+
+	realID, _ := sess.Values[SessionImpersonatorID].(string)
+	sess.Values["user_id"] = realID
+	delete(sess.Values, SessionImpersonationID)
+	delete(sess.Values, SessionImpersonatorID)
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return nil, "", err
+	}
+
+	return nil, realID, nil
+}
+
+// Impersonation returns the active impersonation session, or nil.
+func Impersonation(c echo.Context) *models.ImpersonationSession {
+	if t := Tenant(c); t != nil {
+		return t.Impersonation
+	}
+	return nil
+}
+
+// BlockWhileImpersonating rejects sensitive actions, such as password and MFA
+// changes, while a super admin is acting as another user.
+func BlockWhileImpersonating() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if Impersonation(c) != nil {
+				return echo.NewHTTPError(http.StatusForbidden, "Not allowed while impersonating a user")
+			}
+			return next(c)
+		}
+	}
+}
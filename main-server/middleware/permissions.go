@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"net/http"
+
+	"main-server/models"
+
+	"github.com/labstack/echo/v4"
+)
+
+// RequireCapability rejects requests from users who do not hold capability.
+func RequireCapability(capability models.Capability) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			user := CurrentUser(c)
+			if user == nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Not signed in")
+			}
+			if !user.Can(capability) {
+				return echo.NewHTTPError(http.StatusForbidden, "Missing permission: "+string(capability))
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"database/sql"
+
+	"main-server/database"
+	"main-server/models"
+	"main-server/services"
+	"main-server/tenant"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// LoadTenant builds the tenant.Context for signed-in requests: the user,
+// their company, workspace, features and effective capabilities, and the
+// request ID. It is stored on the request's context.Context, and a database
+// connection carrying the tenant's row-level security settings is reserved
+// for the request; requests that stream files give it back while they do,
+// see database.WithoutTenant and database.ReleaseTenant. During an
+// impersonation the user is the impersonated one and the super admin behind
+// it is recorded on the context.
+//
+// Requests without a valid session pass through with no tenant.
+func LoadTenant(db *sql.DB, users *services.CompanyUserService, perms *services.PermissionService, entitlements *services.EntitlementService, impersonation *services.ImpersonationService) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			sess, err := session.Get("session", c)
+			if err != nil {
+				return next(c)
+			}
+
+			userID, ok := sess.Values["user_id"].(string)
+			if !ok || userID == "" {
+				return next(c)
+			}
+
+			ctx := c.Request().Context()
+			imp, userID, err := resolveImpersonation(c, sess, users, impersonation, userID)
+			if err != nil {
+				return err
+			}
+
+			user, err := users.GetUser(ctx, userID)
+			if err != nil {
+				return next(c)
+			}
+			if err := perms.Load(ctx, user); err != nil {
+				return err
+			}
+
+			t := &tenant.Context{
+				User:          user,
+				Impersonation: imp,
+				CompanyID:     user.CompanyID,
+				WorkspaceID:   user.WorkspaceID,
+				Permissions:   user.Permissions,
+				RequestID:     c.Response().Header().Get(echo.HeaderXRequestID),
+				IPAddress:     c.RealIP(),
+				UserAgent:     c.Request().UserAgent(),
+			}
+			if user.CompanyID != "" {
+				company, _, err := users.GetCompany(ctx, user.CompanyID)
+				if err != nil {
+					return err
+				}
+				t.Company = company
+
+				t.Entitlements, err = entitlements.Resolve(ctx, user.CompanyID)
+				if err != nil {
+					return err
+				}
+			}
+
+			ctx, release, err := database.BindTenant(tenant.WithContext(ctx, t), db, t)
+			if err != nil {
+				return err
+			}
+			defer release()
+
+			c.SetRequest(c.Request().WithContext(ctx))
+			return next(c)
+		}
+	}
+}
+
+// Tenant returns the tenant loaded by LoadTenant, or nil.
+func Tenant(c echo.Context) *tenant.Context {
+	return tenant.From(c.Request().Context())
+}
+
+// ReleaseTenant gives the request's tenant-bound database connection back
+// early; see database.ReleaseTenant. The tenant itself stays loaded.
+func ReleaseTenant(c echo.Context) {
+	database.ReleaseTenant(c.Request().Context())
+}
+
+// CurrentUser returns the signed-in user, or nil.
+func CurrentUser(c echo.Context) *models.User {
+	if t := Tenant(c); t != nil {
+		return t.User
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Alert severities, lowest first
+const (
+	AlertSeverityLow      = "low"
+	AlertSeverityMedium   = "medium"
+	AlertSeverityHigh     = "high"
+	AlertSeverityCritical = "critical"
+)
+
+// Alert statuses
+const (
+	AlertStatusOpen         = "open"
+	AlertStatusAcknowledged = "acknowledged"
+)
+
+// Alert is a security alert raised when audit or login events match a rule.
+type Alert struct {
+	ID          int64         `db:"id" json:"id"`
+	Rule        string        `db:"rule" json:"rule"`
+	Severity    string        `db:"severity" json:"severity"`
+	Message     string        `db:"message" json:"message"`
+	GroupKey    string        `db:"group_key" json:"group_key,omitempty"`
+	CompanyID   string        `db:"company_id" json:"company_id,omitempty"`
+	WorkspaceID string        `db:"workspace_id" json:"workspace_id,omitempty"`
+	EventIDs    pq.Int64Array `db:"event_ids" json:"event_ids"`
+	Status      string        `db:"status" json:"status"`
+	CreatedAt   time.Time     `db:"created_at" json:"created_at"`
+
+	AcknowledgedBy *string    `db:"acknowledged_by" json:"acknowledged_by,omitempty"`
+	AcknowledgedAt *time.Time `db:"acknowledged_at" json:"acknowledged_at,omitempty"`
+}
@@ -0,0 +1,183 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Audience file statuses. Files are quarantined until they have been
+// checked, then either ready or rejected. Purged files were emptied from the
+// trash and no longer have any contents.
+const (
+	AudienceFileQuarantined = "quarantined"
+	AudienceFileReady       = "ready"
+	AudienceFileRejected    = "rejected"
+	AudienceFilePurged      = "purged"
+)
+
+// Parse statuses of ready audience files. A file's columns are detected
+// once it is ready; it then waits for a user to confirm which identifier
+// each column holds, and is processed with that mapping. Files that cannot
+// be parsed fail with a reason.
+const (
+	AudienceParseDetecting    = "detecting"
+	AudienceParseNeedsMapping = "needs_mapping"
+	AudienceParseProcessing   = "processing"
+	AudienceParseProcessed    = "processed"
+	AudienceParseFailed       = "failed"
+)
+
+// Identifier types audience file columns can be mapped to.
+const (
+	IdentifierEmail     = "email"
+	IdentifierPhone     = "phone"
+	IdentifierMAID      = "maid"
+	IdentifierFirstName = "first_name"
+	IdentifierLastName  = "last_name"
+	IdentifierZip       = "zip"
+	IdentifierCountry   = "country"
+)
+
+// IdentifierTypes lists the identifier types in the order they are offered.
+var IdentifierTypes = []string{
+	IdentifierEmail, IdentifierPhone, IdentifierMAID,
+	IdentifierFirstName, IdentifierLastName, IdentifierZip, IdentifierCountry,
+}
+
+// AudienceFile is an uploaded audience list. The file itself lives in the
+// configured storage backend under StoragePath, never under its original
+// name; files of a company with the same contents share one stored blob.
+type AudienceFile struct {
+	ID               int        `db:"id" json:"id"`
+	CompanyID        string     `db:"company_id" json:"company_id"`
+	Name             string     `db:"name" json:"name"`
+	OriginalFilename string     `db:"original_filename" json:"original_filename"`
+	StoragePath      string     `db:"storage_path" json:"-"`
+	ContentType      string     `db:"content_type" json:"content_type"`
+	FileSizeBytes    int64      `db:"file_size_bytes" json:"file_size_bytes"`
+	FileHash         string     `db:"file_hash" json:"file_hash"`
+	Status           string     `db:"status" json:"status"`
+	DetectedType     string     `db:"detected_type" json:"detected_type,omitempty"`
+	RejectionReason  string     `db:"rejection_reason" json:"rejection_reason,omitempty"`
+	UploadedBy       string     `db:"uploaded_by" json:"uploaded_by,omitempty"`
+	CreatedAt        time.Time  `db:"created_at" json:"created_at"`
+	ValidatedAt      *time.Time `db:"validated_at" json:"validated_at,omitempty"`
+	ProcessedAt      *time.Time `db:"processed_at" json:"processed_at,omitempty"`
+
+	// Set while the file is in the trash. DeletedBy is empty when the
+	// workspace's retention policy put it there, and PurgeAt is when it will
+	// be deleted for good.
+	DeletedAt *time.Time `db:"deleted_at" json:"deleted_at,omitempty"`
+	DeletedBy string     `db:"deleted_by" json:"deleted_by,omitempty"`
+	PurgeAt   *time.Time `db:"-" json:"purge_at,omitempty"`
+	PurgedAt  *time.Time `db:"purged_at" json:"purged_at,omitempty"`
+
+	// How the file parses and which identifier each column holds. The row
+	// counts are of data rows, without the header; IdentifiedRows have
+	// enough identifiers under the current mapping to be matched.
+	ParseStatus    string          `db:"parse_status" json:"parse_status,omitempty"`
+	ParseError     string          `db:"parse_error" json:"parse_error,omitempty"`
+	Schema         *AudienceSchema `db:"detected_schema" json:"schema,omitempty"`
+	Mapping        ColumnMapping   `db:"column_mapping" json:"column_mapping,omitempty"`
+	RowCount       *int            `db:"row_count" json:"row_count,omitempty"`
+	IdentifiedRows *int            `db:"identified_rows" json:"identified_rows,omitempty"`
+
+	// The company's first upload of the same contents, if this is not it
+	DuplicateOf *AudienceFileRef `db:"-" json:"duplicate_of,omitempty"`
+}
+
+// AudienceFileRef identifies another audience file.
+type AudienceFileRef struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DownloadLink is a signed, expiring link to download one audience file,
+// valid only for the user it was made for, acting as the file's company.
+type DownloadLink struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// StorageUsage is how much a company stores in audience files, against its
+// plan's quota. Files with the same contents are counted once, and files in
+// the trash count until they are purged.
+type StorageUsage struct {
+	UsedBytes    int64 `json:"used_bytes"`
+	QuotaBytes   int64 `json:"quota_bytes,omitempty"` // 0 when unlimited
+	Files        int   `json:"files"`
+	TrashedFiles int   `json:"trashed_files"`
+}
+
+// AudienceFileOutput is an audience file prepared for one ad platform,
+// identified by its slug: its identifiers normalized and hashed the way the
+// platform takes them, one row for each row the platform can match.
+type AudienceFileOutput struct {
+	Platform  string    `db:"platform" json:"platform"`
+	RowCount  int       `db:"row_count" json:"row_count"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// AudienceSchema is how an audience file's rows are laid out, as detected
+// from its contents. Delimiter is one of "," "\t" ";" and "|". Country,
+// an ISO 3166-1 alpha-2 code, is where rows without a country of their own
+// are taken to be, for reading their phone numbers and zips.
+type AudienceSchema struct {
+	Encoding  string           `json:"encoding"`
+	Delimiter string           `json:"delimiter"`
+	HasHeader bool             `json:"has_header"`
+	Country   string           `json:"country,omitempty"`
+	Columns   []AudienceColumn `json:"columns"`
+}
+
+// AudienceColumn is one column of an audience file. Detected is the
+// identifier type its header or values suggest, if any, and DetectedBy
+// which of the two it was: "header" or "values". Filled counts the rows
+// with a value in the column.
+type AudienceColumn struct {
+	Index      int    `json:"index"`
+	Name       string `json:"name"`
+	Detected   string `json:"detected,omitempty"`
+	DetectedBy string `json:"detected_by,omitempty"`
+	Filled     int    `json:"filled"`
+}
+
+func (s AudienceSchema) Value() (driver.Value, error) {
+	return json.Marshal(s)
+}
+
+func (s *AudienceSchema) Scan(value interface{}) error {
+	return scanJSON(value, s)
+}
+
+// ColumnMapping maps identifier types to the index of the column holding
+// them. Columns not in it are ignored.
+type ColumnMapping map[string]int
+
+func (m ColumnMapping) Value() (driver.Value, error) {
+	if m == nil {
+		return nil, nil
+	}
+	return json.Marshal(m)
+}
+
+func (m *ColumnMapping) Scan(value interface{}) error {
+	if value == nil {
+		*m = nil
+		return nil
+	}
+	return scanJSON(value, m)
+}
+
+func scanJSON(value interface{}, dest interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		return json.Unmarshal(v, dest)
+	case string:
+		return json.Unmarshal([]byte(v), dest)
+	}
+	return fmt.Errorf("cannot scan %T as JSON", value)
+}
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// AuditLog is one row of audit_logs. IDs are strings like the rest of the
+// models; empty strings are stored as NULL.
+type AuditLog struct {
+	ID          int64           `db:"id" json:"id"`
+	UserID      string          `db:"user_id" json:"user_id"`
+	Action      string          `db:"action" json:"action"`
+	EntityType  string          `db:"entity_type" json:"entity_type,omitempty"`
+	EntityID    string          `db:"entity_id" json:"entity_id,omitempty"`
+	CompanyID   string          `db:"company_id" json:"company_id,omitempty"`
+	WorkspaceID string          `db:"workspace_id" json:"workspace_id,omitempty"`
+	Changes     json.RawMessage `db:"changes" json:"changes,omitempty"`
+	IPAddress   string          `db:"ip_address" json:"ip_address,omitempty"`
+	UserAgent   string          `db:"user_agent" json:"user_agent,omitempty"`
+	CreatedAt   time.Time       `db:"created_at" json:"created_at"`
+
+	// Set while a super admin is impersonating UserID
+	ImpersonatorID         *string `db:"impersonator_id" json:"impersonator_id,omitempty"`
+	ImpersonationSessionID *int    `db:"impersonation_session_id" json:"impersonation_session_id,omitempty"`
+}
+
+// Authentication events. Sign-in attempts happen before there is a tenant,
+// so they are queued with the request's IP address set directly.
+const (
+	AuditLoginSucceeded = "auth.login_succeeded"
+	AuditLoginFailed    = "auth.login_failed"
+)
+
+// Domain audit actions, named entity.verb.
+const (
+	AuditUserDisabled             = "user.disabled"
+	AuditUserEnabled              = "user.enabled"
+	AuditUserInvited              = "user.invited"
+	AuditUserRoleTemplateAssigned = "user.role_template_assigned"
+	AuditPermissionGranted        = "permission.granted"
+	AuditPermissionRevoked        = "permission.revoked"
+	AuditPermissionReset          = "permission.reset"
+	AuditRoleTemplateCreated      = "role_template.created"
+	AuditRoleTemplateUpdated      = "role_template.updated"
+	AuditRoleTemplateDeleted      = "role_template.deleted"
+	AuditUserImportCommitted      = "user_import.committed"
+	AuditLogExported              = "audit_log.exported"
+	AuditArchiveRestored          = "audit_archive.restored"
+	AuditArchiveReleased          = "audit_archive.released"
+	AuditUsersExported            = "users.exported"
+	AuditAlertAcknowledged        = "security_alert.acknowledged"
+	AuditAudienceFileDownloaded   = "audience_file.downloaded"
+	AuditAudienceFileTrashed      = "audience_file.trashed"
+	AuditAudienceFileRestored     = "audience_file.restored"
+	AuditAudienceFilePurged       = "audience_file.purged"
+	AuditAudienceFileMapped       = "audience_file.mapped"
+)
+
+// AuditChanges is what domain events store in audit_logs.changes: the
+// entity's fields before and after the change, matching NOTES.md's
+// old_values/new_values, and the fields that differ. Secret values are
+// replaced with RedactedValue.
+type AuditChanges struct {
+	OldValues map[string]interface{} `json:"old_values,omitempty"`
+	NewValues map[string]interface{} `json:"new_values,omitempty"`
+	Diff      []FieldChange          `json:"diff,omitempty"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// FieldChange is one field that differs between OldValues and NewValues.
+type FieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+const RedactedValue = "[REDACTED]"
+
+// Audit archive statuses
+const (
+	ArchiveStatusArchiving = "archiving"
+	ArchiveStatusCompleted = "completed"
+	ArchiveStatusFailed    = "failed"
+)
+
+// AuditArchive is a batch of expired audit_logs rows moved to storage by the
+// retention job.
+type AuditArchive struct {
+	ID          int            `db:"id" json:"id"`
+	WorkspaceID string         `db:"workspace_id" json:"workspace_id"`
+	Status      string         `db:"status" json:"status"`
+	StorageKey  string         `db:"storage_key" json:"storage_key"`
+	Cutoff      time.Time      `db:"cutoff" json:"cutoff"`
+	RowCount    int            `db:"row_count" json:"row_count"`
+	OldestAt    *time.Time     `db:"oldest_at" json:"oldest_at,omitempty"`
+	NewestAt    *time.Time     `db:"newest_at" json:"newest_at,omitempty"`
+	SizeBytes   int64          `db:"size_bytes" json:"size_bytes"`
+	SHA256      string         `db:"sha256" json:"sha256,omitempty"`
+	Chains      []ArchiveChain `db:"chains" json:"chains"`
+	Error       string         `db:"error" json:"error,omitempty"`
+	CreatedAt   time.Time      `db:"created_at" json:"created_at"`
+	CompletedAt *time.Time     `db:"completed_at" json:"completed_at,omitempty"`
+
+	RestoredBy       *string    `db:"restored_by" json:"restored_by,omitempty"`
+	RestoredAt       *time.Time `db:"restored_at" json:"restored_at,omitempty"`
+	RestoreExpiresAt *time.Time `db:"restore_expires_at" json:"restore_expires_at,omitempty"`
+}
+
+// ArchiveChain is the part of one audit hash chain an archive holds.
+type ArchiveChain struct {
+	ChainID  int    `json:"chain_id"`
+	FirstSeq int64  `json:"first_seq"`
+	LastSeq  int64  `json:"last_seq"`
+	LastHash string `json:"last_hash"` // hex
+}
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// Direct upload statuses
+const (
+	DirectUploadPending   = "pending"
+	DirectUploadCompleted = "completed"
+	DirectUploadFailed    = "failed"
+	DirectUploadExpired   = "expired"
+)
+
+// DirectUpload is an audience file the browser uploads straight to storage
+// with a presigned request, before it is registered in audience_files.
+type DirectUpload struct {
+	ID             string     `db:"id" json:"id"`
+	CompanyID      string     `db:"company_id" json:"company_id"`
+	WorkspaceID    string     `db:"workspace_id" json:"-"`
+	CreatedBy      string     `db:"created_by" json:"created_by"`
+	Filename       string     `db:"filename" json:"filename"`
+	ContentType    string     `db:"content_type" json:"content_type"`
+	Size           int64      `db:"size" json:"size"`
+	StorageKey     string     `db:"storage_key" json:"-"`
+	Status         string     `db:"status" json:"status"`
+	AudienceFileID *int       `db:"audience_file_id" json:"audience_file_id,omitempty"`
+	ExpiresAt      time.Time  `db:"expires_at" json:"expires_at"`
+	CreatedAt      time.Time  `db:"created_at" json:"created_at"`
+	CompletedAt    *time.Time `db:"completed_at" json:"completed_at,omitempty"`
+}
@@ -0,0 +1,94 @@
+package models
+
+// Feature names a gated capability of a workspace plan. The names match the
+// JSON keys of WorkspaceFeatures.
+type Feature string
+
+const (
+	FeatureAdvancedReports Feature = "advanced_reports"
+	FeatureBulkExport      Feature = "bulk_export"
+	FeatureAPIAccess       Feature = "api_access"
+	FeatureSSO             Feature = "sso_enabled"
+)
+
+// Plans in ascending order. These are the same tiers RequireUserTier knows.
+const (
+	PlanBasic      = "basic"
+	PlanPremium    = "premium"
+	PlanBusiness   = "business"
+	PlanEnterprise = "enterprise"
+)
+
+var PlanOrder = []string{PlanBasic, PlanPremium, PlanBusiness, PlanEnterprise}
+
+// PlanPresets are the features each plan includes before workspace defaults
+// and company overrides are applied.
+var PlanPresets = map[string]WorkspaceFeatures{
+	PlanBasic: {
+		MaxUsersPerCompany: 5,
+		AuditRetentionDays: 30,
+		MaxUploadSizeMB:    100,
+		StorageQuotaMB:     1024,
+	},
+	PlanPremium: {
+		AdvancedReports:    true,
+		MaxUsersPerCompany: 25,
+		AuditRetentionDays: 90,
+		MaxUploadSizeMB:    500,
+		StorageQuotaMB:     10240,
+	},
+	PlanBusiness: {
+		AdvancedReports:    true,
+		BulkExport:         true,
+		APIAccess:          true,
+		MaxUsersPerCompany: 100,
+		AuditRetentionDays: 365,
+		MaxUploadSizeMB:    2048,
+		StorageQuotaMB:     102400,
+	},
+	PlanEnterprise: {
+		AdvancedReports:    true,
+		BulkExport:         true,
+		APIAccess:          true,
+		SSOEnabled:         true,
+		MaxUsersPerCompany: 0, // unlimited
+		AuditRetentionDays: 2555,
+	},
+}
+
+// Enabled reports whether a boolean feature is switched on.
+func (f WorkspaceFeatures) Enabled(feature Feature) bool {
+	switch feature {
+	case FeatureAdvancedReports:
+		return f.AdvancedReports
+	case FeatureBulkExport:
+		return f.BulkExport
+	case FeatureAPIAccess:
+		return f.APIAccess
+	case FeatureSSO:
+		return f.SSOEnabled
+	}
+	return false
+}
+
+// LowestPlanWith returns the cheapest plan that includes feature, or "" when
+// no plan does.
+func LowestPlanWith(feature Feature) string {
+	for _, plan := range PlanOrder {
+		if PlanPresets[plan].Enabled(feature) {
+			return plan
+		}
+	}
+	return ""
+}
+
+// Entitlements are a company's resolved plan and features: the plan preset,
+// then the workspace defaults, then the company overrides.
+type Entitlements struct {
+	Plan     string            `json:"plan"`
+	Features WorkspaceFeatures `json:"features"`
+
+	// Features explicitly switched off by a workspace default or company
+	// override, as opposed to simply not included in the plan.
+	Disabled map[Feature]bool `json:"disabled,omitempty"`
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// ImpersonationSession records a super admin acting as another user.
+type ImpersonationSession struct {
+	ID             int        `db:"id" json:"id"`
+	ImpersonatorID string     `db:"impersonator_id" json:"impersonator_id"`
+	UserID         string     `db:"user_id" json:"user_id"`
+	Reason         string     `db:"reason" json:"reason"`
+	IPAddress      string     `db:"ip_address" json:"ip_address"`
+	StartedAt      time.Time  `db:"started_at" json:"started_at"`
+	ExpiresAt      time.Time  `db:"expires_at" json:"expires_at"`
+	EndedAt        *time.Time `db:"ended_at" json:"ended_at,omitempty"`
+
+	// Loaded for display
+	Impersonator *User `db:"-" json:"-"`
+}
+
+func (s *ImpersonationSession) Active(now time.Time) bool {
+	return s.EndedAt == nil && now.Before(s.ExpiresAt)
+}
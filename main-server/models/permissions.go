@@ -0,0 +1,107 @@
+package models
+
+import (
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Capability names a piece of functionality that can be granted to or
+// withheld from an individual user within their company.
+type Capability string
+
+const (
+	CapUploadAudiences    Capability = "audiences.upload"
+	CapManageDestinations Capability = "destinations.manage"
+	CapLaunchCampaigns    Capability = "campaigns.launch"
+	CapViewAuditLog       Capability = "audit.view"
+	CapExportData         Capability = "data.export"
+)
+
+// AllCapabilities lists every capability in display order.
+var AllCapabilities = []Capability{
+	CapUploadAudiences,
+	CapManageDestinations,
+	CapLaunchCampaigns,
+	CapViewAuditLog,
+	CapExportData,
+}
+
+func ValidCapability(c Capability) bool {
+	for _, known := range AllCapabilities {
+		if c == known {
+			return true
+		}
+	}
+	return false
+}
+
+// PermissionSet is the set of capabilities a user holds.
+type PermissionSet map[Capability]bool
+
+func NewPermissionSet(caps ...Capability) PermissionSet {
+	set := make(PermissionSet, len(caps))
+	for _, c := range caps {
+		set[c] = true
+	}
+	return set
+}
+
+func (p PermissionSet) Has(c Capability) bool {
+	return p[c]
+}
+
+// List returns the held capabilities sorted by name.
+func (p PermissionSet) List() []Capability {
+	caps := make([]Capability, 0, len(p))
+	for c, ok := range p {
+		if ok {
+			caps = append(caps, c)
+		}
+	}
+	sort.Slice(caps, func(i, j int) bool { return caps[i] < caps[j] })
+	return caps
+}
+
+// DefaultCapabilities returns what a role gets when no role template or
+// per-user override applies. Plain users can work with audiences and
+// campaigns; admins get everything.
+func DefaultCapabilities(role string) PermissionSet {
+	switch role {
+	case RoleSuperAdmin, RoleWorkspaceAdmin, RoleCompanyAdmin:
+		return NewPermissionSet(AllCapabilities...)
+	case RoleUser:
+		return NewPermissionSet(CapUploadAudiences, CapLaunchCampaigns)
+	}
+	return PermissionSet{}
+}
+
+// RoleTemplate is a company-defined bundle of capabilities that can be
+// assigned to users instead of their role's defaults.
+type RoleTemplate struct {
+	ID           int            `db:"id" json:"id"`
+	CompanyID    string         `db:"company_id" json:"company_id"`
+	Name         string         `db:"name" json:"name"`
+	Capabilities pq.StringArray `db:"capabilities" json:"capabilities"`
+	CreatedAt    time.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt    time.Time      `db:"updated_at" json:"updated_at"`
+}
+
+func (t *RoleTemplate) PermissionSet() PermissionSet {
+	set := make(PermissionSet, len(t.Capabilities))
+	for _, c := range t.Capabilities {
+		set[Capability(c)] = true
+	}
+	return set
+}
+
+// PermissionOverride grants or revokes a single capability for one user on
+// top of their role or template.
+type PermissionOverride struct {
+	UserID     string     `db:"user_id" json:"user_id"`
+	Capability Capability `db:"capability" json:"capability"`
+	Granted    bool       `db:"granted" json:"granted"`
+	GrantedBy  string     `db:"granted_by" json:"granted_by"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+}
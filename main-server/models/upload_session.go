@@ -0,0 +1,53 @@
+package models
+
+import "time"
+
+// Upload session statuses
+const (
+	UploadSessionActive    = "active"
+	UploadSessionCompleted = "completed"
+	UploadSessionAborted   = "aborted"
+	UploadSessionExpired   = "expired"
+)
+
+// UploadSession is a resumable upload of one audience file, sent as
+// PartCount parts of PartSize bytes (the last may be shorter).
+type UploadSession struct {
+	ID              string     `db:"id" json:"id"`
+	CompanyID       string     `db:"company_id" json:"company_id"`
+	WorkspaceID     string     `db:"workspace_id" json:"-"`
+	CreatedBy       string     `db:"created_by" json:"created_by"`
+	Filename        string     `db:"filename" json:"filename"`
+	ContentType     string     `db:"content_type" json:"content_type"`
+	TotalSize       int64      `db:"total_size" json:"total_size"`
+	PartSize        int64      `db:"part_size" json:"part_size"`
+	PartCount       int        `db:"part_count" json:"part_count"`
+	StorageKey      string     `db:"storage_key" json:"-"`
+	StorageUploadID string     `db:"storage_upload_id" json:"-"`
+	Status          string     `db:"status" json:"status"`
+	AudienceFileID  *int       `db:"audience_file_id" json:"audience_file_id,omitempty"`
+	ExpiresAt       time.Time  `db:"expires_at" json:"expires_at"`
+	CreatedAt       time.Time  `db:"created_at" json:"created_at"`
+	CompletedAt     *time.Time `db:"completed_at" json:"completed_at,omitempty"`
+
+	// Parts received so far, for resuming and progress
+	Parts         []UploadPart `json:"parts"`
+	ReceivedBytes int64        `json:"received_bytes"`
+}
+
+// UploadPart is a received part of an upload session.
+type UploadPart struct {
+	Number     int       `db:"part_number" json:"number"`
+	Size       int64     `db:"size" json:"size"`
+	SHA256     string    `db:"sha256" json:"sha256"`
+	ETag       string    `db:"etag" json:"-"`
+	UploadedAt time.Time `db:"uploaded_at" json:"uploaded_at"`
+}
+
+// PartLength returns the size part n must have.
+func (s *UploadSession) PartLength(n int) int64 {
+	if n == s.PartCount {
+		return s.TotalSize - int64(n-1)*s.PartSize
+	}
+	return s.PartSize
+}
@@ -6,17 +6,44 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	RoleSuperAdmin     = "super_admin"
+	RoleWorkspaceAdmin = "workspace_admin"
+	RoleCompanyAdmin   = "company_admin"
+	RoleUser           = "user"
+)
+
+// roleLevels orders the roles so that a higher level can manage any lower one.
+var roleLevels = map[string]int{
+	RoleUser:           1,
+	RoleCompanyAdmin:   2,
+	RoleWorkspaceAdmin: 3,
+	RoleSuperAdmin:     4,
+}
+
+// ValidRole reports whether role is one of the four known user roles.
+func ValidRole(role string) bool {
+	_, ok := roleLevels[role]
+	return ok
+}
+
 type User struct {
 	ID                string     `db:"string"`
 	Email             string     `db:"email"`
 	Name              string     `db:"name"`
 	PasswordHash      string     `db:"password_hash"`
 	CompanyID         string     `db:"company_id"`
+	WorkspaceID       string     `db:"workspace_id"`
 	Role              string     `db:"role"`
 	IsActive          bool       `db:"is_active"`
 	PasswordChangedAt time.Time  `db:"password_changed_at"`
 	CreatedAt         time.Time  `db:"created_at"`
 	LastLogin         *time.Time `db:"last_login"`
+	RoleTemplateID    *int       `db:"role_template_id"`
+
+	// Effective capabilities, filled in by the permission service. Nil means
+	// they have not been loaded and the role defaults apply.
+	Permissions PermissionSet `db:"-"`
 
 	// Joined fields
 	Company   *Company   `db:"-"`
@@ -56,5 +83,27 @@ func (u *User) CanManageUsers() bool {
 }
 
 func (u *User) CanManageDestinations() bool {
-	return u.Role != "user"
+	return u.Can(CapManageDestinations)
+}
+
+// Can reports whether the user holds a capability. Workspace and super admins
+// always do; everyone else is checked against their loaded permissions.
+func (u *User) Can(c Capability) bool {
+	if u.Role == RoleSuperAdmin || u.Role == RoleWorkspaceAdmin {
+		return true
+	}
+	if u.Permissions == nil {
+		return DefaultCapabilities(u.Role).Has(c)
+	}
+	return u.Permissions.Has(c)
+}
+
+// CanAssignRole reports whether the user may create or invite someone with
+// the given role. Admins can manage their own level or lower; plain users
+// cannot manage anyone.
+func (u *User) CanAssignRole(role string) bool {
+	if !u.CanManageUsers() || !ValidRole(role) {
+		return false
+	}
+	return roleLevels[role] <= roleLevels[u.Role]
 }
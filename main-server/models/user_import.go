@@ -0,0 +1,82 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"time"
+)
+
+const (
+	ImportStatusPending    = "pending"
+	ImportStatusQueued     = "queued"
+	ImportStatusProcessing = "processing"
+	ImportStatusCompleted  = "completed"
+	ImportStatusFailed     = "failed"
+)
+
+type UserImport struct {
+	ID               int              `db:"id" json:"id"`
+	CompanyID        string           `db:"company_id" json:"company_id"`
+	CreatedBy        string           `db:"created_by" json:"created_by"`
+	OriginalFilename string           `db:"original_filename" json:"original_filename"`
+	Status           string           `db:"status" json:"status"`
+	TotalRows        int              `db:"total_rows" json:"total_rows"`
+	AcceptedRows     int              `db:"accepted_rows" json:"accepted_rows"`
+	RejectedRows     int              `db:"rejected_rows" json:"rejected_rows"`
+	InvitedRows      int              `db:"invited_rows" json:"invited_rows"`
+	Report           UserImportReport `db:"report" json:"rows"`
+	ErrorMessage     *string          `db:"error_message" json:"error_message,omitempty"`
+	CreatedAt        time.Time        `db:"created_at" json:"created_at"`
+	CommittedAt      *time.Time       `db:"committed_at" json:"committed_at,omitempty"`
+	CompletedAt      *time.Time       `db:"completed_at" json:"completed_at,omitempty"`
+}
+
+// UserImportRow is one line of an uploaded user CSV together with the
+// validation errors found for it during the dry run.
+type UserImportRow struct {
+	Line   int      `json:"line"`
+	Email  string   `json:"email"`
+	Name   string   `json:"name"`
+	Role   string   `json:"role"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+func (r UserImportRow) Accepted() bool {
+	return len(r.Errors) == 0
+}
+
+type UserImportReport []UserImportRow
+
+// AcceptedRows returns the rows that passed validation.
+func (r UserImportReport) AcceptedRows() []UserImportRow {
+	var rows []UserImportRow
+	for _, row := range r {
+		if row.Accepted() {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+func (r UserImportReport) Value() (driver.Value, error) {
+	if r == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(r)
+}
+
+func (r *UserImportReport) Scan(value interface{}) error {
+	if value == nil {
+		*r = nil
+		return nil
+	}
+
+	switch v := value.(type) {
+	case []byte:
+		return json.Unmarshal(v, r)
+	case string:
+		return json.Unmarshal([]byte(v), r)
+	default:
+		return nil
+	}
+}
@@ -31,6 +31,18 @@ type WorkspaceFeatures struct {
 	SSOEnabled         bool `json:"sso_enabled"`
 	MaxUsersPerCompany int  `json:"max_users_per_company"`
 	AuditRetentionDays int  `json:"audit_retention_days"`
+
+	// Audience uploads: the largest file accepted, where 0 leaves the
+	// server-wide UPLOAD_MAX_SIZE_MB, and the file types accepted, where
+	// empty accepts csv, tsv, gzip and zip
+	MaxUploadSizeMB    int      `json:"max_upload_size_mb"`
+	AllowedUploadTypes []string `json:"allowed_upload_types"`
+
+	// Audience storage: files not used by a campaign for
+	// AudienceRetentionDays are moved to the trash, where 0 keeps them, and
+	// each company may store StorageQuotaMB of them, where 0 is unlimited
+	AudienceRetentionDays int `json:"audience_retention_days"`
+	StorageQuotaMB        int `json:"storage_quota_mb"`
 }
 
 func (f WorkspaceFeatures) Value() (driver.Value, error) {
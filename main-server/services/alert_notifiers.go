@@ -0,0 +1,137 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"main-server/models"
+)
+
+// AlertNotifier delivers raised alerts somewhere people will see them.
+type AlertNotifier interface {
+	Name() string
+	Notify(ctx context.Context, alert *models.Alert) error
+}
+
+// AlertNotifierConfig is one entry under notifiers in the rules file. Type
+// is email (To) or webhook (URL, optionally signed with the secret in the
+// SecretEnv environment variable).
+type AlertNotifierConfig struct {
+	Name      string   `yaml:"name"`
+	Type      string   `yaml:"type"`
+	To        []string `yaml:"to"`
+	URL       string   `yaml:"url"`
+	SecretEnv string   `yaml:"secret_env"`
+}
+
+// BuildAlertNotifiers creates the notifiers in cfg. Email goes through
+// mailer.
+func BuildAlertNotifiers(cfg []AlertNotifierConfig, mailer Mailer, baseURL string) ([]AlertNotifier, error) {
+	var notifiers []AlertNotifier
+	for _, n := range cfg {
+		if n.Name == "" {
+			return nil, fmt.Errorf("alert notifiers need a name")
+		}
+
+		switch n.Type {
+		case "email":
+			if len(n.To) == 0 {
+				return nil, fmt.Errorf("email notifier %q has no recipients", n.Name)
+			}
+			notifiers = append(notifiers, &EmailAlertNotifier{name: n.Name, mailer: mailer, to: n.To, baseURL: baseURL})
+		case "webhook":
+			if n.URL == "" {
+				return nil, fmt.Errorf("webhook notifier %q has no url", n.Name)
+			}
+			var secret string
+			if n.SecretEnv != "" {
+				secret = os.Getenv(n.SecretEnv)
+			}
+			notifiers = append(notifiers, NewWebhookAlertNotifier(n.Name, n.URL, secret))
+		default:
+			return nil, fmt.Errorf("notifier %q has unknown type %q", n.Name, n.Type)
+		}
+	}
+	return notifiers, nil
+}
+
+// EmailAlertNotifier mails each alert to a fixed list of addresses.
+type EmailAlertNotifier struct {
+	name    string
+	mailer  Mailer
+	to      []string
+	baseURL string
+}
+
+func (n *EmailAlertNotifier) Name() string { return n.name }
+
+func (n *EmailAlertNotifier) Notify(ctx context.Context, alert *models.Alert) error {
+	subject := fmt.Sprintf("[%s] Security alert: %s", strings.ToUpper(alert.Severity), alert.Rule)
+	body := fmt.Sprintf("%s\n\nRaised at %s.\nReview it at %s/app/alerts\n",
+		alert.Message, alert.CreatedAt.UTC().Format(time.RFC1123), n.baseURL)
+
+	for _, to := range n.to {
+		if err := n.mailer.Send(ctx, to, subject, body); err != nil {
+			return fmt.Errorf("failed to mail %s: %w", to, err)
+		}
+	}
+	return nil
+}
+
+// WebhookAlertNotifier POSTs each alert as JSON. With a secret, the body's
+// HMAC-SHA256 is sent in X-Alert-Signature as "sha256=<hex>".
+type WebhookAlertNotifier struct {
+	name   string
+	url    string
+	secret string
+	client *http.Client
+}
+
+func NewWebhookAlertNotifier(name, url, secret string) *WebhookAlertNotifier {
+	return &WebhookAlertNotifier{
+		name:   name,
+		url:    url,
+		secret: secret,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (n *WebhookAlertNotifier) Name() string { return n.name }
+
+func (n *WebhookAlertNotifier) Notify(ctx context.Context, alert *models.Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.secret))
+		mac.Write(body)
+		req.Header.Set("X-Alert-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"main-server/models"
+)
+
+// Rule kinds
+const (
+	// Every matching event raises an alert
+	AlertRuleMatch = "match"
+	// Threshold matching events with the same group_by value within window
+	AlertRuleThreshold = "threshold"
+	// A matching event from a network its group_by value has not used before
+	AlertRuleNewNetwork = "new_network"
+)
+
+// AlertConfig is the YAML file named by ALERT_RULES_FILE.
+type AlertConfig struct {
+	Notifiers []AlertNotifierConfig `yaml:"notifiers"`
+	Rules     []AlertRule           `yaml:"rules"`
+}
+
+// AlertRule describes which events raise an alert. Fields are audit_logs
+// columns (action, user_id, company_id, workspace_id, entity_type,
+// entity_id, ip_address, user_agent) or a path into changes such as
+// changes.metadata.rows.
+type AlertRule struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	Severity    string `yaml:"severity"`
+	Kind        string `yaml:"kind"`
+
+	// Action pattern in path.Match syntax, e.g. "auth.login_failed" or
+	// "*.exported"
+	Action string           `yaml:"action"`
+	Where  []AlertCondition `yaml:"where"`
+
+	GroupBy   string        `yaml:"group_by"`
+	Threshold int           `yaml:"threshold"`
+	Window    time.Duration `yaml:"window"`
+
+	// Alerts for the same rule and group_by value are suppressed for this
+	// long after one is raised.
+	Cooldown time.Duration `yaml:"cooldown"`
+
+	// Names of the notifiers to deliver to; all of them when empty.
+	Notify []string `yaml:"notify"`
+}
+
+// AlertCondition compares one field of an event with Value. Op is one of eq
+// (the default), ne, gt, gte, lt, lte, in or prefix.
+type AlertCondition struct {
+	Field string      `yaml:"field"`
+	Op    string      `yaml:"op"`
+	Value interface{} `yaml:"value"`
+}
+
+// LoadAlertConfig reads and validates an alert rules file.
+func LoadAlertConfig(filename string) (*AlertConfig, error) {
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg AlertConfig
+	if err := yaml.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid alert rules in %s: %w", filename, err)
+	}
+
+	names := make(map[string]bool)
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("alert rule %d (%s): %w", i+1, r.Name, err)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("alert rule %q is defined twice", r.Name)
+		}
+		names[r.Name] = true
+	}
+
+	return &cfg, nil
+}
+
+func (r *AlertRule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if r.Action == "" {
+		return fmt.Errorf("action is required")
+	}
+	if _, err := path.Match(r.Action, ""); err != nil {
+		return fmt.Errorf("invalid action pattern %q", r.Action)
+	}
+
+	switch r.Severity {
+	case models.AlertSeverityLow, models.AlertSeverityMedium, models.AlertSeverityHigh, models.AlertSeverityCritical:
+	case "":
+		r.Severity = models.AlertSeverityMedium
+	default:
+		return fmt.Errorf("unknown severity %q", r.Severity)
+	}
+
+	switch r.Kind {
+	case "", AlertRuleMatch:
+		r.Kind = AlertRuleMatch
+	case AlertRuleThreshold:
+		if r.Threshold < 1 || r.Window <= 0 {
+			return fmt.Errorf("threshold rules need a threshold and a window")
+		}
+	case AlertRuleNewNetwork:
+		if r.GroupBy == "" {
+			r.GroupBy = "user_id"
+		}
+	default:
+		return fmt.Errorf("unknown kind %q", r.Kind)
+	}
+
+	for _, c := range r.Where {
+		switch c.Op {
+		case "", "eq", "ne", "gt", "gte", "lt", "lte", "in", "prefix":
+		default:
+			return fmt.Errorf("unknown operator %q", c.Op)
+		}
+		if c.Field == "" {
+			return fmt.Errorf("conditions need a field")
+		}
+	}
+
+	return nil
+}
+
+// alertEvent is an audit log entry with its changes decoded once for all the
+// rules.
+type alertEvent struct {
+	models.AuditLog
+	changes map[string]interface{}
+}
+
+func newAlertEvent(e models.AuditLog) *alertEvent {
+	ev := &alertEvent{AuditLog: e}
+	if len(e.Changes) > 0 {
+		json.Unmarshal(e.Changes, &ev.changes)
+	}
+	return ev
+}
+
+// field returns an event field as a string, or "" when it is not set.
+func (e *alertEvent) field(name string) string {
+	v, ok := e.value(name)
+	if !ok || v == nil {
+		return ""
+	}
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (e *alertEvent) value(name string) (interface{}, bool) {
+	switch name {
+	case "action":
+		return e.Action, true
+	case "user_id":
+		return e.UserID, true
+	case "company_id":
+		return e.CompanyID, true
+	case "workspace_id":
+		return e.WorkspaceID, true
+	case "entity_type":
+		return e.EntityType, true
+	case "entity_id":
+		return e.EntityID, true
+	case "ip_address":
+		return e.IPAddress, true
+	case "user_agent":
+		return e.UserAgent, true
+	}
+
+	keys, ok := strings.CutPrefix(name, "changes.")
+	if !ok {
+		return nil, false
+	}
+	var cur interface{} = e.changes
+	for _, key := range strings.Split(keys, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// matches reports whether e has the rule's action and meets every condition.
+func (r *AlertRule) matches(e *alertEvent) bool {
+	if ok, _ := path.Match(r.Action, e.Action); !ok {
+		return false
+	}
+
+	for _, c := range r.Where {
+		if !c.holds(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c AlertCondition) holds(e *alertEvent) bool {
+	v, ok := e.value(c.Field)
+	if !ok {
+		return c.Op == "ne"
+	}
+	actual := e.field(c.Field)
+
+	switch c.Op {
+	case "", "eq":
+		return actual == fmt.Sprint(c.Value)
+	case "ne":
+		return actual != fmt.Sprint(c.Value)
+	case "prefix":
+		return strings.HasPrefix(actual, fmt.Sprint(c.Value))
+	case "in":
+		values, ok := c.Value.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, want := range values {
+			if actual == fmt.Sprint(want) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Numeric comparisons
+	got, ok := toFloat(v)
+	if !ok {
+		return false
+	}
+	want, ok := toFloat(c.Value)
+	if !ok {
+		return false
+	}
+	switch c.Op {
+	case "gt":
+		return got > want
+	case "gte":
+		return got >= want
+	case "lt":
+		return got < want
+	case "lte":
+		return got <= want
+	}
+	return false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// message describes an alert for the admin page and notifications.
+func (r *AlertRule) message(e *alertEvent, key string, count int) string {
+	msg := r.Description
+	if msg == "" {
+		msg = r.Name
+	}
+	if r.GroupBy != "" && key != "" {
+		msg += fmt.Sprintf(" (%s %s)", r.GroupBy, key)
+	}
+	if count > 1 {
+		msg += fmt.Sprintf(": %d events", count)
+	}
+	if e.IPAddress != "" && r.GroupBy != "ip_address" {
+		msg += fmt.Sprintf(" from %s", e.IPAddress)
+	}
+	return msg
+}
+
+// ipNetwork returns the /24 (IPv4) or /48 (IPv6) network containing ip, the
+// unit new_network rules compare.
+func ipNetwork(ip string) (string, bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", false
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String(), true
+	}
+	return (&net.IPNet{IP: parsed.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String(), true
+}
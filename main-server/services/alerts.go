@@ -0,0 +1,365 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"main-server/database"
+	"main-server/models"
+)
+
+// How long notifiers get to deliver one alert
+const alertNotifyTimeout = 30 * time.Second
+
+var (
+	alertsRaised = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "security_alerts_raised_total",
+		Help: "Security alerts raised, by rule.",
+	}, []string{"rule"})
+	alertNotifyFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "security_alert_notify_failures_total",
+		Help: "Alert deliveries that failed, by notifier.",
+	}, []string{"notifier"})
+)
+
+// AlertService evaluates the alert rules against every new audit log entry,
+// including sign-in attempts, stores the alerts they raise in
+// security_alerts and hands them to the notifiers.
+type AlertService struct {
+	db        *sql.DB
+	rules     []AlertRule
+	notifiers []AlertNotifier
+	audit     *AuditService
+
+	// Recent matching events per threshold rule and group_by value
+	mu      sync.Mutex
+	windows map[string][]windowEvent
+}
+
+type windowEvent struct {
+	id int64
+	at time.Time
+}
+
+func NewAlertService(db *sql.DB, rules []AlertRule, notifiers []AlertNotifier, audit *AuditService) *AlertService {
+	return &AlertService{
+		db:        db,
+		rules:     rules,
+		notifiers: notifiers,
+		audit:     audit,
+		windows:   make(map[string][]windowEvent),
+	}
+}
+
+// Run evaluates every event of stream, as one of its consumers so none are
+// dropped, until ctx is cancelled.
+func (s *AlertService) Run(ctx context.Context, stream *AuditStream) error {
+	stream.Consume(func(streamCtx context.Context, e models.AuditLog) {
+		if ctx.Err() == nil {
+			s.Evaluate(streamCtx, e)
+		}
+	})
+
+	sweep := time.NewTicker(time.Minute)
+	defer sweep.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-sweep.C:
+			s.sweep(now)
+		}
+	}
+}
+
+// Evaluate runs every rule against e.
+func (s *AlertService) Evaluate(ctx context.Context, e models.AuditLog) {
+	ev := newAlertEvent(e)
+	for i := range s.rules {
+		rule := &s.rules[i]
+		if !rule.matches(ev) {
+			continue
+		}
+
+		var err error
+		switch rule.Kind {
+		case AlertRuleMatch:
+			err = s.raise(ctx, rule, ev, ev.field(rule.GroupBy), []int64{ev.ID})
+		case AlertRuleThreshold:
+			key := ev.field(rule.GroupBy)
+			if ids := s.count(rule, key, ev); ids != nil {
+				err = s.raise(ctx, rule, ev, key, ids)
+			}
+		case AlertRuleNewNetwork:
+			err = s.checkNetwork(ctx, rule, ev)
+		}
+		if err != nil {
+			log.Printf("alert rule %s: %v", rule.Name, err)
+		}
+	}
+}
+
+// count adds ev to its window and returns the window's event IDs once it
+// reaches the threshold, starting a new window.
+func (s *AlertService) count(rule *AlertRule, key string, ev *alertEvent) []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	windowKey := rule.Name + "\x00" + key
+	since := ev.CreatedAt.Add(-rule.Window)
+	events := s.windows[windowKey][:0:0]
+	for _, we := range s.windows[windowKey] {
+		if we.at.After(since) {
+			events = append(events, we)
+		}
+	}
+	events = append(events, windowEvent{id: ev.ID, at: ev.CreatedAt})
+
+	if len(events) < rule.Threshold {
+		s.windows[windowKey] = events
+		return nil
+	}
+
+	delete(s.windows, windowKey)
+	ids := make([]int64, len(events))
+	for i, we := range events {
+		ids[i] = we.id
+	}
+	return ids
+}
+
+// sweep forgets windows with no recent events.
+func (s *AlertService) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var longest time.Duration
+	for _, r := range s.rules {
+		if r.Window > longest {
+			longest = r.Window
+		}
+	}
+	for key, events := range s.windows {
+		if len(events) == 0 || now.Sub(events[len(events)-1].at) > longest {
+			delete(s.windows, key)
+		}
+	}
+}
+
+// checkNetwork raises an alert the first time the rule's subject is seen on
+// a network, unless it is the first network seen for them at all.
+func (s *AlertService) checkNetwork(ctx context.Context, rule *AlertRule, ev *alertEvent) error {
+	subject := ev.field(rule.GroupBy)
+	network, ok := ipNetwork(ev.IPAddress)
+	if subject == "" || !ok {
+		return nil
+	}
+
+	var isNew, knownBefore bool
+	err := database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+		if err := tx.QueryRowContext(ctx, `
+			SELECT EXISTS (SELECT 1 FROM alert_known_networks WHERE rule = $1 AND subject = $2)
+		`, rule.Name, subject).Scan(&knownBefore); err != nil {
+			return err
+		}
+		return tx.QueryRowContext(ctx, `
+			INSERT INTO alert_known_networks (rule, subject, network)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (rule, subject, network) DO UPDATE SET last_seen = NOW()
+			RETURNING xmax = 0
+		`, rule.Name, subject, network).Scan(&isNew)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record network: %w", err)
+	}
+
+	if !isNew || !knownBefore {
+		return nil
+	}
+	return s.raise(ctx, rule, ev, subject, []int64{ev.ID})
+}
+
+// raise stores an alert unless one for the same rule and key was raised
+// within the rule's cooldown, then notifies in the background. The lock
+// keeps servers evaluating the same events from raising it twice.
+func (s *AlertService) raise(ctx context.Context, rule *AlertRule, ev *alertEvent, key string, eventIDs []int64) error {
+	alert := &models.Alert{
+		Rule:        rule.Name,
+		Severity:    rule.Severity,
+		Message:     rule.message(ev, key, len(eventIDs)),
+		GroupKey:    key,
+		CompanyID:   ev.CompanyID,
+		WorkspaceID: ev.WorkspaceID,
+		EventIDs:    eventIDs,
+		Status:      models.AlertStatusOpen,
+	}
+
+	raised := false
+	err := database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1 || '/' || $2))`, rule.Name, key); err != nil {
+			return err
+		}
+
+		// The same events seen again, e.g. by another server, never raise a
+		// second alert.
+		var duplicate bool
+		err := tx.QueryRowContext(ctx, `
+			SELECT EXISTS (
+				SELECT 1 FROM security_alerts
+				WHERE rule = $1 AND group_key = $2
+				  AND (created_at > NOW() - $3 * INTERVAL '1 second' OR event_ids && $4)
+			)
+		`, rule.Name, key, int(rule.Cooldown.Seconds()), pq.Array(eventIDs)).Scan(&duplicate)
+		if err != nil || duplicate {
+			return err
+		}
+
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO security_alerts (rule, severity, message, group_key, company_id, workspace_id, event_ids)
+			VALUES ($1, $2, $3, $4, NULLIF($5, '')::integer, NULLIF($6, '')::integer, $7)
+			RETURNING id, created_at
+		`, alert.Rule, alert.Severity, alert.Message, alert.GroupKey, alert.CompanyID, alert.WorkspaceID,
+			alert.EventIDs).Scan(&alert.ID, &alert.CreatedAt)
+		raised = err == nil
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to raise alert: %w", err)
+	}
+	if !raised {
+		return nil
+	}
+
+	alertsRaised.WithLabelValues(rule.Name).Inc()
+	go s.notify(rule, alert)
+	return nil
+}
+
+func (s *AlertService) notify(rule *AlertRule, alert *models.Alert) {
+	ctx, cancel := context.WithTimeout(context.Background(), alertNotifyTimeout)
+	defer cancel()
+
+	for _, n := range s.notifiers {
+		if !rule.notifies(n.Name()) {
+			continue
+		}
+		if err := n.Notify(ctx, alert); err != nil {
+			alertNotifyFailures.WithLabelValues(n.Name()).Inc()
+			log.Printf("alert %d: notifier %s failed: %v", alert.ID, n.Name(), err)
+		}
+	}
+}
+
+func (r *AlertRule) notifies(name string) bool {
+	if len(r.Notify) == 0 {
+		return true
+	}
+	for _, n := range r.Notify {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// AlertFilter selects alerts for the admin page. Row-level security limits
+// them to what the viewer may see.
+type AlertFilter struct {
+	Status   string
+	Severity string
+	Rule     string
+	Limit    int
+}
+
+// List returns alerts newest first.
+func (s *AlertService) List(ctx context.Context, f AlertFilter) ([]models.Alert, error) {
+	limit := f.Limit
+	if limit <= 0 || limit > MaxAuditPageSize {
+		limit = DefaultAuditPageSize
+	}
+
+	rows, err := database.Conn(ctx, s.db).QueryContext(ctx, alertSelect+`
+		WHERE ($1 = '' OR status = $1) AND ($2 = '' OR severity = $2) AND ($3 = '' OR rule = $3)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $4
+	`, f.Status, f.Severity, f.Rule, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query alerts: %w", err)
+	}
+	defer rows.Close()
+
+	alerts := []models.Alert{}
+	for rows.Next() {
+		a, err := scanAlert(rows)
+		if err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, *a)
+	}
+	return alerts, rows.Err()
+}
+
+// Acknowledge marks an open alert as handled by user.
+func (s *AlertService) Acknowledge(ctx context.Context, id int64, user *models.User) (*models.Alert, error) {
+	var alert *models.Alert
+	err := database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+		var err error
+		alert, err = scanAlert(tx.QueryRowContext(ctx, alertSelect+`
+			WHERE id = $1
+			FOR UPDATE
+		`, id))
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("alert not found")
+		}
+		if err != nil || alert.Status != models.AlertStatusOpen {
+			return err
+		}
+
+		err = tx.QueryRowContext(ctx, `
+			UPDATE security_alerts
+			SET status = $2, acknowledged_by = $3::integer, acknowledged_at = NOW()
+			WHERE id = $1
+			RETURNING acknowledged_at
+		`, id, models.AlertStatusAcknowledged, user.ID).Scan(&alert.AcknowledgedAt)
+		if err != nil {
+			return fmt.Errorf("failed to acknowledge alert: %w", err)
+		}
+		alert.Status, alert.AcknowledgedBy = models.AlertStatusAcknowledged, &user.ID
+
+		return s.audit.Record(ctx, tx, AuditEvent{
+			Action:      models.AuditAlertAcknowledged,
+			EntityType:  "security_alert",
+			EntityID:    strconv.FormatInt(id, 10),
+			CompanyID:   alert.CompanyID,
+			WorkspaceID: alert.WorkspaceID,
+			Metadata:    map[string]interface{}{"rule": alert.Rule},
+		})
+	})
+	return alert, err
+}
+
+const alertSelect = `
+	SELECT id, rule, severity, message, group_key, COALESCE(company_id::text, ''),
+	       COALESCE(workspace_id::text, ''), event_ids, status, created_at,
+	       acknowledged_by::text, acknowledged_at
+	FROM security_alerts`
+
+func scanAlert(row interface{ Scan(...interface{}) error }) (*models.Alert, error) {
+	var a models.Alert
+	err := row.Scan(&a.ID, &a.Rule, &a.Severity, &a.Message, &a.GroupKey, &a.CompanyID, &a.WorkspaceID,
+		&a.EventIDs, &a.Status, &a.CreatedAt, &a.AcknowledgedBy, &a.AcknowledgedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
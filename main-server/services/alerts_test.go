@@ -0,0 +1,62 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+
+	"main-server/models"
+)
+
+// auditLogFor builds the audit_logs row Record would write for event.
+func auditLogFor(t *testing.T, event AuditEvent) models.AuditLog {
+	t.Helper()
+	changes, err := BuildAuditChanges(event.Before, event.After)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return models.AuditLog{
+		Action:     event.Action,
+		EntityType: event.EntityType,
+		EntityID:   event.EntityID,
+		CompanyID:  event.CompanyID,
+		Changes:    raw,
+	}
+}
+
+func TestSuperAdminGrantedRule(t *testing.T) {
+	config, err := LoadAlertConfig("../alert_rules.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rule *AlertRule
+	for i := range config.Rules {
+		if config.Rules[i].Name == "super_admin_granted" {
+			rule = &config.Rules[i]
+		}
+	}
+	if rule == nil {
+		t.Fatal("alert_rules.yaml has no super_admin_granted rule")
+	}
+
+	tests := []struct {
+		role string
+		want bool
+	}{
+		{models.RoleSuperAdmin, true},
+		{models.RoleWorkspaceAdmin, false},
+		{models.RoleCompanyAdmin, false},
+		{models.RoleUser, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role, func(t *testing.T) {
+			e := auditLogFor(t, invitationEvent(7, "new@example.com", tt.role, "3"))
+			if got := rule.matches(newAlertEvent(e)); got != tt.want {
+				t.Errorf("invitation as %s: matches = %v, want %v", tt.role, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,317 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+
+	"main-server/database"
+	"main-server/models"
+)
+
+const (
+	// Unreferenced blobs, and objects nothing refers to, are kept this long
+	// before they are collected. Objects are written before the rows that
+	// refer to them, so younger ones may just be in the middle of an upload.
+	blobCollectionGrace = 24 * time.Hour
+
+	// Advisory lock held while blobs are collected, so only one server
+	// collects at a time.
+	blobCollectionLock int64 = 0x626c6f62
+)
+
+// audienceBlob is the stored content of one or more audience files of a
+// company.
+type audienceBlob struct {
+	ID           int
+	StorageKey   string
+	DetectedType string
+}
+
+// blobKey returns the content-addressed key of a company's blob.
+func blobKey(workspaceID, companyID, sha256 string) string {
+	return fmt.Sprintf("%s/%s/%s", workspaceID, companyID, sha256)
+}
+
+// findBlob returns the company's blob with the given hash, or nil if it has
+// none.
+func findBlob(ctx context.Context, q rowQuerier, companyID, sha256 string) (*audienceBlob, error) {
+	var b audienceBlob
+	err := q.QueryRowContext(ctx, `
+		SELECT id, storage_key, COALESCE(detected_type, '')
+		FROM audience_blobs
+		WHERE company_id = $1 AND sha256 = $2
+	`, dbID(companyID), sha256).Scan(&b.ID, &b.StorageKey, &b.DetectedType)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up blob: %w", err)
+	}
+	return &b, nil
+}
+
+// referenceBlob takes a reference to the company's blob with the given
+// hash, creating it if there is none, or none left. Created reports whether
+// it did; the caller must then store the blob's object before committing.
+func referenceBlob(ctx context.Context, tx *sql.Tx, workspaceID, companyID, sha256 string, size int64, fileType string) (b *audienceBlob, created bool, err error) {
+	b = &audienceBlob{}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO audience_blobs (company_id, sha256, size, storage_key, detected_type, ref_count)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), 1)
+		ON CONFLICT (company_id, sha256) DO UPDATE
+		SET ref_count = audience_blobs.ref_count + 1, unreferenced_at = NULL
+		RETURNING id, storage_key, COALESCE(detected_type, ''), xmax = 0
+	`, companyID, sha256, size, blobKey(workspaceID, companyID, sha256), fileType).Scan(
+		&b.ID, &b.StorageKey, &b.DetectedType, &created)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to reference blob: %w", err)
+	}
+	return b, created, nil
+}
+
+// releaseBlob gives up a file's reference to a blob, and reports whether it
+// was the last one.
+func releaseBlob(ctx context.Context, tx *sql.Tx, blobID int) (unreferenced bool, err error) {
+	err = tx.QueryRowContext(ctx, `
+		UPDATE audience_blobs
+		SET ref_count = ref_count - 1,
+		    unreferenced_at = CASE WHEN ref_count = 1 THEN CURRENT_TIMESTAMP ELSE unreferenced_at END
+		WHERE id = $1
+		RETURNING ref_count = 0
+	`, blobID).Scan(&unreferenced)
+	if err != nil {
+		return false, fmt.Errorf("failed to release blob: %w", err)
+	}
+	return unreferenced, nil
+}
+
+// removeBlob deletes a blob and its object if nothing refers to it, and
+// reports whether it did. The row stays locked until the object is gone, so
+// a file referencing the blob meanwhile waits and then stores it again.
+func removeBlob(ctx context.Context, db *sql.DB, storage StorageBackend, id int) (bool, error) {
+	removed := false
+	err := database.WithTx(ctx, db, func(tx *sql.Tx) error {
+		var key string
+		err := tx.QueryRowContext(ctx, `
+			SELECT storage_key FROM audience_blobs WHERE id = $1 AND ref_count = 0 FOR UPDATE
+		`, id).Scan(&key)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := storage.Delete(ctx, key); err != nil {
+			return fmt.Errorf("failed to remove blob %s: %w", key, err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM audience_blobs WHERE id = $1`, id); err != nil {
+			return err
+		}
+		removed = true
+		return nil
+	})
+	return removed, err
+}
+
+// storageUsed returns how many bytes of audience files a company stores:
+// its blobs still in use, once each, and files that have no blob, either
+// because they are still quarantined or because they were stored before
+// blobs were.
+func storageUsed(ctx context.Context, q rowQuerier, companyID string) (int64, error) {
+	var used int64
+	err := q.QueryRowContext(ctx, `
+		SELECT COALESCE((SELECT SUM(size) FROM audience_blobs
+		                 WHERE company_id = $1 AND ref_count > 0), 0)
+		     + COALESCE((SELECT SUM(file_size_bytes) FROM audience_files
+		                 WHERE company_id = $1 AND blob_id IS NULL AND status IN ($2, $3)), 0)
+	`, dbID(companyID), models.AudienceFileQuarantined, models.AudienceFileReady).Scan(&used)
+	if err != nil {
+		return 0, fmt.Errorf("failed to measure storage: %w", err)
+	}
+	return used, nil
+}
+
+// BlobCollector removes stored audience file contents nothing refers to:
+// blobs whose last file has gone, and objects under a workspace's keys
+// with no row at all, such as those left by an upload that failed after
+// storing its file, or prepared copies of a file that have been replaced.
+type BlobCollector struct {
+	db      *sql.DB
+	storage StorageBackend
+}
+
+func NewBlobCollector(db *sql.DB, storage StorageBackend) *BlobCollector {
+	return &BlobCollector{db: db, storage: storage}
+}
+
+// RunEvery calls Collect every interval until ctx is cancelled.
+func (c *BlobCollector) RunEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := c.Collect(ctx); err != nil {
+				log.Printf("blob collection failed: %v", err)
+			} else if n > 0 {
+				log.Printf("removed %d unreferenced audience file objects", n)
+			}
+		}
+	}
+}
+
+// Collect removes unreferenced blobs and orphaned objects older than
+// blobCollectionGrace and returns how many objects it removed. It does
+// nothing if another server is already collecting.
+func (c *BlobCollector) Collect(ctx context.Context) (int, error) {
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, blobCollectionLock).Scan(&locked); err != nil {
+		return 0, fmt.Errorf("failed to take blob collection lock: %w", err)
+	}
+	if !locked {
+		return 0, nil
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, blobCollectionLock)
+
+	n, err := c.collectBlobs(ctx)
+	if err != nil {
+		return n, err
+	}
+	orphans, err := c.collectOrphans(ctx)
+	return n + orphans, err
+}
+
+func (c *BlobCollector) collectBlobs(ctx context.Context) (int, error) {
+	rows, err := c.db.QueryContext(ctx, `
+		SELECT id
+		FROM audience_blobs
+		WHERE ref_count = 0 AND unreferenced_at < CURRENT_TIMESTAMP - make_interval(secs => $1)
+		ORDER BY unreferenced_at
+		LIMIT 1000
+	`, blobCollectionGrace.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to find unreferenced blobs: %w", err)
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, id := range ids {
+		removed, err := removeBlob(ctx, c.db, c.storage, id)
+		if err != nil {
+			return n, err
+		}
+		if removed {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// collectOrphans removes objects under each workspace's keys, quarantined
+// or not, that no file, blob or open upload refers to.
+func (c *BlobCollector) collectOrphans(ctx context.Context) (int, error) {
+	rows, err := c.db.QueryContext(ctx, `SELECT id::text FROM workspaces ORDER BY id`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query workspaces: %w", err)
+	}
+	var prefixes []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		prefixes = append(prefixes, id+"/", quarantinePrefix+id+"/")
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	cutoff := time.Now().Add(-blobCollectionGrace)
+	for _, prefix := range prefixes {
+		objects, err := c.storage.List(ctx, prefix)
+		if err != nil {
+			return n, fmt.Errorf("failed to list %s: %w", prefix, err)
+		}
+
+		var old []string
+		for _, o := range objects {
+			if o.ModTime.Before(cutoff) {
+				old = append(old, o.Key)
+			}
+		}
+		for len(old) > 0 {
+			batch := old[:min(len(old), 1000)]
+			old = old[len(batch):]
+
+			orphans, err := c.unreferenced(ctx, batch)
+			if err != nil {
+				return n, err
+			}
+			for _, key := range orphans {
+				if err := c.storage.Delete(ctx, key); err != nil {
+					return n, fmt.Errorf("failed to remove %s: %w", key, err)
+				}
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// unreferenced returns the keys nothing refers to. Rejected and purged
+// files and finished uploads keep the key their object had, but no longer
+// need it.
+func (c *BlobCollector) unreferenced(ctx context.Context, keys []string) ([]string, error) {
+	rows, err := c.db.QueryContext(ctx, `
+		SELECT k FROM unnest($1::text[]) AS k
+		WHERE NOT EXISTS (SELECT 1 FROM audience_blobs WHERE storage_key = k)
+		  AND NOT EXISTS (SELECT 1 FROM audience_files WHERE storage_path = k AND status NOT IN ($2, $3))
+		  AND NOT EXISTS (SELECT 1 FROM upload_sessions WHERE storage_key = k AND status = $4)
+		  AND NOT EXISTS (SELECT 1 FROM direct_uploads WHERE storage_key = k AND status = $5)
+		  AND NOT EXISTS (SELECT 1 FROM audience_file_outputs WHERE storage_key = k)
+	`, pq.Array(keys), models.AudienceFileRejected, models.AudienceFilePurged, models.UploadSessionActive, models.DirectUploadPending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check object references: %w", err)
+	}
+	defer rows.Close()
+
+	var orphans []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, key)
+	}
+	return orphans, rows.Err()
+}
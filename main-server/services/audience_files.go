@@ -0,0 +1,273 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"main-server/database"
+	"main-server/models"
+)
+
+// AudienceFileService stores uploaded audience files in a StorageBackend and
+// keeps their audience_files records. Queries run on the request's
+// tenant-bound connection, so row-level security limits every lookup to
+// companies the user may access.
+//
+// New files are quarantined and submitted to ingest, which makes them ready
+// once they have been checked. Uploads that would take a company past its
+// storage quota are refused. Files are downloaded through links signed with
+// linkKey, which expire after linkTTL, and every download is audited.
+type AudienceFileService struct {
+	db           *sql.DB
+	storage      StorageBackend
+	ingest       *IngestService
+	entitlements *EntitlementService
+	audit        *AuditService
+	linkKey      []byte
+	linkTTL      time.Duration
+}
+
+func NewAudienceFileService(db *sql.DB, storage StorageBackend, ingest *IngestService, entitlements *EntitlementService, audit *AuditService, linkKey []byte, linkTTL time.Duration) *AudienceFileService {
+	return &AudienceFileService{db: db, storage: storage, ingest: ingest, entitlements: entitlements, audit: audit, linkKey: linkKey, linkTTL: linkTTL}
+}
+
+// Upload streams r to storage under a generated key, hashing it on the way,
+// and records it for companyID as quarantined. The original filename is
+// only kept in the record, so files with the same name never collide. The
+// size is only known once the file is stored, so the quota is checked
+// before and again after.
+func (s *AudienceFileService) Upload(ctx context.Context, actor *models.User, workspaceID, companyID, filename, contentType string, r io.Reader) (*models.AudienceFile, error) {
+	key, err := audienceFileKey(workspaceID, companyID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.entitlements.CheckStorage(ctx, companyID, 0); err != nil {
+		return nil, err
+	}
+
+	// Streaming the file to storage does not need the database, so the
+	// request's connection goes back to the pool until it is done
+	sum := sha256.New()
+	counter := &countingWriter{}
+	err = database.WithoutTenant(ctx, func() error {
+		return s.storage.Upload(ctx, io.TeeReader(r, io.MultiWriter(sum, counter)), key)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store file: %w", err)
+	}
+	if err := s.entitlements.CheckStorage(ctx, companyID, counter.n); err != nil {
+		s.removeObject(key)
+		return nil, err
+	}
+
+	f := &models.AudienceFile{
+		CompanyID:        companyID,
+		Name:             filename,
+		OriginalFilename: filename,
+		StoragePath:      key,
+		ContentType:      contentType,
+		FileSizeBytes:    counter.n,
+		FileHash:         hex.EncodeToString(sum.Sum(nil)),
+		Status:           models.AudienceFileQuarantined,
+		UploadedBy:       actor.ID,
+	}
+
+	if err := insertAudienceFile(ctx, database.Conn(ctx, s.db), f); err != nil {
+		// Nothing refers to the object without its record
+		s.removeObject(key)
+		return nil, err
+	}
+
+	s.ingest.Submit(f.ID)
+	return f, nil
+}
+
+// insertAudienceFile records a stored file and sets its ID and created_at.
+func insertAudienceFile(ctx context.Context, q rowQuerier, f *models.AudienceFile) error {
+	err := q.QueryRowContext(ctx, `
+		INSERT INTO audience_files (company_id, name, original_filename, storage_path, content_type,
+		                            file_size_bytes, file_hash, status, uploaded_by)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, $8, $9)
+		RETURNING id, created_at
+	`, f.CompanyID, f.Name, f.OriginalFilename, f.StoragePath, f.ContentType,
+		f.FileSizeBytes, f.FileHash, f.Status, f.UploadedBy).Scan(&f.ID, &f.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save audience file: %w", err)
+	}
+	return nil
+}
+
+// removeObject deletes a stored object that could not be recorded. It runs
+// on its own context, as the request's may be what failed.
+func (s *AudienceFileService) removeObject(key string) {
+	if err := s.storage.Delete(context.Background(), key); err != nil {
+		log.Printf("failed to remove unrecorded upload %s: %v", key, err)
+	}
+}
+
+// Get loads an audience file by ID, with the company's first upload of the
+// same contents if it is a later one.
+func (s *AudienceFileService) Get(ctx context.Context, id int) (*models.AudienceFile, error) {
+	var f models.AudienceFile
+	var earlierID sql.NullInt64
+	var earlierName sql.NullString
+	var earlierCreatedAt sql.NullTime
+	err := database.Conn(ctx, s.db).QueryRowContext(ctx, `
+		SELECT af.id, af.company_id::text, af.name, af.original_filename, af.storage_path,
+		       COALESCE(af.content_type, ''), COALESCE(af.file_size_bytes, 0), COALESCE(af.file_hash, ''),
+		       af.status, COALESCE(af.detected_type, ''), COALESCE(af.rejection_reason, ''),
+		       COALESCE(af.uploaded_by::text, ''), af.created_at, af.validated_at, af.processed_at,
+		       af.deleted_at, COALESCE(af.deleted_by::text, ''), af.purged_at,
+		       COALESCE(af.parse_status, ''), COALESCE(af.parse_error, ''), af.detected_schema, af.column_mapping,
+		       af.row_count, af.identified_rows,
+		       earlier.id, earlier.original_filename, earlier.created_at
+		FROM audience_files af
+		LEFT JOIN LATERAL (
+			SELECT id, original_filename, created_at
+			FROM audience_files
+			WHERE company_id = af.company_id AND file_hash = af.file_hash AND id < af.id AND status = $2
+			  AND deleted_at IS NULL
+			ORDER BY id
+			LIMIT 1
+		) earlier ON true
+		WHERE af.id = $1
+	`, id, models.AudienceFileReady).Scan(&f.ID, &f.CompanyID, &f.Name, &f.OriginalFilename, &f.StoragePath,
+		&f.ContentType, &f.FileSizeBytes, &f.FileHash,
+		&f.Status, &f.DetectedType, &f.RejectionReason,
+		&f.UploadedBy, &f.CreatedAt, &f.ValidatedAt, &f.ProcessedAt,
+		&f.DeletedAt, &f.DeletedBy, &f.PurgedAt,
+		&f.ParseStatus, &f.ParseError, &f.Schema, &f.Mapping,
+		&f.RowCount, &f.IdentifiedRows,
+		&earlierID, &earlierName, &earlierCreatedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("audience file not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	if earlierID.Valid {
+		f.DuplicateOf = &models.AudienceFileRef{ID: int(earlierID.Int64), Name: earlierName.String, CreatedAt: earlierCreatedAt.Time}
+	}
+
+	return &f, nil
+}
+
+// DownloadLink returns a link that lets userID, acting as f's company,
+// download f until it expires.
+func (s *AudienceFileService) DownloadLink(f *models.AudienceFile, userID string) *models.DownloadLink {
+	expires := time.Now().Add(s.linkTTL).Truncate(time.Second)
+	q := url.Values{"expires": {strconv.FormatInt(expires.Unix(), 10)}}
+	q.Set("signature", hex.EncodeToString(s.linkSignature(f, userID, q.Get("expires"))))
+	return &models.DownloadLink{
+		URL:       fmt.Sprintf("/app/uploads/%d/download?%s", f.ID, q.Encode()),
+		ExpiresAt: expires,
+	}
+}
+
+// VerifyDownloadLink checks the query of a download link for f used by
+// userID, failing with ErrInvalidSignature if it was made for another file,
+// user or company, or has expired.
+func (s *AudienceFileService) VerifyDownloadLink(f *models.AudienceFile, userID string, q url.Values) error {
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return ErrInvalidSignature
+	}
+	got, err := hex.DecodeString(q.Get("signature"))
+	if err != nil || !hmac.Equal(got, s.linkSignature(f, userID, q.Get("expires"))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// linkSignature is specific to downloading, so no other signature made with
+// the same key can pass for a download link.
+func (s *AudienceFileService) linkSignature(f *models.AudienceFile, userID, expires string) []byte {
+	return hmacSHA256(s.linkKey, strings.Join([]string{
+		models.AuditAudienceFileDownloaded, strconv.Itoa(f.ID), f.CompanyID, userID, expires,
+	}, "\n"))
+}
+
+// Reader returns the contents of f as a seekable reader, which reads only
+// the ranges asked for. The caller must close it.
+func (s *AudienceFileService) Reader(ctx context.Context, f *models.AudienceFile) (*ObjectReader, error) {
+	// The stored size is authoritative, and a missing object is reported
+	// before anything is sent
+	info, err := s.storage.Stat(ctx, f.StoragePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audience file: %w", err)
+	}
+	return NewObjectReader(ctx, s.storage, f.StoragePath, info.Size), nil
+}
+
+// RecordDownload writes a download of f, or of byteRange of it, to the
+// audit log.
+func (s *AudienceFileService) RecordDownload(ctx context.Context, f *models.AudienceFile, byteRange string) error {
+	metadata := map[string]interface{}{"filename": f.OriginalFilename, "size": f.FileSizeBytes}
+	if byteRange != "" {
+		metadata["range"] = byteRange
+	}
+	return s.audit.Record(ctx, database.Conn(ctx, s.db), AuditEvent{
+		Action:     models.AuditAudienceFileDownloaded,
+		EntityType: "audience_file",
+		EntityID:   strconv.Itoa(f.ID),
+		CompanyID:  f.CompanyID,
+		Metadata:   metadata,
+	})
+}
+
+// audienceFileKey returns a new storage key in quarantine,
+// quarantine/{workspace}/{company}/{uuid}. Files that pass their checks are
+// moved to their blob's key, {workspace}/{company}/{sha256}.
+func audienceFileKey(workspaceID, companyID string) (string, error) {
+	if workspaceID == "" || companyID == "" {
+		return "", fmt.Errorf("audience files need a workspace and a company")
+	}
+	id, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%s/%s/%s", quarantinePrefix, workspaceID, companyID, id), nil
+}
+
+// AudienceKeyScheme gives each workspace its own encryption keys, for the
+// files under {workspace}/ and quarantine/{workspace}/ and the audit
+// archives under audit-archives/{workspace}/. Archives of rows without a
+// company use the shared scope.
+type AudienceKeyScheme struct{}
+
+func (AudienceKeyScheme) Scope(key string) string {
+	key = strings.TrimPrefix(key, quarantinePrefix)
+	key = strings.TrimPrefix(key, auditArchivePrefix+"/")
+	workspaceID, _, ok := strings.Cut(key, "/")
+	if !ok || workspaceID == auditPlatformArchiveDir {
+		return ""
+	}
+	return workspaceID
+}
+
+func (AudienceKeyScheme) Prefixes(workspaceID string) []string {
+	return []string{workspaceID + "/", quarantinePrefix + workspaceID + "/", auditArchivePrefix + "/" + workspaceID + "/"}
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// validateUpload stores data in memory and validates it as IngestService
+// would.
+func validateUpload(ctx context.Context, validator *UploadValidator, data []byte, policy UploadPolicy) (string, error) {
+	storage := NewMemoryStorage()
+	if err := storage.Upload(ctx, bytes.NewReader(data), "file"); err != nil {
+		return "", err
+	}
+	r := NewObjectReader(ctx, storage, "file", int64(len(data)))
+	defer r.Close()
+	return validator.Validate(ctx, r, int64(len(data)), policy)
+}
+
+func gzipped(name string, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Name = name
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func zipped(files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, data := range files {
+		f, _ := w.Create(name)
+		f.Write(data)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func utf16LE(s string) []byte {
+	b := []byte{0xff, 0xfe}
+	for _, r := range s {
+		b = append(b, byte(r), byte(r>>8))
+	}
+	return b
+}
+
+func newTestScanner(t *testing.T) *ClamAVScanner {
+	t.Helper()
+	clamd := newFakeClamd(t)
+	clamd.StreamMaxLength = 1 << 20
+	scanner := NewClamAVScanner(clamd.Addr(), 10*time.Second)
+	if err := scanner.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return scanner
+}
+
+func TestUploadValidator(t *testing.T) {
+	ctx := context.Background()
+	scanner := newTestScanner(t)
+	validator := NewUploadValidator(scanner)
+
+	csv := []byte("email,first_name,zip\nada@example.com,Ada,10001\n")
+	tsv := []byte("email\tfirst_name\tzip\nada@example.com\tAda\t10001\n")
+	exe := append([]byte("MZ\x90\x00\x03\x00\x00\x00"), bytes.Repeat([]byte{0}, 64)...)
+	infected := append(append([]byte{}, csv...), eicar...)
+
+	tests := []struct {
+		name   string
+		data   []byte
+		policy UploadPolicy
+		// The type the file is accepted as, or "" if it is rejected
+		want string
+	}{
+		{name: "csv", data: csv, want: FileTypeCSV},
+		{name: "tsv", data: tsv, want: FileTypeTSV},
+		{name: "csv with a UTF-8 BOM", data: append([]byte("\xef\xbb\xbf"), csv...), want: FileTypeCSV},
+		{name: "UTF-16 tsv", data: utf16LE(string(tsv)), want: FileTypeTSV},
+		{name: "single column", data: []byte("email\nada@example.com\n"), want: FileTypeCSV},
+		{name: "gzipped csv", data: gzipped("list.csv", csv), want: FileTypeGzip},
+		{name: "zipped csv", data: zipped(map[string][]byte{"list.csv": csv, "more/list.tsv": tsv}), want: FileTypeZip},
+		{name: "empty", data: nil},
+		{name: "Windows executable named .csv", data: exe},
+		{name: "ELF binary", data: append([]byte("\x7fELF\x02\x01\x01"), bytes.Repeat([]byte{0}, 64)...)},
+		{name: "shell script", data: []byte("#!/bin/sh\nrm -rf /\n")},
+		{name: "HTML page", data: []byte("<!DOCTYPE html>\n<html><body>email</body></html>\n")},
+		{name: "binary noise", data: bytes.Repeat([]byte{0x01, 0x02, 0x03, 0xff}, 1024)},
+		{name: "gzipped executable", data: gzipped("list.csv", exe)},
+		{name: "zip with an executable", data: zipped(map[string][]byte{"list.csv": csv, "setup.csv": exe})},
+		{name: "nested zip", data: zipped(map[string][]byte{"inner.zip": zipped(map[string][]byte{"list.csv": csv})})},
+		{name: "zip with an unsafe path", data: zipped(map[string][]byte{"../list.csv": csv})},
+		{name: "too large", data: bytes.Repeat(csv, 100), policy: UploadPolicy{MaxSize: 1 << 10}},
+		{name: "type not allowed", data: gzipped("list.csv", csv), policy: UploadPolicy{AllowedTypes: []string{FileTypeCSV}}},
+		{name: "EICAR test file", data: infected},
+		{name: "EICAR in a zip", data: zipped(map[string][]byte{"list.csv": infected})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateUpload(ctx, validator, tt.data, tt.policy)
+			var rejected *RejectedFileError
+			switch {
+			case err != nil && !errors.As(err, &rejected):
+				t.Fatal(err)
+			case tt.want == "" && err == nil:
+				t.Errorf("accepted as %s, want rejected", got)
+			case tt.want != "" && err != nil:
+				t.Errorf("rejected (%s), want %s", rejected.Reason, tt.want)
+			case got != tt.want:
+				t.Errorf("accepted as %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// Scanner failures leave the file unchecked rather than rejected.
+func TestUploadValidatorScanErrors(t *testing.T) {
+	ctx := context.Background()
+	scanner := newTestScanner(t)
+	csv := []byte("email,first_name,zip\nada@example.com,Ada,10001\n")
+
+	tests := []struct {
+		name    string
+		scanner MalwareScanner
+		data    []byte
+	}{
+		{"stream over clamd's limit", scanner, bytes.Repeat(csv, (2<<20)/len(csv))},
+		{"clamd down", NewClamAVScanner("127.0.0.1:1", time.Second), csv},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := validateUpload(ctx, NewUploadValidator(tt.scanner), tt.data, UploadPolicy{})
+			var rejected *RejectedFileError
+			if err == nil || errors.As(err, &rejected) {
+				t.Errorf("got %v, want a scan error", err)
+			}
+		})
+	}
+}
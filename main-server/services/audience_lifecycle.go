@@ -0,0 +1,470 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"main-server/database"
+	"main-server/models"
+)
+
+// Advisory lock held while the lifecycle job runs, so only one server
+// applies retention and empties the trash at a time.
+const audienceLifecycleLock int64 = 0x6c696665
+
+var (
+	ErrAudienceFileNotFound = errors.New("audience file not found")
+	ErrAudienceFileBusy     = errors.New("this file is still being checked and cannot be deleted yet")
+	ErrAudienceFileTrashed  = errors.New("this file is already in the trash")
+	ErrNotInTrash           = errors.New("this file is not in the trash")
+)
+
+// AudienceLifecycleService deletes audience files in two steps. Files are
+// moved to the trash by a user, or by their workspace's retention policy
+// once no campaign has used them for AudienceRetentionDays, and can be
+// restored for trashTTL. After that, or when a user empties them from the
+// trash, they are purged: their blob reference is released and, if it was
+// the last, the blob's object is deleted from storage straight away. Files
+// count against their company's StorageQuotaMB until they are purged.
+//
+// User actions run on the request's tenant-bound connection; the
+// background job runs on the pool.
+type AudienceLifecycleService struct {
+	db           *sql.DB
+	storage      StorageBackend
+	entitlements *EntitlementService
+	audit        *AuditService
+	trashTTL     time.Duration
+}
+
+func NewAudienceLifecycleService(db *sql.DB, storage StorageBackend, entitlements *EntitlementService, audit *AuditService, trashTTL time.Duration) *AudienceLifecycleService {
+	return &AudienceLifecycleService{
+		db:           db,
+		storage:      storage,
+		entitlements: entitlements,
+		audit:        audit,
+		trashTTL:     trashTTL,
+	}
+}
+
+// lifecycleFile is an audience file locked for a lifecycle change.
+type lifecycleFile struct {
+	models.AudienceFile
+	WorkspaceID string
+	BlobID      sql.NullInt64
+}
+
+// lockAudienceFile loads a company's audience file and locks it until tx
+// ends.
+func lockAudienceFile(ctx context.Context, tx *sql.Tx, companyID string, id int) (*lifecycleFile, error) {
+	var f lifecycleFile
+	err := tx.QueryRowContext(ctx, `
+		SELECT af.id, af.company_id::text, c.workspace_id::text, af.name, af.original_filename, af.storage_path,
+		       COALESCE(af.file_size_bytes, 0), af.status, af.blob_id,
+		       af.created_at, af.deleted_at, COALESCE(af.deleted_by::text, ''), af.purged_at
+		FROM audience_files af
+		JOIN companies c ON c.id = af.company_id
+		WHERE af.id = $1 AND af.company_id = $2
+		FOR UPDATE OF af
+	`, id, dbID(companyID)).Scan(&f.ID, &f.CompanyID, &f.WorkspaceID, &f.Name, &f.OriginalFilename, &f.StoragePath,
+		&f.FileSizeBytes, &f.Status, &f.BlobID,
+		&f.CreatedAt, &f.DeletedAt, &f.DeletedBy, &f.PurgedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrAudienceFileNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load audience file: %w", err)
+	}
+	return &f, nil
+}
+
+// Trash moves a company's file to the trash. Files still in quarantine are
+// left alone, as ingest may be moving them.
+func (s *AudienceLifecycleService) Trash(ctx context.Context, actor *models.User, companyID string, id int) (*models.AudienceFile, error) {
+	var f *lifecycleFile
+	err := database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+		var err error
+		if f, err = lockAudienceFile(ctx, tx, companyID, id); err != nil {
+			return err
+		}
+		switch {
+		case f.DeletedAt != nil:
+			return ErrAudienceFileTrashed
+		case f.Status == models.AudienceFileQuarantined:
+			return ErrAudienceFileBusy
+		}
+
+		err = tx.QueryRowContext(ctx, `
+			UPDATE audience_files SET deleted_at = CURRENT_TIMESTAMP, deleted_by = $2
+			WHERE id = $1
+			RETURNING deleted_at
+		`, f.ID, actor.ID).Scan(&f.DeletedAt)
+		if err != nil {
+			return fmt.Errorf("failed to move audience file to the trash: %w", err)
+		}
+		f.DeletedBy = actor.ID
+
+		return s.audit.Record(ctx, tx, AuditEvent{
+			Action:     models.AuditAudienceFileTrashed,
+			EntityType: "audience_file",
+			EntityID:   strconv.Itoa(f.ID),
+			CompanyID:  f.CompanyID,
+			Metadata:   map[string]interface{}{"filename": f.OriginalFilename},
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.trashed(&f.AudienceFile), nil
+}
+
+// Restore takes a company's file back out of the trash.
+func (s *AudienceLifecycleService) Restore(ctx context.Context, companyID string, id int) (*models.AudienceFile, error) {
+	var f *lifecycleFile
+	err := database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+		var err error
+		if f, err = lockAudienceFile(ctx, tx, companyID, id); err != nil {
+			return err
+		}
+		if f.DeletedAt == nil || f.PurgedAt != nil {
+			return ErrNotInTrash
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			UPDATE audience_files SET deleted_at = NULL, deleted_by = NULL WHERE id = $1
+		`, f.ID)
+		if err != nil {
+			return fmt.Errorf("failed to restore audience file: %w", err)
+		}
+		f.DeletedAt, f.DeletedBy = nil, ""
+
+		return s.audit.Record(ctx, tx, AuditEvent{
+			Action:     models.AuditAudienceFileRestored,
+			EntityType: "audience_file",
+			EntityID:   strconv.Itoa(f.ID),
+			CompanyID:  f.CompanyID,
+			Metadata:   map[string]interface{}{"filename": f.OriginalFilename},
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &f.AudienceFile, nil
+}
+
+// Purge deletes a company's file from the trash for good.
+func (s *AudienceLifecycleService) Purge(ctx context.Context, companyID string, id int) error {
+	return s.purge(ctx, companyID, id, "user")
+}
+
+// purge releases a trashed file's contents and prepared copies and keeps
+// its row as a record. The objects are deleted once the release is
+// committed; if that fails, BlobCollector deletes them later.
+func (s *AudienceLifecycleService) purge(ctx context.Context, companyID string, id int, reason string) error {
+	var f *lifecycleFile
+	var unreferenced bool
+	var outputs []string
+	err := database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+		var err error
+		if f, err = lockAudienceFile(ctx, tx, companyID, id); err != nil {
+			return err
+		}
+		if f.DeletedAt == nil || f.PurgedAt != nil {
+			return ErrNotInTrash
+		}
+
+		if f.BlobID.Valid {
+			if unreferenced, err = releaseBlob(ctx, tx, int(f.BlobID.Int64)); err != nil {
+				return err
+			}
+		}
+		if outputs, err = removeAudienceOutputs(ctx, tx, f.ID); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE audience_files SET status = $2, purged_at = CURRENT_TIMESTAMP, blob_id = NULL WHERE id = $1
+		`, f.ID, models.AudienceFilePurged)
+		if err != nil {
+			return fmt.Errorf("failed to purge audience file: %w", err)
+		}
+
+		return s.audit.Record(ctx, tx, AuditEvent{
+			Action:      models.AuditAudienceFilePurged,
+			EntityType:  "audience_file",
+			EntityID:    strconv.Itoa(f.ID),
+			CompanyID:   f.CompanyID,
+			WorkspaceID: f.WorkspaceID,
+			Before:      map[string]interface{}{"status": f.Status},
+			After:       map[string]interface{}{"status": models.AudienceFilePurged},
+			Metadata:    map[string]interface{}{"filename": f.OriginalFilename, "size": f.FileSizeBytes, "reason": reason},
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	deleteAudienceOutputs(ctx, s.storage, f.ID, outputs)
+	switch {
+	case unreferenced:
+		if _, err := removeBlob(ctx, s.db, s.storage, int(f.BlobID.Int64)); err != nil {
+			log.Printf("blob of purged audience file %d is left for collection: %v", f.ID, err)
+		}
+	case !f.BlobID.Valid && f.Status == models.AudienceFileReady:
+		// Files stored before blobs have an object of their own
+		if err := s.storage.Delete(ctx, f.StoragePath); err != nil {
+			log.Printf("object of purged audience file %d is left for collection: %v", f.ID, err)
+		}
+	}
+	return nil
+}
+
+// ListTrash returns a company's files in the trash, most recently deleted
+// first.
+func (s *AudienceLifecycleService) ListTrash(ctx context.Context, companyID string) ([]models.AudienceFile, error) {
+	rows, err := database.Conn(ctx, s.db).QueryContext(ctx, `
+		SELECT id, company_id::text, name, original_filename, COALESCE(content_type, ''),
+		       COALESCE(file_size_bytes, 0), COALESCE(file_hash, ''), status,
+		       COALESCE(uploaded_by::text, ''), created_at, deleted_at, COALESCE(deleted_by::text, '')
+		FROM audience_files
+		WHERE company_id = $1 AND deleted_at IS NOT NULL AND purged_at IS NULL
+		ORDER BY deleted_at DESC, id DESC
+	`, dbID(companyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query trash: %w", err)
+	}
+	defer rows.Close()
+
+	files := []models.AudienceFile{}
+	for rows.Next() {
+		var f models.AudienceFile
+		if err := rows.Scan(&f.ID, &f.CompanyID, &f.Name, &f.OriginalFilename, &f.ContentType,
+			&f.FileSizeBytes, &f.FileHash, &f.Status,
+			&f.UploadedBy, &f.CreatedAt, &f.DeletedAt, &f.DeletedBy); err != nil {
+			return nil, err
+		}
+		files = append(files, *s.trashed(&f))
+	}
+	return files, rows.Err()
+}
+
+// trashed sets when a file in the trash will be purged.
+func (s *AudienceLifecycleService) trashed(f *models.AudienceFile) *models.AudienceFile {
+	if f.DeletedAt != nil {
+		purgeAt := f.DeletedAt.Add(s.trashTTL)
+		f.PurgeAt = &purgeAt
+	}
+	return f
+}
+
+// Usage returns how much a company stores against its quota.
+func (s *AudienceLifecycleService) Usage(ctx context.Context, companyID string) (*models.StorageUsage, error) {
+	ent, err := s.entitlements.Resolve(ctx, companyID)
+	if err != nil {
+		return nil, err
+	}
+
+	q := database.Conn(ctx, s.db)
+	usage := &models.StorageUsage{QuotaBytes: int64(ent.Features.StorageQuotaMB) << 20}
+	if usage.UsedBytes, err = storageUsed(ctx, q, companyID); err != nil {
+		return nil, err
+	}
+	err = q.QueryRowContext(ctx, `
+		SELECT COUNT(*) FILTER (WHERE deleted_at IS NULL AND status IN ($2, $3)),
+		       COUNT(*) FILTER (WHERE deleted_at IS NOT NULL AND purged_at IS NULL)
+		FROM audience_files
+		WHERE company_id = $1
+	`, dbID(companyID), models.AudienceFileQuarantined, models.AudienceFileReady).Scan(&usage.Files, &usage.TrashedFiles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count audience files: %w", err)
+	}
+	return usage, nil
+}
+
+// RunEvery calls Run every interval until ctx is cancelled.
+func (s *AudienceLifecycleService) RunEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Run(ctx); err != nil {
+				log.Printf("audience file lifecycle failed: %v", err)
+			}
+		}
+	}
+}
+
+// Run applies every workspace's retention policy, then purges files that
+// have been in the trash for trashTTL. It does nothing if another server is
+// already running it.
+func (s *AudienceLifecycleService) Run(ctx context.Context) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, audienceLifecycleLock).Scan(&locked); err != nil {
+		return fmt.Errorf("failed to take lifecycle lock: %w", err)
+	}
+	if !locked {
+		return nil
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, audienceLifecycleLock)
+
+	rows, err := s.db.QueryContext(ctx, `SELECT id::text FROM workspaces ORDER BY id`)
+	if err != nil {
+		return fmt.Errorf("failed to query workspaces: %w", err)
+	}
+	var workspaces []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		workspaces = append(workspaces, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, workspaceID := range workspaces {
+		ent, err := s.entitlements.ResolveWorkspace(ctx, workspaceID)
+		if err != nil {
+			log.Printf("audience retention: workspace %s: %v", workspaceID, err)
+			continue
+		}
+		days := ent.Features.AudienceRetentionDays
+		if days <= 0 {
+			continue
+		}
+
+		n, err := s.TrashUnused(ctx, workspaceID, time.Now().AddDate(0, 0, -days))
+		if err != nil {
+			log.Printf("audience retention: workspace %s: %v", workspaceID, err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("audience retention: moved %d files of workspace %s to the trash", n, workspaceID)
+		}
+	}
+
+	n, err := s.PurgeExpired(ctx)
+	if n > 0 {
+		log.Printf("purged %d audience files from the trash", n)
+	}
+	return err
+}
+
+// TrashUnused moves a workspace's ready files to the trash if they were
+// uploaded and last used by a campaign before cutoff. Campaigns that were
+// submitted but have not completed are still using their file.
+func (s *AudienceLifecycleService) TrashUnused(ctx context.Context, workspaceID string, cutoff time.Time) (int, error) {
+	n := 0
+	err := database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `
+			UPDATE audience_files af
+			SET deleted_at = CURRENT_TIMESTAMP
+			FROM companies c
+			WHERE c.id = af.company_id AND c.workspace_id = $1
+			  AND af.status = $2 AND af.deleted_at IS NULL
+			  AND GREATEST(af.created_at, (
+			      SELECT MAX(COALESCE(cp.completed_at, CASE WHEN cp.submitted_at IS NOT NULL THEN CURRENT_TIMESTAMP END, cp.created_at))
+			      FROM campaigns cp
+			      WHERE cp.audience_file_id = af.id
+			  )) < $3
+			RETURNING af.id, af.company_id::text, af.original_filename
+		`, dbID(workspaceID), models.AudienceFileReady, cutoff)
+		if err != nil {
+			return fmt.Errorf("failed to apply retention: %w", err)
+		}
+
+		var events []AuditEvent
+		for rows.Next() {
+			var id int
+			var companyID, filename string
+			if err := rows.Scan(&id, &companyID, &filename); err != nil {
+				rows.Close()
+				return err
+			}
+			events = append(events, AuditEvent{
+				Action:      models.AuditAudienceFileTrashed,
+				EntityType:  "audience_file",
+				EntityID:    strconv.Itoa(id),
+				CompanyID:   companyID,
+				WorkspaceID: workspaceID,
+				Metadata:    map[string]interface{}{"filename": filename, "reason": "retention", "cutoff": cutoff},
+			})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			if err := s.audit.Record(ctx, tx, event); err != nil {
+				return err
+			}
+		}
+		n = len(events)
+		return nil
+	})
+	return n, err
+}
+
+// PurgeExpired purges files that have been in the trash for trashTTL, one
+// at a time, and returns how many it purged.
+func (s *AudienceLifecycleService) PurgeExpired(ctx context.Context) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, company_id::text
+		FROM audience_files
+		WHERE deleted_at < CURRENT_TIMESTAMP - make_interval(secs => $1) AND purged_at IS NULL
+		ORDER BY deleted_at
+		LIMIT 1000
+	`, s.trashTTL.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to find expired trash: %w", err)
+	}
+	type expired struct {
+		id        int
+		companyID string
+	}
+	var files []expired
+	for rows.Next() {
+		var f expired
+		if err := rows.Scan(&f.id, &f.companyID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		files = append(files, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, f := range files {
+		err := s.purge(ctx, f.companyID, f.id, "expired")
+		if errors.Is(err, ErrNotInTrash) {
+			// Restored meanwhile
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,153 @@
+package services
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"main-server/database"
+	"main-server/models"
+)
+
+// audienceOutputKey returns the key of an audience file prepared for a
+// platform. Each processing of the file writes under its own key, so a
+// processing that has been overtaken never overwrites a newer one's.
+func audienceOutputKey(workspaceID, companyID string, fileID int, queuedAt time.Time, platform string) string {
+	return fmt.Sprintf("%s/%s/outputs/%d/%d/%s.csv.gz", workspaceID, companyID, fileID, queuedAt.UnixNano(), platform)
+}
+
+// audienceOutput writes an audience file prepared for one platform, a
+// gzipped CSV of the platform's columns, to a temporary file while the
+// audience file is processed. Only hashed contact details and mobile ad IDs
+// are written to it.
+type audienceOutput struct {
+	platform string
+	encoder  *PlatformEncoder
+	tmp      *os.File
+	gz       *gzip.Writer
+	csv      *csv.Writer
+	rows     int
+	key      string // once stored
+}
+
+// newAudienceOutputs starts an output for each of AudiencePlatforms. The
+// caller must close them.
+func newAudienceOutputs(mapping models.ColumnMapping) ([]*audienceOutput, error) {
+	var outputs []*audienceOutput
+	for _, platform := range AudiencePlatforms {
+		tmp, err := os.CreateTemp("", "audience-output-*")
+		if err != nil {
+			closeAudienceOutputs(outputs)
+			return nil, err
+		}
+		o := &audienceOutput{platform: platform, encoder: NewPlatformEncoder(platform, mapping), tmp: tmp}
+		o.gz = gzip.NewWriter(tmp)
+		o.csv = csv.NewWriter(o.gz)
+		outputs = append(outputs, o)
+		if err := o.csv.Write(o.encoder.Columns()); err != nil {
+			closeAudienceOutputs(outputs)
+			return nil, err
+		}
+	}
+	return outputs, nil
+}
+
+// write adds an identity to the output, if the platform can match it.
+func (o *audienceOutput) write(id Identity) error {
+	record := o.encoder.Record(id)
+	if record == nil {
+		return nil
+	}
+	o.rows++
+	return o.csv.Write(record)
+}
+
+// store finishes the output and uploads it under key.
+func (o *audienceOutput) store(ctx context.Context, storage StorageBackend, key string) error {
+	o.csv.Flush()
+	if err := o.csv.Error(); err != nil {
+		return err
+	}
+	if err := o.gz.Close(); err != nil {
+		return err
+	}
+	if _, err := o.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := storage.Upload(ctx, o.tmp, key); err != nil {
+		return fmt.Errorf("failed to store %s audience: %w", o.platform, err)
+	}
+	o.key = key
+	return nil
+}
+
+// closeAudienceOutputs removes the outputs' temporary files.
+func closeAudienceOutputs(outputs []*audienceOutput) {
+	for _, o := range outputs {
+		o.tmp.Close()
+		os.Remove(o.tmp.Name())
+	}
+}
+
+// removeAudienceOutputs forgets the prepared copies of an audience file and
+// returns their keys, for the caller to delete once tx has committed.
+func removeAudienceOutputs(ctx context.Context, tx *sql.Tx, fileID int) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, `
+		DELETE FROM audience_file_outputs WHERE audience_file_id = $1 RETURNING storage_key
+	`, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove prepared audiences: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// deleteAudienceOutputs deletes the objects of prepared copies no row
+// refers to any more. Those it cannot delete are left for BlobCollector.
+func deleteAudienceOutputs(ctx context.Context, storage StorageBackend, fileID int, keys []string) {
+	for _, key := range keys {
+		if err := storage.Delete(ctx, key); err != nil {
+			log.Printf("prepared audience %s of audience file %d is left for collection: %v", key, fileID, err)
+		}
+	}
+}
+
+// Outputs returns the platforms a processed audience file has been
+// prepared for, and how many of its rows each can match.
+func (s *AudienceSchemaService) Outputs(ctx context.Context, fileID int) ([]models.AudienceFileOutput, error) {
+	rows, err := database.Conn(ctx, s.db).QueryContext(ctx, `
+		SELECT platform, row_count, created_at
+		FROM audience_file_outputs
+		WHERE audience_file_id = $1
+		ORDER BY platform
+	`, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query prepared audiences: %w", err)
+	}
+	defer rows.Close()
+
+	outputs := []models.AudienceFileOutput{}
+	for rows.Next() {
+		var o models.AudienceFileOutput
+		if err := rows.Scan(&o.Platform, &o.RowCount, &o.CreatedAt); err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, o)
+	}
+	return outputs, rows.Err()
+}
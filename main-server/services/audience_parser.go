@@ -0,0 +1,738 @@
+package services
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"main-server/models"
+)
+
+// Text encodings audience files are read in. Files without a byte order
+// mark that are not valid UTF-8 are taken to be Windows-1252, which covers
+// Latin-1 and is what spreadsheet programs on Windows export.
+const (
+	EncodingUTF8        = "utf-8"
+	EncodingUTF16LE     = "utf-16le"
+	EncodingUTF16BE     = "utf-16be"
+	EncodingWindows1252 = "windows-1252"
+)
+
+const (
+	// How much of the first file in an audience file its format is
+	// detected from
+	schemaSampleSize = 64 << 10
+	// Most rows of that sample whose values are looked at
+	schemaSampleRows = 1000
+	// Share of a column's values that must look like one identifier type
+	// for the column to be detected as holding it
+	valueMatchShare = 0.8
+)
+
+// Delimiters audience files may use, preferred in this order when the
+// sample fits more than one equally well.
+var audienceDelimiters = []rune{',', '\t', ';', '|'}
+
+// Column headers recognised for each identifier type, lowercased with
+// everything but letters and digits removed.
+var headerAliases = map[string]string{
+	"email": models.IdentifierEmail, "emailaddress": models.IdentifierEmail, "mail": models.IdentifierEmail,
+	"emails": models.IdentifierEmail, "useremail": models.IdentifierEmail, "contactemail": models.IdentifierEmail,
+
+	"phone": models.IdentifierPhone, "phonenumber": models.IdentifierPhone, "mobile": models.IdentifierPhone,
+	"mobilephone": models.IdentifierPhone, "mobilenumber": models.IdentifierPhone, "cell": models.IdentifierPhone,
+	"cellphone": models.IdentifierPhone, "telephone": models.IdentifierPhone, "tel": models.IdentifierPhone,
+	"msisdn": models.IdentifierPhone,
+
+	"maid": models.IdentifierMAID, "madid": models.IdentifierMAID, "idfa": models.IdentifierMAID,
+	"gaid": models.IdentifierMAID, "aaid": models.IdentifierMAID, "adid": models.IdentifierMAID,
+	"advertisingid": models.IdentifierMAID, "mobileadid": models.IdentifierMAID, "deviceid": models.IdentifierMAID,
+
+	"firstname": models.IdentifierFirstName, "fname": models.IdentifierFirstName, "first": models.IdentifierFirstName,
+	"givenname": models.IdentifierFirstName, "forename": models.IdentifierFirstName,
+
+	"lastname": models.IdentifierLastName, "lname": models.IdentifierLastName, "last": models.IdentifierLastName,
+	"surname": models.IdentifierLastName, "familyname": models.IdentifierLastName,
+
+	"zip": models.IdentifierZip, "zipcode": models.IdentifierZip, "postalcode": models.IdentifierZip,
+	"postcode": models.IdentifierZip, "postal": models.IdentifierZip,
+
+	"country": models.IdentifierCountry, "countrycode": models.IdentifierCountry, "countryiso": models.IdentifierCountry,
+}
+
+var (
+	emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	maidPattern  = regexp.MustCompile(`^[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}$`)
+	// US ZIP and ZIP+4, Canadian and UK postcodes
+	zipPattern = regexp.MustCompile(`^(\d{5}(-\d{4})?|[A-Za-z]\d[A-Za-z] ?\d[A-Za-z]\d|[A-Za-z]{1,2}\d[A-Za-z\d]? ?\d[A-Za-z]{2})$`)
+)
+
+// ErrInvalidMapping is wrapped by the errors ValidateMapping returns.
+var ErrInvalidMapping = errors.New("invalid column mapping")
+
+// AudienceFormatError is returned for audience files that cannot be
+// parsed. Reason is shown to the user who uploaded the file.
+type AudienceFormatError struct {
+	Reason string
+}
+
+func (e *AudienceFormatError) Error() string {
+	return "cannot parse file: " + e.Reason
+}
+
+func formatError(format string, args ...interface{}) error {
+	return &AudienceFormatError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// DetectAudienceSchema works out how the audience file of fileType read by
+// r is laid out, and which identifier each column holds, from a sample of
+// the first file in it. It then reads all of it, counting its rows and
+// filling in how many have a value in each column, and returns the schema,
+// the mapping it suggests and the row count. Files that cannot be parsed
+// are reported as an *AudienceFormatError.
+func DetectAudienceSchema(r io.ReaderAt, size int64, fileType string) (*models.AudienceSchema, models.ColumnMapping, int, error) {
+	sources, err := audienceSources(r, size, fileType)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	sample, complete, err := sources[0].sample(schemaSampleSize)
+	if err != nil {
+		return nil, nil, 0, readError(sources[0], fileType, err)
+	}
+
+	encoding := detectEncoding(sample, complete)
+	text, err := io.ReadAll(decodeAudienceText(bytes.NewReader(sample), encoding))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	delimiter := detectDelimiter(string(text), complete)
+	records := sampleRecords(string(text), delimiter, complete)
+	if len(records) == 0 {
+		return nil, nil, 0, formatError("the file has no rows")
+	}
+
+	schema := &models.AudienceSchema{
+		Encoding:  encoding,
+		Delimiter: string(delimiter),
+		HasHeader: detectHeader(records[0], records[1:]),
+		Country:   DefaultAudienceCountry,
+	}
+	var header []string
+	rows := records
+	if schema.HasHeader {
+		header, rows = records[0], records[1:]
+	}
+	columns := len(header)
+	for _, row := range rows {
+		columns = max(columns, len(row))
+	}
+	schema.Columns = detectColumns(header, rows, columns)
+
+	count, err := CountAudienceRows(r, size, fileType, schema)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if count == 0 {
+		return nil, nil, 0, formatError("the file has no rows")
+	}
+	return schema, suggestMapping(schema.Columns), count, nil
+}
+
+// CountAudienceRows reads an audience file with schema, returning its row
+// count and setting each column's Filled count.
+func CountAudienceRows(r io.ReaderAt, size int64, fileType string, schema *models.AudienceSchema) (int, error) {
+	ar, err := NewAudienceReader(r, size, fileType, schema)
+	if err != nil {
+		return 0, err
+	}
+	defer ar.Close()
+
+	for i := range schema.Columns {
+		schema.Columns[i].Filled = 0
+	}
+	count := 0
+	for {
+		row, err := ar.Read()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		count++
+		for i, v := range row {
+			if i < len(schema.Columns) && strings.TrimSpace(v) != "" {
+				schema.Columns[i].Filled++
+			}
+		}
+	}
+}
+
+// ValidateMapping checks a mapping fits schema: every identifier type is
+// known and mapped to a column that exists, no column holds two, and the
+// rows will have enough identifiers to be matched.
+func ValidateMapping(schema *models.AudienceSchema, mapping models.ColumnMapping) error {
+	for t := range mapping {
+		if !slices.Contains(models.IdentifierTypes, t) {
+			return fmt.Errorf("%w: %q is not an identifier type", ErrInvalidMapping, t)
+		}
+	}
+
+	mappedTo := make(map[int]string)
+	for _, t := range models.IdentifierTypes {
+		i, ok := mapping[t]
+		if !ok {
+			continue
+		}
+		if i < 0 || i >= len(schema.Columns) {
+			return fmt.Errorf("%w: the file has no column %d", ErrInvalidMapping, i+1)
+		}
+		if other, ok := mappedTo[i]; ok {
+			return fmt.Errorf("%w: column %q is mapped to both %s and %s", ErrInvalidMapping, schema.Columns[i].Name, other, t)
+		}
+		mappedTo[i] = t
+	}
+
+	if !identifiable(func(t string) bool { _, ok := mapping[t]; return ok }) {
+		return fmt.Errorf("%w: map an email, phone or mobile ad ID column, or first name, last name and zip columns", ErrInvalidMapping)
+	}
+	return nil
+}
+
+// identifiable reports whether having the identifier types has reports
+// true for is enough to match someone on: an email, phone or mobile ad ID alone,
+// or a full name and zip together.
+func identifiable(has func(identifierType string) bool) bool {
+	return has(models.IdentifierEmail) || has(models.IdentifierPhone) || has(models.IdentifierMAID) ||
+		has(models.IdentifierFirstName) && has(models.IdentifierLastName) && has(models.IdentifierZip)
+}
+
+// AudienceReader streams the rows of an audience file, whatever it is
+// packed in. Every file in a zip archive is read in turn, and is expected to
+// have the same columns, and its own header row if the schema has one.
+// Rows without any values are skipped.
+type AudienceReader struct {
+	sources   []audienceSource
+	fileType  string
+	encoding  string
+	delimiter rune
+	hasHeader bool
+
+	header  []string
+	next    int
+	current *audienceSource
+	body    io.ReadCloser
+	csv     *csv.Reader
+}
+
+func NewAudienceReader(r io.ReaderAt, size int64, fileType string, schema *models.AudienceSchema) (*AudienceReader, error) {
+	sources, err := audienceSources(r, size, fileType)
+	if err != nil {
+		return nil, err
+	}
+	delimiter, _ := utf8.DecodeRuneInString(schema.Delimiter)
+	return &AudienceReader{
+		sources:   sources,
+		fileType:  fileType,
+		encoding:  schema.Encoding,
+		delimiter: delimiter,
+		hasHeader: schema.HasHeader,
+	}, nil
+}
+
+// Read returns the next row, or io.EOF after the last.
+func (a *AudienceReader) Read() ([]string, error) {
+	for {
+		if a.csv == nil {
+			if a.next >= len(a.sources) {
+				return nil, io.EOF
+			}
+			if err := a.open(&a.sources[a.next]); err != nil {
+				return nil, err
+			}
+			a.next++
+		}
+
+		row, err := a.csv.Read()
+		if err == io.EOF {
+			a.Close()
+			continue
+		}
+		if err != nil {
+			return nil, readError(*a.current, a.fileType, err)
+		}
+		if !blankRow(row) {
+			return row, nil
+		}
+	}
+}
+
+func (a *AudienceReader) open(src *audienceSource) error {
+	body, err := src.open()
+	if err != nil {
+		return readError(*src, a.fileType, err)
+	}
+	a.current, a.body = src, body
+	a.csv = newAudienceCSV(decodeAudienceText(body, a.encoding), a.delimiter)
+	if a.hasHeader {
+		header, err := a.csv.Read()
+		if err != nil && err != io.EOF {
+			return readError(*src, a.fileType, err)
+		}
+		if a.header == nil {
+			a.header = header
+		}
+	}
+	return nil
+}
+
+// Header returns the header row of the first file, once a row has been
+// read, or nil if the schema has no header row.
+func (a *AudienceReader) Header() []string {
+	return a.header
+}
+
+// Close closes the file being read. Read carries on with the next one.
+func (a *AudienceReader) Close() error {
+	if a.body == nil {
+		return nil
+	}
+	err := a.body.Close()
+	a.body, a.csv = nil, nil
+	return err
+}
+
+// audienceSource is one delimited text file in an audience file: the file
+// itself, the file in a gzip archive, or one of the files in a zip archive.
+type audienceSource struct {
+	name string
+	open func() (io.ReadCloser, error)
+}
+
+func audienceSources(r io.ReaderAt, size int64, fileType string) ([]audienceSource, error) {
+	switch fileType {
+	case FileTypeCSV, FileTypeTSV:
+		return []audienceSource{{open: func() (io.ReadCloser, error) {
+			return io.NopCloser(io.NewSectionReader(r, 0, size)), nil
+		}}}, nil
+
+	case FileTypeGzip:
+		return []audienceSource{{open: func() (io.ReadCloser, error) {
+			gz, err := gzip.NewReader(io.NewSectionReader(r, 0, size))
+			if err != nil {
+				return nil, err
+			}
+			return gz, nil
+		}}}, nil
+
+	case FileTypeZip:
+		archive, err := zip.NewReader(r, size)
+		if err != nil {
+			return nil, formatError("the zip file is corrupt")
+		}
+		var sources []audienceSource
+		for _, f := range archive.File {
+			if f.FileInfo().IsDir() || isZipMetadata(f.Name) {
+				continue
+			}
+			sources = append(sources, audienceSource{name: f.Name, open: f.Open})
+		}
+		if len(sources) == 0 {
+			return nil, formatError("the zip file is empty")
+		}
+		return sources, nil
+	}
+	return nil, fmt.Errorf("cannot parse audience files of type %q", fileType)
+}
+
+// sample reads up to n bytes from the start of the source, and reports
+// whether that was all of it.
+func (s audienceSource) sample(n int) ([]byte, bool, error) {
+	body, err := s.open()
+	if err != nil {
+		return nil, false, err
+	}
+	defer body.Close()
+
+	buf := make([]byte, n)
+	got, err := io.ReadFull(body, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return buf[:got], true, nil
+	}
+	return buf, false, err
+}
+
+// readError reports an error reading a source as an *AudienceFormatError if
+// it is the file's fault: rows that cannot be parsed, or a corrupt archive.
+// Anything else, such as a storage error, is returned as it is.
+func readError(src audienceSource, fileType string, err error) error {
+	where := ""
+	if src.name != "" {
+		where = src.name + ", "
+	}
+
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return formatError("%sline %d: %v", where, parseErr.Line, parseErr.Err)
+	}
+
+	var corrupt flate.CorruptInputError
+	archived := fileType == FileTypeGzip || fileType == FileTypeZip
+	if errors.As(err, &corrupt) || errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) ||
+		errors.Is(err, zip.ErrChecksum) || errors.Is(err, zip.ErrFormat) || errors.Is(err, zip.ErrAlgorithm) ||
+		archived && errors.Is(err, io.ErrUnexpectedEOF) {
+		if src.name != "" {
+			return formatError("%s in the zip file is corrupt", src.name)
+		}
+		return formatError("the %s file is corrupt", fileType)
+	}
+	return err
+}
+
+func newAudienceCSV(r io.Reader, delimiter rune) *csv.Reader {
+	cr := csv.NewReader(r)
+	cr.Comma = delimiter
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	return cr
+}
+
+func blankRow(row []string) bool {
+	for _, v := range row {
+		if strings.TrimSpace(v) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// detectEncoding works out the encoding of a sample of text from the start
+// of a file, which is all of it if complete.
+func detectEncoding(sample []byte, complete bool) string {
+	switch {
+	case bytes.HasPrefix(sample, []byte{0xef, 0xbb, 0xbf}):
+		return EncodingUTF8
+	case bytes.HasPrefix(sample, []byte{0xff, 0xfe}):
+		return EncodingUTF16LE
+	case bytes.HasPrefix(sample, []byte{0xfe, 0xff}):
+		return EncodingUTF16BE
+	}
+
+	// The sample may end part way through a character
+	if !complete {
+		for k := 1; k < utf8.UTFMax && k <= len(sample); k++ {
+			if utf8.RuneStart(sample[len(sample)-k]) {
+				if !utf8.FullRune(sample[len(sample)-k:]) {
+					sample = sample[:len(sample)-k]
+				}
+				break
+			}
+		}
+	}
+	if utf8.Valid(sample) {
+		return EncodingUTF8
+	}
+	return EncodingWindows1252
+}
+
+// decodeAudienceText returns the text read by r, in encoding, as UTF-8
+// without a byte order mark.
+func decodeAudienceText(r io.Reader, encoding string) io.Reader {
+	br := bufio.NewReaderSize(r, 64<<10)
+	switch encoding {
+	case EncodingUTF16LE, EncodingUTF16BE:
+		var order binary.ByteOrder = binary.LittleEndian
+		if encoding == EncodingUTF16BE {
+			order = binary.BigEndian
+		}
+		if bom, _ := br.Peek(2); len(bom) == 2 && order.Uint16(bom) == 0xfeff {
+			br.Discard(2)
+		}
+		return &textDecoder{next: utf16Runes(br, order)}
+
+	case EncodingWindows1252:
+		return &textDecoder{next: func() (rune, error) {
+			b, err := br.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			return windows1252Rune(b), nil
+		}}
+	}
+
+	if bom, _ := br.Peek(3); bytes.Equal(bom, []byte{0xef, 0xbb, 0xbf}) {
+		br.Discard(3)
+	}
+	return br
+}
+
+// textDecoder is a reader of the UTF-8 encoding of the runes next returns.
+type textDecoder struct {
+	next func() (rune, error)
+	buf  []byte
+	err  error
+}
+
+func (d *textDecoder) Read(p []byte) (int, error) {
+	for len(d.buf) < len(p) && d.err == nil {
+		r, err := d.next()
+		if err != nil {
+			d.err = err
+			break
+		}
+		d.buf = utf8.AppendRune(d.buf, r)
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[:copy(d.buf, d.buf[n:])]
+	if n == 0 && len(p) > 0 {
+		return 0, d.err
+	}
+	return n, nil
+}
+
+// utf16Runes returns a function decoding the next rune of UTF-16 text read
+// from br. Unpaired surrogates decode as U+FFFD, and a stray last byte is
+// dropped.
+func utf16Runes(br *bufio.Reader, order binary.ByteOrder) func() (rune, error) {
+	var held rune
+	holding := false
+	unit := func() (rune, error) {
+		if holding {
+			holding = false
+			return held, nil
+		}
+		var b [2]byte
+		if _, err := io.ReadFull(br, b[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		return rune(order.Uint16(b[:])), nil
+	}
+
+	return func() (rune, error) {
+		u, err := unit()
+		if err != nil || !utf16.IsSurrogate(u) {
+			return u, err
+		}
+		low, err := unit()
+		if err != nil {
+			return utf8.RuneError, nil
+		}
+		if r := utf16.DecodeRune(u, low); r != utf8.RuneError {
+			return r, nil
+		}
+		held, holding = low, true
+		return utf8.RuneError, nil
+	}
+}
+
+// Windows-1252 differs from Latin-1 only in 0x80 to 0x9f. The five bytes
+// it leaves undefined decode to the control characters of the same value.
+var windows1252High = [32]rune{
+	0x20ac, 0x81, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021,
+	0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0x8d, 0x017d, 0x8f,
+	0x90, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+	0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0x9d, 0x017e, 0x0178,
+}
+
+func windows1252Rune(b byte) rune {
+	if b >= 0x80 && b < 0xa0 {
+		return windows1252High[b-0x80]
+	}
+	return rune(b)
+}
+
+// detectDelimiter picks the delimiter that splits the rows of a sample of
+// text into the same number of fields most consistently, or a comma if none
+// splits them at all.
+func detectDelimiter(text string, complete bool) rune {
+	best, bestShare, bestFields := audienceDelimiters[0], 0.0, 0
+	for _, d := range audienceDelimiters {
+		records := sampleRecords(text, d, complete)
+		counts := make(map[int]int)
+		for _, rec := range records {
+			counts[len(rec)]++
+		}
+		fields, rows := 0, 0
+		for f, n := range counts {
+			if n > rows || n == rows && f > fields {
+				fields, rows = f, n
+			}
+		}
+		if fields < 2 {
+			continue
+		}
+
+		share := float64(rows) / float64(len(records))
+		if share > bestShare || share == bestShare && fields > bestFields {
+			best, bestShare, bestFields = d, share, fields
+		}
+	}
+	return best
+}
+
+// sampleRecords parses up to schemaSampleRows+1 non-blank records of a
+// sample of text. Unless the sample is complete, its last record is left
+// out, as the sample may have cut it short.
+func sampleRecords(text string, delimiter rune, complete bool) [][]string {
+	cr := newAudienceCSV(strings.NewReader(text), delimiter)
+	var records [][]string
+	for len(records) <= schemaSampleRows {
+		rec, err := cr.Read()
+		if err != nil {
+			break
+		}
+		if !blankRow(rec) {
+			records = append(records, rec)
+		}
+	}
+	if !complete && len(records) > 1 {
+		records = records[:len(records)-1]
+	}
+	return records
+}
+
+// detectHeader reports whether first is a header row, given the rows that
+// follow it: it is if it names a known identifier, or if a column's values
+// look like one identifier type and its first cell does not.
+func detectHeader(first []string, rows [][]string) bool {
+	for _, cell := range first {
+		if headerType(cell) != "" {
+			return true
+		}
+	}
+	for i, cell := range first {
+		cell = strings.TrimSpace(cell)
+		if t := columnValueType(rows, i); t != "" && cell != "" && valueType(cell) != t {
+			return true
+		}
+	}
+	return false
+}
+
+// detectColumns describes n columns from their header, if there is one,
+// and a sample of their rows. A recognised header decides a column's type;
+// otherwise its values may.
+func detectColumns(header []string, rows [][]string, n int) []models.AudienceColumn {
+	columns := make([]models.AudienceColumn, n)
+	for i := range columns {
+		c := &columns[i]
+		c.Index = i
+		c.Name = fmt.Sprintf("Column %d", i+1)
+		if i < len(header) {
+			if name := strings.TrimSpace(header[i]); name != "" {
+				c.Name = name
+			}
+			if t := headerType(header[i]); t != "" {
+				c.Detected, c.DetectedBy = t, "header"
+				continue
+			}
+		}
+		if t := columnValueType(rows, i); t != "" {
+			c.Detected, c.DetectedBy = t, "values"
+		}
+	}
+	return columns
+}
+
+// suggestMapping maps each identifier type to the first column detected as
+// holding it by its header or, failing that, by its values.
+func suggestMapping(columns []models.AudienceColumn) models.ColumnMapping {
+	mapping := make(models.ColumnMapping)
+	for _, by := range []string{"header", "values"} {
+		for _, c := range columns {
+			if _, ok := mapping[c.Detected]; c.DetectedBy == by && !ok {
+				mapping[c.Detected] = c.Index
+			}
+		}
+	}
+	return mapping
+}
+
+// headerType returns the identifier type a column header names, or "".
+// Numbered headers, such as email2, count too.
+func headerType(name string) string {
+	key := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+	if t, ok := headerAliases[key]; ok {
+		return t
+	}
+	return headerAliases[strings.TrimRight(key, "0123456789")]
+}
+
+// columnValueType returns the identifier type most of column i's values in
+// rows look like, or "". Names and countries cannot be told from their
+// values, so only emails, mobile ad IDs, zips and phones are.
+func columnValueType(rows [][]string, i int) string {
+	counts := make(map[string]int)
+	values := 0
+	for _, row := range rows {
+		if i >= len(row) {
+			continue
+		}
+		if v := strings.TrimSpace(row[i]); v != "" {
+			values++
+			counts[valueType(v)]++
+		}
+	}
+	if values == 0 {
+		return ""
+	}
+	for _, t := range []string{models.IdentifierEmail, models.IdentifierMAID, models.IdentifierZip, models.IdentifierPhone} {
+		if float64(counts[t]) >= valueMatchShare*float64(values) {
+			return t
+		}
+	}
+	return ""
+}
+
+// valueType returns the identifier type a single value looks like, or "".
+func valueType(v string) string {
+	switch {
+	case emailPattern.MatchString(v):
+		return models.IdentifierEmail
+	case maidPattern.MatchString(v):
+		return models.IdentifierMAID
+	case zipPattern.MatchString(v):
+		return models.IdentifierZip
+	case looksLikePhone(v):
+		return models.IdentifierPhone
+	}
+	return ""
+}
+
+// looksLikePhone reports whether v is 7 to 15 digits, optionally led by a
+// plus and broken up by spaces, brackets, dashes or dots.
+func looksLikePhone(v string) bool {
+	digits := 0
+	for i, c := range v {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case c == '+' && i == 0:
+		case strings.ContainsRune(" ()-.", c):
+		default:
+			return false
+		}
+	}
+	return digits >= 7 && digits <= 15
+}
@@ -0,0 +1,464 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"main-server/database"
+	"main-server/models"
+)
+
+const (
+	// A parse step that has not finished this long after it started is
+	// assumed to have died with its worker, and is run again
+	parseTimeout = time.Hour
+	// Parse steps waiting this long were never queued, or their job was
+	// lost, and are picked up by the sweep
+	unqueuedParseDelay = 5 * time.Minute
+	// Rows of a file shown while its mapping is confirmed
+	previewRows = 5
+)
+
+var ErrMappingNotReady = errors.New("this file's columns have not been detected yet")
+
+// AudienceSchemaService parses ready audience files in two steps, each run
+// on the job queue. Detection works out the file's encoding, delimiter,
+// header row and columns, and suggests which identifier each column holds;
+// the file then waits for a user to confirm or fix that mapping. Processing
+// reads the file with the confirmed mapping, normalizes each row's
+// identifiers, counts the rows that can be matched, and stores the file
+// prepared for each ad platform, hashed, so raw identifiers never have to
+// leave the server; then it sets processed_at. A mapping can be fixed
+// again after processing, which processes the file again.
+//
+// Files that cannot be parsed fail with a reason the uploader can see.
+// Steps that could not complete, for example because storage was down, are
+// picked up again by the sweep. Jobs run on the pool; user actions on the
+// request's tenant-bound connection.
+type AudienceSchemaService struct {
+	db      *sql.DB
+	storage StorageBackend
+	audit   *AuditService
+	jobs    *JobQueue
+}
+
+func NewAudienceSchemaService(db *sql.DB, storage StorageBackend, audit *AuditService, jobs *JobQueue) *AudienceSchemaService {
+	return &AudienceSchemaService{db: db, storage: storage, audit: audit, jobs: jobs}
+}
+
+// Submit queues the pending parse step of a file. If the queue is full or
+// shutting down the file is left for the sweep.
+func (s *AudienceSchemaService) Submit(fileID int) {
+	err := s.jobs.Enqueue(fmt.Sprintf("parse-%d", fileID), func(ctx context.Context) error {
+		return s.Parse(ctx, fileID)
+	})
+	if err != nil {
+		log.Printf("audience file %d will be parsed by the next sweep: %v", fileID, err)
+	}
+}
+
+// Parse runs the pending parse step of a file, detection or processing. It
+// does nothing if the file has no step pending, is in the trash, or another
+// worker is running it. A step whose mapping was changed while it ran
+// finishes without effect, as the change queued another.
+func (s *AudienceSchemaService) Parse(ctx context.Context, fileID int) error {
+	var f models.AudienceFile
+	var workspaceID string
+	var queuedAt time.Time
+	err := s.db.QueryRowContext(ctx, `
+		UPDATE audience_files
+		SET parse_started_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = $2 AND deleted_at IS NULL AND parse_status IN ($3, $4)
+		  AND (parse_started_at IS NULL
+		       OR parse_started_at < CURRENT_TIMESTAMP - make_interval(secs => $5))
+		RETURNING id, company_id::text,
+		          (SELECT workspace_id::text FROM companies WHERE id = audience_files.company_id),
+		          storage_path, COALESCE(detected_type, ''), parse_status,
+		          detected_schema, column_mapping, parse_queued_at
+	`, fileID, models.AudienceFileReady, models.AudienceParseDetecting, models.AudienceParseProcessing,
+		parseTimeout.Seconds()).Scan(
+		&f.ID, &f.CompanyID, &workspaceID, &f.StoragePath, &f.DetectedType, &f.ParseStatus,
+		&f.Schema, &f.Mapping, &queuedAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to claim audience file %d for parsing: %w", fileID, err)
+	}
+
+	if f.ParseStatus == models.AudienceParseDetecting {
+		err = s.detect(ctx, &f, queuedAt)
+	} else {
+		err = s.process(ctx, &f, workspaceID, queuedAt)
+	}
+	var formatErr *AudienceFormatError
+	if errors.As(err, &formatErr) {
+		return s.fail(ctx, &f, queuedAt, formatErr.Reason)
+	}
+	if err != nil {
+		s.release(f.ID, queuedAt)
+		return fmt.Errorf("failed to parse audience file %d: %w", f.ID, err)
+	}
+	return nil
+}
+
+func (s *AudienceSchemaService) detect(ctx context.Context, f *models.AudienceFile, queuedAt time.Time) error {
+	r, size, err := s.open(ctx, f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	schema, mapping, rows, err := DetectAudienceSchema(r, size, f.DetectedType)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+		UPDATE audience_files
+		SET parse_status = $3, detected_schema = $4, column_mapping = $5, row_count = $6,
+		    parse_error = NULL, parse_started_at = NULL
+		WHERE id = $1 AND parse_queued_at = $2
+	`, f.ID, queuedAt, models.AudienceParseNeedsMapping, schema, mapping, rows)
+	if err != nil {
+		return fmt.Errorf("failed to save detected columns: %w", err)
+	}
+	return nil
+}
+
+func (s *AudienceSchemaService) process(ctx context.Context, f *models.AudienceFile, workspaceID string, queuedAt time.Time) error {
+	if f.Schema == nil || len(f.Mapping) == 0 {
+		return formatError("the file's columns have not been mapped")
+	}
+	r, size, err := s.open(ctx, f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	ar, err := NewAudienceReader(r, size, f.DetectedType, f.Schema)
+	if err != nil {
+		return err
+	}
+	defer ar.Close()
+
+	outputs, err := newAudienceOutputs(f.Mapping)
+	if err != nil {
+		return err
+	}
+	defer closeAudienceOutputs(outputs)
+	country := f.Schema.Country
+	if country == "" {
+		country = DefaultAudienceCountry
+	}
+
+	// The header row may have been switched on or off since detection, so
+	// the counts and column names are taken afresh
+	for i := range f.Schema.Columns {
+		f.Schema.Columns[i].Filled = 0
+	}
+	rows, identified := 0, 0
+	for {
+		row, err := ar.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		rows++
+		for i, v := range row {
+			if i < len(f.Schema.Columns) && strings.TrimSpace(v) != "" {
+				f.Schema.Columns[i].Filled++
+			}
+		}
+		id := NormalizeRow(row, f.Mapping, country)
+		if !id.Matchable() {
+			continue
+		}
+		identified++
+		for _, o := range outputs {
+			if err := o.write(id); err != nil {
+				return fmt.Errorf("failed to write %s audience: %w", o.platform, err)
+			}
+		}
+	}
+	for i, name := range ar.Header() {
+		if name = strings.TrimSpace(name); i < len(f.Schema.Columns) && name != "" {
+			f.Schema.Columns[i].Name = name
+		}
+	}
+	if identified == 0 {
+		return formatError("no rows have valid identifiers in the columns mapped")
+	}
+
+	// Outputs are stored before the rows referring to them, and deleted
+	// again if those cannot be saved
+	var stored, replaced []string
+	for _, o := range outputs {
+		if o.rows == 0 {
+			continue
+		}
+		if err := o.store(ctx, s.storage, audienceOutputKey(workspaceID, f.CompanyID, f.ID, queuedAt, o.platform)); err != nil {
+			deleteAudienceOutputs(ctx, s.storage, f.ID, stored)
+			return err
+		}
+		stored = append(stored, o.key)
+	}
+
+	current := true
+	err = database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `
+			UPDATE audience_files
+			SET parse_status = $3, detected_schema = $4, row_count = $5, identified_rows = $6,
+			    processed_at = CURRENT_TIMESTAMP, parse_error = NULL, parse_started_at = NULL
+			WHERE id = $1 AND parse_queued_at = $2
+		`, f.ID, queuedAt, models.AudienceParseProcessed, f.Schema, rows, identified)
+		if err != nil {
+			return fmt.Errorf("failed to save processed audience file: %w", err)
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			current = false
+			return err
+		}
+
+		if replaced, err = removeAudienceOutputs(ctx, tx, f.ID); err != nil {
+			return err
+		}
+		for _, o := range outputs {
+			if o.key == "" {
+				continue
+			}
+			_, err := tx.ExecContext(ctx, `
+				INSERT INTO audience_file_outputs (audience_file_id, company_id, platform, storage_key, row_count)
+				VALUES ($1, $2, $3, $4, $5)
+			`, f.ID, f.CompanyID, o.platform, o.key, o.rows)
+			if err != nil {
+				return fmt.Errorf("failed to save prepared %s audience: %w", o.platform, err)
+			}
+		}
+		return nil
+	})
+	if err != nil || !current {
+		deleteAudienceOutputs(ctx, s.storage, f.ID, stored)
+		return err
+	}
+	deleteAudienceOutputs(ctx, s.storage, f.ID, replaced)
+	return nil
+}
+
+// open returns a reader of f's contents and their size.
+func (s *AudienceSchemaService) open(ctx context.Context, f *models.AudienceFile) (*ObjectReader, int64, error) {
+	info, err := s.storage.Stat(ctx, f.StoragePath)
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil, 0, formatError("the file is missing from storage")
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return NewObjectReader(ctx, s.storage, f.StoragePath, info.Size), info.Size, nil
+}
+
+// fail records why f could not be parsed.
+func (s *AudienceSchemaService) fail(ctx context.Context, f *models.AudienceFile, queuedAt time.Time, reason string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE audience_files
+		SET parse_status = $3, parse_error = $4, parse_started_at = NULL
+		WHERE id = $1 AND parse_queued_at = $2
+	`, f.ID, queuedAt, models.AudienceParseFailed, reason)
+	if err != nil {
+		s.release(f.ID, queuedAt)
+		return fmt.Errorf("failed to record parse failure of audience file %d: %w", f.ID, err)
+	}
+	log.Printf("could not parse audience file %d: %s", f.ID, reason)
+	return nil
+}
+
+// release lets the sweep run a file's parse step again. It runs on its own
+// context, as the job's may be what failed.
+func (s *AudienceSchemaService) release(fileID int, queuedAt time.Time) {
+	_, err := s.db.ExecContext(context.Background(), `
+		UPDATE audience_files SET parse_started_at = NULL WHERE id = $1 AND parse_queued_at = $2
+	`, fileID, queuedAt)
+	if err != nil {
+		log.Printf("failed to release audience file %d: %v", fileID, err)
+	}
+}
+
+// Preview returns the first rows of f, parsed with its detected schema.
+func (s *AudienceSchemaService) Preview(ctx context.Context, f *models.AudienceFile) ([][]string, error) {
+	if f.Schema == nil {
+		return nil, ErrMappingNotReady
+	}
+	r, size, err := s.open(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	ar, err := NewAudienceReader(r, size, f.DetectedType, f.Schema)
+	if err != nil {
+		return nil, err
+	}
+	defer ar.Close()
+
+	rows := [][]string{}
+	for len(rows) < previewRows {
+		row, err := ar.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// ConfirmMapping sets which identifier each column of f holds, whether its
+// first row is a header, and, unless country is empty, the country its rows
+// are in when they have none of their own, and queues f to be processed
+// with them. The file's prepared copies for the previous mapping are
+// removed. Until its columns have been detected it fails with
+// ErrMappingNotReady, and mappings that do not fit the file with an error
+// wrapping ErrInvalidMapping.
+func (s *AudienceSchemaService) ConfirmMapping(ctx context.Context, f *models.AudienceFile, mapping models.ColumnMapping, hasHeader bool, country string) error {
+	var replaced []string
+	err := database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+		var status string
+		var schema *models.AudienceSchema
+		var before models.ColumnMapping
+		err := tx.QueryRowContext(ctx, `
+			SELECT COALESCE(parse_status, ''), detected_schema, column_mapping
+			FROM audience_files
+			WHERE id = $1 AND deleted_at IS NULL
+			FOR UPDATE
+		`, f.ID).Scan(&status, &schema, &before)
+		if err == sql.ErrNoRows {
+			return ErrAudienceFileNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load audience file: %w", err)
+		}
+		// Files whose processing failed can be mapped again; those that
+		// failed detection have nothing to map
+		if status == models.AudienceParseDetecting || schema == nil {
+			return ErrMappingNotReady
+		}
+
+		schema.HasHeader = hasHeader
+		if country != "" {
+			code, ok := NormalizeCountry(country)
+			if !ok {
+				return fmt.Errorf("%w: %q is not a country", ErrInvalidMapping, country)
+			}
+			schema.Country = code
+		}
+		if err := ValidateMapping(schema, mapping); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			UPDATE audience_files
+			SET parse_status = $2, detected_schema = $3, column_mapping = $4,
+			    parse_queued_at = CURRENT_TIMESTAMP, parse_started_at = NULL,
+			    identified_rows = NULL, processed_at = NULL
+			WHERE id = $1
+		`, f.ID, models.AudienceParseProcessing, schema, mapping)
+		if err != nil {
+			return fmt.Errorf("failed to save column mapping: %w", err)
+		}
+		if replaced, err = removeAudienceOutputs(ctx, tx, f.ID); err != nil {
+			return err
+		}
+
+		return s.audit.Record(ctx, tx, AuditEvent{
+			Action:     models.AuditAudienceFileMapped,
+			EntityType: "audience_file",
+			EntityID:   strconv.Itoa(f.ID),
+			CompanyID:  f.CompanyID,
+			Before:     map[string]interface{}{"column_mapping": before},
+			After:      map[string]interface{}{"column_mapping": mapping, "has_header": hasHeader, "country": schema.Country},
+			Metadata:   map[string]interface{}{"filename": f.OriginalFilename},
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	deleteAudienceOutputs(ctx, s.storage, f.ID, replaced)
+	s.Submit(f.ID)
+	return nil
+}
+
+// RunEvery runs parse steps left pending every uploadSweepInterval until
+// ctx is cancelled.
+func (s *AudienceSchemaService) RunEvery(ctx context.Context) {
+	ticker := time.NewTicker(uploadSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := s.Sweep(ctx); err != nil {
+				log.Printf("parse sweep failed: %v", err)
+			} else if n > 0 {
+				log.Printf("parsed %d audience files left pending", n)
+			}
+		}
+	}
+}
+
+// Sweep runs parse steps that were never queued, could not complete, or
+// whose worker died, one at a time. It returns how many it ran.
+func (s *AudienceSchemaService) Sweep(ctx context.Context) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id
+		FROM audience_files
+		WHERE parse_status IN ($1, $2) AND status = $3 AND deleted_at IS NULL
+		  AND ((parse_started_at IS NULL AND parse_queued_at < CURRENT_TIMESTAMP - make_interval(secs => $4))
+		       OR parse_started_at < CURRENT_TIMESTAMP - make_interval(secs => $5))
+		ORDER BY parse_queued_at
+		LIMIT 1000
+	`, models.AudienceParseDetecting, models.AudienceParseProcessing, models.AudienceFileReady,
+		unqueuedParseDelay.Seconds(), parseTimeout.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to find audience files to parse: %w", err)
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return n, ctx.Err()
+		}
+		if err := s.Parse(ctx, id); err != nil {
+			log.Printf("audience file %d is still waiting to be parsed: %v", id, err)
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,157 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"maps"
+	"strings"
+	"testing"
+
+	"main-server/models"
+)
+
+const schemaTestCSV = "email,first_name,last_name,zip\nada@example.com,Ada,Lovelace,10001\ngrace@example.com,Grace,Hopper,20500\n"
+
+// zippedInOrder archives each of files under its name, in order.
+func zippedInOrder(names []string, files ...[]byte) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for i, name := range names {
+		f, _ := w.Create(name)
+		f.Write(files[i])
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestDetectAudienceSchema(t *testing.T) {
+	csv := schemaTestCSV
+	large := gzipped("", bytes.Repeat([]byte(csv), 1000))
+
+	tests := []struct {
+		name     string
+		data     []byte
+		fileType string
+
+		// What should be detected, or fails if the file should not parse
+		encoding  string
+		delimiter string
+		hasHeader bool
+		mapping   models.ColumnMapping
+		rows      int
+		fails     bool
+	}{
+		{
+			name: "csv with a header", data: []byte(csv), fileType: FileTypeCSV,
+			encoding: EncodingUTF8, delimiter: ",", hasHeader: true, rows: 2,
+			mapping: models.ColumnMapping{"email": 0, "first_name": 1, "last_name": 2, "zip": 3},
+		},
+		{
+			name: "UTF-8 BOM and CRLF", data: []byte("\xef\xbb\xbf" + strings.ReplaceAll(csv, "\n", "\r\n")), fileType: FileTypeCSV,
+			encoding: EncodingUTF8, delimiter: ",", hasHeader: true, rows: 2,
+			mapping: models.ColumnMapping{"email": 0, "first_name": 1, "last_name": 2, "zip": 3},
+		},
+		{
+			name: "Windows-1252 semicolons", fileType: FileTypeCSV,
+			data:     []byte("E-Mail;Vorname;Nachname;PLZ\nm\xfcller@example.de;J\xfcrgen;M\xfcller;10115\nanna@example.de;Anna;Schmidt;80331\n"),
+			encoding: EncodingWindows1252, delimiter: ";", hasHeader: true, rows: 2,
+			mapping: models.ColumnMapping{"email": 0, "zip": 3},
+		},
+		{
+			name: "UTF-16 tsv", data: utf16LE(strings.ReplaceAll(csv, ",", "\t")), fileType: FileTypeTSV,
+			encoding: EncodingUTF16LE, delimiter: "\t", hasHeader: true, rows: 2,
+			mapping: models.ColumnMapping{"email": 0, "first_name": 1, "last_name": 2, "zip": 3},
+		},
+		{
+			name: "no header row", fileType: FileTypeCSV,
+			data:     []byte("ada@example.com,+1 (212) 555-0100\ngrace@example.com,+1 (202) 555-0199\n"),
+			encoding: EncodingUTF8, delimiter: ",", rows: 2,
+			mapping: models.ColumnMapping{"email": 0, "phone": 1},
+		},
+		{
+			name: "header told from values", fileType: FileTypeCSV,
+			data:     []byte("contact,number\nada@example.com,2125550100\ngrace@example.com,2025550199\n"),
+			encoding: EncodingUTF8, delimiter: ",", hasHeader: true, rows: 2,
+			mapping: models.ColumnMapping{"email": 0, "phone": 1},
+		},
+		{
+			name: "pipes and quoted fields", fileType: FileTypeCSV,
+			data: []byte("Email Address|Mobile Ad ID|Notes\n" +
+				"ada@example.com|6D92078A-8246-4BA4-AE5B-76104861E7DC|\"likes | pipes\"\n" +
+				"grace@example.com|3f1a3c2e-9d7b-4e58-a1b2-0c9d8e7f6a5b|\"two\nlines\"\n"),
+			encoding: EncodingUTF8, delimiter: "|", hasHeader: true, rows: 2,
+			mapping: models.ColumnMapping{"email": 0, "maid": 1},
+		},
+		{
+			name: "blank rows skipped", fileType: FileTypeCSV,
+			data:     []byte("email\n\nada@example.com\n,\ngrace@example.com\n"),
+			encoding: EncodingUTF8, delimiter: ",", hasHeader: true, rows: 2,
+			mapping: models.ColumnMapping{"email": 0},
+		},
+		{
+			name: "gzipped csv", data: gzipped("", []byte(csv)), fileType: FileTypeGzip,
+			encoding: EncodingUTF8, delimiter: ",", hasHeader: true, rows: 2,
+			mapping: models.ColumnMapping{"email": 0, "first_name": 1, "last_name": 2, "zip": 3},
+		},
+		{
+			name: "zip of two csvs", fileType: FileTypeZip,
+			data:     zippedInOrder([]string{"a.csv", "__MACOSX/._a.csv", "b.csv"}, []byte(csv), []byte("junk"), []byte(csv)),
+			encoding: EncodingUTF8, delimiter: ",", hasHeader: true, rows: 4,
+			mapping: models.ColumnMapping{"email": 0, "first_name": 1, "last_name": 2, "zip": 3},
+		},
+		{name: "header only", data: []byte("email,phone\n"), fileType: FileTypeCSV, fails: true},
+		{name: "truncated gzip", data: large[:len(large)/2], fileType: FileTypeGzip, fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema, mapping, rows, err := DetectAudienceSchema(bytes.NewReader(tt.data), int64(len(tt.data)), tt.fileType)
+			var formatErr *AudienceFormatError
+			switch {
+			case tt.fails && errors.As(err, &formatErr):
+			case tt.fails && err == nil:
+				t.Errorf("parsed, want a format error")
+			case err != nil:
+				t.Fatal(err)
+			case schema.Encoding != tt.encoding:
+				t.Errorf("encoding %s, want %s", schema.Encoding, tt.encoding)
+			case schema.Delimiter != tt.delimiter:
+				t.Errorf("delimiter %q, want %q", schema.Delimiter, tt.delimiter)
+			case schema.HasHeader != tt.hasHeader:
+				t.Errorf("header row %t, want %t", schema.HasHeader, tt.hasHeader)
+			case rows != tt.rows:
+				t.Errorf("%d rows, want %d", rows, tt.rows)
+			case !maps.Equal(mapping, tt.mapping):
+				t.Errorf("mapping %v, want %v", mapping, tt.mapping)
+			}
+		})
+	}
+}
+
+func TestValidateMapping(t *testing.T) {
+	schema, _, _, err := DetectAudienceSchema(strings.NewReader(schemaTestCSV), int64(len(schemaTestCSV)), FileTypeCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		mapping models.ColumnMapping
+		valid   bool
+	}{
+		{"email alone", models.ColumnMapping{"email": 0}, true},
+		{"name and zip", models.ColumnMapping{"first_name": 1, "last_name": 2, "zip": 3}, true},
+		{"names without zip", models.ColumnMapping{"first_name": 1, "last_name": 2}, false},
+		{"column mapped twice", models.ColumnMapping{"email": 0, "phone": 0}, false},
+		{"column out of range", models.ColumnMapping{"email": 4}, false},
+		{"unknown type", models.ColumnMapping{"email": 0, "ssn": 1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateMapping(schema, tt.mapping)
+			if tt.valid && err != nil || !tt.valid && !errors.Is(err, ErrInvalidMapping) {
+				t.Errorf("got %v", err)
+			}
+		})
+	}
+}
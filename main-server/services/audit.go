@@ -0,0 +1,215 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"main-server/models"
+	"main-server/tenant"
+)
+
+// Execer is satisfied by *sql.Tx, *sql.Conn and *sql.DB. Pass the
+// transaction that makes the change so the event commits or rolls back with
+// it.
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// AuditEvent describes one change to a domain entity. Before and After are
+// the entity's state on either side of the change (nil for creations and
+// deletions); any value that marshals to a JSON object works.
+type AuditEvent struct {
+	Action     string
+	EntityType string
+	EntityID   string
+
+	// Default to the tenant's company and workspace. Set them when acting on
+	// an entity that belongs elsewhere, e.g. a workspace admin changing a user
+	// in one of their companies.
+	CompanyID   string
+	WorkspaceID string
+
+	Before   interface{}
+	After    interface{}
+	Metadata map[string]interface{}
+}
+
+// Field names whose values are never written to the audit log. Matching is
+// by substring on the lower-cased name.
+var secretFields = []string{"password", "secret", "token", "api_key", "apikey", "private_key", "access_key", "credential"}
+
+// AuditService writes domain events with before/after diffs to audit_logs.
+// Unlike the request-level Audit middleware, events are written
+// synchronously in the caller's transaction.
+type AuditService struct {
+	db *sql.DB
+}
+
+func NewAuditService(db *sql.DB) *AuditService {
+	return &AuditService{db: db}
+}
+
+// Record writes event using tx. The actor, impersonation, IP address and
+// user agent come from the tenant in ctx.
+func (s *AuditService) Record(ctx context.Context, tx Execer, event AuditEvent) error {
+	changes, err := BuildAuditChanges(event.Before, event.After)
+	if err != nil {
+		return fmt.Errorf("failed to diff %s: %w", event.Action, err)
+	}
+	changes.Metadata = redact(event.Metadata)
+
+	raw, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+
+	t := tenant.From(ctx)
+	companyID, workspaceID := event.CompanyID, event.WorkspaceID
+	if companyID == "" && t != nil {
+		companyID = t.CompanyID
+	}
+	if workspaceID == "" && t != nil {
+		workspaceID = t.WorkspaceID
+	}
+
+	var impersonatorID *string
+	var impersonationSessionID *int
+	var ip, userAgent string
+	if t != nil {
+		ip, userAgent = t.IPAddress, t.UserAgent
+		if imp := t.Impersonation; imp != nil {
+			impersonatorID = &imp.ImpersonatorID
+			impersonationSessionID = &imp.ID
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO audit_logs (user_id, action, entity_type, entity_id, company_id, workspace_id,
+		                        changes, ip_address, user_agent, impersonator_id, impersonation_session_id)
+		VALUES (NULLIF($1, '')::integer, $2, NULLIF($3, ''), NULLIF($4, '')::integer, NULLIF($5, '')::integer,
+		        NULLIF($6, '')::integer, $7, NULLIF($8, '')::inet, $9, $10::integer, $11)
+	`, t.UserID(), event.Action, event.EntityType, event.EntityID, companyID, workspaceID,
+		raw, ip, userAgent, impersonatorID, impersonationSessionID)
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+// BuildAuditChanges flattens before and after into JSON field maps, lists the
+// fields that differ and redacts secrets. Secrets are compared before
+// redaction, so a changed password still shows up in the diff.
+func BuildAuditChanges(before, after interface{}) (*models.AuditChanges, error) {
+	oldValues, err := toFields(before)
+	if err != nil {
+		return nil, err
+	}
+	newValues, err := toFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]bool)
+	for k := range oldValues {
+		keys[k] = true
+	}
+	for k := range newValues {
+		keys[k] = true
+	}
+
+	var diff []models.FieldChange
+	for k := range keys {
+		oldValue, newValue := oldValues[k], newValues[k]
+		if reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+		if isSecretField(k) {
+			oldValue, newValue = redactedUnlessNil(oldValue), redactedUnlessNil(newValue)
+		} else {
+			oldValue, newValue = redactValue(oldValue), redactValue(newValue)
+		}
+		diff = append(diff, models.FieldChange{Field: k, Old: oldValue, New: newValue})
+	}
+	sort.Slice(diff, func(i, j int) bool { return diff[i].Field < diff[j].Field })
+
+	return &models.AuditChanges{
+		OldValues: redact(oldValues),
+		NewValues: redact(newValues),
+		Diff:      diff,
+	}, nil
+}
+
+// toFields turns a struct or map into its JSON object form.
+func toFields(v interface{}) (map[string]interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return nil, nil
+	}
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, fmt.Errorf("audit values must be a JSON object: %w", err)
+	}
+	return fields, nil
+}
+
+func isSecretField(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range secretFields {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact returns a copy of fields with secret values replaced, including in
+// nested objects and arrays.
+func redact(fields map[string]interface{}) map[string]interface{} {
+	if fields == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		if isSecretField(k) {
+			out[k] = redactedUnlessNil(v)
+		} else {
+			out[k] = redactValue(v)
+		}
+	}
+	return out
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return redact(v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = redactValue(item)
+		}
+		return out
+	}
+	return v
+}
+
+// redactedUnlessNil keeps an unset secret visible as null, so the log shows
+// when one was added or removed.
+func redactedUnlessNil(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	return models.RedactedValue
+}
@@ -0,0 +1,296 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+)
+
+// AuditChainService signs checkpoints of the audit_logs hash chains and
+// verifies them. The chains themselves are maintained by the database; see
+// 009_audit_hash_chain.sql.
+type AuditChainService struct {
+	db  *sql.DB
+	key ed25519.PrivateKey
+}
+
+// NewAuditChainService returns a service that signs with key, which may be
+// nil for verification only.
+func NewAuditChainService(db *sql.DB, key ed25519.PrivateKey) *AuditChainService {
+	return &AuditChainService{
+		db:  db,
+		key: key,
+	}
+}
+
+// ParseAuditSigningKey decodes a base64 Ed25519 seed, as found in
+// AUDIT_SIGNING_KEY.
+func ParseAuditSigningKey(encoded string) (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("audit signing key is not base64: %w", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("audit signing key must be a %d byte Ed25519 seed", ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// AuditKeyID identifies a public key in audit_checkpoints so keys can be
+// rotated.
+func AuditKeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// checkpointMessage is what a checkpoint signature covers.
+func checkpointMessage(chainID int, seq int64, rowHash []byte) []byte {
+	return []byte(fmt.Sprintf("audit-checkpoint|%d|%d|%x", chainID, seq, rowHash))
+}
+
+// Checkpoint signs the current head of every chain that has grown since its
+// last checkpoint.
+func (s *AuditChainService) Checkpoint(ctx context.Context) (int, error) {
+	if s.key == nil {
+		return 0, fmt.Errorf("no audit signing key configured")
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT h.chain_id, h.chain_seq, h.row_hash
+		FROM audit_chain_heads h
+		WHERE h.chain_seq > COALESCE((
+			SELECT MAX(c.chain_seq) FROM audit_checkpoints c WHERE c.chain_id = h.chain_id
+		), 0)
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query chain heads: %w", err)
+	}
+
+	type head struct {
+		chainID int
+		seq     int64
+		hash    []byte
+	}
+	var heads []head
+	for rows.Next() {
+		var h head
+		if err := rows.Scan(&h.chainID, &h.seq, &h.hash); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan chain head: %w", err)
+		}
+		heads = append(heads, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	keyID := AuditKeyID(s.key.Public().(ed25519.PublicKey))
+	for _, h := range heads {
+		sig := ed25519.Sign(s.key, checkpointMessage(h.chainID, h.seq, h.hash))
+		_, err := s.db.ExecContext(ctx, `
+			INSERT INTO audit_checkpoints (chain_id, chain_seq, row_hash, key_id, signature)
+			VALUES ($1, $2, $3, $4, $5)
+		`, h.chainID, h.seq, h.hash, keyID, sig)
+		if err != nil {
+			return 0, fmt.Errorf("failed to save checkpoint for chain %d: %w", h.chainID, err)
+		}
+	}
+
+	return len(heads), nil
+}
+
+// RunCheckpoints calls Checkpoint every interval until ctx is cancelled.
+func (s *AuditChainService) RunCheckpoints(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.Checkpoint(ctx); err != nil {
+				log.Printf("audit checkpoint failed: %v", err)
+			}
+		}
+	}
+}
+
+// ChainReport is the result of verifying one chain. Broken is empty when
+// the chain is intact.
+type ChainReport struct {
+	ChainID     int
+	Rows        int64
+	Checkpoints int
+	Broken      string
+	BrokenID    int64
+	BrokenSeq   int64
+}
+
+func (r *ChainReport) fail(id, seq int64, format string, args ...interface{}) {
+	if r.Broken != "" {
+		return
+	}
+	r.BrokenID, r.BrokenSeq = id, seq
+	r.Broken = fmt.Sprintf(format, args...)
+}
+
+// Chains lists the IDs of every chain: company IDs, and 0 for rows without a
+// company.
+func (s *AuditChainService) Chains(ctx context.Context) ([]int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT chain_id FROM audit_chain_heads ORDER BY chain_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chains: %w", err)
+	}
+	defer rows.Close()
+
+	var chains []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		chains = append(chains, id)
+	}
+	return chains, rows.Err()
+}
+
+// Verify walks one chain in order, recomputing every hash, and checks each
+// checkpoint signed by a key in keys against it. It stops at the first broken
+// link.
+func (s *AuditChainService) Verify(ctx context.Context, chainID int, keys []ed25519.PublicKey) (*ChainReport, error) {
+	report := &ChainReport{ChainID: chainID}
+
+	checkpoints, err := s.checkpoints(ctx, chainID)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]ed25519.PublicKey)
+	for _, k := range keys {
+		byID[AuditKeyID(k)] = k
+	}
+
+	// Rows removed by retention are covered by the archive; the remaining rows
+	// must link to the last one removed.
+	var prevHash []byte
+	var expectSeq int64 = 1
+	var anchorSeq int64
+	err = s.db.QueryRowContext(ctx, `
+		SELECT chain_seq, row_hash FROM audit_chain_anchors WHERE chain_id = $1
+	`, chainID).Scan(&anchorSeq, &prevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to query chain anchor: %w", err)
+	}
+	if err == nil {
+		expectSeq = anchorSeq + 1
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT a.id, a.chain_seq, a.prev_hash, a.row_hash, audit_log_payload(a)
+		FROM audit_logs a
+		WHERE COALESCE(a.company_id, 0) = $1
+		ORDER BY a.chain_seq
+	`, chainID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chain %d: %w", chainID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, seq int64
+		var prev, hash []byte
+		var payload string
+		if err := rows.Scan(&id, &seq, &prev, &hash, &payload); err != nil {
+			return nil, fmt.Errorf("failed to scan audit log: %w", err)
+		}
+		report.Rows++
+
+		switch {
+		case seq != expectSeq:
+			report.fail(id, seq, "expected sequence %d, found %d: rows are missing", expectSeq, seq)
+		case !bytes.Equal(prev, prevHash):
+			report.fail(id, seq, "prev_hash does not match the previous row's hash")
+		case !bytes.Equal(hash, chainHash(prev, payload)):
+			report.fail(id, seq, "row_hash does not match the row's contents")
+		}
+		if report.Broken != "" {
+			return report, nil
+		}
+
+		for _, cp := range checkpoints[seq] {
+			pub, ok := byID[cp.keyID]
+			switch {
+			case !ok:
+				report.fail(id, seq, "checkpoint %d is signed by unknown key %s", cp.id, cp.keyID)
+			case !bytes.Equal(cp.hash, hash):
+				report.fail(id, seq, "checkpoint %d does not match the chain", cp.id)
+			case !ed25519.Verify(pub, checkpointMessage(chainID, seq, cp.hash), cp.signature):
+				report.fail(id, seq, "checkpoint %d has an invalid signature", cp.id)
+			}
+			if report.Broken != "" {
+				return report, nil
+			}
+			report.Checkpoints++
+		}
+
+		prevHash = hash
+		expectSeq = seq + 1
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// A checkpoint past the end means rows were removed from the tail.
+	for seq, cps := range checkpoints {
+		if seq >= expectSeq {
+			report.fail(0, seq, "checkpoint %d covers sequence %d but the chain ends at %d", cps[0].id, seq, expectSeq-1)
+		}
+	}
+
+	return report, nil
+}
+
+func chainHash(prev []byte, payload string) []byte {
+	h := sha256.New()
+	h.Write(prev)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+type checkpoint struct {
+	id        int
+	keyID     string
+	hash      []byte
+	signature []byte
+}
+
+func (s *AuditChainService) checkpoints(ctx context.Context, chainID int) (map[int64][]checkpoint, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, chain_seq, row_hash, key_id, signature
+		FROM audit_checkpoints
+		WHERE chain_id = $1
+	`, chainID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query checkpoints: %w", err)
+	}
+	defer rows.Close()
+
+	checkpoints := make(map[int64][]checkpoint)
+	for rows.Next() {
+		var cp checkpoint
+		var seq int64
+		if err := rows.Scan(&cp.id, &seq, &cp.hash, &cp.keyID, &cp.signature); err != nil {
+			return nil, fmt.Errorf("failed to scan checkpoint: %w", err)
+		}
+		checkpoints[seq] = append(checkpoints[seq], cp)
+	}
+	return checkpoints, rows.Err()
+}
@@ -0,0 +1,207 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"main-server/models"
+)
+
+var (
+	ErrAuditQueueClosed = errors.New("audit queue is shut down")
+	ErrAuditQueueFull   = errors.New("audit queue is full")
+)
+
+// How long Enqueue waits for room in a full queue before dropping the event.
+// This slows requests down a little under load instead of losing entries
+// straight away.
+const auditEnqueueWait = 100 * time.Millisecond
+
+var (
+	auditEnqueued = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "audit_events_enqueued_total",
+		Help: "Audit events accepted by the write queue.",
+	})
+	auditDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "audit_events_dropped_total",
+		Help: "Audit events that were never written, by reason.",
+	}, []string{"reason"})
+	auditWritten = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "audit_events_written_total",
+		Help: "Audit events inserted into audit_logs.",
+	})
+	auditBatchSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "audit_batch_write_seconds",
+		Help:    "Time taken to insert one batch of audit events.",
+		Buckets: prometheus.DefBuckets,
+	})
+	auditQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "audit_queue_depth",
+		Help: "Audit events waiting to be written.",
+	})
+)
+
+// AuditQueue buffers audit events in memory and writes them to audit_logs in
+// batches from a single goroutine, so requests never wait on the insert.
+// Events still buffered when Shutdown's context expires are lost.
+type AuditQueue struct {
+	db        *sql.DB
+	events    chan *models.AuditLog
+	batchSize int
+	interval  time.Duration
+
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+func NewAuditQueue(db *sql.DB, size, batchSize int, interval time.Duration) *AuditQueue {
+	q := &AuditQueue{
+		db:        db,
+		events:    make(chan *models.AuditLog, size),
+		batchSize: batchSize,
+		interval:  interval,
+		done:      make(chan struct{}),
+	}
+
+	go q.run()
+
+	return q
+}
+
+// Enqueue hands an event to the writer. When the queue is full it waits up
+// to auditEnqueueWait, then drops the event and returns ErrAuditQueueFull.
+func (q *AuditQueue) Enqueue(event *models.AuditLog) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		auditDropped.WithLabelValues("shutdown").Inc()
+		return ErrAuditQueueClosed
+	}
+
+	select {
+	case q.events <- event:
+	default:
+		timer := time.NewTimer(auditEnqueueWait)
+		defer timer.Stop()
+
+		select {
+		case q.events <- event:
+		case <-timer.C:
+			auditDropped.WithLabelValues("queue_full").Inc()
+			return ErrAuditQueueFull
+		}
+	}
+
+	auditEnqueued.Inc()
+	auditQueueDepth.Set(float64(len(q.events)))
+	return nil
+}
+
+// Shutdown stops accepting events and waits for the buffered ones to be
+// written.
+func (q *AuditQueue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.events)
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		auditDropped.WithLabelValues("shutdown").Add(float64(len(q.events)))
+		return ctx.Err()
+	}
+}
+
+func (q *AuditQueue) run() {
+	defer close(q.done)
+
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+
+	batch := make([]*models.AuditLog, 0, q.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		q.write(batch)
+		batch = batch[:0]
+		auditQueueDepth.Set(float64(len(q.events)))
+	}
+
+	for {
+		select {
+		case event, ok := <-q.events:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= q.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+const auditColumns = 12
+
+// write inserts a batch in one statement. A failed batch is logged and
+// counted as dropped; it is not retried so a broken database cannot grow the
+// queue without bound.
+func (q *AuditQueue) write(batch []*models.AuditLog) {
+	start := time.Now()
+
+	var sb strings.Builder
+	sb.WriteString(`INSERT INTO audit_logs (user_id, action, entity_type, entity_id, company_id, workspace_id,
+		changes, ip_address, user_agent, impersonator_id, impersonation_session_id, created_at) VALUES `)
+
+	args := make([]interface{}, 0, len(batch)*auditColumns)
+	for i, e := range batch {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		n := i * auditColumns
+		fmt.Fprintf(&sb, "(NULLIF($%d, '')::integer, $%d, NULLIF($%d, ''), NULLIF($%d, '')::integer, "+
+			"NULLIF($%d, '')::integer, NULLIF($%d, '')::integer, $%d, NULLIF($%d, '')::inet, $%d, $%d::integer, $%d, $%d)",
+			n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, n+9, n+10, n+11, n+12)
+
+		var changes interface{}
+		if len(e.Changes) > 0 {
+			changes = []byte(e.Changes)
+		}
+		if e.CreatedAt.IsZero() {
+			e.CreatedAt = time.Now()
+		}
+		args = append(args, e.UserID, e.Action, e.EntityType, e.EntityID, e.CompanyID, e.WorkspaceID,
+			changes, e.IPAddress, e.UserAgent, e.ImpersonatorID, e.ImpersonationSessionID, e.CreatedAt)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := q.db.ExecContext(ctx, sb.String(), args...); err != nil {
+		log.Printf("failed to write %d audit events: %v", len(batch), err)
+		auditDropped.WithLabelValues("write_error").Add(float64(len(batch)))
+		return
+	}
+
+	auditWritten.Add(float64(len(batch)))
+	auditBatchSeconds.Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,685 @@
+package services
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"main-server/database"
+	"main-server/models"
+)
+
+const (
+	// How long a restored archive stays readable before the retention job
+	// removes it again.
+	AuditRestoreTTL = 7 * 24 * time.Hour
+
+	auditArchivePrefix = "audit-archives"
+	// Archives of rows without a company are kept under this directory of
+	// auditArchivePrefix, beside the workspaces'
+	auditPlatformArchiveDir = "platform"
+	auditDeleteBatch        = 1000
+	auditRestoreBatch       = 500
+
+	// Advisory lock held while the retention job runs, so only one server
+	// archives at a time.
+	auditRetentionLock int64 = 0x61756469
+)
+
+// archivedAuditLog is one line of an archive: the row plus its place in the
+// hash chain, so archived history can still be verified.
+type archivedAuditLog struct {
+	models.AuditLog
+	ChainSeq int64  `json:"chain_seq"`
+	PrevHash string `json:"prev_hash"`
+	RowHash  string `json:"row_hash"`
+}
+
+// AuditRetentionService enforces AuditRetentionDays. Expired rows are written
+// to storage as gzipped NDJSON, recorded in audit_archives and then deleted.
+// Rows without a company, such as logins, form chain 0, which spans
+// workspaces; they are kept for platformRetentionDays and archived on their
+// own, in archives without a workspace.
+type AuditRetentionService struct {
+	db           *sql.DB
+	storage      StorageBackend
+	entitlements *EntitlementService
+	audit        *AuditService
+	// 0 keeps rows without a company forever
+	platformRetentionDays int
+}
+
+func NewAuditRetentionService(db *sql.DB, storage StorageBackend, entitlements *EntitlementService, audit *AuditService, platformRetentionDays int) *AuditRetentionService {
+	return &AuditRetentionService{
+		db:                    db,
+		storage:               storage,
+		entitlements:          entitlements,
+		audit:                 audit,
+		platformRetentionDays: platformRetentionDays,
+	}
+}
+
+// RunEvery calls Run every interval until ctx is cancelled.
+func (s *AuditRetentionService) RunEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Run(ctx); err != nil {
+				log.Printf("audit retention failed: %v", err)
+			}
+		}
+	}
+}
+
+// Run archives the expired rows of every workspace and of chain 0, and
+// removes restored archives whose investigation window has passed. It does
+// nothing if another server is already running it.
+func (s *AuditRetentionService) Run(ctx context.Context) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, auditRetentionLock).Scan(&locked); err != nil {
+		return fmt.Errorf("failed to take retention lock: %w", err)
+	}
+	if !locked {
+		return nil
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, auditRetentionLock)
+
+	workspaces, err := s.workspaceIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, workspaceID := range workspaces {
+		ent, err := s.entitlements.ResolveWorkspace(ctx, workspaceID)
+		if err != nil {
+			log.Printf("audit retention: workspace %s: %v", workspaceID, err)
+			continue
+		}
+		days := ent.Features.AuditRetentionDays
+		if days <= 0 {
+			continue
+		}
+
+		archive, err := s.ArchiveWorkspace(ctx, workspaceID, time.Now().AddDate(0, 0, -days))
+		if err != nil {
+			log.Printf("audit retention: workspace %s: %v", workspaceID, err)
+			continue
+		}
+		if archive != nil {
+			log.Printf("audit retention: archived %d rows of workspace %s to %s", archive.RowCount, workspaceID, archive.StorageKey)
+		}
+	}
+
+	if s.platformRetentionDays > 0 {
+		archive, err := s.ArchivePlatform(ctx, time.Now().AddDate(0, 0, -s.platformRetentionDays))
+		if err != nil {
+			log.Printf("audit retention: rows without a company: %v", err)
+		} else if archive != nil {
+			log.Printf("audit retention: archived %d rows without a company to %s", archive.RowCount, archive.StorageKey)
+		}
+	}
+
+	return s.releaseExpired(ctx)
+}
+
+func (s *AuditRetentionService) workspaceIDs(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id::text FROM workspaces ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query workspaces: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ArchiveWorkspace archives and deletes a workspace's rows created before
+// cutoff. Each company's chain is archived up to its newest expired row, so
+// the rows left behind are always an unbroken tail of the chain. It returns
+// nil when nothing has expired.
+func (s *AuditRetentionService) ArchiveWorkspace(ctx context.Context, workspaceID string, cutoff time.Time) (*models.AuditArchive, error) {
+	bounds, err := s.expiredChains(ctx, workspaceID, cutoff)
+	if err != nil || len(bounds) == 0 {
+		return nil, err
+	}
+	return s.archive(ctx, workspaceID, cutoff, bounds)
+}
+
+// ArchivePlatform archives and deletes the rows without a company created
+// before cutoff, as ArchiveWorkspace does for a workspace's.
+func (s *AuditRetentionService) ArchivePlatform(ctx context.Context, cutoff time.Time) (*models.AuditArchive, error) {
+	var seq sql.NullInt64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT MAX(chain_seq) FROM audit_logs WHERE company_id IS NULL AND created_at < $1
+	`, cutoff).Scan(&seq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find expired audit rows: %w", err)
+	}
+	if !seq.Valid {
+		return nil, nil
+	}
+	return s.archive(ctx, "", cutoff, map[int]int64{0: seq.Int64})
+}
+
+// archive writes the chains in bounds to a new archive of workspaceID, or of
+// the platform if it is empty, and deletes the archived rows.
+func (s *AuditRetentionService) archive(ctx context.Context, workspaceID string, cutoff time.Time, bounds map[int]int64) (*models.AuditArchive, error) {
+	archive := &models.AuditArchive{WorkspaceID: workspaceID, Cutoff: cutoff, Status: models.ArchiveStatusArchiving}
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO audit_archives (workspace_id, storage_key, cutoff)
+		VALUES (NULLIF($1, '')::integer, '', $2)
+		RETURNING id, created_at
+	`, workspaceID, cutoff).Scan(&archive.ID, &archive.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archive: %w", err)
+	}
+	dir := workspaceID
+	if dir == "" {
+		dir = auditPlatformArchiveDir
+	}
+	archive.StorageKey = fmt.Sprintf("%s/%s/%s-%d.ndjson.gz", auditArchivePrefix, dir, cutoff.Format("20060102"), archive.ID)
+
+	if err := s.upload(ctx, archive, bounds); err != nil {
+		s.db.ExecContext(ctx, `
+			UPDATE audit_archives SET status = $2, error = $3 WHERE id = $1
+		`, archive.ID, models.ArchiveStatusFailed, err.Error())
+		return nil, fmt.Errorf("failed to write archive %d: %w", archive.ID, err)
+	}
+
+	chains, err := json.Marshal(archive.Chains)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		UPDATE audit_archives
+		SET status = $2, storage_key = $3, row_count = $4, oldest_at = $5, newest_at = $6,
+		    size_bytes = $7, sha256 = $8, chains = $9, completed_at = NOW()
+		WHERE id = $1
+	`, archive.ID, models.ArchiveStatusCompleted, archive.StorageKey, archive.RowCount, archive.OldestAt,
+		archive.NewestAt, archive.SizeBytes, archive.SHA256, chains)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record archive: %w", err)
+	}
+	archive.Status = models.ArchiveStatusCompleted
+
+	// Only delete once the manifest says where the rows went. If this is
+	// interrupted the remaining rows are archived again on the next run.
+	for _, chain := range archive.Chains {
+		if err := s.deleteArchived(ctx, archive.ID, chain); err != nil {
+			return archive, err
+		}
+	}
+
+	return archive, nil
+}
+
+// expiredChains returns, for each company chain in the workspace, the
+// highest chain_seq created before cutoff.
+func (s *AuditRetentionService) expiredChains(ctx context.Context, workspaceID string, cutoff time.Time) (map[int]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT a.company_id, MAX(a.chain_seq)
+		FROM audit_logs a
+		JOIN companies c ON c.id = a.company_id
+		WHERE c.workspace_id = $1 AND a.created_at < $2
+		GROUP BY a.company_id
+	`, dbID(workspaceID), cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find expired audit rows: %w", err)
+	}
+	defer rows.Close()
+
+	bounds := make(map[int]int64)
+	for rows.Next() {
+		var chainID int
+		var seq int64
+		if err := rows.Scan(&chainID, &seq); err != nil {
+			return nil, err
+		}
+		bounds[chainID] = seq
+	}
+	return bounds, rows.Err()
+}
+
+// upload streams the archive to storage while it is written, filling in the
+// archive's counts, checksum and chain ranges.
+func (s *AuditRetentionService) upload(ctx context.Context, archive *models.AuditArchive, bounds map[int]int64) error {
+	pr, pw := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		err := s.writeArchive(ctx, pw, archive, bounds)
+		pw.CloseWithError(err)
+		written <- err
+	}()
+
+	err := s.storage.Upload(ctx, pr, archive.StorageKey)
+	pr.CloseWithError(err)
+	if werr := <-written; werr != nil && !errors.Is(werr, io.ErrClosedPipe) {
+		return werr
+	}
+	return err
+}
+
+func (s *AuditRetentionService) writeArchive(ctx context.Context, w io.Writer, archive *models.AuditArchive, bounds map[int]int64) error {
+	sum := sha256.New()
+	counter := &countingWriter{}
+	gz := gzip.NewWriter(io.MultiWriter(w, sum, counter))
+	enc := json.NewEncoder(gz)
+
+	for chainID, lastSeq := range bounds {
+		chain := models.ArchiveChain{ChainID: chainID}
+		err := s.eachChainRow(ctx, chainID, lastSeq, func(row archivedAuditLog) error {
+			if chain.FirstSeq == 0 {
+				chain.FirstSeq = row.ChainSeq
+			}
+			chain.LastSeq, chain.LastHash = row.ChainSeq, row.RowHash
+
+			archive.RowCount++
+			createdAt := row.CreatedAt
+			if archive.OldestAt == nil || createdAt.Before(*archive.OldestAt) {
+				archive.OldestAt = &createdAt
+			}
+			if archive.NewestAt == nil || createdAt.After(*archive.NewestAt) {
+				archive.NewestAt = &createdAt
+			}
+			return enc.Encode(row)
+		})
+		if err != nil {
+			return err
+		}
+		if chain.FirstSeq != 0 {
+			archive.Chains = append(archive.Chains, chain)
+		}
+	}
+
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	archive.SizeBytes = counter.n
+	archive.SHA256 = hex.EncodeToString(sum.Sum(nil))
+	return nil
+}
+
+func (s *AuditRetentionService) eachChainRow(ctx context.Context, chainID int, lastSeq int64, fn func(archivedAuditLog) error) error {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, COALESCE(user_id::text, ''), action, COALESCE(entity_type, ''),
+		       COALESCE(entity_id::text, ''), COALESCE(company_id::text, ''),
+		       COALESCE(workspace_id::text, ''), changes, COALESCE(legacy_ip_address, host(ip_address), ''),
+		       COALESCE(user_agent, ''), created_at, impersonator_id::text, impersonation_session_id,
+		       chain_seq, prev_hash, row_hash
+		FROM audit_logs
+		WHERE COALESCE(company_id, 0) = $1 AND chain_seq <= $2
+		ORDER BY chain_seq
+	`, chainID, lastSeq)
+	if err != nil {
+		return fmt.Errorf("failed to query audit rows: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row archivedAuditLog
+		var changes, prevHash, rowHash []byte
+		err := rows.Scan(&row.ID, &row.UserID, &row.Action, &row.EntityType, &row.EntityID, &row.CompanyID,
+			&row.WorkspaceID, &changes, &row.IPAddress, &row.UserAgent, &row.CreatedAt,
+			&row.ImpersonatorID, &row.ImpersonationSessionID, &row.ChainSeq, &prevHash, &rowHash)
+		if err != nil {
+			return fmt.Errorf("failed to scan audit row: %w", err)
+		}
+		if len(changes) > 0 {
+			row.Changes = json.RawMessage(changes)
+		}
+		row.PrevHash, row.RowHash = hex.EncodeToString(prevHash), hex.EncodeToString(rowHash)
+
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// deleteArchived removes a chain's archived rows oldest first, in batches.
+// Each batch moves the chain's anchor forward in the same transaction, so
+// verify-audit always knows where the remaining rows start.
+func (s *AuditRetentionService) deleteArchived(ctx context.Context, archiveID int, chain models.ArchiveChain) error {
+	for {
+		var deleted int
+		err := database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, `SELECT set_config('app.audit_retention', 'on', true)`); err != nil {
+				return err
+			}
+
+			var seq int64
+			var hash []byte
+			err := tx.QueryRowContext(ctx, `
+				WITH gone AS (
+					DELETE FROM audit_logs
+					WHERE id IN (
+						SELECT id FROM audit_logs
+						WHERE COALESCE(company_id, 0) = $1 AND chain_seq <= $2
+						ORDER BY chain_seq
+						LIMIT $3
+					)
+					RETURNING chain_seq, row_hash
+				)
+				SELECT COUNT(*), COALESCE(MAX(chain_seq), 0),
+				       COALESCE((SELECT row_hash FROM gone ORDER BY chain_seq DESC LIMIT 1), ''::bytea)
+				FROM gone
+			`, chain.ChainID, chain.LastSeq, auditDeleteBatch).Scan(&deleted, &seq, &hash)
+			if err != nil {
+				return fmt.Errorf("failed to delete archived rows: %w", err)
+			}
+			if deleted == 0 {
+				return nil
+			}
+
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO audit_chain_anchors (chain_id, chain_seq, row_hash, archive_id)
+				VALUES ($1, $2, $3, $4)
+				ON CONFLICT (chain_id) DO UPDATE
+				SET chain_seq = EXCLUDED.chain_seq, row_hash = EXCLUDED.row_hash,
+				    archive_id = EXCLUDED.archive_id, updated_at = NOW()
+				WHERE audit_chain_anchors.chain_seq < EXCLUDED.chain_seq
+			`, chain.ChainID, seq, hash, archiveID)
+			if err != nil {
+				return fmt.Errorf("failed to move chain anchor: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if deleted < auditDeleteBatch {
+			return nil
+		}
+	}
+}
+
+// ListArchives returns a workspace's archives, newest first. An empty
+// workspaceID lists every archive, including those of rows without a
+// company.
+func (s *AuditRetentionService) ListArchives(ctx context.Context, workspaceID string) ([]models.AuditArchive, error) {
+	rows, err := database.Conn(ctx, s.db).QueryContext(ctx, auditArchiveSelect+`
+		WHERE $1 = '' OR workspace_id = $2
+		ORDER BY created_at DESC
+	`, workspaceID, dbID(workspaceID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query archives: %w", err)
+	}
+	defer rows.Close()
+
+	archives := []models.AuditArchive{}
+	for rows.Next() {
+		a, err := scanAuditArchive(rows)
+		if err != nil {
+			return nil, err
+		}
+		archives = append(archives, *a)
+	}
+	return archives, rows.Err()
+}
+
+func (s *AuditRetentionService) GetArchive(ctx context.Context, id int) (*models.AuditArchive, error) {
+	a, err := scanAuditArchive(database.Conn(ctx, s.db).QueryRowContext(ctx, auditArchiveSelect+`
+		WHERE id = $1
+	`, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("archive not found")
+	}
+	return a, err
+}
+
+const auditArchiveSelect = `
+	SELECT id, COALESCE(workspace_id::text, ''), status, storage_key, cutoff, row_count, oldest_at, newest_at,
+	       size_bytes, COALESCE(sha256, ''), chains, COALESCE(error, ''), created_at, completed_at,
+	       restored_by::text, restored_at, restore_expires_at
+	FROM audit_archives`
+
+func scanAuditArchive(row interface{ Scan(...interface{}) error }) (*models.AuditArchive, error) {
+	var a models.AuditArchive
+	var chains []byte
+	err := row.Scan(&a.ID, &a.WorkspaceID, &a.Status, &a.StorageKey, &a.Cutoff, &a.RowCount, &a.OldestAt,
+		&a.NewestAt, &a.SizeBytes, &a.SHA256, &chains, &a.Error, &a.CreatedAt, &a.CompletedAt,
+		&a.RestoredBy, &a.RestoredAt, &a.RestoreExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(chains, &a.Chains); err != nil {
+		return nil, fmt.Errorf("invalid archive chains: %w", err)
+	}
+	return &a, nil
+}
+
+// Restore loads an archive into archived_audit_logs so it can be searched
+// with the audit viewer for AuditRestoreTTL. The file's checksum must match
+// the manifest.
+func (s *AuditRetentionService) Restore(ctx context.Context, archive *models.AuditArchive, restoredBy string) error {
+	if archive.Status != models.ArchiveStatusCompleted {
+		return fmt.Errorf("archive is %s", archive.Status)
+	}
+	if archive.RestoredAt != nil {
+		return nil
+	}
+
+	file, err := s.storage.Download(ctx, archive.StorageKey)
+	if err != nil {
+		return fmt.Errorf("failed to download archive: %w", err)
+	}
+	defer file.Close()
+
+	sum := sha256.New()
+	gz, err := gzip.NewReader(io.TeeReader(bufio.NewReader(file), sum))
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+	defer gz.Close()
+
+	// Restores run as the owner role: app_tenant can only read the table.
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	dec := json.NewDecoder(gz)
+	batch := make([]archivedAuditLog, 0, auditRestoreBatch)
+	for {
+		var row archivedAuditLog
+		err := dec.Decode(&row)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		batch = append(batch, row)
+		if len(batch) == auditRestoreBatch {
+			if err := insertArchivedRows(ctx, tx, archive.ID, batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := insertArchivedRows(ctx, tx, archive.ID, batch); err != nil {
+		return err
+	}
+
+	// Drain the gzip trailer so the whole file has been hashed.
+	io.Copy(io.Discard, gz)
+	if got := hex.EncodeToString(sum.Sum(nil)); got != archive.SHA256 {
+		return fmt.Errorf("archive checksum mismatch: manifest %s, file %s", archive.SHA256, got)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE audit_archives
+		SET restored_by = NULLIF($2, '')::integer, restored_at = NOW(), restore_expires_at = NOW() + $3 * INTERVAL '1 second'
+		WHERE id = $1
+	`, archive.ID, restoredBy, int(AuditRestoreTTL.Seconds()))
+	if err != nil {
+		return fmt.Errorf("failed to record restore: %w", err)
+	}
+
+	err = s.audit.Record(ctx, tx, AuditEvent{
+		Action:      models.AuditArchiveRestored,
+		EntityType:  "audit_archive",
+		EntityID:    strconv.Itoa(archive.ID),
+		WorkspaceID: archive.WorkspaceID,
+		Metadata:    map[string]interface{}{"rows": archive.RowCount, "storage_key": archive.StorageKey},
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Release removes a restored archive's rows. The archive itself stays in
+// storage.
+func (s *AuditRetentionService) Release(ctx context.Context, archive *models.AuditArchive) error {
+	// Like restores, releases run as the owner role: app_tenant cannot
+	// delete from archived_audit_logs.
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.release(ctx, tx, archive.ID, archive.WorkspaceID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *AuditRetentionService) release(ctx context.Context, tx *sql.Tx, archiveID int, workspaceID string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM archived_audit_logs WHERE archive_id = $1`, archiveID); err != nil {
+		return fmt.Errorf("failed to remove restored rows: %w", err)
+	}
+	_, err := tx.ExecContext(ctx, `
+		UPDATE audit_archives SET restored_by = NULL, restored_at = NULL, restore_expires_at = NULL
+		WHERE id = $1
+	`, archiveID)
+	if err != nil {
+		return fmt.Errorf("failed to record release: %w", err)
+	}
+
+	return s.audit.Record(ctx, tx, AuditEvent{
+		Action:      models.AuditArchiveReleased,
+		EntityType:  "audit_archive",
+		EntityID:    strconv.Itoa(archiveID),
+		WorkspaceID: workspaceID,
+	})
+}
+
+// releaseExpired releases every restore past its restore_expires_at.
+func (s *AuditRetentionService) releaseExpired(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, COALESCE(workspace_id::text, '') FROM audit_archives WHERE restore_expires_at < NOW()
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to query expired restores: %w", err)
+	}
+
+	type expired struct {
+		id          int
+		workspaceID string
+	}
+	var archives []expired
+	for rows.Next() {
+		var e expired
+		if err := rows.Scan(&e.id, &e.workspaceID); err != nil {
+			rows.Close()
+			return err
+		}
+		archives = append(archives, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, a := range archives {
+		err := database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+			return s.release(ctx, tx, a.id, a.workspaceID)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertArchivedRows(ctx context.Context, tx *sql.Tx, archiveID int, rows []archivedAuditLog) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	const columns = 17
+	var sb strings.Builder
+	sb.WriteString(`INSERT INTO archived_audit_logs (archive_id, id, user_id, action, entity_type, entity_id,
+		company_id, workspace_id, changes, ip_address, legacy_ip_address, user_agent, created_at,
+		impersonator_id, impersonation_session_id, chain_seq, prev_hash, row_hash) VALUES `)
+
+	args := make([]interface{}, 0, len(rows)*columns)
+	for i, r := range rows {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		n := i * columns
+		fmt.Fprintf(&sb, "($%d, $%d, NULLIF($%d, '')::integer, $%d, NULLIF($%d, ''), NULLIF($%d, '')::integer, "+
+			"NULLIF($%d, '')::integer, NULLIF($%d, '')::integer, $%d, try_inet($%d), "+
+			"NULLIF($%d, COALESCE(host(try_inet($%d)), '')), $%d, $%d, $%d::integer, $%d, $%d, "+
+			"decode($%d, 'hex'), decode($%d, 'hex'))",
+			n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, n+9, n+10, n+10, n+10, n+11, n+12, n+13, n+14, n+15, n+16, n+17)
+
+		var changes interface{}
+		if len(r.Changes) > 0 {
+			changes = []byte(r.Changes)
+		}
+		args = append(args, archiveID, r.ID, r.UserID, r.Action, r.EntityType, r.EntityID, r.CompanyID,
+			r.WorkspaceID, changes, r.IPAddress, r.UserAgent, r.CreatedAt, r.ImpersonatorID,
+			r.ImpersonationSessionID, r.ChainSeq, r.PrevHash, r.RowHash)
+	}
+
+	if _, err := tx.ExecContext(ctx, sb.String(), args...); err != nil {
+		return fmt.Errorf("failed to restore audit rows: %w", err)
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
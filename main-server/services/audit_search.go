@@ -0,0 +1,347 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"main-server/database"
+	"main-server/models"
+)
+
+const (
+	DefaultAuditPageSize = 50
+	MaxAuditPageSize     = 200
+
+	// Longest per-entity timeline returned by History.
+	maxAuditHistory = 500
+)
+
+// Export formats for ExportAuditLog.
+const (
+	AuditExportCSV    = "csv"
+	AuditExportNDJSON = "ndjson"
+)
+
+var ErrInvalidAuditCursor = errors.New("invalid cursor")
+
+var auditCSVHeader = []string{"id", "created_at", "user_id", "impersonator_id", "action", "entity_type",
+	"entity_id", "company_id", "workspace_id", "ip_address", "user_agent", "changes"}
+
+// AuditFilter selects audit_logs rows. CompanyID and WorkspaceID scope the
+// search and are set from the viewer's role, never straight from the
+// request; the rest are optional filters.
+type AuditFilter struct {
+	CompanyID   string
+	WorkspaceID string
+
+	ActorID    string
+	Action     string // exact, or a prefix when it ends in "*"
+	EntityType string
+	EntityID   string
+	IPAddress  string // an address, or a range in CIDR notation
+	From       *time.Time
+	To         *time.Time
+
+	// ArchiveID searches a restored archive instead of the live log.
+	ArchiveID string
+
+	Cursor string
+	Limit  int
+}
+
+// AuditPage is one page of Search results, newest first.
+type AuditPage struct {
+	Events     []models.AuditLog `json:"events"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+// Search returns a page of events matching f. Pass NextCursor back as
+// f.Cursor for the following page.
+func (s *AuditService) Search(ctx context.Context, f AuditFilter) (*AuditPage, error) {
+	if f.Limit <= 0 {
+		f.Limit = DefaultAuditPageSize
+	}
+	if f.Limit > MaxAuditPageSize {
+		f.Limit = MaxAuditPageSize
+	}
+
+	page := &AuditPage{Events: []models.AuditLog{}}
+	err := s.each(ctx, f, false, f.Limit+1, func(event models.AuditLog) error {
+		page.Events = append(page.Events, event)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(page.Events) > f.Limit {
+		page.Events = page.Events[:f.Limit]
+		page.NextCursor = encodeAuditCursor(page.Events[f.Limit-1])
+	}
+	return page, nil
+}
+
+// History returns the events for one entity, oldest first, for a timeline.
+func (s *AuditService) History(ctx context.Context, f AuditFilter, entityType, entityID string) ([]models.AuditLog, error) {
+	f.EntityType, f.EntityID, f.Cursor = entityType, entityID, ""
+
+	events := []models.AuditLog{}
+	err := s.each(ctx, f, true, maxAuditHistory, func(event models.AuditLog) error {
+		events = append(events, event)
+		return nil
+	})
+	return events, err
+}
+
+// ExportAuditLog streams every event matching f to w as CSV or NDJSON and
+// returns the number of rows written. The export itself is audited.
+func (s *AuditService) ExportAuditLog(ctx context.Context, f AuditFilter, format string, w io.Writer) (int, error) {
+	f.Cursor = ""
+
+	var write func(models.AuditLog) error
+	var flush func() error
+	switch format {
+	case AuditExportCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(auditCSVHeader); err != nil {
+			return 0, err
+		}
+		write = func(e models.AuditLog) error { return cw.Write(auditCSVRecord(e)) }
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	case AuditExportNDJSON:
+		enc := json.NewEncoder(w)
+		write = func(e models.AuditLog) error { return enc.Encode(e) }
+		flush = func() error { return nil }
+	default:
+		return 0, fmt.Errorf("unknown export format %q", format)
+	}
+
+	exported := 0
+	err := s.each(ctx, f, false, 0, func(event models.AuditLog) error {
+		exported++
+		return write(event)
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return exported, err
+	}
+
+	return exported, s.Record(ctx, database.Conn(ctx, s.db), AuditEvent{
+		Action:     models.AuditLogExported,
+		EntityType: "audit_log",
+		CompanyID:  f.CompanyID,
+		Metadata: map[string]interface{}{
+			"format":  format,
+			"rows":    exported,
+			"filters": f.describe(),
+		},
+	})
+}
+
+// each runs the query for f and calls fn for every row while the result set
+// is open, so fn must not query the database. limit 0 means no limit.
+func (s *AuditService) each(ctx context.Context, f AuditFilter, ascending bool, limit int, fn func(models.AuditLog) error) error {
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	table := "audit_logs"
+	if f.ArchiveID != "" {
+		table = "archived_audit_logs"
+		where = append(where, "a.archive_id::text = "+arg(f.ArchiveID))
+	}
+	if f.CompanyID != "" {
+		where = append(where, "a.company_id::text = "+arg(f.CompanyID))
+	}
+	if f.WorkspaceID != "" {
+		p := arg(f.WorkspaceID)
+		where = append(where, "(a.workspace_id::text = "+p+
+			" OR a.company_id IN (SELECT id FROM companies WHERE workspace_id::text = "+p+"))")
+	}
+	if f.ActorID != "" {
+		p := arg(f.ActorID)
+		where = append(where, "(a.user_id::text = "+p+" OR a.impersonator_id::text = "+p+")")
+	}
+	if f.Action != "" {
+		if prefix, ok := strings.CutSuffix(f.Action, "*"); ok {
+			where = append(where, "a.action LIKE "+arg(escapeLike(prefix)+"%"))
+		} else {
+			where = append(where, "a.action = "+arg(f.Action))
+		}
+	}
+	if f.EntityType != "" {
+		where = append(where, "a.entity_type = "+arg(f.EntityType))
+	}
+	if f.EntityID != "" {
+		where = append(where, "a.entity_id::text = "+arg(f.EntityID))
+	}
+	if f.IPAddress != "" {
+		where = append(where, "a.ip_address <<= "+arg(f.IPAddress)+"::inet")
+	}
+	if f.From != nil {
+		where = append(where, "a.created_at >= "+arg(*f.From))
+	}
+	if f.To != nil {
+		where = append(where, "a.created_at < "+arg(*f.To))
+	}
+	if f.Cursor != "" {
+		createdAt, id, err := decodeAuditCursor(f.Cursor)
+		if err != nil {
+			return err
+		}
+		where = append(where, "(a.created_at, a.id) < ("+arg(createdAt)+", "+arg(id)+")")
+	}
+
+	query := `
+		SELECT a.id, COALESCE(a.user_id::text, ''), a.action, COALESCE(a.entity_type, ''),
+		       COALESCE(a.entity_id::text, ''), COALESCE(a.company_id::text, ''),
+		       COALESCE(a.workspace_id::text, ''), a.changes, COALESCE(host(a.ip_address), a.legacy_ip_address, ''),
+		       COALESCE(a.user_agent, ''), a.created_at, a.impersonator_id::text, a.impersonation_session_id
+		FROM ` + table + ` a`
+	if len(where) > 0 {
+		query += "\n\t\tWHERE " + strings.Join(where, " AND ")
+	}
+	if ascending {
+		query += "\n\t\tORDER BY a.created_at, a.id"
+	} else {
+		query += "\n\t\tORDER BY a.created_at DESC, a.id DESC"
+	}
+	if limit > 0 {
+		query += "\n\t\tLIMIT " + arg(limit)
+	}
+
+	rows, err := database.Conn(ctx, s.db).QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query audit log: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e models.AuditLog
+		var changes []byte
+		err := rows.Scan(&e.ID, &e.UserID, &e.Action, &e.EntityType, &e.EntityID, &e.CompanyID,
+			&e.WorkspaceID, &changes, &e.IPAddress, &e.UserAgent, &e.CreatedAt,
+			&e.ImpersonatorID, &e.ImpersonationSessionID)
+		if err != nil {
+			return fmt.Errorf("failed to scan audit log: %w", err)
+		}
+		if len(changes) > 0 {
+			e.Changes = json.RawMessage(changes)
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// ParseIPFilter parses an IP address or CIDR range for AuditFilter.IPAddress.
+// A single address becomes a /32 or /128 range.
+func ParseIPFilter(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		if v4 := ip.To4(); v4 != nil {
+			return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not an IP address or CIDR range", s)
+	}
+	return network, nil
+}
+
+// describe lists the filters that were set, for the export's audit event.
+func (f AuditFilter) describe() map[string]string {
+	d := make(map[string]string)
+	for k, v := range map[string]string{
+		"company_id":   f.CompanyID,
+		"workspace_id": f.WorkspaceID,
+		"actor_id":     f.ActorID,
+		"action":       f.Action,
+		"entity_type":  f.EntityType,
+		"entity_id":    f.EntityID,
+		"ip_address":   f.IPAddress,
+	} {
+		if v != "" {
+			d[k] = v
+		}
+	}
+	if f.From != nil {
+		d["from"] = f.From.Format(time.RFC3339)
+	}
+	if f.To != nil {
+		d["to"] = f.To.Format(time.RFC3339)
+	}
+	return d
+}
+
+func auditCSVRecord(e models.AuditLog) []string {
+	impersonatorID := ""
+	if e.ImpersonatorID != nil {
+		impersonatorID = *e.ImpersonatorID
+	}
+	return []string{
+		strconv.FormatInt(e.ID, 10),
+		e.CreatedAt.UTC().Format(time.RFC3339Nano),
+		e.UserID,
+		impersonatorID,
+		e.Action,
+		e.EntityType,
+		e.EntityID,
+		e.CompanyID,
+		e.WorkspaceID,
+		e.IPAddress,
+		e.UserAgent,
+		string(e.Changes),
+	}
+}
+
+// Cursors are the created_at and id of the last event on a page, opaque to
+// clients.
+func encodeAuditCursor(e models.AuditLog) string {
+	raw := e.CreatedAt.Format(time.RFC3339Nano) + "|" + strconv.FormatInt(e.ID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeAuditCursor(cursor string) (time.Time, int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, ErrInvalidAuditCursor
+	}
+	ts, id, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return time.Time{}, 0, ErrInvalidAuditCursor
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return time.Time{}, 0, ErrInvalidAuditCursor
+	}
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, ErrInvalidAuditCursor
+	}
+	return createdAt, n, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
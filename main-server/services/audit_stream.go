@@ -0,0 +1,350 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"main-server/models"
+)
+
+// AuditNotifyChannel is the channel 011_audit_notify.sql announces new
+// audit_logs rows on.
+const AuditNotifyChannel = "audit_logs"
+
+const (
+	// Events buffered per subscriber before new ones are dropped for it
+	auditStreamBuffer = 64
+	// Most notifications loaded in one query
+	auditStreamBatch = 200
+)
+
+var (
+	ErrTooManyAuditStreams = errors.New("too many audit streams are open")
+	ErrAuditStreamClosed   = errors.New("audit stream is closed")
+)
+
+var (
+	auditStreamSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "audit_stream_subscribers",
+		Help: "Open audit event streams.",
+	})
+	auditStreamDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "audit_stream_events_dropped_total",
+		Help: "Audit events not delivered to a stream because it was not keeping up.",
+	})
+)
+
+// AuditStream tails audit_logs with LISTEN/NOTIFY and fans new events out
+// to subscribers, each seeing only the events its filter matches. Rows are
+// loaded once per batch of notifications, whoever is subscribed.
+//
+// Subscribers are best effort and miss events they do not keep up with.
+// Consumers, such as the alert rules, see every event: Run waits for them,
+// and catches up on the rows written while its listener was reconnecting.
+type AuditStream struct {
+	db             *sql.DB
+	connString     string
+	maxSubscribers int
+
+	mu          sync.Mutex
+	subscribers map[*AuditSubscription]struct{}
+	consumers   []func(context.Context, models.AuditLog)
+	closed      bool
+
+	// The last event loaded, which catching up starts after; only Run's
+	// goroutine uses it
+	lastID int64
+}
+
+// AuditSubscription receives the events matching its filter until it is
+// passed to Unsubscribe.
+type AuditSubscription struct {
+	filter AuditFilter
+	events chan models.AuditLog
+}
+
+// Events delivers matching events. It is closed by Unsubscribe.
+func (sub *AuditSubscription) Events() <-chan models.AuditLog {
+	return sub.events
+}
+
+func NewAuditStream(db *sql.DB, connString string, maxSubscribers int) *AuditStream {
+	return &AuditStream{
+		db:             db,
+		connString:     connString,
+		maxSubscribers: maxSubscribers,
+		subscribers:    make(map[*AuditSubscription]struct{}),
+	}
+}
+
+// Subscribe starts delivering events matching f. Only the scope and
+// attribute filters apply; From, To, Cursor and Limit are ignored.
+func (s *AuditStream) Subscribe(f AuditFilter) (*AuditSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrAuditStreamClosed
+	}
+	if len(s.subscribers) >= s.maxSubscribers {
+		return nil, ErrTooManyAuditStreams
+	}
+
+	sub := &AuditSubscription{filter: f, events: make(chan models.AuditLog, auditStreamBuffer)}
+	s.subscribers[sub] = struct{}{}
+	auditStreamSubscribers.Inc()
+	return sub, nil
+}
+
+// Consume has fn called with every new event, one at a time, on Run's
+// goroutine. Nothing is dropped for a slow fn; Run waits for it.
+func (s *AuditStream) Consume(fn func(ctx context.Context, e models.AuditLog)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.consumers = append(s.consumers, fn)
+}
+
+func (s *AuditStream) Unsubscribe(sub *AuditSubscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.subscribers[sub]; !ok {
+		return
+	}
+	delete(s.subscribers, sub)
+	close(sub.events)
+	auditStreamSubscribers.Dec()
+}
+
+// Close ends every subscription and refuses new ones, so open streams
+// finish and the HTTP server can shut down.
+func (s *AuditStream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for sub := range s.subscribers {
+		delete(s.subscribers, sub)
+		close(sub.events)
+		auditStreamSubscribers.Dec()
+	}
+}
+
+// Run listens for new audit events until ctx is cancelled.
+func (s *AuditStream) Run(ctx context.Context) error {
+	listener := pq.NewListener(s.connString, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("audit stream listener: %v", err)
+		}
+	})
+	defer listener.Close()
+
+	if err := listener.Listen(AuditNotifyChannel); err != nil {
+		return fmt.Errorf("failed to listen for audit events: %w", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case n := <-listener.Notify:
+			if n == nil {
+				// The connection was re-established; anything written in
+				// between was not announced.
+				if err := s.catchUp(ctx); err != nil {
+					log.Printf("audit stream reconnected; events may have been missed: %v", err)
+				}
+				continue
+			}
+
+			ids := []int64{}
+			ids = appendNotifiedID(ids, n)
+		drain:
+			for len(ids) < auditStreamBatch {
+				select {
+				case n := <-listener.Notify:
+					if n == nil {
+						break drain
+					}
+					ids = appendNotifiedID(ids, n)
+				default:
+					break drain
+				}
+			}
+
+			if err := s.dispatch(ctx, ids); err != nil {
+				log.Printf("audit stream: %v", err)
+			}
+
+		case <-time.After(90 * time.Second):
+			go listener.Ping()
+		}
+	}
+}
+
+func appendNotifiedID(ids []int64, n *pq.Notification) []int64 {
+	id, err := strconv.ParseInt(n.Extra, 10, 64)
+	if err != nil {
+		log.Printf("audit stream: invalid notification %q", n.Extra)
+		return ids
+	}
+	return append(ids, id)
+}
+
+// catchUp dispatches the rows written after the last one loaded.
+func (s *AuditStream) catchUp(ctx context.Context) error {
+	if s.lastID == 0 {
+		return nil
+	}
+	for {
+		rows, err := s.db.QueryContext(ctx, `
+			SELECT id FROM audit_logs WHERE id > $1 ORDER BY id LIMIT $2
+		`, s.lastID, auditStreamBatch)
+		if err != nil {
+			return fmt.Errorf("failed to query missed audit events: %w", err)
+		}
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		last := s.lastID
+		if err := s.dispatch(ctx, ids); err != nil {
+			return err
+		}
+		if s.lastID == last {
+			return nil
+		}
+	}
+}
+
+// dispatch loads the announced rows, passes each to the consumers, and
+// hands it to the subscribers whose filters match. A subscriber that is not
+// keeping up misses events rather than holding up everyone else.
+func (s *AuditStream) dispatch(ctx context.Context, ids []int64) error {
+	s.mu.Lock()
+	idle := len(s.subscribers) == 0 && len(s.consumers) == 0
+	consumers := slices.Clone(s.consumers)
+	s.mu.Unlock()
+	if idle || len(ids) == 0 {
+		return nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT a.id, COALESCE(a.user_id::text, ''), a.action, COALESCE(a.entity_type, ''),
+		       COALESCE(a.entity_id::text, ''), COALESCE(a.company_id::text, ''),
+		       COALESCE(a.workspace_id::text, ''), a.changes, COALESCE(host(a.ip_address), a.legacy_ip_address, ''),
+		       COALESCE(a.user_agent, ''), a.created_at, a.impersonator_id::text, a.impersonation_session_id,
+		       COALESCE(a.workspace_id, c.workspace_id)::text
+		FROM audit_logs a
+		LEFT JOIN companies c ON c.id = a.company_id
+		WHERE a.id = ANY($1)
+		ORDER BY a.id
+	`, pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("failed to load audit events: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e models.AuditLog
+		var changes []byte
+		var workspaceID sql.NullString
+		err := rows.Scan(&e.ID, &e.UserID, &e.Action, &e.EntityType, &e.EntityID, &e.CompanyID,
+			&e.WorkspaceID, &changes, &e.IPAddress, &e.UserAgent, &e.CreatedAt,
+			&e.ImpersonatorID, &e.ImpersonationSessionID, &workspaceID)
+		if err != nil {
+			return fmt.Errorf("failed to scan audit event: %w", err)
+		}
+		if len(changes) > 0 {
+			e.Changes = json.RawMessage(changes)
+		}
+		s.lastID = max(s.lastID, e.ID)
+
+		for _, consume := range consumers {
+			consume(ctx, e)
+		}
+		s.publish(e, workspaceID.String)
+	}
+	return rows.Err()
+}
+
+func (s *AuditStream) publish(e models.AuditLog, workspaceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sub := range s.subscribers {
+		if !sub.filter.matches(e, workspaceID) {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+			auditStreamDropped.Inc()
+		}
+	}
+}
+
+// matches reports whether e passes f's scope and attribute filters, the
+// in-memory equivalent of the WHERE clause built by each. workspaceID is
+// the workspace of e or of its company.
+func (f AuditFilter) matches(e models.AuditLog, workspaceID string) bool {
+	switch {
+	case f.CompanyID != "" && e.CompanyID != f.CompanyID:
+		return false
+	case f.WorkspaceID != "" && workspaceID != f.WorkspaceID:
+		return false
+	case f.ActorID != "" && e.UserID != f.ActorID && (e.ImpersonatorID == nil || *e.ImpersonatorID != f.ActorID):
+		return false
+	case f.EntityType != "" && e.EntityType != f.EntityType:
+		return false
+	case f.EntityID != "" && e.EntityID != f.EntityID:
+		return false
+	case f.IPAddress != "" && !ipInFilter(f.IPAddress, e.IPAddress):
+		return false
+	}
+
+	if f.Action == "" {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(f.Action, "*"); ok {
+		return strings.HasPrefix(e.Action, prefix)
+	}
+	return e.Action == f.Action
+}
+
+func ipInFilter(filter, ip string) bool {
+	network, err := ParseIPFilter(filter)
+	if err != nil {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	return parsed != nil && network.Contains(parsed)
+}
@@ -0,0 +1,231 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"main-server/database"
+	"main-server/models"
+
+	"github.com/lib/pq"
+)
+
+// CompanyUserService reads users in the workspace → company → user hierarchy
+// described in NOTES.md.
+type CompanyUserService struct {
+	db    *sql.DB
+	audit *AuditService
+}
+
+func NewCompanyUserService(db *sql.DB, audit *AuditService) *CompanyUserService {
+	return &CompanyUserService{
+		db:    db,
+		audit: audit,
+	}
+}
+
+// GetUser loads an active user together with the workspace of their company.
+func (s *CompanyUserService) GetUser(ctx context.Context, id string) (*models.User, error) {
+	return s.getUser(ctx, id, true)
+}
+
+// FindUser is GetUser for admin screens: it also returns disabled users.
+func (s *CompanyUserService) FindUser(ctx context.Context, id string) (*models.User, error) {
+	return s.getUser(ctx, id, false)
+}
+
+func (s *CompanyUserService) getUser(ctx context.Context, id string, activeOnly bool) (*models.User, error) {
+	var user models.User
+	err := database.Conn(ctx, s.db).QueryRowContext(ctx, `
+		SELECT u.id, u.email, u.name, COALESCE(u.company_id::text, ''),
+		       COALESCE(c.workspace_id::text, ''), u.role, u.is_active, u.role_template_id
+		FROM users u
+		LEFT JOIN companies c ON u.company_id = c.id
+		WHERE u.id = $1 AND (u.is_active = true OR NOT $2)
+	`, dbID(id), activeOnly).Scan(&user.ID, &user.Email, &user.Name, &user.CompanyID,
+		&user.WorkspaceID, &user.Role, &user.IsActive, &user.RoleTemplateID)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("user not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return &user, nil
+}
+
+// SetActive disables or re-enables a user. Disabled users cannot sign in and
+// do not take up a seat.
+func (s *CompanyUserService) SetActive(ctx context.Context, user *models.User, active bool) error {
+	action := models.AuditUserDisabled
+	if active {
+		action = models.AuditUserEnabled
+	}
+
+	return database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+		var before bool
+		err := tx.QueryRowContext(ctx, `
+			SELECT is_active FROM users WHERE id = $1 FOR UPDATE
+		`, dbID(user.ID)).Scan(&before)
+		if err != nil {
+			return fmt.Errorf("failed to load user: %w", err)
+		}
+		if before == active {
+			user.IsActive = active
+			return nil
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			UPDATE users SET is_active = $2 WHERE id = $1
+		`, dbID(user.ID), active)
+		if err != nil {
+			return fmt.Errorf("failed to update user: %w", err)
+		}
+
+		err = s.audit.Record(ctx, tx, AuditEvent{
+			Action:      action,
+			EntityType:  "user",
+			EntityID:    user.ID,
+			CompanyID:   user.CompanyID,
+			WorkspaceID: user.WorkspaceID,
+			Before:      map[string]bool{"is_active": before},
+			After:       map[string]bool{"is_active": active},
+		})
+		if err != nil {
+			return err
+		}
+
+		user.IsActive = active
+		return nil
+	})
+}
+
+// GetCompany loads a company and the ID of its workspace. Company.Features
+// holds only the company's own overrides; use EntitlementService.Resolve for
+// the effective features.
+func (s *CompanyUserService) GetCompany(ctx context.Context, id string) (*models.Company, string, error) {
+	var company models.Company
+	var workspaceID string
+	err := database.Conn(ctx, s.db).QueryRowContext(ctx, `
+		SELECT c.id, c.name, c.slug, c.features, c.workspace_id::text
+		FROM companies c
+		WHERE c.id = $1
+	`, dbID(id)).Scan(&company.ID, &company.Name, &company.Slug, &company.Features, &workspaceID)
+
+	if err == sql.ErrNoRows {
+		return nil, "", fmt.Errorf("company not found")
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("database error: %w", err)
+	}
+
+	return &company, workspaceID, nil
+}
+
+// SeatsUsed counts active users plus open invitations for a company, which
+// is what MaxUsersPerCompany is measured against.
+func (s *CompanyUserService) SeatsUsed(ctx context.Context, companyID string) (int, error) {
+	var seats int
+	err := database.Conn(ctx, s.db).QueryRowContext(ctx, `
+		SELECT
+			(SELECT COUNT(*) FROM users WHERE company_id = $1 AND is_active = true) +
+			(SELECT COUNT(*) FROM invitations
+			 WHERE company_id = $1 AND accepted_at IS NULL AND expires_at > NOW())
+	`, companyID).Scan(&seats)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count company seats: %w", err)
+	}
+	return seats, nil
+}
+
+// ExistingEmails returns the lowercased emails of every registered user.
+// Emails are unique across the platform, not per company.
+func (s *CompanyUserService) ExistingEmails(ctx context.Context, emails []string) (map[string]bool, error) {
+	existing := make(map[string]bool)
+	if len(emails) == 0 {
+		return existing, nil
+	}
+
+	rows, err := database.Conn(ctx, s.db).QueryContext(ctx, `
+		SELECT lower(email) FROM users WHERE lower(email) = ANY($1)
+	`, pq.Array(emails))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		existing[email] = true
+	}
+
+	return existing, rows.Err()
+}
+
+// CompanyUser is a row of the user roster export.
+type CompanyUser struct {
+	ID        string
+	Email     string
+	Name      string
+	Role      string
+	IsActive  bool
+	CreatedAt time.Time
+	LastLogin *time.Time
+}
+
+// ListCompanyUsers returns the users of a company ordered by email.
+func (s *CompanyUserService) ListCompanyUsers(ctx context.Context, companyID string) ([]CompanyUser, error) {
+	var users []CompanyUser
+	err := s.EachCompanyUser(ctx, companyID, func(u CompanyUser) error {
+		users = append(users, u)
+		return nil
+	})
+	return users, err
+}
+
+// EachCompanyUser streams the users of a company ordered by email, calling fn
+// for each one. fn must not run other queries: on a tenant-bound connection
+// the rows are still being read.
+func (s *CompanyUserService) EachCompanyUser(ctx context.Context, companyID string, fn func(CompanyUser) error) error {
+	rows, err := database.Conn(ctx, s.db).QueryContext(ctx, `
+		SELECT id, email, name, role, is_active, created_at, last_login
+		FROM users
+		WHERE company_id = $1
+		ORDER BY email
+	`, companyID)
+	if err != nil {
+		return fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u CompanyUser
+		if err := rows.Scan(&u.ID, &u.Email, &u.Name, &u.Role, &u.IsActive, &u.CreatedAt, &u.LastLogin); err != nil {
+			return fmt.Errorf("failed to scan user: %w", err)
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// dbID converts an ID as the models carry it to the integer the database
+// stores, so queries compare the column itself and can use its index.
+// Anything that is not an ID becomes 0, which no row has, so a malformed ID
+// still finds nothing.
+func dbID(id string) int {
+	n, err := strconv.Atoi(id)
+	if err != nil || n < 1 {
+		return 0
+	}
+	return n
+}
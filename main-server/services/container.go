@@ -6,18 +6,18 @@ import (
 )
 
 type Container struct {
-	DB     *sql.DB
-	Config *config.Config
-	// AuditService *AuditService
+	DB           *sql.DB
+	Config       *config.Config
+	AuditService *AuditService
 	// TimeService  *TimeService
 	AuthService *AuthService
 }
 
 func NewContainer(db *sql.DB, cfg *config.Config, authService *AuthService) *Container {
 	return &Container{
-		DB:     db,
-		Config: cfg,
-		// AuditService: &AuditService{db: db}, // You'll need to create this
+		DB:           db,
+		Config:       cfg,
+		AuditService: NewAuditService(db),
 		// TimeService:  &TimeService{},        // You'll need to create this
 		AuthService: authService,
 	}
@@ -0,0 +1,300 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"main-server/database"
+	"main-server/models"
+)
+
+// Objects of direct uploads still pending this long after their presigned
+// request expired are removed, leaving time for uploads started just
+// before the expiry to finish and be completed
+const directUploadGrace = time.Hour
+
+var ErrDirectUploadUnsupported = errors.New("the storage backend does not support direct uploads")
+
+// DirectUploadService lets browsers upload audience files straight to the
+// storage backend. Init records the upload and presigns a request that
+// only accepts a file of the announced size and content type; once the
+// browser has sent it, Complete checks the stored object and registers it
+// as a quarantined audience file for ingest to check.
+type DirectUploadService struct {
+	db           *sql.DB
+	storage      StorageBackend
+	ingest       *IngestService
+	entitlements *EntitlementService
+	maxSize      int64
+	expiry       time.Duration
+}
+
+func NewDirectUploadService(db *sql.DB, storage StorageBackend, ingest *IngestService, entitlements *EntitlementService, maxSize int64, expiry time.Duration) *DirectUploadService {
+	return &DirectUploadService{db: db, storage: storage, ingest: ingest, entitlements: entitlements, maxSize: maxSize, expiry: expiry}
+}
+
+// Init records a direct upload of a size byte file, if the company has room
+// for it, and returns the request the browser must send to store it.
+func (s *DirectUploadService) Init(ctx context.Context, actor *models.User, workspaceID, companyID, filename, contentType string, size int64) (*models.DirectUpload, *PresignedUpload, error) {
+	presigner, ok := s.storage.(PresignedUploadStorage)
+	if !ok {
+		return nil, nil, ErrDirectUploadUnsupported
+	}
+	if size <= 0 {
+		return nil, nil, fmt.Errorf("%w: file size must be positive", ErrInvalidUpload)
+	}
+	if size > s.maxSize {
+		return nil, nil, fmt.Errorf("%w: direct uploads are limited to %d MB", ErrUploadTooLarge, s.maxSize>>20)
+	}
+	if filename == "" {
+		return nil, nil, fmt.Errorf("%w: filename is required", ErrInvalidUpload)
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if err := s.entitlements.CheckStorage(ctx, companyID, size); err != nil {
+		return nil, nil, err
+	}
+
+	key, err := audienceFileKey(workspaceID, companyID)
+	if err != nil {
+		return nil, nil, err
+	}
+	request, err := presigner.PresignUpload(key, UploadConditions{ContentType: contentType, Size: size, Expiry: s.expiry})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to presign upload: %w", err)
+	}
+
+	upload := &models.DirectUpload{
+		CompanyID:   companyID,
+		WorkspaceID: workspaceID,
+		CreatedBy:   actor.ID,
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        size,
+		StorageKey:  key,
+		Status:      models.DirectUploadPending,
+		ExpiresAt:   request.ExpiresAt,
+	}
+
+	err = database.Conn(ctx, s.db).QueryRowContext(ctx, `
+		INSERT INTO direct_uploads (company_id, workspace_id, created_by, filename, content_type,
+		                            size, storage_key, status, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id::text, created_at
+	`, upload.CompanyID, upload.WorkspaceID, upload.CreatedBy, upload.Filename, upload.ContentType,
+		upload.Size, upload.StorageKey, upload.Status, upload.ExpiresAt).Scan(&upload.ID, &upload.CreatedAt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to save direct upload: %w", err)
+	}
+
+	return upload, request, nil
+}
+
+// Get loads a direct upload by ID.
+func (s *DirectUploadService) Get(ctx context.Context, id string) (*models.DirectUpload, error) {
+	return getDirectUpload(ctx, database.Conn(ctx, s.db), id, false)
+}
+
+// Complete is called once the browser has sent the presigned request. It
+// checks the stored object against the upload, hashing it, and registers
+// it in audience_files, quarantined for ingest. A file that has not arrived
+// yet leaves the upload pending, so completing can be retried; one of the
+// wrong size fails it.
+func (s *DirectUploadService) Complete(ctx context.Context, upload *models.DirectUpload) (*models.AudienceFile, error) {
+	var f *models.AudienceFile
+	var rejected error
+	err := database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+		current, err := getDirectUpload(ctx, tx, upload.ID, true)
+		if err != nil {
+			return err
+		}
+		if current.Status != models.DirectUploadPending {
+			return ErrUploadSessionClosed
+		}
+
+		info, err := s.storage.Stat(ctx, current.StorageKey)
+		if errors.Is(err, ErrObjectNotFound) {
+			return fmt.Errorf("%w: the file has not been uploaded", ErrInvalidUpload)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to check upload: %w", err)
+		}
+
+		fileHash, size, err := s.hashObject(ctx, current.StorageKey)
+		if err != nil {
+			return err
+		}
+		if info.Size != current.Size || size != current.Size {
+			rejected = fmt.Errorf("%w: the file is %d bytes, expected %d", ErrInvalidUpload, size, current.Size)
+			s.removeObject(current.StorageKey)
+			_, err := tx.ExecContext(ctx, `
+				UPDATE direct_uploads SET status = $2 WHERE id = $1
+			`, current.ID, models.DirectUploadFailed)
+			return err
+		}
+
+		f = &models.AudienceFile{
+			CompanyID:        current.CompanyID,
+			Name:             current.Filename,
+			OriginalFilename: current.Filename,
+			StoragePath:      current.StorageKey,
+			ContentType:      current.ContentType,
+			FileSizeBytes:    size,
+			FileHash:         fileHash,
+			Status:           models.AudienceFileQuarantined,
+			UploadedBy:       current.CreatedBy,
+		}
+		if err := insertAudienceFile(ctx, tx, f); err != nil {
+			s.removeObject(current.StorageKey)
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			UPDATE direct_uploads
+			SET status = $2, audience_file_id = $3, completed_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+		`, current.ID, models.DirectUploadCompleted, f.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rejected != nil {
+		return nil, rejected
+	}
+
+	s.ingest.Submit(f.ID)
+	return f, nil
+}
+
+// hashObject reads a stored object back, as the browser sent it to storage
+// without passing through main-server.
+func (s *DirectUploadService) hashObject(ctx context.Context, key string) (string, int64, error) {
+	r, err := s.storage.Download(ctx, key)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read upload: %w", err)
+	}
+	defer r.Close()
+
+	sum := sha256.New()
+	size, err := io.Copy(sum, r)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read upload: %w", err)
+	}
+	return hex.EncodeToString(sum.Sum(nil)), size, nil
+}
+
+// RunEvery expires abandoned uploads every uploadSweepInterval until ctx is
+// cancelled.
+func (s *DirectUploadService) RunEvery(ctx context.Context) {
+	ticker := time.NewTicker(uploadSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := s.ExpireAbandoned(ctx); err != nil {
+				log.Printf("direct upload expiry failed: %v", err)
+			} else if n > 0 {
+				log.Printf("expired %d abandoned direct uploads", n)
+			}
+		}
+	}
+}
+
+// ExpireAbandoned marks uploads that were never completed expired and
+// removes whatever the browser stored for them. It runs on the pool,
+// outside any tenant, for every company.
+func (s *DirectUploadService) ExpireAbandoned(ctx context.Context) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id::text, storage_key
+		FROM direct_uploads
+		WHERE status = $1 AND expires_at < CURRENT_TIMESTAMP - make_interval(secs => $2)
+		ORDER BY expires_at
+		LIMIT 1000
+	`, models.DirectUploadPending, directUploadGrace.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to find abandoned direct uploads: %w", err)
+	}
+	var expired []*models.DirectUpload
+	for rows.Next() {
+		upload := &models.DirectUpload{}
+		if err := rows.Scan(&upload.ID, &upload.StorageKey); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		expired = append(expired, upload)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, upload := range expired {
+		// Marking it first means a concurrent Complete either finished
+		// before, and the object is kept, or finds the upload closed
+		res, err := s.db.ExecContext(ctx, `
+			UPDATE direct_uploads SET status = $2 WHERE id = $1 AND status = $3
+		`, upload.ID, models.DirectUploadExpired, models.DirectUploadPending)
+		if err != nil {
+			return n, fmt.Errorf("failed to expire direct upload: %w", err)
+		}
+		if affected, _ := res.RowsAffected(); affected == 0 {
+			continue
+		}
+		if err := s.storage.Delete(ctx, upload.StorageKey); err != nil {
+			return n, fmt.Errorf("failed to remove abandoned upload: %w", err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (s *DirectUploadService) removeObject(key string) {
+	if err := s.storage.Delete(context.Background(), key); err != nil {
+		log.Printf("failed to remove unrecorded upload %s: %v", key, err)
+	}
+}
+
+func getDirectUpload(ctx context.Context, q rowQuerier, id string, forUpdate bool) (*models.DirectUpload, error) {
+	// Anything else would be a UUID syntax error from the database
+	if !isUUID(id) {
+		return nil, fmt.Errorf("direct upload not found")
+	}
+
+	query := `
+		SELECT id::text, company_id::text, workspace_id::text, COALESCE(created_by::text, ''),
+		       filename, content_type, size, storage_key, status, audience_file_id,
+		       expires_at, created_at, completed_at
+		FROM direct_uploads
+		WHERE id = $1
+	`
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+
+	var upload models.DirectUpload
+	err := q.QueryRowContext(ctx, query, id).Scan(&upload.ID, &upload.CompanyID, &upload.WorkspaceID, &upload.CreatedBy,
+		&upload.Filename, &upload.ContentType, &upload.Size, &upload.StorageKey, &upload.Status, &upload.AudienceFileID,
+		&upload.ExpiresAt, &upload.CreatedAt, &upload.CompletedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("direct upload not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return &upload, nil
+}
@@ -0,0 +1,262 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"main-server/database"
+	"main-server/models"
+)
+
+// Usage metrics recorded per company and month.
+const (
+	UsageExportedRows = "export.rows"
+	UsageInvitations  = "users.invited"
+)
+
+// Live usage metrics, measured when usage is read.
+const (
+	UsageSeats        = "users.seats"
+	UsageStorageBytes = "storage.bytes"
+)
+
+// EntitlementError explains why a company cannot use a feature or exceed a
+// limit. Status is 402 when a higher plan would allow it and 403 when it has
+// been switched off by an override.
+type EntitlementError struct {
+	Status       int            `json:"-"`
+	Feature      models.Feature `json:"feature,omitempty"`
+	Limit        string         `json:"limit,omitempty"`
+	Plan         string         `json:"plan"`
+	RequiredPlan string         `json:"required_plan,omitempty"`
+	Message      string         `json:"error"`
+}
+
+func (e *EntitlementError) Error() string {
+	return e.Message
+}
+
+// EntitlementService resolves what each company's plan allows and meters
+// usage against it.
+type EntitlementService struct {
+	db    *sql.DB
+	users *CompanyUserService
+}
+
+func NewEntitlementService(db *sql.DB, users *CompanyUserService) *EntitlementService {
+	return &EntitlementService{
+		db:    db,
+		users: users,
+	}
+}
+
+// Resolve computes a company's entitlements from its workspace plan preset,
+// the workspace's feature defaults and the company's overrides, in that
+// order. Only keys present in the JSON columns change the result.
+func (s *EntitlementService) Resolve(ctx context.Context, companyID string) (*models.Entitlements, error) {
+	var plan string
+	var workspaceFeatures, companyFeatures []byte
+	err := database.Conn(ctx, s.db).QueryRowContext(ctx, `
+		SELECT w.plan, COALESCE(w.features, '{}'), COALESCE(c.features, '{}')
+		FROM companies c
+		JOIN workspaces w ON c.workspace_id = w.id
+		WHERE c.id = $1
+	`, dbID(companyID)).Scan(&plan, &workspaceFeatures, &companyFeatures)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("company not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return resolveEntitlements(plan, workspaceFeatures, companyFeatures)
+}
+
+// ResolveWorkspace computes the entitlements of a workspace as a whole: its
+// plan preset and workspace defaults, without any company's overrides.
+// Workspace-wide policies such as audit retention use these.
+func (s *EntitlementService) ResolveWorkspace(ctx context.Context, workspaceID string) (*models.Entitlements, error) {
+	var plan string
+	var workspaceFeatures []byte
+	err := database.Conn(ctx, s.db).QueryRowContext(ctx, `
+		SELECT plan, COALESCE(features, '{}') FROM workspaces WHERE id = $1
+	`, dbID(workspaceID)).Scan(&plan, &workspaceFeatures)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("workspace not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return resolveEntitlements(plan, workspaceFeatures)
+}
+
+// resolveEntitlements applies each JSON overlay to the plan preset in turn.
+func resolveEntitlements(plan string, overlays ...[]byte) (*models.Entitlements, error) {
+	ent := &models.Entitlements{
+		Plan:     plan,
+		Features: models.PlanPresets[plan],
+		Disabled: make(map[models.Feature]bool),
+	}
+	for _, overrides := range overlays {
+		if err := json.Unmarshal(overrides, &ent.Features); err != nil {
+			return nil, fmt.Errorf("invalid features: %w", err)
+		}
+
+		var set map[string]interface{}
+		if err := json.Unmarshal(overrides, &set); err != nil {
+			return nil, fmt.Errorf("invalid features: %w", err)
+		}
+		for key, value := range set {
+			if on, ok := value.(bool); ok {
+				ent.Disabled[models.Feature(key)] = !on
+			}
+		}
+	}
+
+	return ent, nil
+}
+
+// CheckFeature returns an *EntitlementError if feature is not enabled.
+func (s *EntitlementService) CheckFeature(ent *models.Entitlements, feature models.Feature) error {
+	if ent.Features.Enabled(feature) {
+		return nil
+	}
+
+	if ent.Disabled[feature] {
+		return &EntitlementError{
+			Status:  http.StatusForbidden,
+			Feature: feature,
+			Plan:    ent.Plan,
+			Message: fmt.Sprintf("The %s feature has been disabled for your company. Contact your workspace admin.", feature),
+		}
+	}
+
+	required := models.LowestPlanWith(feature)
+	return &EntitlementError{
+		Status:       http.StatusPaymentRequired,
+		Feature:      feature,
+		Plan:         ent.Plan,
+		RequiredPlan: required,
+		Message:      fmt.Sprintf("Your %s plan does not include %s. Upgrade to %s or higher.", ent.Plan, feature, required),
+	}
+}
+
+// CheckSeats returns an *EntitlementError if adding additional users or
+// invitations would take a company past MaxUsersPerCompany.
+func (s *EntitlementService) CheckSeats(ctx context.Context, companyID string, additional int) error {
+	ent, err := s.Resolve(ctx, companyID)
+	if err != nil {
+		return err
+	}
+
+	limit := ent.Features.MaxUsersPerCompany
+	if limit <= 0 {
+		return nil
+	}
+
+	used, err := s.users.SeatsUsed(ctx, companyID)
+	if err != nil {
+		return err
+	}
+	if used+additional <= limit {
+		return nil
+	}
+
+	return &EntitlementError{
+		Status:  http.StatusPaymentRequired,
+		Limit:   "max_users_per_company",
+		Plan:    ent.Plan,
+		Message: fmt.Sprintf("Your %s plan allows %d users per company and %d are in use.", ent.Plan, limit, used),
+	}
+}
+
+// CheckStorage returns an *EntitlementError if storing additional more
+// bytes of audience files would take a company past StorageQuotaMB. A
+// company already at its quota cannot store anything, so additional may be
+// 0 when the size is not known yet.
+func (s *EntitlementService) CheckStorage(ctx context.Context, companyID string, additional int64) error {
+	ent, err := s.Resolve(ctx, companyID)
+	if err != nil {
+		return err
+	}
+
+	limit := int64(ent.Features.StorageQuotaMB) << 20
+	if limit <= 0 {
+		return nil
+	}
+
+	used, err := storageUsed(ctx, database.Conn(ctx, s.db), companyID)
+	if err != nil {
+		return err
+	}
+	if used < limit && used+additional <= limit {
+		return nil
+	}
+
+	return &EntitlementError{
+		Status:  http.StatusPaymentRequired,
+		Limit:   "storage_quota_mb",
+		Plan:    ent.Plan,
+		Message: fmt.Sprintf("Your %s plan allows %s of audience files per company and %s are in use. Empty the trash or upgrade for more.", ent.Plan, formatSize(limit), formatSize(used)),
+	}
+}
+
+// RecordUsage adds delta to a company's counter for metric this month.
+func (s *EntitlementService) RecordUsage(ctx context.Context, companyID, metric string, delta int64) error {
+	_, err := database.Conn(ctx, s.db).ExecContext(ctx, `
+		INSERT INTO usage_counters (company_id, metric, period_start, value)
+		VALUES ($1, $2, date_trunc('month', NOW())::date, $3)
+		ON CONFLICT (company_id, metric, period_start)
+		DO UPDATE SET value = usage_counters.value + EXCLUDED.value, updated_at = NOW()
+	`, companyID, metric, delta)
+	if err != nil {
+		return fmt.Errorf("failed to record usage: %w", err)
+	}
+	return nil
+}
+
+// Usage returns a company's counters for the current month, plus the live
+// seat count and audience file storage.
+func (s *EntitlementService) Usage(ctx context.Context, companyID string) (map[string]int64, error) {
+	rows, err := database.Conn(ctx, s.db).QueryContext(ctx, `
+		SELECT metric, value FROM usage_counters
+		WHERE company_id = $1 AND period_start = date_trunc('month', NOW())::date
+	`, dbID(companyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage: %w", err)
+	}
+	defer rows.Close()
+
+	usage := make(map[string]int64)
+	for rows.Next() {
+		var metric string
+		var value int64
+		if err := rows.Scan(&metric, &value); err != nil {
+			return nil, fmt.Errorf("failed to scan usage: %w", err)
+		}
+		usage[metric] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	seats, err := s.users.SeatsUsed(ctx, companyID)
+	if err != nil {
+		return nil, err
+	}
+	usage[UsageSeats] = int64(seats)
+
+	stored, err := storageUsed(ctx, database.Conn(ctx, s.db), companyID)
+	if err != nil {
+		return nil, err
+	}
+	usage[UsageStorageBytes] = stored
+
+	return usage, nil
+}
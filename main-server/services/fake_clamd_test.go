@@ -0,0 +1,129 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// eicar is the standard antivirus test file, which every scanner reports
+// as infected. It is assembled here so this source file is not flagged.
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$` + `EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd stands in for the ClamAV daemon, answering the z-prefixed PING
+// and INSTREAM commands on a local TCP port. Streams containing eicar are
+// reported infected; anything else is clean.
+type fakeClamd struct {
+	// Stream length above which INSTREAM fails as clamd's would; 25 MB,
+	// clamd's default, when zero
+	StreamMaxLength int64
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu    sync.Mutex
+	scans int
+}
+
+// newFakeClamd starts a fakeClamd on a free port of 127.0.0.1, stopped
+// when the test ends.
+func newFakeClamd(t *testing.T) *fakeClamd {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeClamd{listener: l}
+	f.wg.Add(1)
+	go f.serve()
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// Addr is the host:port to give the clamd client.
+func (f *fakeClamd) Addr() string {
+	return f.listener.Addr().String()
+}
+
+// Scans counts the INSTREAM commands answered.
+func (f *fakeClamd) Scans() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.scans
+}
+
+func (f *fakeClamd) Close() error {
+	err := f.listener.Close()
+	f.wg.Wait()
+	return err
+}
+
+func (f *fakeClamd) serve() {
+	defer f.wg.Done()
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			defer conn.Close()
+			f.handle(conn)
+		}()
+	}
+}
+
+func (f *fakeClamd) handle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	command, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+
+	switch command {
+	case "zPING\x00":
+		conn.Write([]byte("PONG\x00"))
+	case "zINSTREAM\x00":
+		conn.Write([]byte(f.instream(r) + "\x00"))
+	default:
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+	}
+}
+
+func (f *fakeClamd) instream(r io.Reader) string {
+	limit := f.StreamMaxLength
+	if limit == 0 {
+		limit = 25 << 20
+	}
+
+	var data bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return "INSTREAM: read error ERROR"
+		}
+		if size == 0 {
+			break
+		}
+		if int64(data.Len())+int64(size) > limit {
+			return "INSTREAM size limit exceeded. ERROR"
+		}
+		if _, err := io.CopyN(&data, r, int64(size)); err != nil {
+			return "INSTREAM: read error ERROR"
+		}
+	}
+
+	f.mu.Lock()
+	f.scans++
+	f.mu.Unlock()
+
+	if bytes.Contains(data.Bytes(), []byte(eicar)) {
+		return "stream: Eicar-Test-Signature FOUND"
+	}
+	return "stream: OK"
+}
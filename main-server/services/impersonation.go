@@ -0,0 +1,159 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"main-server/database"
+	"main-server/models"
+)
+
+// ImpersonationService starts and ends time-limited sessions in which a
+// super admin sees the application as another user.
+type ImpersonationService struct {
+	db    *sql.DB
+	users *CompanyUserService
+	ttl   time.Duration
+}
+
+func NewImpersonationService(db *sql.DB, users *CompanyUserService, ttl time.Duration) *ImpersonationService {
+	return &ImpersonationService{
+		db:    db,
+		users: users,
+		ttl:   ttl,
+	}
+}
+
+// Start opens an impersonation session for actor acting as targetID.
+func (s *ImpersonationService) Start(ctx context.Context, actor *models.User, targetID, reason, ip string) (*models.ImpersonationSession, *models.User, error) {
+	if actor.Role != models.RoleSuperAdmin {
+		return nil, nil, fmt.Errorf("only super admins can impersonate users")
+	}
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return nil, nil, fmt.Errorf("a reason is required")
+	}
+
+	target, err := s.users.GetUser(ctx, targetID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if target.ID == actor.ID {
+		return nil, nil, fmt.Errorf("you cannot impersonate yourself")
+	}
+	if target.Role == models.RoleSuperAdmin {
+		return nil, nil, fmt.Errorf("super admins cannot be impersonated")
+	}
+
+	tx, err := database.Conn(ctx, s.db).BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	sess := &models.ImpersonationSession{
+		ImpersonatorID: actor.ID,
+		UserID:         target.ID,
+		Reason:         reason,
+		IPAddress:      ip,
+	}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO impersonation_sessions (impersonator_id, user_id, reason, ip_address, expires_at)
+		VALUES ($1, $2, $3, NULLIF($4, '')::inet, NOW() + $5 * INTERVAL '1 second')
+		RETURNING id, started_at, expires_at
+	`, actor.ID, target.ID, reason, ip, int(s.ttl.Seconds())).Scan(&sess.ID, &sess.StartedAt, &sess.ExpiresAt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start impersonation: %w", err)
+	}
+
+	if err := s.logEvent(ctx, tx, "impersonation.started", sess, target, ip); err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, fmt.Errorf("failed to commit impersonation: %w", err)
+	}
+
+	return sess, target, nil
+}
+
+// End closes a session. It is safe to call on a session that has already
+// ended or expired; the end is only recorded once.
+func (s *ImpersonationService) End(ctx context.Context, id int, ip string) error {
+	sess, err := s.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	tx, err := database.Conn(ctx, s.db).BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE impersonation_sessions SET ended_at = NOW() WHERE id = $1 AND ended_at IS NULL
+	`, id)
+	if err != nil {
+		return fmt.Errorf("failed to end impersonation: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	target, err := s.users.GetUser(ctx, sess.UserID)
+	if err != nil {
+		target = &models.User{ID: sess.UserID}
+	}
+	if err := s.logEvent(ctx, tx, "impersonation.ended", sess, target, ip); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *ImpersonationService) Get(ctx context.Context, id int) (*models.ImpersonationSession, error) {
+	var sess models.ImpersonationSession
+	err := database.Conn(ctx, s.db).QueryRowContext(ctx, `
+		SELECT id, impersonator_id::text, user_id::text, reason, COALESCE(host(ip_address), ''),
+		       started_at, expires_at, ended_at
+		FROM impersonation_sessions
+		WHERE id = $1
+	`, id).Scan(&sess.ID, &sess.ImpersonatorID, &sess.UserID, &sess.Reason, &sess.IPAddress,
+		&sess.StartedAt, &sess.ExpiresAt, &sess.EndedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("impersonation session not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return &sess, nil
+}
+
+// logEvent writes the start or end of a session to audit_logs. The super
+// admin is the actor; the impersonated user is the entity.
+func (s *ImpersonationService) logEvent(ctx context.Context, tx *sql.Tx, action string, sess *models.ImpersonationSession, target *models.User, ip string) error {
+	changes, err := json.Marshal(map[string]interface{}{
+		"reason":     sess.Reason,
+		"expires_at": sess.ExpiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO audit_logs (user_id, action, entity_type, entity_id, company_id, workspace_id,
+		                        changes, ip_address, impersonation_session_id)
+		VALUES ($1, $2, 'user', $3, NULLIF($4, '')::integer, NULLIF($5, '')::integer, $6, NULLIF($7, '')::inet, $8)
+	`, sess.ImpersonatorID, action, target.ID, target.CompanyID, target.WorkspaceID, changes, ip, sess.ID)
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"main-server/database"
+	"main-server/models"
+)
+
+const (
+	// New audience files are stored under this prefix until they are checked
+	quarantinePrefix = "quarantine/"
+
+	// A check that has not finished this long after it started is assumed
+	// to have died with its worker, and the file is checked again
+	validationTimeout = time.Hour
+	// Quarantined files waiting this long were never queued, or their job
+	// was lost, and are picked up by the sweep
+	unqueuedValidationDelay = 5 * time.Minute
+)
+
+// IngestService moves new audience files out of quarantine. Every upload
+// path stores its file under quarantinePrefix, records it as quarantined
+// and calls Submit; the check then runs on the job queue, validating the
+// file against its workspace's upload policy. Files that pass become ready,
+// stored once per company as a content-addressed blob shared by every file
+// with the same contents; files that fail are removed and rejected with a
+// reason the uploader can see. Contents the company already has in a blob
+// have passed the checks before, so only the policy is checked again. Ready
+// files are submitted to schemas to be parsed.
+//
+// Checks run on the pool, outside any tenant, as they outlive the request.
+type IngestService struct {
+	db           *sql.DB
+	storage      StorageBackend
+	validator    *UploadValidator
+	entitlements *EntitlementService
+	schemas      *AudienceSchemaService
+	jobs         *JobQueue
+	// The server-wide size limit, for workspaces without their own
+	maxSize int64
+}
+
+func NewIngestService(db *sql.DB, storage StorageBackend, validator *UploadValidator, entitlements *EntitlementService, schemas *AudienceSchemaService, jobs *JobQueue, maxSize int64) *IngestService {
+	return &IngestService{
+		db:           db,
+		storage:      storage,
+		validator:    validator,
+		entitlements: entitlements,
+		schemas:      schemas,
+		jobs:         jobs,
+		maxSize:      maxSize,
+	}
+}
+
+// Submit queues a quarantined file for checking. If the queue is full or
+// shutting down the file stays quarantined for the sweep, so the upload
+// itself still succeeds.
+func (s *IngestService) Submit(fileID int) {
+	err := s.jobs.Enqueue(fmt.Sprintf("ingest-%d", fileID), func(ctx context.Context) error {
+		return s.Process(ctx, fileID)
+	})
+	if err != nil {
+		log.Printf("audience file %d will be checked by the next sweep: %v", fileID, err)
+	}
+}
+
+// Process checks one quarantined file. It does nothing if the file is no
+// longer quarantined or another worker is checking it. A check that could
+// not complete, for example because the scanner was down, is released to
+// be tried again by the sweep.
+func (s *IngestService) Process(ctx context.Context, fileID int) error {
+	var f models.AudienceFile
+	var workspaceID string
+	err := s.db.QueryRowContext(ctx, `
+		UPDATE audience_files af
+		SET validation_started_at = CURRENT_TIMESTAMP
+		FROM companies c
+		WHERE af.id = $1 AND c.id = af.company_id AND af.status = $2
+		  AND (af.validation_started_at IS NULL
+		       OR af.validation_started_at < CURRENT_TIMESTAMP - make_interval(secs => $3))
+		RETURNING af.id, af.company_id::text, c.workspace_id::text, af.storage_path,
+		          COALESCE(af.file_size_bytes, 0), COALESCE(af.file_hash, '')
+	`, fileID, models.AudienceFileQuarantined, validationTimeout.Seconds()).Scan(
+		&f.ID, &f.CompanyID, &workspaceID, &f.StoragePath, &f.FileSizeBytes, &f.FileHash)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to claim audience file %d: %w", fileID, err)
+	}
+
+	fileType, err := s.validate(ctx, &f, workspaceID)
+	var rejected *RejectedFileError
+	if errors.As(err, &rejected) {
+		return s.reject(ctx, &f, rejected.Reason)
+	}
+	if err != nil {
+		s.release(f.ID)
+		return fmt.Errorf("failed to check audience file %d: %w", f.ID, err)
+	}
+
+	if err := s.accept(ctx, &f, workspaceID, fileType); err != nil {
+		s.release(f.ID)
+		return err
+	}
+	return nil
+}
+
+func (s *IngestService) validate(ctx context.Context, f *models.AudienceFile, workspaceID string) (string, error) {
+	ent, err := s.entitlements.ResolveWorkspace(ctx, workspaceID)
+	if err != nil {
+		return "", err
+	}
+	policy := UploadPolicy{MaxSize: s.maxSize, AllowedTypes: ent.Features.AllowedUploadTypes}
+	if ent.Features.MaxUploadSizeMB > 0 {
+		policy.MaxSize = min(policy.MaxSize, int64(ent.Features.MaxUploadSizeMB)<<20)
+	}
+
+	// The stored size is checked, not the recorded one
+	info, err := s.storage.Stat(ctx, f.StoragePath)
+	if errors.Is(err, ErrObjectNotFound) {
+		return "", rejectFile("the file was not stored")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if f.FileHash != "" {
+		blob, err := findBlob(ctx, s.db, f.CompanyID, f.FileHash)
+		if err != nil {
+			return "", err
+		}
+		if blob != nil && blob.DetectedType != "" {
+			return blob.DetectedType, policy.Check(info.Size, blob.DetectedType)
+		}
+	}
+
+	r := NewObjectReader(ctx, s.storage, f.StoragePath, info.Size)
+	defer r.Close()
+	return s.validator.Validate(ctx, r, info.Size, policy)
+}
+
+// accept moves f out of quarantine into its company's blob for its
+// contents, copying it there if the company has no such blob yet. The copy
+// is made before the blob is committed, so a blob's object always exists.
+func (s *IngestService) accept(ctx context.Context, f *models.AudienceFile, workspaceID, fileType string) error {
+	if !strings.HasPrefix(f.StoragePath, quarantinePrefix) {
+		return fmt.Errorf("audience file %d is not stored in quarantine", f.ID)
+	}
+	if f.FileHash == "" {
+		return fmt.Errorf("audience file %d has no hash", f.ID)
+	}
+
+	err := database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+		blob, created, err := referenceBlob(ctx, tx, workspaceID, f.CompanyID, f.FileHash, f.FileSizeBytes, fileType)
+		if err != nil {
+			return err
+		}
+		if created {
+			if err := s.storage.Copy(ctx, f.StoragePath, blob.StorageKey); err != nil {
+				return fmt.Errorf("failed to move audience file %d out of quarantine: %w", f.ID, err)
+			}
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			UPDATE audience_files
+			SET status = $2, storage_path = $3, blob_id = $4, detected_type = $5,
+			    validation_started_at = NULL, validated_at = CURRENT_TIMESTAMP,
+			    parse_status = $6, parse_queued_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+		`, f.ID, models.AudienceFileReady, blob.StorageKey, blob.ID, fileType, models.AudienceParseDetecting)
+		if err != nil {
+			return fmt.Errorf("failed to mark audience file %d ready: %w", f.ID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.removeObject(f.StoragePath)
+	s.schemas.Submit(f.ID)
+	return nil
+}
+
+// reject records why f failed its check and removes its object, so rejected
+// contents never stay in storage.
+func (s *IngestService) reject(ctx context.Context, f *models.AudienceFile, reason string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE audience_files
+		SET status = $2, rejection_reason = $3,
+		    validation_started_at = NULL, validated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, f.ID, models.AudienceFileRejected, reason)
+	if err != nil {
+		s.release(f.ID)
+		return fmt.Errorf("failed to reject audience file %d: %w", f.ID, err)
+	}
+
+	log.Printf("rejected audience file %d: %s", f.ID, reason)
+	s.removeObject(f.StoragePath)
+	return nil
+}
+
+// release lets the sweep check a file again. It runs on its own context,
+// as the job's may be what failed.
+func (s *IngestService) release(fileID int) {
+	_, err := s.db.ExecContext(context.Background(), `
+		UPDATE audience_files SET validation_started_at = NULL WHERE id = $1 AND status = $2
+	`, fileID, models.AudienceFileQuarantined)
+	if err != nil {
+		log.Printf("failed to release audience file %d: %v", fileID, err)
+	}
+}
+
+func (s *IngestService) removeObject(key string) {
+	if err := s.storage.Delete(context.Background(), key); err != nil {
+		log.Printf("failed to remove quarantined object %s: %v", key, err)
+	}
+}
+
+// RunEvery checks files left in quarantine every uploadSweepInterval until
+// ctx is cancelled.
+func (s *IngestService) RunEvery(ctx context.Context) {
+	ticker := time.NewTicker(uploadSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := s.Sweep(ctx); err != nil {
+				log.Printf("quarantine sweep failed: %v", err)
+			} else if n > 0 {
+				log.Printf("checked %d audience files left in quarantine", n)
+			}
+		}
+	}
+}
+
+// Sweep checks quarantined files that were never queued, whose check
+// failed, or whose worker died, one at a time. It returns how many it
+// checked.
+func (s *IngestService) Sweep(ctx context.Context) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id
+		FROM audience_files
+		WHERE status = $1
+		  AND ((validation_started_at IS NULL AND created_at < CURRENT_TIMESTAMP - make_interval(secs => $2))
+		       OR validation_started_at < CURRENT_TIMESTAMP - make_interval(secs => $3))
+		ORDER BY created_at
+		LIMIT 1000
+	`, models.AudienceFileQuarantined, unqueuedValidationDelay.Seconds(), validationTimeout.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to find quarantined audience files: %w", err)
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return n, ctx.Err()
+		}
+		if err := s.Process(ctx, id); err != nil {
+			log.Printf("audience file %d stays in quarantine: %v", id, err)
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
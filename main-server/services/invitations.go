@@ -0,0 +1,115 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"main-server/database"
+	"main-server/models"
+)
+
+const invitationTTL = 7 * 24 * time.Hour
+
+type InvitationService struct {
+	db      *sql.DB
+	mailer  Mailer
+	audit   *AuditService
+	baseURL string
+}
+
+func NewInvitationService(db *sql.DB, mailer Mailer, audit *AuditService, baseURL string) *InvitationService {
+	return &InvitationService{
+		db:      db,
+		mailer:  mailer,
+		audit:   audit,
+		baseURL: baseURL,
+	}
+}
+
+// Invite records an invitation for email to join companyID with the given
+// role, audited with the role so alert rules can see it, and emails the
+// invitee a link to accept it.
+func (s *InvitationService) Invite(ctx context.Context, email, name, role, companyID, invitedBy string) error {
+	token, err := generateToken()
+	if err != nil {
+		return fmt.Errorf("failed to generate invitation token: %w", err)
+	}
+
+	err = database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+		var id int
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO invitations (email, company_id, role, token, invited_by, expires_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id
+		`, email, companyID, role, token, invitedBy, time.Now().Add(invitationTTL)).Scan(&id)
+		if err != nil {
+			return fmt.Errorf("failed to create invitation: %w", err)
+		}
+		return s.audit.Record(ctx, tx, invitationEvent(id, email, role, companyID))
+	})
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Hi %s,\n\nYou have been invited to join the Ad Tech Platform.\n"+
+		"Accept your invitation within 7 days:\n\n%s/auth/invitations/%s\n", name, s.baseURL, token)
+
+	if err := s.mailer.Send(ctx, email, "You're invited to the Ad Tech Platform", body); err != nil {
+		return fmt.Errorf("failed to send invitation to %s: %w", email, err)
+	}
+
+	return nil
+}
+
+// invitationEvent is the audit event for a new invitation. Its new_values
+// carry the role being granted.
+func invitationEvent(id int, email, role, companyID string) AuditEvent {
+	return AuditEvent{
+		Action:     models.AuditUserInvited,
+		EntityType: "invitation",
+		EntityID:   strconv.Itoa(id),
+		CompanyID:  companyID,
+		After: map[string]string{
+			"email":      email,
+			"role":       role,
+			"company_id": companyID,
+		},
+	}
+}
+
+// PendingEmails returns the subset of emails that already have an open
+// invitation to companyID.
+func (s *InvitationService) PendingEmails(ctx context.Context, companyID string) (map[string]bool, error) {
+	rows, err := database.Conn(ctx, s.db).QueryContext(ctx, `
+		SELECT lower(email) FROM invitations
+		WHERE company_id = $1 AND accepted_at IS NULL AND expires_at > NOW()
+	`, companyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query invitations: %w", err)
+	}
+	defer rows.Close()
+
+	pending := make(map[string]bool)
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, fmt.Errorf("failed to scan invitation: %w", err)
+		}
+		pending[email] = true
+	}
+
+	return pending, rows.Err()
+}
+
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
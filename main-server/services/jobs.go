@@ -0,0 +1,105 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+)
+
+var (
+	ErrQueueFull   = errors.New("job queue is full")
+	ErrQueueClosed = errors.New("job queue is shut down")
+)
+
+// Job is a unit of background work run by a JobQueue.
+type Job func(ctx context.Context) error
+
+type queuedJob struct {
+	name string
+	run  Job
+}
+
+// JobQueue runs jobs in-process on a fixed pool of workers. It is meant for
+// follow-up work such as sending invitations; jobs still queued when the
+// process exits are lost. Work that can run for a long time, such as
+// reading audience files, gets a queue of its own so it cannot hold up the
+// rest.
+type JobQueue struct {
+	jobs   chan queuedJob
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// Guards jobs against sends once Shutdown has closed it
+	mu     sync.Mutex
+	closed bool
+}
+
+func NewJobQueue(workers, size int) *JobQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &JobQueue{
+		jobs:   make(chan queuedJob, size),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+
+	return q
+}
+
+// Enqueue schedules a job without blocking. It returns ErrQueueFull when the
+// queue has no free slots and ErrQueueClosed once Shutdown has been called,
+// which includes jobs that are still running trying to queue a follow-up.
+func (q *JobQueue) Enqueue(name string, job Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	select {
+	case q.jobs <- queuedJob{name: name, run: job}:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Shutdown stops accepting jobs and waits for queued ones to finish. If ctx
+// expires first, running jobs are cancelled.
+func (q *JobQueue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		q.cancel()
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		return ctx.Err()
+	}
+}
+
+func (q *JobQueue) work() {
+	defer q.wg.Done()
+	for job := range q.jobs {
+		if err := job.run(q.ctx); err != nil {
+			log.Printf("job %s failed: %v", job.name, err)
+		}
+	}
+}
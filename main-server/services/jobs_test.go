@@ -0,0 +1,46 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// A job still running when the queue shuts down can try to queue a
+// follow-up; it gets an error rather than a send on a closed channel.
+func TestJobQueueEnqueueAfterShutdown(t *testing.T) {
+	q := NewJobQueue(1, 1)
+	started, resume, follow := make(chan struct{}), make(chan struct{}), make(chan error)
+	err := q.Enqueue("first", func(ctx context.Context) error {
+		close(started)
+		<-resume
+		follow <- q.Enqueue("follow-up", func(ctx context.Context) error { return nil })
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	done := make(chan error)
+	go func() { done <- q.Shutdown(context.Background()) }()
+	// Shutdown marks the queue closed before waiting on the running job
+	for {
+		q.mu.Lock()
+		closed := q.closed
+		q.mu.Unlock()
+		if closed {
+			break
+		}
+	}
+	close(resume)
+	if err := <-follow; !errors.Is(err, ErrQueueClosed) {
+		t.Errorf("follow-up queued during shutdown: %v, want ErrQueueClosed", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue("late", func(ctx context.Context) error { return nil }); !errors.Is(err, ErrQueueClosed) {
+		t.Errorf("job queued after shutdown: %v, want ErrQueueClosed", err)
+	}
+}
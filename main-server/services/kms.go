@@ -0,0 +1,220 @@
+package services
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// KMS holds key-encryption keys (KEKs) and wraps data keys with them. Each
+// scope, such as a workspace, has its own versioned KEKs; the newest
+// version wraps new data keys, and older ones stay available to unwrap data
+// keys wrapped before a rotation.
+type KMS interface {
+	// WrapKey encrypts dataKey with scope's current KEK, creating the first
+	// one if scope has none, and returns it with the KEK's version.
+	WrapKey(ctx context.Context, scope string, dataKey []byte) (wrapped []byte, version string, err error)
+	UnwrapKey(ctx context.Context, scope, version string, wrapped []byte) ([]byte, error)
+	// RotateKey makes a new current KEK for scope and returns its version.
+	RotateKey(ctx context.Context, scope string) (version string, err error)
+	// CurrentVersion returns the version of scope's current KEK, or "" if
+	// it has none.
+	CurrentVersion(ctx context.Context, scope string) (string, error)
+}
+
+var validKeyScope = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+// LocalKMS keeps KEKs in files, {dir}/{scope}/{version}.key, each encrypted
+// with a master key that is not stored with them. It suits development and
+// single-region deployments; keep dir off the volume the files are stored
+// on. New versions are created exclusively, so servers sharing dir never
+// overwrite each other's keys.
+type LocalKMS struct {
+	dir    string
+	master cipher.AEAD
+
+	mu   sync.Mutex
+	keks map[string]cipher.AEAD // by scope/version
+}
+
+// NewLocalKMS returns a LocalKMS for the KEKs in dir. masterKey must be 32
+// bytes.
+func NewLocalKMS(dir string, masterKey []byte) (*LocalKMS, error) {
+	master, err := newGCM(masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &LocalKMS{dir: dir, master: master, keks: make(map[string]cipher.AEAD)}, nil
+}
+
+func (k *LocalKMS) WrapKey(ctx context.Context, scope string, dataKey []byte) ([]byte, string, error) {
+	version, err := k.CurrentVersion(ctx, scope)
+	if err != nil {
+		return nil, "", err
+	}
+	if version == "" {
+		if version, err = k.RotateKey(ctx, scope); err != nil {
+			return nil, "", err
+		}
+	}
+
+	kek, err := k.kek(scope, version)
+	if err != nil {
+		return nil, "", err
+	}
+	return seal(kek, dataKey, []byte(scope+"/"+version)), version, nil
+}
+
+func (k *LocalKMS) UnwrapKey(ctx context.Context, scope, version string, wrapped []byte) ([]byte, error) {
+	kek, err := k.kek(scope, version)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := open(kek, wrapped, []byte(scope+"/"+version))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+func (k *LocalKMS) RotateKey(ctx context.Context, scope string) (string, error) {
+	dir, err := k.scopeDir(scope)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	kek := make([]byte, 32)
+	if _, err := rand.Read(kek); err != nil {
+		return "", err
+	}
+
+	// Another server may take the next version first; the newest wins
+	for {
+		current, err := k.CurrentVersion(ctx, scope)
+		if err != nil {
+			return "", err
+		}
+		n, _ := strconv.Atoi(current)
+		version := strconv.Itoa(n + 1)
+
+		f, err := os.OpenFile(filepath.Join(dir, version+".key"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, err = f.Write(seal(k.master, kek, []byte(scope+"/"+version)))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return "", fmt.Errorf("failed to write key: %w", err)
+		}
+		return version, nil
+	}
+}
+
+func (k *LocalKMS) CurrentVersion(ctx context.Context, scope string) (string, error) {
+	dir, err := k.scopeDir(scope)
+	if err != nil {
+		return "", err
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	latest := 0
+	for _, e := range entries {
+		if n, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".key")); err == nil && n > latest {
+			latest = n
+		}
+	}
+	if latest == 0 {
+		return "", nil
+	}
+	return strconv.Itoa(latest), nil
+}
+
+// kek returns a version of scope's KEK, reading it on first use.
+func (k *LocalKMS) kek(scope, version string) (cipher.AEAD, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if kek, ok := k.keks[scope+"/"+version]; ok {
+		return kek, nil
+	}
+
+	dir, err := k.scopeDir(scope)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := strconv.Atoi(version); err != nil {
+		return nil, fmt.Errorf("invalid key version %q", version)
+	}
+	sealed, err := os.ReadFile(filepath.Join(dir, version+".key"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key %s/%s: %w", scope, version, err)
+	}
+	raw, err := open(k.master, sealed, []byte(scope+"/"+version))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt key %s/%s: %w", scope, version, err)
+	}
+	kek, err := newGCM(raw)
+	if err != nil {
+		return nil, err
+	}
+	k.keks[scope+"/"+version] = kek
+	return kek, nil
+}
+
+func (k *LocalKMS) scopeDir(scope string) (string, error) {
+	if !validKeyScope.MatchString(scope) {
+		return "", fmt.Errorf("invalid key scope %q", scope)
+	}
+	return filepath.Join(k.dir, scope), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext under a random nonce, which it prepends.
+func seal(aead cipher.AEAD, plaintext, additional []byte) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional)
+}
+
+func open(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additional)
+}
@@ -0,0 +1,20 @@
+package services
+
+import (
+	"context"
+	"log"
+)
+
+// Mailer delivers transactional email such as invitations.
+type Mailer interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// LogMailer writes messages to the server log instead of sending them. It is
+// the default in development.
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, to, subject, body string) error {
+	log.Printf("mail to=%s subject=%q\n%s", to, subject, body)
+	return nil
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// MalwareScanner checks file contents for malware. An error means the scan
+// did not complete, not that anything was found.
+type MalwareScanner interface {
+	Scan(ctx context.Context, r io.Reader) (*ScanResult, error)
+}
+
+type ScanResult struct {
+	Infected bool
+	// Name of the signature that matched, when infected
+	Signature string
+}
+
+// clamdChunkSize is how much of the file goes into each INSTREAM chunk
+const clamdChunkSize = 64 << 10
+
+// ClamAVScanner streams files to a clamd daemon with the INSTREAM command.
+// clamd refuses streams longer than its StreamMaxLength, 25 MB by default,
+// which must be raised to cover the largest upload allowed.
+type ClamAVScanner struct {
+	network string
+	addr    string
+	timeout time.Duration
+}
+
+// NewClamAVScanner returns a scanner for the clamd listening on addr, a
+// host:port or, starting with a slash, a unix socket path. timeout bounds
+// each scan.
+func NewClamAVScanner(addr string, timeout time.Duration) *ClamAVScanner {
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+	}
+	return &ClamAVScanner{network: network, addr: addr, timeout: timeout}
+}
+
+// Ping checks clamd is up.
+func (s *ClamAVScanner) Ping(ctx context.Context) error {
+	reply, err := s.command(ctx, func(conn net.Conn) error {
+		_, err := conn.Write([]byte("zPING\x00"))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected clamd reply %q", reply)
+	}
+	return nil
+}
+
+func (s *ClamAVScanner) Scan(ctx context.Context, r io.Reader) (*ScanResult, error) {
+	reply, err := s.command(ctx, func(conn net.Conn) error {
+		if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+			return err
+		}
+		w := bufio.NewWriterSize(conn, clamdChunkSize+4)
+		buf := make([]byte, clamdChunkSize)
+		for {
+			n, err := io.ReadFull(r, buf)
+			if n > 0 {
+				if err := binary.Write(w, binary.BigEndian, uint32(n)); err != nil {
+					return err
+				}
+				if _, err := w.Write(buf[:n]); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read file: %w", err)
+			}
+		}
+		// A zero length chunk ends the stream
+		if err := binary.Write(w, binary.BigEndian, uint32(0)); err != nil {
+			return err
+		}
+		return w.Flush()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Replies are "stream: OK", "stream: <signature> FOUND" or
+	// "<reason> ERROR"
+	result, ok := strings.CutPrefix(reply, "stream: ")
+	switch {
+	case ok && result == "OK":
+		return &ScanResult{}, nil
+	case ok && strings.HasSuffix(result, " FOUND"):
+		return &ScanResult{Infected: true, Signature: strings.TrimSuffix(result, " FOUND")}, nil
+	default:
+		return nil, fmt.Errorf("clamd scan failed: %s", reply)
+	}
+}
+
+// command sends a request on a new connection and reads the one reply,
+// which is NUL terminated for z-prefixed commands.
+func (s *ClamAVScanner) command(ctx context.Context, send func(conn net.Conn) error) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, s.network, s.addr)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// clamd answers a stream over its limit before reading all of it, so a
+	// failed write still leaves a reply worth reading
+	sendErr := send(conn)
+	var netErr *net.OpError
+	if sendErr != nil && !errors.As(sendErr, &netErr) {
+		return "", sendErr
+	}
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && len(reply) == 0 {
+		if sendErr != nil {
+			return "", fmt.Errorf("failed to send to clamd: %w", sendErr)
+		}
+		return "", fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+	return string(bytes.TrimRight(reply, "\x00\n")), nil
+}
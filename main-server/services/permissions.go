@@ -0,0 +1,358 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"main-server/database"
+	"main-server/models"
+
+	"github.com/lib/pq"
+)
+
+// PermissionService resolves a user's effective capabilities and manages
+// role templates and per-user overrides. Capabilities start from the user's
+// role template (or their role defaults when none is assigned) and are then
+// adjusted by any overrides.
+type PermissionService struct {
+	db    *sql.DB
+	audit *AuditService
+}
+
+func NewPermissionService(db *sql.DB, audit *AuditService) *PermissionService {
+	return &PermissionService{
+		db:    db,
+		audit: audit,
+	}
+}
+
+// Load fills in user.Permissions.
+func (s *PermissionService) Load(ctx context.Context, user *models.User) error {
+	perms, err := s.Effective(ctx, user)
+	if err != nil {
+		return err
+	}
+	user.Permissions = perms
+	return nil
+}
+
+// Effective computes the capabilities a user holds.
+func (s *PermissionService) Effective(ctx context.Context, user *models.User) (models.PermissionSet, error) {
+	if user.Role == models.RoleSuperAdmin || user.Role == models.RoleWorkspaceAdmin {
+		return models.NewPermissionSet(models.AllCapabilities...), nil
+	}
+
+	perms := models.DefaultCapabilities(user.Role)
+	if user.RoleTemplateID != nil {
+		tmpl, err := s.GetTemplate(ctx, *user.RoleTemplateID)
+		if err != nil {
+			return nil, err
+		}
+		perms = tmpl.PermissionSet()
+	}
+
+	overrides, err := s.Overrides(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range overrides {
+		perms[o.Capability] = o.Granted
+	}
+
+	return perms, nil
+}
+
+// Overrides lists the per-user grants and revocations for a user.
+func (s *PermissionService) Overrides(ctx context.Context, userID string) ([]models.PermissionOverride, error) {
+	rows, err := database.Conn(ctx, s.db).QueryContext(ctx, `
+		SELECT user_id::text, capability, granted, COALESCE(granted_by::text, ''), created_at
+		FROM user_permission_overrides
+		WHERE user_id = $1
+		ORDER BY capability
+	`, dbID(userID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query permission overrides: %w", err)
+	}
+	defer rows.Close()
+
+	var overrides []models.PermissionOverride
+	for rows.Next() {
+		var o models.PermissionOverride
+		if err := rows.Scan(&o.UserID, &o.Capability, &o.Granted, &o.GrantedBy, &o.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan permission override: %w", err)
+		}
+		overrides = append(overrides, o)
+	}
+
+	return overrides, rows.Err()
+}
+
+// SetOverride grants (granted = true) or revokes (granted = false) a single
+// capability for a user, replacing any earlier override.
+func (s *PermissionService) SetOverride(ctx context.Context, user *models.User, c models.Capability, granted bool, grantedBy string) error {
+	if !models.ValidCapability(c) {
+		return fmt.Errorf("unknown capability %q", c)
+	}
+
+	action, state := models.AuditPermissionRevoked, "revoked"
+	if granted {
+		action, state = models.AuditPermissionGranted, "granted"
+	}
+
+	return database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+		before, err := overrideState(ctx, tx, user.ID, c)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO user_permission_overrides (user_id, capability, granted, granted_by)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id, capability)
+			DO UPDATE SET granted = EXCLUDED.granted, granted_by = EXCLUDED.granted_by, created_at = NOW()
+		`, user.ID, c, granted, grantedBy)
+		if err != nil {
+			return fmt.Errorf("failed to save permission override: %w", err)
+		}
+
+		return s.audit.Record(ctx, tx, AuditEvent{
+			Action:      action,
+			EntityType:  "user",
+			EntityID:    user.ID,
+			CompanyID:   user.CompanyID,
+			WorkspaceID: user.WorkspaceID,
+			Before:      map[string]string{string(c): before},
+			After:       map[string]string{string(c): state},
+		})
+	})
+}
+
+// ClearOverride removes a user's override so the capability is inherited
+// from their role or template again.
+func (s *PermissionService) ClearOverride(ctx context.Context, user *models.User, c models.Capability) error {
+	return database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+		before, err := overrideState(ctx, tx, user.ID, c)
+		if err != nil {
+			return err
+		}
+		if before == "inherited" {
+			return nil
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			DELETE FROM user_permission_overrides WHERE user_id = $1 AND capability = $2
+		`, dbID(user.ID), c)
+		if err != nil {
+			return fmt.Errorf("failed to clear permission override: %w", err)
+		}
+
+		return s.audit.Record(ctx, tx, AuditEvent{
+			Action:      models.AuditPermissionReset,
+			EntityType:  "user",
+			EntityID:    user.ID,
+			CompanyID:   user.CompanyID,
+			WorkspaceID: user.WorkspaceID,
+			Before:      map[string]string{string(c): before},
+			After:       map[string]string{string(c): "inherited"},
+		})
+	})
+}
+
+// overrideState locks and describes a user's override for one capability:
+// "granted", "revoked" or "inherited" when there is none.
+func overrideState(ctx context.Context, tx *sql.Tx, userID string, c models.Capability) (string, error) {
+	var granted bool
+	err := tx.QueryRowContext(ctx, `
+		SELECT granted FROM user_permission_overrides
+		WHERE user_id = $1 AND capability = $2
+		FOR UPDATE
+	`, dbID(userID), c).Scan(&granted)
+
+	switch {
+	case err == sql.ErrNoRows:
+		return "inherited", nil
+	case err != nil:
+		return "", fmt.Errorf("failed to load permission override: %w", err)
+	case granted:
+		return "granted", nil
+	default:
+		return "revoked", nil
+	}
+}
+
+// ListTemplates returns the role templates defined by a company.
+func (s *PermissionService) ListTemplates(ctx context.Context, companyID string) ([]models.RoleTemplate, error) {
+	rows, err := database.Conn(ctx, s.db).QueryContext(ctx, `
+		SELECT id, company_id::text, name, capabilities, created_at, updated_at
+		FROM role_templates
+		WHERE company_id = $1
+		ORDER BY name
+	`, dbID(companyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query role templates: %w", err)
+	}
+	defer rows.Close()
+
+	var templates []models.RoleTemplate
+	for rows.Next() {
+		var t models.RoleTemplate
+		if err := rows.Scan(&t.ID, &t.CompanyID, &t.Name, &t.Capabilities, &t.CreatedAt, &t.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan role template: %w", err)
+		}
+		templates = append(templates, t)
+	}
+
+	return templates, rows.Err()
+}
+
+func (s *PermissionService) GetTemplate(ctx context.Context, id int) (*models.RoleTemplate, error) {
+	return getTemplate(ctx, database.Conn(ctx, s.db), id, false)
+}
+
+// SaveTemplate creates a role template, or updates it when t.ID is set.
+func (s *PermissionService) SaveTemplate(ctx context.Context, t *models.RoleTemplate, createdBy string) error {
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" {
+		return fmt.Errorf("template name is required")
+	}
+	for _, c := range t.Capabilities {
+		if !models.ValidCapability(models.Capability(c)) {
+			return fmt.Errorf("unknown capability %q", c)
+		}
+	}
+
+	return database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+		var before *models.RoleTemplate
+		action := models.AuditRoleTemplateCreated
+
+		var err error
+		if t.ID == 0 {
+			err = tx.QueryRowContext(ctx, `
+				INSERT INTO role_templates (company_id, name, capabilities, created_by)
+				VALUES ($1, $2, $3, $4)
+				RETURNING id, created_at, updated_at
+			`, t.CompanyID, t.Name, pq.Array(t.Capabilities), createdBy).Scan(&t.ID, &t.CreatedAt, &t.UpdatedAt)
+		} else {
+			action = models.AuditRoleTemplateUpdated
+			before, err = getTemplate(ctx, tx, t.ID, true)
+			if err != nil {
+				return err
+			}
+
+			err = tx.QueryRowContext(ctx, `
+				UPDATE role_templates
+				SET name = $2, capabilities = $3, updated_at = NOW()
+				WHERE id = $1
+				RETURNING created_at, updated_at
+			`, t.ID, t.Name, pq.Array(t.Capabilities)).Scan(&t.CreatedAt, &t.UpdatedAt)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to save role template: %w", err)
+		}
+
+		return s.audit.Record(ctx, tx, AuditEvent{
+			Action:     action,
+			EntityType: "role_template",
+			EntityID:   strconv.Itoa(t.ID),
+			CompanyID:  t.CompanyID,
+			Before:     templateFields(before),
+			After:      templateFields(t),
+		})
+	})
+}
+
+// DeleteTemplate removes a template. Users assigned to it fall back to their
+// role defaults.
+func (s *PermissionService) DeleteTemplate(ctx context.Context, id int) error {
+	return database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+		before, err := getTemplate(ctx, tx, id, true)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `DELETE FROM role_templates WHERE id = $1`, id); err != nil {
+			return fmt.Errorf("failed to delete role template: %w", err)
+		}
+
+		return s.audit.Record(ctx, tx, AuditEvent{
+			Action:     models.AuditRoleTemplateDeleted,
+			EntityType: "role_template",
+			EntityID:   strconv.Itoa(id),
+			CompanyID:  before.CompanyID,
+			Before:     templateFields(before),
+		})
+	})
+}
+
+// AssignTemplate sets (or with templateID nil, clears) a user's role template.
+func (s *PermissionService) AssignTemplate(ctx context.Context, user *models.User, templateID *int) error {
+	return database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+		var before *int
+		err := tx.QueryRowContext(ctx, `
+			SELECT role_template_id FROM users WHERE id = $1 FOR UPDATE
+		`, dbID(user.ID)).Scan(&before)
+		if err != nil {
+			return fmt.Errorf("failed to load user: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			UPDATE users SET role_template_id = $2 WHERE id = $1
+		`, dbID(user.ID), templateID)
+		if err != nil {
+			return fmt.Errorf("failed to assign role template: %w", err)
+		}
+
+		return s.audit.Record(ctx, tx, AuditEvent{
+			Action:      models.AuditUserRoleTemplateAssigned,
+			EntityType:  "user",
+			EntityID:    user.ID,
+			CompanyID:   user.CompanyID,
+			WorkspaceID: user.WorkspaceID,
+			Before:      map[string]*int{"role_template_id": before},
+			After:       map[string]*int{"role_template_id": templateID},
+		})
+	})
+}
+
+// rowQuerier is satisfied by *sql.Tx as well as database.Querier.
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func getTemplate(ctx context.Context, q rowQuerier, id int, forUpdate bool) (*models.RoleTemplate, error) {
+	query := `
+		SELECT id, company_id::text, name, capabilities, created_at, updated_at
+		FROM role_templates
+		WHERE id = $1
+	`
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+
+	var t models.RoleTemplate
+	err := q.QueryRowContext(ctx, query, id).Scan(&t.ID, &t.CompanyID, &t.Name, &t.Capabilities, &t.CreatedAt, &t.UpdatedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("role template not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return &t, nil
+}
+
+// templateFields is the audited state of a template. Timestamps are left
+// out so they don't show up in every diff.
+func templateFields(t *models.RoleTemplate) map[string]interface{} {
+	if t == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"name":         t.Name,
+		"capabilities": []string(t.Capabilities),
+	}
+}
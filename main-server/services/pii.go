@@ -0,0 +1,489 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"main-server/models"
+)
+
+// Platforms audience files are prepared for, by their slug in the platforms
+// table.
+const (
+	PlatformMeta      = "meta"
+	PlatformGoogleAds = "google_ads"
+	PlatformTTD       = "ttd"
+)
+
+// AudiencePlatforms lists the platforms every processed audience file is
+// prepared for.
+var AudiencePlatforms = []string{PlatformMeta, PlatformGoogleAds, PlatformTTD}
+
+// DefaultAudienceCountry is the country rows are taken to be in when their
+// file has no country column and none was chosen for it. Phone numbers
+// without a country code, and zips, are read as of a row's country.
+const DefaultAudienceCountry = "US"
+
+// phoneCountry is how phone numbers are written in a country: its calling
+// code, the trunk prefix national numbers are dialled with, if any, and the
+// most digits a national number has without it.
+type phoneCountry struct {
+	callingCode string
+	trunk       string
+	maxNational int
+}
+
+// Countries phone numbers without a country code can be read for. Numbers
+// with one can be from anywhere.
+var phoneCountries = map[string]phoneCountry{
+	"US": {"1", "1", 10}, "CA": {"1", "1", 10},
+	"GB": {"44", "0", 10}, "IE": {"353", "0", 9}, "FR": {"33", "0", 9}, "DE": {"49", "0", 11},
+	"ES": {"34", "", 9}, "IT": {"39", "", 11}, "NL": {"31", "0", 9}, "BE": {"32", "0", 9},
+	"CH": {"41", "0", 9}, "AT": {"43", "0", 13}, "SE": {"46", "0", 9}, "NO": {"47", "", 8},
+	"DK": {"45", "", 8}, "FI": {"358", "0", 10}, "PL": {"48", "", 9}, "PT": {"351", "", 9},
+	"GR": {"30", "", 10}, "CZ": {"420", "", 9}, "HU": {"36", "06", 9}, "RO": {"40", "0", 9},
+	"AU": {"61", "0", 9}, "NZ": {"64", "0", 10}, "JP": {"81", "0", 10}, "KR": {"82", "0", 10},
+	"CN": {"86", "0", 11}, "IN": {"91", "0", 10}, "SG": {"65", "", 8}, "HK": {"852", "", 8},
+	"MX": {"52", "", 10}, "BR": {"55", "0", 11}, "AR": {"54", "0", 10}, "CL": {"56", "", 9},
+	"CO": {"57", "", 10}, "ZA": {"27", "0", 9}, "AE": {"971", "0", 9}, "IL": {"972", "0", 9},
+	"TR": {"90", "0", 10}, "PH": {"63", "0", 10}, "ID": {"62", "0", 12}, "MY": {"60", "0", 10},
+	"TH": {"66", "0", 9},
+}
+
+// Country names and codes other than ISO 3166-1 alpha-2 ones that files
+// use, lowercased with everything but letters removed.
+var countryAliases = map[string]string{
+	"usa": "US", "unitedstates": "US", "unitedstatesofamerica": "US", "america": "US",
+	"uk": "GB", "gbr": "GB", "unitedkingdom": "GB", "greatbritain": "GB", "england": "GB",
+	"scotland": "GB", "wales": "GB", "northernireland": "GB",
+	"can": "CA", "canada": "CA", "ireland": "IE", "irl": "IE", "fra": "FR", "france": "FR",
+	"deu": "DE", "germany": "DE", "deutschland": "DE", "esp": "ES", "spain": "ES", "espana": "ES",
+	"ita": "IT", "italy": "IT", "italia": "IT", "nld": "NL", "netherlands": "NL", "holland": "NL",
+	"bel": "BE", "belgium": "BE", "che": "CH", "switzerland": "CH", "aut": "AT", "austria": "AT",
+	"swe": "SE", "sweden": "SE", "nor": "NO", "norway": "NO", "dnk": "DK", "denmark": "DK",
+	"fin": "FI", "finland": "FI", "pol": "PL", "poland": "PL", "prt": "PT", "portugal": "PT",
+	"aus": "AU", "australia": "AU", "nzl": "NZ", "newzealand": "NZ", "jpn": "JP", "japan": "JP",
+	"ind": "IN", "india": "IN", "mex": "MX", "mexico": "MX", "bra": "BR", "brazil": "BR",
+	"zaf": "ZA", "southafrica": "ZA", "sgp": "SG", "singapore": "SG",
+}
+
+var (
+	// Extensions cannot be matched on, so they are dropped
+	phoneExtension = regexp.MustCompile(`(?i)\s*(ext\.?|extension|x|#)\s*\d+\s*$`)
+	// Characters phone numbers are written with besides digits
+	phoneSeparators = regexp.MustCompile(`[\s().\-/]`)
+	postalCodeChars = regexp.MustCompile(`^[A-Z0-9][A-Z0-9 \-]{1,9}$`)
+	countryCode     = regexp.MustCompile(`^[A-Z]{2}$`)
+)
+
+// NormalizeEmail trims and lowercases an email address, and reports whether
+// it is one.
+func NormalizeEmail(s string) (string, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if !emailPattern.MatchString(s) || strings.Contains(s, "..") {
+		return "", false
+	}
+	return s, true
+}
+
+// NormalizePhone writes a phone number in E.164, +{country code}{number},
+// and reports whether it is one. Numbers with a "+" or an international
+// dialling prefix keep their country code; others are read as numbers of
+// country, an ISO 3166-1 alpha-2 code, with its trunk prefix dropped.
+// Extensions are dropped, and numbers with letters are refused.
+func NormalizePhone(s, country string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if loc := phoneExtension.FindStringIndex(s); loc != nil {
+		s = s[:loc[0]]
+	}
+	s = phoneSeparators.ReplaceAllString(s, "")
+	international := strings.HasPrefix(s, "+")
+	digits := strings.TrimPrefix(s, "+")
+	if digits == "" || strings.IndexFunc(digits, func(r rune) bool { return r < '0' || r > '9' }) >= 0 {
+		return "", false
+	}
+
+	pc, known := phoneCountries[country]
+	nanp := known && pc.callingCode == "1"
+	switch {
+	case international:
+	case nanp && strings.HasPrefix(digits, "011"):
+		digits = digits[3:]
+	case !nanp && strings.HasPrefix(digits, "00"):
+		digits = digits[2:]
+	case !known:
+		return "", false
+	case nanp:
+		if len(digits) == 11 && digits[0] == '1' {
+			digits = digits[1:]
+		}
+		// Area codes and exchanges never start with 0 or 1
+		if len(digits) != 10 || digits[0] < '2' || digits[3] < '2' {
+			return "", false
+		}
+		digits = "1" + digits
+	case len(digits) > pc.maxNational && strings.HasPrefix(digits, pc.callingCode) &&
+		len(digits)-len(pc.callingCode) <= pc.maxNational:
+		// Written with the country code but without the "+"
+	default:
+		if pc.trunk != "" {
+			digits = strings.TrimPrefix(digits, pc.trunk)
+		}
+		if len(digits) > pc.maxNational {
+			return "", false
+		}
+		digits = pc.callingCode + digits
+	}
+
+	if len(digits) < 8 || len(digits) > 15 || digits[0] == '0' {
+		return "", false
+	}
+	return "+" + digits, true
+}
+
+// NormalizeName trims and lowercases a first or last name, with runs of
+// whitespace made single spaces, and reports whether it has any letters.
+func NormalizeName(s string) (string, bool) {
+	s = strings.ToLower(strings.Join(strings.Fields(s), " "))
+	if strings.IndexFunc(s, unicode.IsLetter) < 0 {
+		return "", false
+	}
+	return s, true
+}
+
+// NormalizeZip writes a postal code of country in upper case with single
+// spaces, and reports whether it is one. US zips are cut to their first
+// five digits, with the leading zeros spreadsheets drop put back.
+func NormalizeZip(s, country string) (string, bool) {
+	s = strings.ToUpper(strings.Join(strings.Fields(s), " "))
+	if country == "US" {
+		digits := strings.ReplaceAll(strings.ReplaceAll(s, "-", ""), " ", "")
+		switch {
+		case len(digits) == 9:
+			digits = digits[:5]
+		case len(digits) >= 3 && len(digits) < 5:
+			digits = strings.Repeat("0", 5-len(digits)) + digits
+		}
+		if len(digits) != 5 || strings.IndexFunc(digits, func(r rune) bool { return r < '0' || r > '9' }) >= 0 {
+			return "", false
+		}
+		return digits, true
+	}
+	if !postalCodeChars.MatchString(s) {
+		return "", false
+	}
+	return s, true
+}
+
+// NormalizeCountry returns the ISO 3166-1 alpha-2 code of a country, given
+// as one, as some other common code or by its English name, and reports
+// whether it knows it.
+func NormalizeCountry(s string) (string, bool) {
+	key := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r
+		}
+		return -1
+	}, strings.ToLower(s))
+	if code, ok := countryAliases[key]; ok {
+		return code, true
+	}
+	if code := strings.ToUpper(key); countryCode.MatchString(code) {
+		return code, true
+	}
+	return "", false
+}
+
+// NormalizeMAID lowercases a mobile ad ID, an IDFA or Android advertising
+// ID, and reports whether it is one. Devices limiting ad tracking report an
+// ID of zeros, which is refused.
+func NormalizeMAID(s string) (string, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if !maidPattern.MatchString(s) || strings.Trim(s, "0-") == "" {
+		return "", false
+	}
+	return s, true
+}
+
+// HashIdentifier returns the SHA-256 of a normalized identifier in
+// lowercase hex.
+func HashIdentifier(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// hashIdentifierBase64 returns the SHA-256 of a normalized identifier in
+// standard base64, as UID2 takes it.
+func hashIdentifierBase64(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Identity is the identifiers of one audience file row, normalized. Those
+// not mapped, empty or not valid are left empty. Country is the row's own,
+// or its file's when the row has none.
+type Identity struct {
+	Email     string
+	Phone     string // E.164
+	MAID      string
+	FirstName string
+	LastName  string
+	Zip       string
+	Country   string // ISO 3166-1 alpha-2
+}
+
+// NormalizeRow picks the identifiers of a row out under mapping and
+// normalizes them. Rows without a valid country of their own are taken to
+// be in country.
+func NormalizeRow(row []string, mapping models.ColumnMapping, country string) Identity {
+	value := func(t string) string {
+		if i, ok := mapping[t]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+
+	id := Identity{Country: country}
+	if c, ok := NormalizeCountry(value(models.IdentifierCountry)); ok {
+		id.Country = c
+	}
+	id.Email, _ = NormalizeEmail(value(models.IdentifierEmail))
+	id.Phone, _ = NormalizePhone(value(models.IdentifierPhone), id.Country)
+	id.MAID, _ = NormalizeMAID(value(models.IdentifierMAID))
+	id.FirstName, _ = NormalizeName(value(models.IdentifierFirstName))
+	id.LastName, _ = NormalizeName(value(models.IdentifierLastName))
+	id.Zip, _ = NormalizeZip(value(models.IdentifierZip), id.Country)
+	return id
+}
+
+// Matchable reports whether the identity has enough valid identifiers to
+// be matched on.
+func (id Identity) Matchable() bool {
+	return identifiable(func(t string) bool { return id.get(t) != "" })
+}
+
+func (id Identity) get(identifierType string) string {
+	switch identifierType {
+	case models.IdentifierEmail:
+		return id.Email
+	case models.IdentifierPhone:
+		return id.Phone
+	case models.IdentifierMAID:
+		return id.MAID
+	case models.IdentifierFirstName:
+		return id.FirstName
+	case models.IdentifierLastName:
+		return id.LastName
+	case models.IdentifierZip:
+		return id.Zip
+	case models.IdentifierCountry:
+		return id.Country
+	}
+	return ""
+}
+
+// PlatformEncoder writes identities the way one platform's audience uploads
+// take them: normalized by the platform's published rules, with contact
+// details SHA-256 hashed and mobile ad IDs as they are. Its columns are
+// those of the identifier types a file's mapping has.
+//
+//   - Meta Custom Audiences: EMAIL, PHONE (digits with the country code, no
+//     "+"), FN and LN (letters only), ZIP (no spaces or dashes; UK
+//     postcodes without their last two letters) and COUNTRY, hashed and
+//     lowercased, and MADID.
+//   - Google Ads Customer Match: Email (with the dots of Gmail addresses'
+//     names removed), Phone (E.164) and First Name and Last Name, hashed;
+//     Country and Zip, which are not; or, for files without contact
+//     details, Mobile Device ID, as a list may not have both. Names, country
+//     and zip are only sent together.
+//   - The Trade Desk, as UID2: email_hash (Gmail addresses without the dots
+//     or "+" suffix of their names) and phone_hash (E.164), hashed and
+//     base64 encoded, and device_id. Names and zips are not taken.
+type PlatformEncoder struct {
+	columns []string
+	values  func(Identity) []string
+}
+
+// NewPlatformEncoder returns the encoder for a platform and mapping, or nil
+// if the platform is not one of AudiencePlatforms.
+func NewPlatformEncoder(platform string, mapping models.ColumnMapping) *PlatformEncoder {
+	has := func(t string) bool { _, ok := mapping[t]; return ok }
+	hashed := func(s string) string {
+		if s == "" {
+			return ""
+		}
+		return HashIdentifier(s)
+	}
+
+	e := &PlatformEncoder{}
+	var fields []func(Identity) string
+	add := func(column string, value func(Identity) string) {
+		e.columns = append(e.columns, column)
+		fields = append(fields, value)
+	}
+
+	switch platform {
+	case PlatformMeta:
+		if has(models.IdentifierEmail) {
+			add("EMAIL", func(id Identity) string { return hashed(id.Email) })
+		}
+		if has(models.IdentifierPhone) {
+			add("PHONE", func(id Identity) string { return hashed(strings.TrimPrefix(id.Phone, "+")) })
+		}
+		if has(models.IdentifierMAID) {
+			add("MADID", func(id Identity) string { return id.MAID })
+		}
+		if has(models.IdentifierFirstName) {
+			add("FN", func(id Identity) string { return hashed(metaName(id.FirstName)) })
+		}
+		if has(models.IdentifierLastName) {
+			add("LN", func(id Identity) string { return hashed(metaName(id.LastName)) })
+		}
+		if has(models.IdentifierZip) {
+			add("ZIP", func(id Identity) string { return hashed(metaZip(id.Zip, id.Country)) })
+		}
+		add("COUNTRY", func(id Identity) string { return hashed(strings.ToLower(id.Country)) })
+		e.values = encodeMatchable(fields, Identity.Matchable)
+
+	case PlatformGoogleAds:
+		contact := has(models.IdentifierEmail) || has(models.IdentifierPhone) ||
+			has(models.IdentifierFirstName) && has(models.IdentifierLastName) && has(models.IdentifierZip)
+		if !contact {
+			add("Mobile Device ID", func(id Identity) string { return id.MAID })
+			e.values = encodeMatchable(fields, func(id Identity) bool { return id.MAID != "" })
+			break
+		}
+		if has(models.IdentifierEmail) {
+			add("Email", func(id Identity) string { return hashed(googleEmail(id.Email)) })
+		}
+		if has(models.IdentifierPhone) {
+			add("Phone", func(id Identity) string { return hashed(id.Phone) })
+		}
+		if has(models.IdentifierFirstName) && has(models.IdentifierLastName) && has(models.IdentifierZip) {
+			address := func(value func(Identity) string) func(Identity) string {
+				return func(id Identity) string {
+					if !googleAddress(id) {
+						return ""
+					}
+					return value(id)
+				}
+			}
+			add("First Name", address(func(id Identity) string { return hashed(id.FirstName) }))
+			add("Last Name", address(func(id Identity) string { return hashed(id.LastName) }))
+			add("Country", address(func(id Identity) string { return id.Country }))
+			add("Zip", address(func(id Identity) string { return id.Zip }))
+		}
+		e.values = encodeMatchable(fields, func(id Identity) bool {
+			return id.Email != "" || id.Phone != "" || googleAddress(id)
+		})
+
+	case PlatformTTD:
+		if has(models.IdentifierEmail) {
+			add("email_hash", func(id Identity) string {
+				if id.Email == "" {
+					return ""
+				}
+				return hashIdentifierBase64(uid2Email(id.Email))
+			})
+		}
+		if has(models.IdentifierPhone) {
+			add("phone_hash", func(id Identity) string {
+				if id.Phone == "" {
+					return ""
+				}
+				return hashIdentifierBase64(id.Phone)
+			})
+		}
+		if has(models.IdentifierMAID) {
+			add("device_id", func(id Identity) string { return id.MAID })
+		}
+		e.values = encodeMatchable(fields, func(id Identity) bool {
+			return id.Email != "" || id.Phone != "" || id.MAID != ""
+		})
+
+	default:
+		return nil
+	}
+	return e
+}
+
+// encodeMatchable returns a function writing the fields of identities the
+// platform can match.
+func encodeMatchable(fields []func(Identity) string, matchable func(Identity) bool) func(Identity) []string {
+	return func(id Identity) []string {
+		if !matchable(id) {
+			return nil
+		}
+		values := make([]string, len(fields))
+		for i, field := range fields {
+			values[i] = field(id)
+		}
+		return values
+	}
+}
+
+// Columns returns the header of the platform's upload.
+func (e *PlatformEncoder) Columns() []string {
+	return e.columns
+}
+
+// Record returns an identity's row of the platform's upload, or nil if the
+// platform cannot match it on what it has.
+func (e *PlatformEncoder) Record(id Identity) []string {
+	return e.values(id)
+}
+
+// metaName keeps only the letters of a name, as Meta matches names without
+// punctuation or spaces.
+func metaName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.Is(unicode.Mn, r) {
+			return r
+		}
+		return -1
+	}, name)
+}
+
+// metaZip lowercases a zip without spaces or dashes. UK postcodes are cut
+// to their area, district and sector, as Meta matches them.
+func metaZip(zip, country string) string {
+	if zip == "" {
+		return ""
+	}
+	zip = strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(zip))
+	if country == "GB" && len(zip) > 4 {
+		zip = zip[:len(zip)-2]
+	}
+	return zip
+}
+
+// googleEmail removes the dots from the names of Gmail addresses, which
+// Gmail ignores.
+func googleEmail(email string) string {
+	name, domain, ok := strings.Cut(email, "@")
+	if !ok || domain != "gmail.com" && domain != "googlemail.com" {
+		return email
+	}
+	return strings.ReplaceAll(name, ".", "") + "@" + domain
+}
+
+// googleAddress reports whether an identity has the whole address Google
+// Ads matches on.
+func googleAddress(id Identity) bool {
+	return id.FirstName != "" && id.LastName != "" && id.Zip != "" && id.Country != ""
+}
+
+// uid2Email removes the dots and "+" suffix from the names of gmail.com
+// addresses, as UID2 normalizes them.
+func uid2Email(email string) string {
+	name, domain, ok := strings.Cut(email, "@")
+	if !ok || domain != "gmail.com" {
+		return email
+	}
+	name, _, _ = strings.Cut(name, "+")
+	return strings.ReplaceAll(name, ".", "") + "@" + domain
+}
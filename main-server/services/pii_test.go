@@ -0,0 +1,250 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"flag"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"main-server/models"
+)
+
+// -update rewrites the golden files in testdata from the current output;
+// review the diff before committing it.
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestNormalizers(t *testing.T) {
+	email := func(s, _ string) (string, bool) { return NormalizeEmail(s) }
+	name := func(s, _ string) (string, bool) { return NormalizeName(s) }
+	country := func(s, _ string) (string, bool) { return NormalizeCountry(s) }
+	maid := func(s, _ string) (string, bool) { return NormalizeMAID(s) }
+	phone, zip := NormalizePhone, NormalizeZip
+
+	tests := []struct {
+		name string
+		fn   func(string, string) (string, bool)
+		in   string
+		arg  string // the country, for phones and zips
+		want string // empty if the value should be refused
+	}{
+		{"email trimmed and lowercased", email, " Test@Example.COM ", "", "test@example.com"},
+		{"email without a domain", email, "test@example", "", ""},
+		{"email with two @", email, "a@b@example.com", "", ""},
+		{"email with empty label", email, "a@example..com", "", ""},
+
+		{"US national", phone, "(212) 555-0100", "US", "+12125550100"},
+		{"US with trunk 1", phone, "1-212-555-0100", "US", "+12125550100"},
+		{"US extension dropped", phone, "212.555.0100 x12", "US", "+12125550100"},
+		{"US too short", phone, "555-0100", "US", ""},
+		{"US area code from 1", phone, "112-555-0100", "US", ""},
+		{"US vanity letters", phone, "1-800-FLOWERS", "US", ""},
+		{"international with +", phone, "+44 20 7946 0958", "US", "+442079460958"},
+		{"international from the US", phone, "011 44 20 7946 0958", "US", "+442079460958"},
+		{"international with 00", phone, "00 44 20 7946 0958", "GB", "+442079460958"},
+		{"UK national", phone, "020 7946 0958", "GB", "+442079460958"},
+		{"UK code without +", phone, "442079460958", "GB", "+442079460958"},
+		{"German national", phone, "030 1234567", "DE", "+49301234567"},
+		{"Hungarian trunk 06", phone, "06 1 234 5678", "HU", "+3612345678"},
+		{"Italian keeps its 0", phone, "06 1234 5678", "IT", "+390612345678"},
+		{"unknown country", phone, "212 555 0100", "ZZ", ""},
+		{"too long", phone, "+1234567890123456", "US", ""},
+
+		{"name trimmed", name, "  Mary   Jane ", "", "mary jane"},
+		{"name keeps accents", name, "José", "", "josé"},
+		{"name without letters", name, "--", "", ""},
+
+		{"ZIP+4 cut", zip, "10001-1234", "US", "10001"},
+		{"ZIP leading zero", zip, "2134", "US", "02134"},
+		{"ZIP with letters", zip, "1000A", "US", ""},
+		{"UK postcode", zip, "sw1a  1aa", "GB", "SW1A 1AA"},
+		{"postcode too long", zip, "ABCDEF1234567", "GB", ""},
+
+		{"country code", country, "de", "", "DE"},
+		{"country name", country, "United Kingdom", "", "GB"},
+		{"country alias", country, "U.S.A.", "", "US"},
+		{"unknown country name", country, "Narnia", "", ""},
+
+		{"IDFA lowercased", maid, "6D92078A-8246-4BA4-AE5B-76104861E7DC", "", "6d92078a-8246-4ba4-ae5b-76104861e7dc"},
+		{"limited ad tracking", maid, "00000000-0000-0000-0000-000000000000", "", ""},
+		{"not a MAID", maid, "6D92078A82464BA4AE5B76104861E7DC", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.fn(tt.in, tt.arg)
+			if ok != (tt.want != "") || got != tt.want {
+				t.Errorf("%q gave %q, %t; want %q", tt.in, got, ok, tt.want)
+			}
+		})
+	}
+}
+
+const (
+	hashHex    = "hex"
+	hashBase64 = "base64"
+)
+
+// TestPlatformRules checks each platform's encoding against examples of its
+// published rules.
+func TestPlatformRules(t *testing.T) {
+	// Each case is one identifier of a row as a platform takes it: want is
+	// the normalized value before hashing, hashed as the platform does
+	tests := []struct {
+		platform string
+		row      map[string]string
+		column   string
+		want     string
+		hash     string // "hex", "base64" or "" for none
+	}{
+		// Meta: lowercase and trimmed emails; phones as digits with the
+		// country code; names as lowercase letters; zips without spaces,
+		// US ones as five digits, UK ones to the sector; lowercase countries
+		{PlatformMeta, map[string]string{"email": " John_Smith@Gmail.com "}, "EMAIL", "john_smith@gmail.com", hashHex},
+		{PlatformMeta, map[string]string{"phone": "+1 (650) 555-1212"}, "PHONE", "16505551212", hashHex},
+		{PlatformMeta, map[string]string{"email": "a@b.co", "first_name": "Mary-Jane"}, "FN", "maryjane", hashHex},
+		{PlatformMeta, map[string]string{"email": "a@b.co", "last_name": "O'Neil Smith"}, "LN", "oneilsmith", hashHex},
+		{PlatformMeta, map[string]string{"email": "a@b.co", "first_name": "Valéry"}, "FN", "valéry", hashHex},
+		{PlatformMeta, map[string]string{"email": "a@b.co", "zip": "94025-1234"}, "ZIP", "94025", hashHex},
+		{PlatformMeta, map[string]string{"email": "a@b.co", "zip": "SW1A 1AA", "country": "GB"}, "ZIP", "sw1a1", hashHex},
+		{PlatformMeta, map[string]string{"email": "a@b.co", "country": "United States"}, "COUNTRY", "us", hashHex},
+		{PlatformMeta, map[string]string{"maid": "6D92078A-8246-4BA4-AE5B-76104861E7DC"}, "MADID", "6d92078a-8246-4ba4-ae5b-76104861e7dc", ""},
+
+		// Google Ads: Gmail addresses without the dots of their names;
+		// E.164 phones; country and zip as they are
+		{PlatformGoogleAds, map[string]string{"email": "Jane.Doe@gmail.com"}, "Email", "janedoe@gmail.com", hashHex},
+		{PlatformGoogleAds, map[string]string{"email": "Jane.Doe@googlemail.com"}, "Email", "janedoe@googlemail.com", hashHex},
+		{PlatformGoogleAds, map[string]string{"email": "jane.doe+ads@example.com"}, "Email", "jane.doe+ads@example.com", hashHex},
+		{PlatformGoogleAds, map[string]string{"phone": "(650) 555-1212"}, "Phone", "+16505551212", hashHex},
+		{PlatformGoogleAds, map[string]string{"first_name": " Jane ", "last_name": "Doe", "zip": "94025"}, "First Name", "jane", hashHex},
+		{PlatformGoogleAds, map[string]string{"first_name": "Jane", "last_name": "Doe", "zip": "94025-1234"}, "Zip", "94025", ""},
+		{PlatformGoogleAds, map[string]string{"first_name": "Jane", "last_name": "Doe", "zip": "94025"}, "Country", "US", ""},
+		{PlatformGoogleAds, map[string]string{"maid": "3F1A3C2E-9D7B-4E58-A1B2-0C9D8E7F6A5B"}, "Mobile Device ID", "3f1a3c2e-9d7b-4e58-a1b2-0c9d8e7f6a5b", ""},
+
+		// The Trade Desk, as UID2: its published examples, and gmail.com
+		// addresses without the dots or "+" suffix of their names
+		{PlatformTTD, map[string]string{"email": "user@example.com"}, "email_hash", "user@example.com", hashBase64},
+		{PlatformTTD, map[string]string{"phone": "+1 234 567 8901"}, "phone_hash", "+12345678901", hashBase64},
+		{PlatformTTD, map[string]string{"email": "Jane.Doe+Marketing@Gmail.com"}, "email_hash", "janedoe@gmail.com", hashBase64},
+		{PlatformTTD, map[string]string{"email": "jane.doe@googlemail.com"}, "email_hash", "jane.doe@googlemail.com", hashBase64},
+		{PlatformTTD, map[string]string{"maid": "6D92078A-8246-4BA4-AE5B-76104861E7DC"}, "device_id", "6d92078a-8246-4ba4-ae5b-76104861e7dc", ""},
+	}
+
+	// UID2 publishes the hashes of its examples, which pins the encoding
+	published := map[string]string{
+		"user@example.com": "tMmiiTI7IaAcPpQPFQ65uMVCWH8av9jw4cwf/F5HVRQ=",
+		"+12345678901":     "EObwtHBUqDNZR33LNSMdtt5cafsYFuGmuY4ZLenlue4=",
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.platform+" "+tt.column+" "+tt.want, func(t *testing.T) {
+			want := tt.want
+			switch tt.hash {
+			case hashHex:
+				sum := sha256.Sum256([]byte(want))
+				want = hex.EncodeToString(sum[:])
+			case hashBase64:
+				sum := sha256.Sum256([]byte(want))
+				want = base64.StdEncoding.EncodeToString(sum[:])
+				if p, ok := published[tt.want]; ok && p != want {
+					t.Fatalf("UID2 publishes %s for %q, the test computes %s", p, tt.want, want)
+				}
+			}
+
+			// The row's columns in order of their types
+			mapping := models.ColumnMapping{}
+			var row []string
+			for _, typ := range slices.Sorted(maps.Keys(tt.row)) {
+				mapping[typ] = len(row)
+				row = append(row, tt.row[typ])
+			}
+			e := NewPlatformEncoder(tt.platform, mapping)
+			i := slices.Index(e.Columns(), tt.column)
+			if i < 0 {
+				t.Fatalf("no %s column in %v", tt.column, e.Columns())
+			}
+			record := e.Record(NormalizeRow(row, mapping, DefaultAudienceCountry))
+			if record == nil {
+				t.Fatal("the row is not matchable")
+			}
+			if record[i] != want {
+				t.Errorf("got %q, want %q, from %q", record[i], want, tt.want)
+			}
+		})
+	}
+}
+
+// TestPlatformGoldenFiles prepares testdata/audience.csv for each platform
+// the way processing does and compares it with
+// testdata/{platform}.golden.csv. Run with -update to rewrite them.
+func TestPlatformGoldenFiles(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "audience.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, mapping, _, err := DetectAudienceSchema(bytes.NewReader(data), int64(len(data)), FileTypeCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := models.ColumnMapping{"email": 0, "phone": 1, "first_name": 2, "last_name": 3, "zip": 4, "country": 5, "maid": 6}
+	if !maps.Equal(mapping, want) {
+		t.Fatalf("detected mapping %v, want %v", mapping, want)
+	}
+
+	buf := make([]bytes.Buffer, len(AudiencePlatforms))
+	writers := make([]*csv.Writer, len(buf))
+	encoders := make([]*PlatformEncoder, len(buf))
+	for i, platform := range AudiencePlatforms {
+		writers[i] = csv.NewWriter(&buf[i])
+		encoders[i] = NewPlatformEncoder(platform, mapping)
+		writers[i].Write(encoders[i].Columns())
+	}
+
+	ar, err := NewAudienceReader(bytes.NewReader(data), int64(len(data)), FileTypeCSV, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ar.Close()
+	for {
+		row, err := ar.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := NormalizeRow(row, mapping, schema.Country)
+		if !id.Matchable() {
+			continue
+		}
+		for i, e := range encoders {
+			if record := e.Record(id); record != nil {
+				writers[i].Write(record)
+			}
+		}
+	}
+
+	for i, platform := range AudiencePlatforms {
+		writers[i].Flush()
+		path := filepath.Join("testdata", platform+".golden.csv")
+		if *update {
+			if err := os.WriteFile(path, buf[i].Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		golden, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(golden, buf[i].Bytes()) {
+			t.Errorf("%s output differs from %s:\n%s", platform, path, buf[i].String())
+		}
+	}
+}
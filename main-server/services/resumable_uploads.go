@@ -0,0 +1,586 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"main-server/database"
+	"main-server/models"
+)
+
+const (
+	// S3 rejects parts smaller than this, except the last
+	MinUploadPartSize = 5 << 20
+	// and uploads of more parts than this
+	maxUploadParts = 10000
+
+	uploadSweepInterval = 15 * time.Minute
+)
+
+var (
+	ErrInvalidUpload        = errors.New("invalid upload")
+	ErrUploadTooLarge       = errors.New("file is too large")
+	ErrUploadSessionClosed  = errors.New("upload session is no longer active")
+	ErrInvalidPart          = errors.New("invalid part")
+	ErrMultipartUnsupported = errors.New("the storage backend does not support resumable uploads")
+)
+
+// ResumableUploadService uploads large audience files in parts. A session is
+// opened with the file's size; parts can then be sent in any order, retried,
+// and resumed after a dropped connection or a page reload, until the
+// session is completed or expires. Parts go straight to a multipart upload
+// in the storage backend, after their SHA-256 checksum is checked. Completed
+// files are quarantined until ingest has checked them.
+type ResumableUploadService struct {
+	db           *sql.DB
+	storage      StorageBackend
+	ingest       *IngestService
+	entitlements *EntitlementService
+	partSize     int64
+	maxSize      int64
+	// Sessions expire this long after their last part
+	ttl time.Duration
+}
+
+func NewResumableUploadService(db *sql.DB, storage StorageBackend, ingest *IngestService, entitlements *EntitlementService, partSize, maxSize int64, ttl time.Duration) *ResumableUploadService {
+	if partSize < MinUploadPartSize {
+		partSize = MinUploadPartSize
+	}
+	return &ResumableUploadService{db: db, storage: storage, ingest: ingest, entitlements: entitlements, partSize: partSize, maxSize: maxSize, ttl: ttl}
+}
+
+func (s *ResumableUploadService) multipart() (MultipartStorage, error) {
+	m, ok := s.storage.(MultipartStorage)
+	if !ok {
+		return nil, ErrMultipartUnsupported
+	}
+	return m, nil
+}
+
+// Init opens an upload session for a file of size bytes, if the company
+// has room for it.
+func (s *ResumableUploadService) Init(ctx context.Context, actor *models.User, workspaceID, companyID, filename, contentType string, size int64) (*models.UploadSession, error) {
+	m, err := s.multipart()
+	if err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("%w: file size must be positive", ErrInvalidUpload)
+	}
+	if size > s.maxSize {
+		return nil, fmt.Errorf("%w: the limit is %d MB", ErrUploadTooLarge, s.maxSize>>20)
+	}
+	if filename == "" {
+		return nil, fmt.Errorf("%w: filename is required", ErrInvalidUpload)
+	}
+	if err := s.entitlements.CheckStorage(ctx, companyID, size); err != nil {
+		return nil, err
+	}
+
+	partSize := s.partSize
+	for (size+partSize-1)/partSize > maxUploadParts {
+		partSize *= 2
+	}
+
+	key, err := audienceFileKey(workspaceID, companyID)
+	if err != nil {
+		return nil, err
+	}
+	uploadID, err := m.CreateMultipart(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start upload: %w", err)
+	}
+
+	session := &models.UploadSession{
+		CompanyID:       companyID,
+		WorkspaceID:     workspaceID,
+		CreatedBy:       actor.ID,
+		Filename:        filename,
+		ContentType:     contentType,
+		TotalSize:       size,
+		PartSize:        partSize,
+		PartCount:       int((size + partSize - 1) / partSize),
+		StorageKey:      key,
+		StorageUploadID: uploadID,
+		Status:          models.UploadSessionActive,
+		ExpiresAt:       time.Now().Add(s.ttl),
+		Parts:           []models.UploadPart{},
+	}
+
+	err = database.Conn(ctx, s.db).QueryRowContext(ctx, `
+		INSERT INTO upload_sessions (company_id, workspace_id, created_by, filename, content_type,
+		                             total_size, part_size, part_count, storage_key, storage_upload_id,
+		                             status, expires_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, $8, $9, $10, $11, $12)
+		RETURNING id::text, created_at
+	`, session.CompanyID, session.WorkspaceID, session.CreatedBy, session.Filename, session.ContentType,
+		session.TotalSize, session.PartSize, session.PartCount, session.StorageKey, session.StorageUploadID,
+		session.Status, session.ExpiresAt).Scan(&session.ID, &session.CreatedAt)
+	if err != nil {
+		if aerr := m.AbortMultipart(context.Background(), key, uploadID); aerr != nil {
+			log.Printf("failed to abort unrecorded upload %s: %v", uploadID, aerr)
+		}
+		return nil, fmt.Errorf("failed to save upload session: %w", err)
+	}
+
+	return session, nil
+}
+
+// Get loads a session with the parts received so far.
+func (s *ResumableUploadService) Get(ctx context.Context, id string) (*models.UploadSession, error) {
+	q := database.Conn(ctx, s.db)
+	session, err := getUploadSession(ctx, q, id, false)
+	if err != nil {
+		return nil, err
+	}
+	if session.Parts, err = uploadParts(ctx, q, id); err != nil {
+		return nil, err
+	}
+	for _, p := range session.Parts {
+		session.ReceivedBytes += p.Size
+	}
+	return session, nil
+}
+
+// PutPart stores part n of a session. checksum is the hex SHA-256 of the
+// part, which must also have exactly the part's expected length. Sending a
+// part again replaces it, and every part pushes the session's expiry back.
+func (s *ResumableUploadService) PutPart(ctx context.Context, session *models.UploadSession, n int, r io.Reader, checksum string) (*models.UploadPart, error) {
+	m, err := s.multipart()
+	if err != nil {
+		return nil, err
+	}
+	if session.Status != models.UploadSessionActive || time.Now().After(session.ExpiresAt) {
+		return nil, ErrUploadSessionClosed
+	}
+	if n < 1 || n > session.PartCount {
+		return nil, fmt.Errorf("%w: part numbers run from 1 to %d", ErrInvalidPart, session.PartCount)
+	}
+	checksum = strings.ToLower(strings.TrimSpace(checksum))
+	if checksum == "" {
+		return nil, fmt.Errorf("%w: a SHA-256 checksum is required", ErrInvalidPart)
+	}
+
+	// Spool the part so it can be checked before it is stored, and sent to
+	// S3, which needs to seek, without holding it in memory
+	tmp, err := os.CreateTemp("", "upload-part-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// Receiving and storing the part does not need the database, so the
+	// request's connection goes back to the pool until it is done
+	var part *models.UploadPart
+	err = database.WithoutTenant(ctx, func() error {
+		want := session.PartLength(n)
+		sum := sha256.New()
+		size, err := io.Copy(io.MultiWriter(tmp, sum), io.LimitReader(r, want+1))
+		if err != nil {
+			return fmt.Errorf("failed to receive part: %w", err)
+		}
+		if size != want {
+			return fmt.Errorf("%w: part %d must be %d bytes, got %d", ErrInvalidPart, n, want, size)
+		}
+		part = &models.UploadPart{Number: n, Size: size, SHA256: hex.EncodeToString(sum.Sum(nil))}
+		if part.SHA256 != checksum {
+			return fmt.Errorf("%w: checksum mismatch for part %d", ErrInvalidPart, n)
+		}
+
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		part.ETag, err = m.UploadPart(ctx, session.StorageKey, session.StorageUploadID, n, tmp, size)
+		if errors.Is(err, ErrUnknownUpload) {
+			return ErrUploadSessionClosed
+		}
+		if err != nil {
+			return fmt.Errorf("failed to store part: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+		current, err := getUploadSession(ctx, tx, session.ID, true)
+		if err != nil {
+			return err
+		}
+		if current.Status != models.UploadSessionActive {
+			return ErrUploadSessionClosed
+		}
+
+		var previous string
+		err = tx.QueryRowContext(ctx, `
+			SELECT sha256 FROM upload_parts WHERE session_id = $1 AND part_number = $2
+		`, session.ID, n).Scan(&previous)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("database error: %w", err)
+		}
+
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO upload_parts (session_id, part_number, company_id, size, sha256, etag)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (session_id, part_number)
+			DO UPDATE SET size = EXCLUDED.size, sha256 = EXCLUDED.sha256, etag = EXCLUDED.etag,
+			              uploaded_at = CURRENT_TIMESTAMP
+			RETURNING uploaded_at
+		`, session.ID, n, session.CompanyID, part.Size, part.SHA256, part.ETag).Scan(&part.UploadedAt)
+		if err != nil {
+			return fmt.Errorf("failed to save part: %w", err)
+		}
+
+		state, hashed, err := s.advanceHash(ctx, tx, session.ID, n, previous, part.SHA256, tmp)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE upload_sessions SET hash_state = $2, hashed_parts = $3, expires_at = $4
+			WHERE id = $1
+		`, session.ID, state, hashed, time.Now().Add(s.ttl))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return part, nil
+}
+
+// advanceHash keeps the running SHA-256 of the whole file up to date while
+// parts arrive in order: part n extends it when parts 1..n-1 are already
+// hashed, and replacing a hashed part with different content starts over.
+// Parts that arrive early are left for Complete, which then reads the file
+// back. It returns the session's new hash state.
+func (s *ResumableUploadService) advanceHash(ctx context.Context, tx *sql.Tx, sessionID string, n int, previous, current string, part io.ReadSeeker) ([]byte, int, error) {
+	var state []byte
+	var hashed int
+	err := tx.QueryRowContext(ctx, `
+		SELECT hash_state, hashed_parts FROM upload_sessions WHERE id = $1
+	`, sessionID).Scan(&state, &hashed)
+	if err != nil {
+		return nil, 0, fmt.Errorf("database error: %w", err)
+	}
+
+	if n <= hashed && previous != current {
+		state, hashed = nil, 0
+	}
+	if n != hashed+1 {
+		return state, hashed, nil
+	}
+
+	h := sha256.New()
+	if hashed > 0 {
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+			return nil, 0, nil
+		}
+	}
+	if _, err := part.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	if _, err := io.Copy(h, part); err != nil {
+		return nil, 0, err
+	}
+	state, err = h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, 0, err
+	}
+	return state, n, nil
+}
+
+// Complete assembles the parts into the stored file, records it in
+// audience_files and submits it to ingest.
+func (s *ResumableUploadService) Complete(ctx context.Context, session *models.UploadSession) (*models.AudienceFile, error) {
+	m, err := s.multipart()
+	if err != nil {
+		return nil, err
+	}
+
+	var f *models.AudienceFile
+	err = database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+		current, err := getUploadSession(ctx, tx, session.ID, true)
+		if err != nil {
+			return err
+		}
+		if current.Status != models.UploadSessionActive {
+			return ErrUploadSessionClosed
+		}
+
+		parts, err := uploadParts(ctx, tx, session.ID)
+		if err != nil {
+			return err
+		}
+		if len(parts) != current.PartCount {
+			return fmt.Errorf("%w: %d of %d parts have been uploaded", ErrInvalidUpload, len(parts), current.PartCount)
+		}
+		completed := make([]CompletedPart, len(parts))
+		for i, p := range parts {
+			completed[i] = CompletedPart{Number: p.Number, ETag: p.ETag}
+		}
+
+		if err := m.CompleteMultipart(ctx, current.StorageKey, current.StorageUploadID, completed); err != nil {
+			return fmt.Errorf("failed to assemble upload: %w", err)
+		}
+
+		fileHash, err := s.fileHash(ctx, tx, current)
+		if err != nil {
+			s.removeObject(current.StorageKey)
+			return err
+		}
+
+		f = &models.AudienceFile{
+			CompanyID:        current.CompanyID,
+			Name:             current.Filename,
+			OriginalFilename: current.Filename,
+			StoragePath:      current.StorageKey,
+			ContentType:      current.ContentType,
+			FileSizeBytes:    current.TotalSize,
+			FileHash:         fileHash,
+			Status:           models.AudienceFileQuarantined,
+			UploadedBy:       current.CreatedBy,
+		}
+		if err := insertAudienceFile(ctx, tx, f); err != nil {
+			s.removeObject(current.StorageKey)
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			UPDATE upload_sessions
+			SET status = $2, audience_file_id = $3, completed_at = CURRENT_TIMESTAMP, hash_state = NULL
+			WHERE id = $1
+		`, current.ID, models.UploadSessionCompleted, f.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.ingest.Submit(f.ID)
+	return f, nil
+}
+
+// fileHash finishes the running hash, or reads the assembled file back when
+// the parts did not arrive in order.
+func (s *ResumableUploadService) fileHash(ctx context.Context, tx *sql.Tx, session *models.UploadSession) (string, error) {
+	var state []byte
+	var hashed int
+	err := tx.QueryRowContext(ctx, `
+		SELECT hash_state, hashed_parts FROM upload_sessions WHERE id = $1
+	`, session.ID).Scan(&state, &hashed)
+	if err != nil {
+		return "", fmt.Errorf("database error: %w", err)
+	}
+
+	var h hash.Hash = sha256.New()
+	if hashed == session.PartCount {
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err == nil {
+			return hex.EncodeToString(h.Sum(nil)), nil
+		}
+		h = sha256.New()
+	}
+
+	r, err := s.storage.Download(ctx, session.StorageKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to read assembled upload: %w", err)
+	}
+	defer r.Close()
+
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return "", fmt.Errorf("failed to read assembled upload: %w", err)
+	}
+	if size != session.TotalSize {
+		return "", fmt.Errorf("assembled upload is %d bytes, expected %d", size, session.TotalSize)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Abort cancels an active session and discards its parts.
+func (s *ResumableUploadService) Abort(ctx context.Context, session *models.UploadSession) error {
+	return s.close(ctx, database.Conn(ctx, s.db), session, models.UploadSessionAborted)
+}
+
+// close marks an active session aborted or expired and discards its parts.
+func (s *ResumableUploadService) close(ctx context.Context, q database.Querier, session *models.UploadSession, status string) error {
+	m, err := s.multipart()
+	if err != nil {
+		return err
+	}
+
+	res, err := q.ExecContext(ctx, `
+		UPDATE upload_sessions SET status = $2, hash_state = NULL
+		WHERE id = $1 AND status = $3
+	`, session.ID, status, models.UploadSessionActive)
+	if err != nil {
+		return fmt.Errorf("failed to close upload session: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUploadSessionClosed
+	}
+
+	err = m.AbortMultipart(ctx, session.StorageKey, session.StorageUploadID)
+	if err != nil && !errors.Is(err, ErrUnknownUpload) {
+		return fmt.Errorf("failed to discard upload: %w", err)
+	}
+	return nil
+}
+
+// RunEvery expires abandoned sessions every uploadSweepInterval until ctx
+// is cancelled.
+func (s *ResumableUploadService) RunEvery(ctx context.Context) {
+	ticker := time.NewTicker(uploadSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := s.ExpireAbandoned(ctx); err != nil {
+				log.Printf("upload session expiry failed: %v", err)
+			} else if n > 0 {
+				log.Printf("expired %d abandoned upload sessions", n)
+			}
+		}
+	}
+}
+
+// ExpireAbandoned aborts active sessions past their expiry. It runs on the
+// pool, outside any tenant, for every company.
+func (s *ResumableUploadService) ExpireAbandoned(ctx context.Context) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id::text, storage_key, storage_upload_id
+		FROM upload_sessions
+		WHERE status = $1 AND expires_at < CURRENT_TIMESTAMP
+		ORDER BY expires_at
+		LIMIT 1000
+	`, models.UploadSessionActive)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find abandoned uploads: %w", err)
+	}
+	var expired []*models.UploadSession
+	for rows.Next() {
+		session := &models.UploadSession{}
+		if err := rows.Scan(&session.ID, &session.StorageKey, &session.StorageUploadID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		expired = append(expired, session)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, session := range expired {
+		err := s.close(ctx, s.db, session, models.UploadSessionExpired)
+		if errors.Is(err, ErrUploadSessionClosed) {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (s *ResumableUploadService) removeObject(key string) {
+	if err := s.storage.Delete(context.Background(), key); err != nil {
+		log.Printf("failed to remove unrecorded upload %s: %v", key, err)
+	}
+}
+
+func getUploadSession(ctx context.Context, q rowQuerier, id string, forUpdate bool) (*models.UploadSession, error) {
+	// Anything else would be a UUID syntax error from the database
+	if !isUUID(id) {
+		return nil, fmt.Errorf("upload session not found")
+	}
+
+	query := `
+		SELECT id::text, company_id::text, workspace_id::text, COALESCE(created_by::text, ''),
+		       filename, COALESCE(content_type, ''), total_size, part_size, part_count,
+		       storage_key, storage_upload_id, status, audience_file_id,
+		       expires_at, created_at, completed_at
+		FROM upload_sessions
+		WHERE id = $1
+	`
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+
+	var session models.UploadSession
+	err := q.QueryRowContext(ctx, query, id).Scan(&session.ID, &session.CompanyID, &session.WorkspaceID, &session.CreatedBy,
+		&session.Filename, &session.ContentType, &session.TotalSize, &session.PartSize, &session.PartCount,
+		&session.StorageKey, &session.StorageUploadID, &session.Status, &session.AudienceFileID,
+		&session.ExpiresAt, &session.CreatedAt, &session.CompletedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("upload session not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return &session, nil
+}
+
+// partQuerier is satisfied by *sql.Tx as well as database.Querier.
+type partQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func uploadParts(ctx context.Context, q partQuerier, sessionID string) ([]models.UploadPart, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT part_number, size, sha256, etag, uploaded_at
+		FROM upload_parts
+		WHERE session_id = $1
+		ORDER BY part_number
+	`, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	defer rows.Close()
+
+	parts := []models.UploadPart{}
+	for rows.Next() {
+		var p models.UploadPart
+		if err := rows.Scan(&p.Number, &p.Size, &p.SHA256, &p.ETag, &p.UploadedAt); err != nil {
+			return nil, err
+		}
+		parts = append(parts, p)
+	}
+	return parts, rows.Err()
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if c != '-' {
+				return false
+			}
+		case !strings.ContainsRune("0123456789abcdefABCDEF", c):
+			return false
+		}
+	}
+	return true
+}
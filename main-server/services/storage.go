@@ -1,106 +1,485 @@
 package services
 
 import (
-    "context"
-    "fmt"
-    "io"
-    "os"
-    "path/filepath"
-    "time"
-    
-    "github.com/aws/aws-sdk-go/aws"
-    "github.com/aws/aws-sdk-go/aws/session"
-    "github.com/aws/aws-sdk-go/service/s3"
-    "github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"main-server/config"
 )
 
+// ErrObjectNotFound is returned, possibly wrapped, when a key does not exist.
+var ErrObjectNotFound = errors.New("object not found")
+
+// StorageBackend stores objects under slash-separated keys. Every backend
+// must behave the same way; storagetest.Check describes how.
 type StorageBackend interface {
-    Upload(ctx context.Context, file io.Reader, key string) error
-    Download(ctx context.Context, key string) (io.Reader, error)
-    Delete(ctx context.Context, key string) error
-    GeneratePresignedURL(key string, expiry time.Duration) (string, error)
+	Upload(ctx context.Context, file io.Reader, key string) error
+	// Download fails with ErrObjectNotFound for a missing key. The caller
+	// must close the reader.
+	Download(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete succeeds for a key that does not exist.
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	// List returns the objects whose keys start with prefix, sorted by key.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	Copy(ctx context.Context, srcKey, dstKey string) error
+	GeneratePresignedURL(key string, expiry time.Duration) (string, error)
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	// ETag is set by S3; other backends may leave it empty.
+	ETag string
+}
+
+// OpenStorage returns the backend selected by STORAGE_BACKEND, wrapped in
+// the layers STORAGE_LAYERS lists and encrypted as STORAGE_ENCRYPTION says.
+// Encryption goes outside the layers, so they see the stored bytes: the
+// cache only holds ciphertext, and metrics count what reaches the backend.
+func OpenStorage(cfg *config.Config) (StorageBackend, error) {
+	var backend StorageBackend
+	switch cfg.StorageBackend {
+	case "local":
+		backend = NewSignedLocalStorage(cfg.UploadDir, cfg.BaseURL, []byte(cfg.StorageSigningKey))
+	case "s3":
+		s3Storage, err := NewS3Storage(S3Config{
+			Region:         cfg.S3Region,
+			Bucket:         cfg.S3Bucket,
+			Endpoint:       cfg.S3Endpoint,
+			ForcePathStyle: cfg.S3ForcePathStyle,
+			SSE:            cfg.S3SSE,
+			SSEKMSKeyID:    cfg.S3SSEKMSKeyID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		backend = s3Storage
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
+
+	layers, err := storageLayers(cfg)
+	if err != nil {
+		return nil, err
+	}
+	backend = LayerStorage(backend, layers...)
+
+	switch cfg.StorageEncryption {
+	case "":
+		return backend, nil
+	case "local":
+		masterKey, err := base64.StdEncoding.DecodeString(cfg.StorageMasterKey)
+		if err != nil || len(masterKey) != 32 {
+			return nil, fmt.Errorf("STORAGE_MASTER_KEY must be 32 base64-encoded bytes")
+		}
+		kms, err := NewLocalKMS(cfg.StorageKeysDir, masterKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open storage keys: %w", err)
+		}
+		return NewEncryptedStorage(backend, kms, AudienceKeyScheme{}), nil
+	default:
+		return nil, fmt.Errorf("unknown storage encryption %q", cfg.StorageEncryption)
+	}
 }
 
 // S3 Storage Implementation
 type S3Storage struct {
-    client   *s3.S3
-    uploader *s3manager.Uploader
-    bucket   string
-}
-
-func NewS3Storage(region, bucket string) (*S3Storage, error) {
-    sess, err := session.NewSession(&aws.Config{
-        Region: aws.String(region),
-    })
-    if err != nil {
-        return nil, err
-    }
-    
-    return &S3Storage{
-        client:   s3.New(sess),
-        uploader: s3manager.NewUploader(sess),
-        bucket:   bucket,
-    }, nil
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+
+	// Server-side encryption applied to uploads and copies
+	sse      string
+	sseKeyID string
+
+	maxCopySize int64
+}
+
+// S3Config configures S3Storage. Endpoint and ForcePathStyle point it at
+// S3-compatible servers such as MinIO; the static credentials are optional
+// and the SDK's usual environment and profile lookup is used without them.
+type S3Config struct {
+	Region         string
+	Bucket         string
+	Endpoint       string
+	ForcePathStyle bool
+
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// "AES256" or "aws:kms", with SSEKMSKeyID naming the KMS key for the
+	// latter. Empty leaves encryption to the bucket's defaults.
+	SSE         string
+	SSEKMSKeyID string
+
+	// The largest object copied in one request; larger ones are copied in
+	// parts of this size. Zero means 5 GiB, S3's limit.
+	MaxCopySize int64
+}
+
+func NewS3Storage(cfg S3Config) (*S3Storage, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("an S3 bucket is required")
+	}
+	switch cfg.SSE {
+	case "", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms:
+	default:
+		return nil, fmt.Errorf("unknown S3 server-side encryption %q", cfg.SSE)
+	}
+
+	awsConfig := &aws.Config{
+		Region:           aws.String(cfg.Region),
+		S3ForcePathStyle: aws.Bool(cfg.ForcePathStyle),
+	}
+	if cfg.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(cfg.Endpoint)
+	}
+	if cfg.AccessKeyID != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(cfg.AccessKeyID, cfg.SecretAccessKey, "")
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.MaxCopySize <= 0 {
+		cfg.MaxCopySize = 5 << 30
+	}
+
+	return &S3Storage{
+		client:      s3.New(sess),
+		uploader:    s3manager.NewUploader(sess),
+		bucket:      cfg.Bucket,
+		sse:         cfg.SSE,
+		sseKeyID:    cfg.SSEKMSKeyID,
+		maxCopySize: cfg.MaxCopySize,
+	}, nil
 }
 
 func (s *S3Storage) Upload(ctx context.Context, file io.Reader, key string) error {
-    _, err := s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
-        Bucket: aws.String(s.bucket),
-        Key:    aws.String(key),
-        Body:   file,
-    })
-    return err
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   file,
+	}
+	if s.sse != "" {
+		input.ServerSideEncryption = aws.String(s.sse)
+	}
+	if s.sseKeyID != "" {
+		input.SSEKMSKeyId = aws.String(s.sseKeyID)
+	}
+
+	_, err := s.uploader.UploadWithContext(ctx, input)
+	return s3Error(err, key)
+}
+
+func (s *S3Storage) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, s3Error(err, key)
+	}
+	return out.Body, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err = s3Error(err, key); errors.Is(err, ErrObjectNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s *S3Storage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	out, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, s3Error(err, key)
+	}
+
+	return &ObjectInfo{
+		Key:     key,
+		Size:    aws.Int64Value(out.ContentLength),
+		ModTime: aws.TimeValue(out.LastModified),
+		ETag:    strings.Trim(aws.StringValue(out.ETag), `"`),
+	}, nil
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:     aws.StringValue(o.Key),
+				Size:    aws.Int64Value(o.Size),
+				ModTime: aws.TimeValue(o.LastModified),
+				ETag:    strings.Trim(aws.StringValue(o.ETag), `"`),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, s3Error(err, prefix)
+	}
+	return objects, nil
+}
+
+// Copy copies within the bucket. Objects larger than maxCopySize, which S3
+// cannot copy in one request, are copied in parts.
+func (s *S3Storage) Copy(ctx context.Context, srcKey, dstKey string) error {
+	src, err := s.Stat(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	if src.Size > s.maxCopySize {
+		return s.copyMultipart(ctx, srcKey, dstKey, src.Size)
+	}
+
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        aws.String(dstKey),
+		CopySource: aws.String(s.copySource(srcKey)),
+	}
+	if s.sse != "" {
+		input.ServerSideEncryption = aws.String(s.sse)
+	}
+	if s.sseKeyID != "" {
+		input.SSEKMSKeyId = aws.String(s.sseKeyID)
+	}
+
+	_, err = s.client.CopyObjectWithContext(ctx, input)
+	return s3Error(err, srcKey)
+}
+
+func (s *S3Storage) copySource(key string) string {
+	return url.PathEscape(s.bucket) + "/" + s3EscapeKey(key)
 }
 
 func (s *S3Storage) GeneratePresignedURL(key string, expiry time.Duration) (string, error) {
-    req, _ := s.client.GetObjectRequest(&s3.GetObjectInput{
-        Bucket: aws.String(s.bucket),
-        Key:    aws.String(key),
-    })
-    
-    urlStr, err := req.Presign(expiry)
-    if err != nil {
-        return "", err
-    }
-    
-    return urlStr, nil
+	req, _ := s.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+
+	urlStr, err := req.Presign(expiry)
+	if err != nil {
+		return "", err
+	}
+
+	return urlStr, nil
+}
+
+// s3Error maps S3's missing-object errors to ErrObjectNotFound.
+func s3Error(err error, key string) error {
+	if err == nil {
+		return nil
+	}
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && reqErr.StatusCode() == http.StatusNotFound {
+		return fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && (awsErr.Code() == s3.ErrCodeNoSuchKey || awsErr.Code() == "NotFound") {
+		return fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+	}
+	return err
+}
+
+// s3EscapeKey escapes each segment of a key for use in a copy source. Plus
+// signs are escaped too, since S3 may decode them as spaces.
+func s3EscapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = strings.ReplaceAll(url.QueryEscape(segment), "+", "%20")
+	}
+	return strings.Join(segments, "/")
 }
 
 // Local Storage Implementation (for development)
 type LocalStorage struct {
-    basePath string
+	basePath string
+
+	// Signed URLs point at baseURL and are signed with secret; without a
+	// secret the storage cannot presign
+	baseURL string
+	secret  []byte
 }
 
 func NewLocalStorage(basePath string) *LocalStorage {
-    os.MkdirAll(basePath, 0755)
-    return &LocalStorage{basePath: basePath}
+	os.MkdirAll(basePath, 0755)
+	return &LocalStorage{basePath: basePath}
 }
 
+// NewSignedLocalStorage returns a LocalStorage that presigns URLs served by
+// main-server at baseURL.
+func NewSignedLocalStorage(basePath, baseURL string, secret []byte) *LocalStorage {
+	l := NewLocalStorage(basePath)
+	l.baseURL = strings.TrimSuffix(baseURL, "/")
+	l.secret = secret
+	return l
+}
+
+// path returns the file for key, refusing keys that would leave basePath.
+func (l *LocalStorage) path(key string) (string, error) {
+	if key == "" || !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(l.basePath, filepath.FromSlash(key)), nil
+}
+
+// Upload writes to a temporary file first, so readers never see a partial
+// object and a failed upload leaves any previous one in place.
 func (l *LocalStorage) Upload(ctx context.Context, file io.Reader, key string) error {
-    path := filepath.Join(l.basePath, key)
-    os.MkdirAll(filepath.Dir(path), 0755)
-    
-    out, err := os.Create(path)
-    if err != nil {
-        return err
-    }
-    defer out.Close()
-    
-    _, err = io.Copy(out, file)
-    return err
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	if _, err := io.Copy(out, file); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), path)
 }
 
-func (l *LocalStorage) Download(ctx context.Context, key string) (io.Reader, error) {
-    path := filepath.Join(l.basePath, key)
-    return os.Open(path)
+func (l *LocalStorage) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+	}
+	return f, err
 }
 
 func (l *LocalStorage) Delete(ctx context.Context, key string) error {
-    path := filepath.Join(l.basePath, key)
-    return os.Remove(path)
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (l *LocalStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && fi.IsDir()) {
+		return nil, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (l *LocalStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	// Walk the deepest directory the prefix names, then filter by the rest
+	dir := l.basePath
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		path, err := l.path(prefix[:i])
+		if err != nil {
+			return nil, err
+		}
+		dir = path
+	}
+
+	var objects []ObjectInfo
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		// Multipart parts and uploads in progress are not objects
+		if d.IsDir() && path != dir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.basePath, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
 }
 
-func (l *LocalStorage) GeneratePresignedURL(key string, expiry time.Duration) (string, error) {
-    // For local storage, just return a local URL
-    return fmt.Sprintf("/files/%s", key), nil
+func (l *LocalStorage) Copy(ctx context.Context, srcKey, dstKey string) error {
+	src, err := l.Download(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return l.Upload(ctx, src, dstKey)
 }
@@ -0,0 +1,327 @@
+package services
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Reads to the end of an object from no further in than this fill the cache
+// with the whole object; the bytes before the offset are read and dropped.
+// Encrypted objects are read from just past their header.
+const cacheFillMaxOffset = 1 << 20
+
+var (
+	storageCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "storage_cache_requests_total",
+		Help: "Downloads looked up in the storage cache, by result.",
+	}, []string{"result"})
+	storageCacheBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "storage_cache_bytes",
+		Help: "Bytes of objects held in the storage cache.",
+	})
+)
+
+// Files the cache owns in its directory: entries and unfinished fills.
+var cacheFileName = regexp.MustCompile(`^[0-9a-f]{64}(\..*\.tmp)?$`)
+
+// StorageCache is a StorageLayer keeping recently downloaded objects on
+// local disk, up to maxSize bytes, and evicting the least recently used
+// first. Every hit is checked against the backend with a Stat, so objects
+// changed by another server, or uploaded straight to storage, are never
+// served stale; the cache saves the transfer, not the round trip. Writes
+// through the layer drop the key at once.
+//
+// Objects larger than a quarter of maxSize are not cached. The index is
+// kept in memory, so the directory is emptied when the cache is opened.
+// Put it beneath encryption, so the disk only holds ciphertext.
+type StorageCache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // of *cacheEntry, by key
+	lru     *list.List               // most recently used first
+	size    int64
+	// The fill in progress for each key; a write drops it, so a fill that
+	// started before the write is never committed after it
+	fills map[string]*cacheFill
+}
+
+type cacheEntry struct {
+	key  string
+	path string
+	info ObjectInfo
+}
+
+// cacheFill identifies one fill. It is not empty, as pointers to distinct
+// empty values may compare equal.
+type cacheFill struct{ _ byte }
+
+func NewStorageCache(dir string, maxSize int64) (*StorageCache, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("the storage cache needs a size")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Type().IsRegular() && cacheFileName.MatchString(e.Name()) {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+
+	return &StorageCache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		fills:   make(map[string]*cacheFill),
+	}, nil
+}
+
+func (c *StorageCache) Call(ctx context.Context, inner StorageBackend, op *StorageOp, next func(context.Context) error) error {
+	switch op.Name {
+	case StorageOpDownload, StorageOpDownloadRange:
+		return c.read(ctx, inner, op, next)
+	case StorageOpUpload, StorageOpDelete, StorageOpCopy, StorageOpCompleteMultipart:
+		c.drop(op.Key)
+		err := next(ctx)
+		c.drop(op.Key)
+		return err
+	}
+	return next(ctx)
+}
+
+func (c *StorageCache) read(ctx context.Context, inner StorageBackend, op *StorageOp, next func(context.Context) error) error {
+	if body := c.lookup(ctx, inner, op); body != nil {
+		storageCacheRequests.WithLabelValues("hit").Inc()
+		op.Result = body
+		return nil
+	}
+	storageCacheRequests.WithLabelValues("miss").Inc()
+
+	offset := int64(0)
+	if op.Name == StorageOpDownloadRange {
+		if op.Length >= 0 || op.Offset > cacheFillMaxOffset {
+			return next(ctx)
+		}
+		offset = op.Offset
+	}
+
+	// The object is described before it is read, so if it changes in
+	// between, the entry is stale and its next hit misses
+	stat, err := inner.Stat(ctx, op.Key)
+	if err != nil {
+		return err
+	}
+	info := *stat
+	info.Key = op.Key
+	if info.Size > c.maxSize/4 || offset > info.Size {
+		return next(ctx)
+	}
+
+	fill := c.startFill(op.Key)
+	body, err := inner.Download(ctx, op.Key)
+	if err != nil {
+		c.endFill(op.Key, fill)
+		return err
+	}
+	filler, err := c.newFiller(body, info, fill)
+	if err != nil {
+		c.endFill(op.Key, fill)
+		log.Printf("storage cache: %v", err)
+		op.Result = body
+	} else {
+		op.Result = filler
+	}
+	if _, err := io.CopyN(io.Discard, op.Result, offset); err != nil {
+		op.Result.Close()
+		op.Result = nil
+		return err
+	}
+	return nil
+}
+
+// lookup opens the cached copy of op's object, if there is one and the
+// object has not changed since it was cached.
+func (c *StorageCache) lookup(ctx context.Context, inner StorageBackend, op *StorageOp) io.ReadCloser {
+	c.mu.Lock()
+	el, ok := c.entries[op.Key]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+
+	info, err := inner.Stat(ctx, op.Key)
+	if err != nil || info.Size != e.info.Size || !info.ModTime.Equal(e.info.ModTime) || info.ETag != e.info.ETag {
+		c.drop(op.Key)
+		return nil
+	}
+	if op.Name == StorageOpDownloadRange && (op.Offset < 0 || op.Offset > e.info.Size) {
+		return nil
+	}
+
+	// An eviction may have removed the file since; then it is a miss
+	f, err := os.Open(e.path)
+	if err != nil {
+		return nil
+	}
+	if op.Name == StorageOpDownload {
+		return f
+	}
+	if _, err := f.Seek(op.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil
+	}
+	if op.Length < 0 {
+		return f
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, op.Length), f}
+}
+
+func (c *StorageCache) startFill(key string) *cacheFill {
+	fill := &cacheFill{}
+	c.mu.Lock()
+	c.fills[key] = fill
+	c.mu.Unlock()
+	return fill
+}
+
+func (c *StorageCache) endFill(key string, fill *cacheFill) {
+	c.mu.Lock()
+	if c.fills[key] == fill {
+		delete(c.fills, key)
+	}
+	c.mu.Unlock()
+}
+
+// drop forgets a key and any fill of it in progress.
+func (c *StorageCache) drop(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.fills, key)
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+}
+
+// commit makes a finished fill the key's entry, unless a write dropped the
+// fill meanwhile, and evicts entries until the cache fits.
+func (c *StorageCache) commit(tmp string, info ObjectInfo, fill *cacheFill) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fills[info.Key] != fill {
+		os.Remove(tmp)
+		return
+	}
+	delete(c.fills, info.Key)
+	if el, ok := c.entries[info.Key]; ok {
+		c.remove(el)
+	}
+
+	path := c.path(info.Key)
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		log.Printf("storage cache: %v", err)
+		return
+	}
+	c.entries[info.Key] = c.lru.PushFront(&cacheEntry{key: info.Key, path: path, info: info})
+	c.size += info.Size
+
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+	storageCacheBytes.Set(float64(c.size))
+}
+
+// remove deletes an entry and its file. Readers that have the file open
+// can finish reading it.
+func (c *StorageCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	os.Remove(e.path)
+	c.size -= e.info.Size
+	storageCacheBytes.Set(float64(c.size))
+}
+
+func (c *StorageCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// cacheFiller copies a download to a temporary file as it is read, and
+// commits it to the cache when it has been read to the end and closed.
+type cacheFiller struct {
+	cache *StorageCache
+	body  io.ReadCloser
+	tmp   *os.File
+	info  ObjectInfo
+	fill  *cacheFill
+
+	written int64
+	eof     bool
+	failed  bool
+}
+
+func (c *StorageCache) newFiller(body io.ReadCloser, info ObjectInfo, fill *cacheFill) (*cacheFiller, error) {
+	tmp, err := os.CreateTemp(c.dir, filepath.Base(c.path(info.Key))+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &cacheFiller{cache: c, body: body, tmp: tmp, info: info, fill: fill}, nil
+}
+
+func (f *cacheFiller) Read(p []byte) (int, error) {
+	n, err := f.body.Read(p)
+	if n > 0 && !f.failed {
+		if _, werr := f.tmp.Write(p[:n]); werr != nil {
+			f.failed = true
+		}
+		f.written += int64(n)
+	}
+	if err == io.EOF {
+		f.eof = true
+	}
+	return n, err
+}
+
+func (f *cacheFiller) Close() error {
+	err := f.body.Close()
+	if f.tmp == nil {
+		return err
+	}
+
+	tmp := f.tmp.Name()
+	closeErr := f.tmp.Close()
+	f.tmp = nil
+	if f.eof && !f.failed && closeErr == nil && f.written == f.info.Size {
+		f.cache.commit(tmp, f.info, f.fill)
+	} else {
+		os.Remove(tmp)
+		f.cache.endFill(f.info.Key, f.fill)
+	}
+	return err
+}
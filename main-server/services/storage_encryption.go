@@ -0,0 +1,855 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// Every encrypted object starts with encryptionMagic, the ID of its data
+	// key and, for multipart uploads, the number of frames in each part
+	encryptionMagic      = "\x00AFENC2\x00"
+	dataKeyIDSize        = 16
+	encryptionKeyedSize  = len(encryptionMagic) + dataKeyIDSize
+	encryptionHeaderSize = encryptionKeyedSize + 4
+
+	// Plaintext is sealed in frames of this size, the last one shorter,
+	// each stored as a random nonce, the ciphertext and the GCM tag
+	encryptionFrameSize = 64 << 10
+	sealedFrameOverhead = 12 + 16
+	sealedFrameSize     = encryptionFrameSize + sealedFrameOverhead
+
+	// Wrapped data keys are kept beside the objects, under this prefix
+	keysPrefix = ".keys/"
+	// Scope for keys KeyScheme places in none
+	defaultKeyScope = "shared"
+)
+
+// ErrNotEncrypted is returned when reading an object EncryptedStorage did
+// not write, such as one stored before encryption was turned on.
+var ErrNotEncrypted = errors.New("object is not encrypted")
+
+// KeyScheme tells EncryptedStorage which KMS scope protects each storage key,
+// and under which prefixes a scope's keys live, for rotation.
+type KeyScheme interface {
+	// Scope returns the scope of key, or "" for the shared scope.
+	Scope(key string) string
+	Prefixes(scope string) []string
+}
+
+// KeyRotator is implemented by backends that encrypt with keys a KMS holds.
+type KeyRotator interface {
+	// RotateKeys makes a new key-encryption key for scope and rewraps the
+	// scope's data keys with it. Stored objects are not re-encrypted. It
+	// returns the new key's version and how many data keys were rewrapped.
+	RotateKeys(ctx context.Context, scope string) (version string, rewrapped int, err error)
+}
+
+// EncryptedStorage encrypts objects before they reach another backend, so
+// neither the backend nor anyone with access to it sees file contents. Each
+// object has its own random AES-256 data key, sealed into GCM frames as it
+// streams, and the data key is stored beside the object wrapped by its
+// scope's key-encryption key, which never leaves the KMS:
+//
+//	{key}                   magic, data key ID, frames
+//	.keys/{key}/{key ID}    the wrapped data key, as JSON
+//
+// Frames are sealed in the STREAM construction: each frame's additional
+// data holds the magic, the data key ID, its part number, its index in the
+// part and whether it ends the part, so frames cannot be reordered, repeated
+// or moved between objects. The number of parts is sealed into the data key
+// record, so cutting off the end of an object is noticed too.
+//
+// Sizes reported by Stat and List are the plaintext sizes, worked out from
+// the stored ones, and ranges find their frames by offset, so every frame
+// but the last must be full: multipart parts must be numbered from 1 and all
+// but the last the same size, a multiple of 64 KiB, as the whole-MiB parts
+// resumable uploads use always are.
+//
+// Presigned URLs would hand out ciphertext, so GeneratePresignedURL fails
+// and presigned uploads are not offered. Turning encryption on for a backend
+// that already holds objects needs them uploaded again; reading one fails
+// with ErrNotEncrypted.
+type EncryptedStorage struct {
+	inner  StorageBackend
+	kms    KMS
+	scheme KeyScheme
+}
+
+// NewEncryptedStorage returns inner with client-side encryption. The result
+// is MultipartStorage and RangeStorage as well when inner is.
+func NewEncryptedStorage(inner StorageBackend, kms KMS, scheme KeyScheme) StorageBackend {
+	s := &EncryptedStorage{inner: inner, kms: kms, scheme: scheme}
+	if m, ok := inner.(MultipartStorage); ok {
+		return &encryptedMultipartStorage{EncryptedStorage: s, multipart: m}
+	}
+	return s
+}
+
+// wrappedDataKey is what is stored beside an object.
+type wrappedDataKey struct {
+	ID         string `json:"id"`
+	Scope      string `json:"scope"`
+	KEKVersion string `json:"kek_version"`
+	WrappedKey []byte `json:"wrapped_key"`
+
+	// How many parts the object was written in, sealed with the data key,
+	// once the object is complete
+	Parts     int    `json:"parts,omitempty"`
+	PartsSeal []byte `json:"parts_seal,omitempty"`
+}
+
+func (s *EncryptedStorage) Upload(ctx context.Context, file io.Reader, key string) error {
+	wk, c, err := s.newDataKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := c.sealParts(wk, 1); err != nil {
+		return err
+	}
+
+	// The key is stored first, so an object is never without one
+	keyPath := dataKeyPath(key, wk.ID)
+	if err := s.putDataKey(ctx, keyPath, wk); err != nil {
+		return err
+	}
+	header := encryptionHeader(wk.ID, 0)
+	if err := s.inner.Upload(ctx, newEncryptingReader(file, c, 1, header), key); err != nil {
+		s.inner.Delete(context.Background(), keyPath)
+		return err
+	}
+
+	s.removeStaleDataKeys(ctx, key)
+	return nil
+}
+
+func (s *EncryptedStorage) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	body, err := s.inner.Download(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	header, err := readEncryptionHeader(body, key)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	c, parts, err := s.dataKey(ctx, key, header)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return newDecryptingReader(body, c, header, parts, 0, 0, -1), nil
+}
+
+// DownloadRange decrypts only the frames holding the range, if inner can
+// read ranges, and otherwise decrypts from the start. The index of the first
+// frame, which its additional data needs, follows from the offset.
+func (s *EncryptedStorage) DownloadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	ranged, ok := s.inner.(RangeStorage)
+	if !ok {
+		body, err := s.Download(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(io.Discard, body, offset); err != nil {
+			body.Close()
+			return nil, err
+		}
+		if length < 0 {
+			return body, nil
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(body, length), body}, nil
+	}
+
+	header, err := s.readHeader(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	c, parts, err := s.dataKey(ctx, key, header)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	// One byte past the last frame tells whether it is the object's last
+	first := offset / encryptionFrameSize
+	sealedLength := int64(-1)
+	if length > 0 {
+		last := (offset + length - 1) / encryptionFrameSize
+		sealedLength = (last-first+1)*sealedFrameSize + 1
+	}
+	body, err := ranged.DownloadRange(ctx, key, int64(encryptionHeaderSize)+first*sealedFrameSize, sealedLength)
+	if err != nil {
+		return nil, err
+	}
+	return newDecryptingReader(body, c, header, parts, first, offset%encryptionFrameSize, length), nil
+}
+
+// Delete removes the object and then every data key stored for it.
+func (s *EncryptedStorage) Delete(ctx context.Context, key string) error {
+	if err := s.inner.Delete(ctx, key); err != nil {
+		return err
+	}
+	keys, err := s.dataKeyObjects(ctx, key)
+	if err != nil {
+		return err
+	}
+	for _, o := range keys {
+		if err := s.inner.Delete(ctx, o.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *EncryptedStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	info, err := s.inner.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size, err = plaintextSize(key, info.Size); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// List leaves out the stored data keys.
+func (s *EncryptedStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects, err := s.inner.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := objects[:0]
+	for _, o := range objects {
+		if strings.HasPrefix(o.Key, keysPrefix) {
+			continue
+		}
+		if o.Size, err = plaintextSize(o.Key, o.Size); err != nil {
+			return nil, err
+		}
+		listed = append(listed, o)
+	}
+	return listed, nil
+}
+
+// Copy copies the object as it is stored, with its data key. The data key
+// is rewrapped if dstKey is in another scope.
+func (s *EncryptedStorage) Copy(ctx context.Context, srcKey, dstKey string) error {
+	header, err := s.readHeader(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	id := hex.EncodeToString(header[len(encryptionMagic):encryptionKeyedSize])
+	wk, err := s.getDataKey(ctx, dataKeyPath(srcKey, id))
+	if err != nil {
+		return err
+	}
+
+	if scope := s.scope(dstKey); scope != wk.Scope {
+		dataKey, err := s.kms.UnwrapKey(ctx, wk.Scope, wk.KEKVersion, wk.WrappedKey)
+		if err != nil {
+			return err
+		}
+		if wk.WrappedKey, wk.KEKVersion, err = s.kms.WrapKey(ctx, scope, dataKey); err != nil {
+			return fmt.Errorf("failed to wrap data key: %w", err)
+		}
+		wk.Scope = scope
+	}
+
+	keyPath := dataKeyPath(dstKey, id)
+	if err := s.putDataKey(ctx, keyPath, wk); err != nil {
+		return err
+	}
+	if err := s.inner.Copy(ctx, srcKey, dstKey); err != nil {
+		if _, statErr := s.inner.Stat(context.Background(), dstKey); errors.Is(statErr, ErrObjectNotFound) {
+			s.inner.Delete(context.Background(), keyPath)
+		}
+		return err
+	}
+
+	s.removeStaleDataKeys(ctx, dstKey)
+	return nil
+}
+
+func (s *EncryptedStorage) GeneratePresignedURL(key string, expiry time.Duration) (string, error) {
+	return "", errors.New("presigned URLs are not available for encrypted storage")
+}
+
+// RotateKeys rewraps the data keys under the scheme's prefixes for scope.
+// Data keys wrapped by an older version stay readable meanwhile, as the
+// KMS keeps every version.
+func (s *EncryptedStorage) RotateKeys(ctx context.Context, scope string) (string, int, error) {
+	version, err := s.kms.RotateKey(ctx, scope)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to rotate key for %s: %w", scope, err)
+	}
+
+	n := 0
+	for _, prefix := range s.scheme.Prefixes(scope) {
+		objects, err := s.inner.List(ctx, keysPrefix+prefix)
+		if err != nil {
+			return version, n, err
+		}
+		for _, o := range objects {
+			if !isDataKeyID(o.Key[strings.LastIndex(o.Key, "/")+1:]) {
+				continue
+			}
+			wk, err := s.getDataKey(ctx, o.Key)
+			if err != nil {
+				return version, n, err
+			}
+			if wk.Scope != scope || wk.KEKVersion == version {
+				continue
+			}
+
+			dataKey, err := s.kms.UnwrapKey(ctx, wk.Scope, wk.KEKVersion, wk.WrappedKey)
+			if err != nil {
+				return version, n, fmt.Errorf("failed to unwrap %s: %w", o.Key, err)
+			}
+			if wk.WrappedKey, wk.KEKVersion, err = s.kms.WrapKey(ctx, scope, dataKey); err != nil {
+				return version, n, fmt.Errorf("failed to wrap data key: %w", err)
+			}
+			if err := s.putDataKey(ctx, o.Key, wk); err != nil {
+				return version, n, err
+			}
+			n++
+		}
+	}
+	return version, n, nil
+}
+
+func (s *EncryptedStorage) scope(key string) string {
+	if scope := s.scheme.Scope(key); scope != "" {
+		return scope
+	}
+	return defaultKeyScope
+}
+
+// newDataKey makes a data key for key, wrapped by its scope's KEK.
+func (s *EncryptedStorage) newDataKey(ctx context.Context, key string) (*wrappedDataKey, *frameCipher, error) {
+	dataKey := make([]byte, 32)
+	id := make([]byte, dataKeyIDSize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(id); err != nil {
+		return nil, nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wk := &wrappedDataKey{ID: hex.EncodeToString(id), Scope: s.scope(key)}
+	if wk.WrappedKey, wk.KEKVersion, err = s.kms.WrapKey(ctx, wk.Scope, dataKey); err != nil {
+		return nil, nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	return wk, newFrameCipher(aead, wk.ID), nil
+}
+
+// dataKey returns the unwrapped data key named by an object's header, and
+// the number of parts it was written in.
+func (s *EncryptedStorage) dataKey(ctx context.Context, key string, header []byte) (*frameCipher, int64, error) {
+	wk, err := s.getDataKey(ctx, dataKeyPath(key, hex.EncodeToString(header[len(encryptionMagic):encryptionKeyedSize])))
+	if err != nil {
+		return nil, 0, err
+	}
+	c, err := s.unwrapDataKey(ctx, key, wk)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := c.openParts(wk); err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return c, int64(wk.Parts), nil
+}
+
+func (s *EncryptedStorage) unwrapDataKey(ctx context.Context, key string, wk *wrappedDataKey) (*frameCipher, error) {
+	dataKey, err := s.kms.UnwrapKey(ctx, wk.Scope, wk.KEKVersion, wk.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key of %s: %w", key, err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return newFrameCipher(aead, wk.ID), nil
+}
+
+func (s *EncryptedStorage) getDataKey(ctx context.Context, path string) (*wrappedDataKey, error) {
+	body, err := s.inner.Download(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data key: %w", err)
+	}
+	defer body.Close()
+
+	var wk wrappedDataKey
+	if err := json.NewDecoder(body).Decode(&wk); err != nil {
+		return nil, fmt.Errorf("failed to read data key %s: %w", path, err)
+	}
+	return &wk, nil
+}
+
+func (s *EncryptedStorage) putDataKey(ctx context.Context, path string, wk *wrappedDataKey) error {
+	data, err := json.Marshal(wk)
+	if err != nil {
+		return err
+	}
+	if err := s.inner.Upload(ctx, bytes.NewReader(data), path); err != nil {
+		return fmt.Errorf("failed to store data key: %w", err)
+	}
+	return nil
+}
+
+// readHeader reads just the header of an object.
+func (s *EncryptedStorage) readHeader(ctx context.Context, key string) ([]byte, error) {
+	var body io.ReadCloser
+	var err error
+	if ranged, ok := s.inner.(RangeStorage); ok {
+		body, err = ranged.DownloadRange(ctx, key, 0, int64(encryptionHeaderSize))
+	} else {
+		body, err = s.inner.Download(ctx, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return readEncryptionHeader(body, key)
+}
+
+// dataKeyObjects returns the data keys stored for key.
+func (s *EncryptedStorage) dataKeyObjects(ctx context.Context, key string) ([]ObjectInfo, error) {
+	dir := keysPrefix + key + "/"
+	objects, err := s.inner.List(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys under key/ as well as key itself have theirs in dir
+	keys := objects[:0]
+	for _, o := range objects {
+		if isDataKeyID(strings.TrimPrefix(o.Key, dir)) {
+			keys = append(keys, o)
+		}
+	}
+	return keys, nil
+}
+
+// removeStaleDataKeys removes the data keys of objects key held before it
+// was overwritten. Only keys older than the current one's go, so a write
+// racing with this one never loses its key.
+func (s *EncryptedStorage) removeStaleDataKeys(ctx context.Context, key string) {
+	header, err := s.readHeader(ctx, key)
+	if err != nil {
+		log.Printf("failed to remove stale data keys of %s: %v", key, err)
+		return
+	}
+	keys, err := s.dataKeyObjects(ctx, key)
+	if err != nil {
+		log.Printf("failed to remove stale data keys of %s: %v", key, err)
+		return
+	}
+
+	current := dataKeyPath(key, hex.EncodeToString(header[len(encryptionMagic):encryptionKeyedSize]))
+	var currentTime time.Time
+	for _, o := range keys {
+		if o.Key == current {
+			currentTime = o.ModTime
+		}
+	}
+	for _, o := range keys {
+		if o.Key != current && o.ModTime.Before(currentTime) {
+			if err := s.inner.Delete(ctx, o.Key); err != nil {
+				log.Printf("failed to remove stale data key %s: %v", o.Key, err)
+			}
+		}
+	}
+}
+
+// encryptedMultipartStorage is EncryptedStorage over a MultipartStorage.
+// Each part is encrypted as it arrives, the first with the header, which
+// records how many frames it holds and so every part but the last. The
+// wrapped data key waits in a pending key until the upload is completed,
+// when the number of parts is sealed into it.
+type encryptedMultipartStorage struct {
+	*EncryptedStorage
+	multipart MultipartStorage
+}
+
+func (s *encryptedMultipartStorage) CreateMultipart(ctx context.Context, key string) (string, error) {
+	wk, _, err := s.newDataKey(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	uploadID, err := s.multipart.CreateMultipart(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if err := s.putDataKey(ctx, pendingDataKeyPath(key, uploadID), wk); err != nil {
+		s.multipart.AbortMultipart(context.Background(), key, uploadID)
+		return "", err
+	}
+	return uploadID, nil
+}
+
+// UploadPart encrypts the part in memory, as the stored part is larger and
+// must be sent with its size.
+func (s *encryptedMultipartStorage) UploadPart(ctx context.Context, key, uploadID string, number int, r io.ReadSeeker, size int64) (string, error) {
+	wk, c, err := s.pendingDataKey(ctx, key, uploadID)
+	if err != nil {
+		return "", err
+	}
+	var header []byte
+	if number == 1 {
+		header = encryptionHeader(wk.ID, sealedFrames(size))
+	}
+
+	var sealed bytes.Buffer
+	sealed.Grow(int(sealedSize(size)))
+	if _, err := io.Copy(&sealed, newEncryptingReader(io.LimitReader(r, size), c, int64(number), header)); err != nil {
+		return "", err
+	}
+	return s.multipart.UploadPart(ctx, key, uploadID, number, bytes.NewReader(sealed.Bytes()), int64(sealed.Len()))
+}
+
+func (s *encryptedMultipartStorage) CompleteMultipart(ctx context.Context, key, uploadID string, parts []CompletedPart) error {
+	for i, part := range parts {
+		if part.Number != i+1 {
+			return fmt.Errorf("encrypted uploads need parts numbered from 1 without gaps, got part %d at %d", part.Number, i+1)
+		}
+	}
+
+	pending := pendingDataKeyPath(key, uploadID)
+	wk, c, err := s.pendingDataKey(ctx, key, uploadID)
+	if err != nil {
+		return err
+	}
+	if err := c.sealParts(wk, len(parts)); err != nil {
+		return err
+	}
+
+	if err := s.putDataKey(ctx, dataKeyPath(key, wk.ID), wk); err != nil {
+		return err
+	}
+	if err := s.multipart.CompleteMultipart(ctx, key, uploadID, parts); err != nil {
+		return err
+	}
+
+	if err := s.inner.Delete(ctx, pending); err != nil {
+		log.Printf("failed to remove pending data key %s: %v", pending, err)
+	}
+	s.removeStaleDataKeys(ctx, key)
+	return nil
+}
+
+func (s *encryptedMultipartStorage) AbortMultipart(ctx context.Context, key, uploadID string) error {
+	if err := s.multipart.AbortMultipart(ctx, key, uploadID); err != nil {
+		return err
+	}
+	return s.inner.Delete(ctx, pendingDataKeyPath(key, uploadID))
+}
+
+func (s *encryptedMultipartStorage) pendingDataKey(ctx context.Context, key, uploadID string) (*wrappedDataKey, *frameCipher, error) {
+	wk, err := s.getDataKey(ctx, pendingDataKeyPath(key, uploadID))
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil, nil, fmt.Errorf("%s: %w", uploadID, ErrUnknownUpload)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := s.unwrapDataKey(ctx, key, wk)
+	return wk, c, err
+}
+
+func dataKeyPath(key, id string) string {
+	return keysPrefix + key + "/" + id
+}
+
+// pendingDataKeyPath is hashed, as upload IDs are chosen by the backend and
+// may hold anything.
+func pendingDataKeyPath(key, uploadID string) string {
+	sum := sha256.Sum256([]byte(key + "\x00" + uploadID))
+	return keysPrefix + ".uploads/" + hex.EncodeToString(sum[:])
+}
+
+func isDataKeyID(s string) bool {
+	if len(s) != 2*dataKeyIDSize {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// encryptionHeader returns the header of an object whose data key is id.
+// framesPerPart is 0 unless it is a multipart upload.
+func encryptionHeader(id string, framesPerPart int64) []byte {
+	raw, _ := hex.DecodeString(id)
+	header := append([]byte(encryptionMagic), raw...)
+	return binary.BigEndian.AppendUint32(header, uint32(framesPerPart))
+}
+
+func readEncryptionHeader(r io.Reader, key string) ([]byte, error) {
+	header := make([]byte, encryptionHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%s: %w", key, ErrNotEncrypted)
+		}
+		return nil, err
+	}
+	if !bytes.HasPrefix(header, []byte(encryptionMagic)) {
+		return nil, fmt.Errorf("%s: %w", key, ErrNotEncrypted)
+	}
+	return header, nil
+}
+
+// sealedFrames returns how many frames n bytes of plaintext are sealed in.
+// Nothing is still one, empty, frame.
+func sealedFrames(n int64) int64 {
+	return max(1, (n+encryptionFrameSize-1)/encryptionFrameSize)
+}
+
+// sealedSize returns the stored size of n bytes of plaintext, without the
+// header.
+func sealedSize(n int64) int64 {
+	return n + sealedFrames(n)*sealedFrameOverhead
+}
+
+// plaintextSize works out the size of an object from its stored size.
+func plaintextSize(key string, stored int64) (int64, error) {
+	sealed := stored - int64(encryptionHeaderSize)
+	frames := (sealed + sealedFrameSize - 1) / sealedFrameSize
+	last := sealed - (frames-1)*sealedFrameSize
+	if frames < 1 || last < sealedFrameOverhead || (frames > 1 && last == sealedFrameOverhead) {
+		return 0, fmt.Errorf("%s: %w", key, ErrNotEncrypted)
+	}
+	return sealed - frames*sealedFrameOverhead, nil
+}
+
+// frameCipher seals and opens the frames of one object with its data key.
+type frameCipher struct {
+	aead cipher.AEAD
+	// The header's magic and data key ID, which start every frame's
+	// additional data
+	keyed []byte
+}
+
+func newFrameCipher(aead cipher.AEAD, id string) *frameCipher {
+	return &frameCipher{aead: aead, keyed: encryptionHeader(id, 0)[:encryptionKeyedSize]}
+}
+
+// frameAD returns the additional data of the index-th frame of part, which
+// is last if the part ends with it.
+func (c *frameCipher) frameAD(part, index int64, last bool) []byte {
+	ad := append(slices.Clip(c.keyed), "frame"...)
+	ad = binary.BigEndian.AppendUint32(ad, uint32(part))
+	ad = binary.BigEndian.AppendUint64(ad, uint64(index))
+	if last {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+func (c *frameCipher) partsAD(parts int) []byte {
+	ad := append(slices.Clip(c.keyed), "parts"...)
+	return binary.BigEndian.AppendUint32(ad, uint32(parts))
+}
+
+// sealParts records in wk that the object has the given number of parts.
+func (c *frameCipher) sealParts(wk *wrappedDataKey, parts int) error {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	wk.Parts = parts
+	wk.PartsSeal = c.aead.Seal(nonce, nonce, nil, c.partsAD(parts))
+	return nil
+}
+
+// openParts checks the number of parts recorded in wk.
+func (c *frameCipher) openParts(wk *wrappedDataKey) error {
+	nonceSize := c.aead.NonceSize()
+	if wk.Parts < 1 || len(wk.PartsSeal) < nonceSize {
+		return errors.New("data key does not record the object's parts")
+	}
+	if _, err := c.aead.Open(nil, wk.PartsSeal[:nonceSize], wk.PartsSeal[nonceSize:], c.partsAD(wk.Parts)); err != nil {
+		return errors.New("data key's record of the object's parts has been altered")
+	}
+	return nil
+}
+
+// encryptingReader reads plaintext from src as the sealed frames of part,
+// after header unless it is nil. It reads a byte ahead, to tell whether a
+// full frame is the part's last.
+type encryptingReader struct {
+	src   io.Reader
+	c     *frameCipher
+	part  int64
+	index int64
+	plain []byte
+	ahead bool // plain[0] holds the byte read ahead
+	frame []byte
+	out   []byte
+	err   error
+}
+
+func newEncryptingReader(src io.Reader, c *frameCipher, part int64, header []byte) *encryptingReader {
+	return &encryptingReader{
+		src:   src,
+		c:     c,
+		part:  part,
+		plain: make([]byte, encryptionFrameSize+1),
+		frame: make([]byte, 0, sealedFrameSize),
+		out:   header,
+	}
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		start := 0
+		if r.ahead {
+			start = 1
+		}
+		n, err := io.ReadFull(r.src, r.plain[start:])
+		n += start
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			r.err = io.EOF
+		} else if err != nil {
+			r.err = err
+			continue
+		}
+
+		// Even an empty part has a frame, so that it has a last one
+		last := n <= encryptionFrameSize
+		nonce := r.frame[:r.c.aead.NonceSize()]
+		if _, err := rand.Read(nonce); err != nil {
+			r.err = err
+			continue
+		}
+		r.out = r.c.aead.Seal(nonce, nonce, r.plain[:min(n, encryptionFrameSize)], r.c.frameAD(r.part, r.index, last))
+		r.index++
+		if r.ahead = !last; r.ahead {
+			r.plain[0] = r.plain[encryptionFrameSize]
+		}
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// decryptingReader reads sealed frames from src, starting with the object's
+// index-th, as plaintext, dropping the first skip bytes and stopping after
+// limit, unless it is negative. Like encryptingReader it reads a byte ahead,
+// to tell whether a frame is the object's last.
+type decryptingReader struct {
+	src           io.ReadCloser
+	c             *frameCipher
+	framesPerPart int64
+	parts         int64
+	index         int64
+	frame         []byte
+	ahead         bool // frame[0] holds the byte read ahead
+	last          bool
+	plain         []byte
+	skip          int64
+	limit         int64
+}
+
+func newDecryptingReader(src io.ReadCloser, c *frameCipher, header []byte, parts, index, skip, limit int64) *decryptingReader {
+	return &decryptingReader{
+		src:           src,
+		c:             c,
+		framesPerPart: int64(binary.BigEndian.Uint32(header[encryptionKeyedSize:])),
+		parts:         parts,
+		index:         index,
+		frame:         make([]byte, sealedFrameSize+1),
+		skip:          skip,
+		limit:         limit,
+	}
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	if r.limit == 0 {
+		return 0, io.EOF
+	}
+	for len(r.plain) == 0 {
+		if r.last {
+			return 0, io.EOF
+		}
+		start := 0
+		if r.ahead {
+			start = 1
+		}
+		n, err := io.ReadFull(r.src, r.frame[start:])
+		n += start
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, err
+		}
+		more := n > sealedFrameSize
+		sealed := r.frame[:min(n, sealedFrameSize)]
+
+		// A frame ends its part where the part's frames run out, except
+		// in the last part, which ends where the object does
+		part, index := int64(1), r.index
+		if r.framesPerPart > 0 {
+			part, index = r.index/r.framesPerPart+1, r.index%r.framesPerPart
+		}
+		if len(sealed) <= sealedFrameOverhead && !(len(sealed) == sealedFrameOverhead && r.index == 0) ||
+			part > r.parts || (!more && part < r.parts) {
+			return 0, errors.New("encrypted object is truncated")
+		}
+		last := !more && part == r.parts
+		endsPart := last || (part < r.parts && index == r.framesPerPart-1)
+
+		nonceSize := r.c.aead.NonceSize()
+		plain, err := r.c.aead.Open(sealed[nonceSize:nonceSize], sealed[:nonceSize], sealed[nonceSize:], r.c.frameAD(part, index, endsPart))
+		if err != nil {
+			return 0, fmt.Errorf("failed to decrypt object: %w", err)
+		}
+		r.index++
+		r.last = last
+		if r.ahead = more; more {
+			r.frame[0] = r.frame[sealedFrameSize]
+		}
+
+		drop := min(r.skip, int64(len(plain)))
+		r.plain = plain[drop:]
+		r.skip -= drop
+	}
+
+	if r.limit > 0 && int64(len(p)) > r.limit {
+		p = p[:r.limit]
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	if r.limit > 0 {
+		r.limit -= int64(n)
+	}
+	return n, nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.src.Close()
+}
@@ -0,0 +1,176 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+func newTestEncryptedStorage(t *testing.T) (StorageBackend, *MemoryStorage) {
+	t.Helper()
+	kms, err := NewLocalKMS(t.TempDir(), bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := NewMemoryStorage()
+	return NewEncryptedStorage(inner, kms, AudienceKeyScheme{}), inner
+}
+
+func readObject(ctx context.Context, b StorageBackend, key string) ([]byte, error) {
+	r, err := b.Download(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// frames splits a stored object into its header and sealed frames.
+func frames(stored []byte) (header []byte, sealed [][]byte) {
+	header, rest := stored[:encryptionHeaderSize], stored[encryptionHeaderSize:]
+	for len(rest) > 0 {
+		n := min(len(rest), sealedFrameSize)
+		sealed = append(sealed, rest[:n])
+		rest = rest[n:]
+	}
+	return header, sealed
+}
+
+func TestEncryptedStorageRejectsRearrangedFrames(t *testing.T) {
+	ctx := context.Background()
+	const key, otherKey = "ws/company/list.csv", "ws/company/other.csv"
+
+	// Four frames, the last one full
+	data := bytes.Repeat([]byte("ada@example.com,Ada,10001\n"), 4*encryptionFrameSize/26+1)[:4*encryptionFrameSize]
+
+	tests := []struct {
+		name   string
+		tamper func(header []byte, sealed, other [][]byte) [][]byte
+	}{
+		{"frames swapped", func(header []byte, sealed, other [][]byte) [][]byte {
+			return [][]byte{header, sealed[1], sealed[0], sealed[2], sealed[3]}
+		}},
+		{"frame repeated", func(header []byte, sealed, other [][]byte) [][]byte {
+			return [][]byte{header, sealed[0], sealed[1], sealed[1], sealed[2], sealed[3]}
+		}},
+		{"frame left out", func(header []byte, sealed, other [][]byte) [][]byte {
+			return [][]byte{header, sealed[0], sealed[2], sealed[3]}
+		}},
+		{"last frame cut off", func(header []byte, sealed, other [][]byte) [][]byte {
+			return [][]byte{header, sealed[0], sealed[1], sealed[2]}
+		}},
+		{"only the header", func(header []byte, sealed, other [][]byte) [][]byte {
+			return [][]byte{header}
+		}},
+		{"frame from another object", func(header []byte, sealed, other [][]byte) [][]byte {
+			return [][]byte{header, sealed[0], other[1], sealed[2], sealed[3]}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encrypted, inner := newTestEncryptedStorage(t)
+			// The same plaintext under another key as well
+			for _, k := range []string{key, otherKey} {
+				if err := encrypted.Upload(ctx, bytes.NewReader(data), k); err != nil {
+					t.Fatal(err)
+				}
+			}
+			stored, err := readObject(ctx, inner, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := readObject(ctx, inner, otherKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := readObject(ctx, encrypted, key); err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("untampered object read back %d bytes, %v", len(got), err)
+			}
+
+			header, sealed := frames(stored)
+			_, otherSealed := frames(other)
+			parts := tt.tamper(header, sealed, otherSealed)
+			if err := inner.Upload(ctx, bytes.NewReader(bytes.Join(parts, nil)), key); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := readObject(ctx, encrypted, key); err == nil {
+				t.Errorf("read back %d bytes without an error", len(got))
+			}
+		})
+	}
+}
+
+func TestEncryptedStorageRejectsAlteredPartCount(t *testing.T) {
+	ctx := context.Background()
+	encrypted, inner := newTestEncryptedStorage(t)
+	m := encrypted.(MultipartStorage)
+	const key = "ws/company/upload.csv"
+
+	first := bytes.Repeat([]byte("a"), 2*encryptionFrameSize)
+	id, err := m.CreateMultipart(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []CompletedPart
+	for i, part := range [][]byte{first, first, []byte("end")} {
+		etag, err := m.UploadPart(ctx, key, id, i+1, bytes.NewReader(part), int64(len(part)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, CompletedPart{Number: i + 1, ETag: etag})
+	}
+	if err := m.CompleteMultipart(ctx, key, id, parts); err != nil {
+		t.Fatal(err)
+	}
+
+	want := append(append(append([]byte{}, first...), first...), "end"...)
+	if got, err := readObject(ctx, encrypted, key); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("read back %d bytes, %v", len(got), err)
+	}
+	r, err := encrypted.(RangeStorage).DownloadRange(ctx, key, int64(len(want))-5, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(got) != "aaend" {
+		t.Fatalf("range of the last part returned %q, %v", got, err)
+	}
+
+	// Drop the last part and claim there were only two
+	stored, err := readObject(ctx, inner, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := stored[:encryptionHeaderSize+4*sealedFrameSize]
+	if err := inner.Upload(ctx, bytes.NewReader(truncated), key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readObject(ctx, encrypted, key); err == nil {
+		t.Fatal("an object missing its last part was read back")
+	}
+
+	keys, err := inner.List(ctx, keysPrefix+key+"/")
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("found %d data keys, %v", len(keys), err)
+	}
+	raw, err := readObject(ctx, inner, keys[0].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wk wrappedDataKey
+	if err := json.Unmarshal(raw, &wk); err != nil {
+		t.Fatal(err)
+	}
+	wk.Parts = 2
+	raw, _ = json.Marshal(wk)
+	if err := inner.Upload(ctx, bytes.NewReader(raw), keys[0].Key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readObject(ctx, encrypted, key); err == nil || !strings.Contains(err.Error(), "altered") {
+		t.Fatalf("a data key with its part count altered was used: %v", err)
+	}
+}
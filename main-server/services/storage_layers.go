@@ -0,0 +1,394 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"main-server/config"
+)
+
+// Operation names a StorageLayer sees, one per StorageBackend method.
+const (
+	StorageOpUpload            = "upload"
+	StorageOpDownload          = "download"
+	StorageOpDownloadRange     = "download_range"
+	StorageOpDelete            = "delete"
+	StorageOpStat              = "stat"
+	StorageOpList              = "list"
+	StorageOpCopy              = "copy"
+	StorageOpPresignURL        = "presign_url"
+	StorageOpPresignUpload     = "presign_upload"
+	StorageOpCreateMultipart   = "create_multipart"
+	StorageOpUploadPart        = "upload_part"
+	StorageOpCompleteMultipart = "complete_multipart"
+	StorageOpAbortMultipart    = "abort_multipart"
+)
+
+// StorageOp is one call to a backend, as a StorageLayer sees it.
+type StorageOp struct {
+	Name string
+	// The object's key; the prefix for list and the destination for copy
+	Key    string
+	SrcKey string
+	// The range asked for, for download_range
+	Offset, Length int64
+
+	// What is being stored, for upload and upload_part. A layer that runs
+	// the operation more than once must rewind it first, which only works
+	// if it is an io.Seeker.
+	Body io.Reader
+	// What was downloaded, for download and download_range, once the
+	// operation has succeeded. Layers may replace it with a reader of their
+	// own, which must close this one.
+	Result io.ReadCloser
+}
+
+// StorageLayer adds behaviour around every operation of a backend, such as
+// metrics, retries or caching. Call performs op by calling next, which runs
+// it on inner, the backend beneath the layer: once, several times, or not at
+// all if the layer can answer it itself.
+type StorageLayer interface {
+	Call(ctx context.Context, inner StorageBackend, op *StorageOp, next func(context.Context) error) error
+}
+
+// LayerStorage wraps backend in layers, the first outermost. The result
+// supports the same optional interfaces backend does, multipart, range and
+// presigned uploads, so layers never change what a backend can do.
+func LayerStorage(backend StorageBackend, layers ...StorageLayer) StorageBackend {
+	for i := len(layers) - 1; i >= 0; i-- {
+		backend = newLayeredStorage(backend, layers[i])
+	}
+	return backend
+}
+
+// BaseStorage returns the backend beneath any layers.
+func BaseStorage(b StorageBackend) StorageBackend {
+	for {
+		u, ok := b.(interface{ Unwrap() StorageBackend })
+		if !ok {
+			return b
+		}
+		b = u.Unwrap()
+	}
+}
+
+// newLayeredStorage picks the wrapper with exactly the optional interfaces
+// inner has, so type assertions on it answer as they would on inner.
+func newLayeredStorage(inner StorageBackend, layer StorageLayer) StorageBackend {
+	l := &layeredStorage{inner: inner, layer: layer}
+	m, isMultipart := inner.(MultipartStorage)
+	r, isRange := inner.(RangeStorage)
+	p, isPresigned := inner.(PresignedUploadStorage)
+	mp, rg, ps := layeredMultipart{l, m}, layeredRange{l, r}, layeredPresigned{l, p}
+
+	switch {
+	case isMultipart && isRange && isPresigned:
+		return &struct {
+			*layeredStorage
+			layeredMultipart
+			layeredRange
+			layeredPresigned
+		}{l, mp, rg, ps}
+	case isMultipart && isRange:
+		return &struct {
+			*layeredStorage
+			layeredMultipart
+			layeredRange
+		}{l, mp, rg}
+	case isMultipart && isPresigned:
+		return &struct {
+			*layeredStorage
+			layeredMultipart
+			layeredPresigned
+		}{l, mp, ps}
+	case isRange && isPresigned:
+		return &struct {
+			*layeredStorage
+			layeredRange
+			layeredPresigned
+		}{l, rg, ps}
+	case isMultipart:
+		return &struct {
+			*layeredStorage
+			layeredMultipart
+		}{l, mp}
+	case isRange:
+		return &struct {
+			*layeredStorage
+			layeredRange
+		}{l, rg}
+	case isPresigned:
+		return &struct {
+			*layeredStorage
+			layeredPresigned
+		}{l, ps}
+	}
+	return l
+}
+
+// layeredStorage runs every StorageBackend method through one layer.
+type layeredStorage struct {
+	inner StorageBackend
+	layer StorageLayer
+}
+
+func (s *layeredStorage) Unwrap() StorageBackend {
+	return s.inner
+}
+
+func (s *layeredStorage) call(ctx context.Context, op *StorageOp, next func(context.Context) error) error {
+	return s.layer.Call(ctx, s.inner, op, next)
+}
+
+func (s *layeredStorage) Upload(ctx context.Context, file io.Reader, key string) error {
+	op := &StorageOp{Name: StorageOpUpload, Key: key, Body: file}
+	return s.call(ctx, op, func(ctx context.Context) error {
+		return s.inner.Upload(ctx, op.Body, key)
+	})
+}
+
+func (s *layeredStorage) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	op := &StorageOp{Name: StorageOpDownload, Key: key}
+	err := s.call(ctx, op, func(ctx context.Context) error {
+		body, err := s.inner.Download(ctx, key)
+		if err != nil {
+			return err
+		}
+		op.Result = body
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return op.Result, nil
+}
+
+func (s *layeredStorage) Delete(ctx context.Context, key string) error {
+	return s.call(ctx, &StorageOp{Name: StorageOpDelete, Key: key}, func(ctx context.Context) error {
+		return s.inner.Delete(ctx, key)
+	})
+}
+
+func (s *layeredStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	var info *ObjectInfo
+	err := s.call(ctx, &StorageOp{Name: StorageOpStat, Key: key}, func(ctx context.Context) error {
+		var err error
+		info, err = s.inner.Stat(ctx, key)
+		return err
+	})
+	return info, err
+}
+
+func (s *layeredStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := s.call(ctx, &StorageOp{Name: StorageOpList, Key: prefix}, func(ctx context.Context) error {
+		var err error
+		objects, err = s.inner.List(ctx, prefix)
+		return err
+	})
+	return objects, err
+}
+
+func (s *layeredStorage) Copy(ctx context.Context, srcKey, dstKey string) error {
+	return s.call(ctx, &StorageOp{Name: StorageOpCopy, Key: dstKey, SrcKey: srcKey}, func(ctx context.Context) error {
+		return s.inner.Copy(ctx, srcKey, dstKey)
+	})
+}
+
+func (s *layeredStorage) GeneratePresignedURL(key string, expiry time.Duration) (string, error) {
+	var url string
+	err := s.call(context.Background(), &StorageOp{Name: StorageOpPresignURL, Key: key}, func(context.Context) error {
+		var err error
+		url, err = s.inner.GeneratePresignedURL(key, expiry)
+		return err
+	})
+	return url, err
+}
+
+type layeredMultipart struct {
+	s     *layeredStorage
+	inner MultipartStorage
+}
+
+func (m layeredMultipart) CreateMultipart(ctx context.Context, key string) (string, error) {
+	var uploadID string
+	err := m.s.call(ctx, &StorageOp{Name: StorageOpCreateMultipart, Key: key}, func(ctx context.Context) error {
+		var err error
+		uploadID, err = m.inner.CreateMultipart(ctx, key)
+		return err
+	})
+	return uploadID, err
+}
+
+func (m layeredMultipart) UploadPart(ctx context.Context, key, uploadID string, number int, r io.ReadSeeker, size int64) (string, error) {
+	var etag string
+	op := &StorageOp{Name: StorageOpUploadPart, Key: key, Body: r}
+	err := m.s.call(ctx, op, func(ctx context.Context) error {
+		// Layers may only wrap the part in readers that can seek too
+		body, ok := op.Body.(io.ReadSeeker)
+		if !ok {
+			return fmt.Errorf("part %d of %s cannot be rewound", number, key)
+		}
+		var err error
+		etag, err = m.inner.UploadPart(ctx, key, uploadID, number, body, size)
+		return err
+	})
+	return etag, err
+}
+
+func (m layeredMultipart) CompleteMultipart(ctx context.Context, key, uploadID string, parts []CompletedPart) error {
+	return m.s.call(ctx, &StorageOp{Name: StorageOpCompleteMultipart, Key: key}, func(ctx context.Context) error {
+		return m.inner.CompleteMultipart(ctx, key, uploadID, parts)
+	})
+}
+
+func (m layeredMultipart) AbortMultipart(ctx context.Context, key, uploadID string) error {
+	return m.s.call(ctx, &StorageOp{Name: StorageOpAbortMultipart, Key: key}, func(ctx context.Context) error {
+		return m.inner.AbortMultipart(ctx, key, uploadID)
+	})
+}
+
+type layeredRange struct {
+	s     *layeredStorage
+	inner RangeStorage
+}
+
+func (r layeredRange) DownloadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	op := &StorageOp{Name: StorageOpDownloadRange, Key: key, Offset: offset, Length: length}
+	err := r.s.call(ctx, op, func(ctx context.Context) error {
+		body, err := r.inner.DownloadRange(ctx, key, offset, length)
+		if err != nil {
+			return err
+		}
+		op.Result = body
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return op.Result, nil
+}
+
+type layeredPresigned struct {
+	s     *layeredStorage
+	inner PresignedUploadStorage
+}
+
+func (p layeredPresigned) PresignUpload(key string, cond UploadConditions) (*PresignedUpload, error) {
+	var upload *PresignedUpload
+	err := p.s.call(context.Background(), &StorageOp{Name: StorageOpPresignUpload, Key: key}, func(context.Context) error {
+		var err error
+		upload, err = p.inner.PresignUpload(key, cond)
+		return err
+	})
+	return upload, err
+}
+
+// storageLayers builds the layers STORAGE_LAYERS lists, in its order.
+func storageLayers(cfg *config.Config) ([]StorageLayer, error) {
+	var layers []StorageLayer
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(cfg.StorageLayers, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("storage layer %q is listed twice", name)
+		}
+		seen[name] = true
+
+		switch name {
+		case "logging":
+			layers = append(layers, NewStorageLogging(slog.Default(), cfg.StorageLogSlow))
+		case "metrics":
+			layers = append(layers, NewStorageMetrics(cfg.StorageBackend))
+		case "retry":
+			layers = append(layers, NewStorageRetry(cfg.StorageRetryAttempts, cfg.StorageRetryBaseDelay))
+		case "cache":
+			cache, err := NewStorageCache(cfg.StorageCacheDir, int64(cfg.StorageCacheSizeMB)<<20)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open storage cache: %w", err)
+			}
+			layers = append(layers, cache)
+		default:
+			return nil, fmt.Errorf("unknown storage layer %q", name)
+		}
+	}
+	return layers, nil
+}
+
+// storageErrorKind sorts errors for metrics and logs: a missing object is
+// an answer rather than a failure, and cancellations are the caller's.
+func storageErrorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrObjectNotFound):
+		return "not_found"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	}
+	return "error"
+}
+
+// countingBody counts the bytes read through it.
+type countingBody struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingSeeker is a countingBody over a reader that can seek, counting
+// from the new position after a seek. It is kept apart so a body that
+// cannot seek does not appear to, which uploaders check for.
+type countingSeeker struct {
+	*countingBody
+	seeker io.Seeker
+}
+
+func (c countingSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := c.seeker.Seek(offset, whence)
+	if err == nil {
+		c.n = pos
+	}
+	return pos, err
+}
+
+// countBody wraps r in a countingBody that can seek if r can.
+func countBody(r io.Reader) (io.Reader, *countingBody) {
+	body := &countingBody{r: r}
+	if seeker, ok := r.(io.Seeker); ok {
+		return countingSeeker{body, seeker}, body
+	}
+	return body, body
+}
+
+// closeHook calls onClose with the bytes read, once, when body is closed.
+type closeHook struct {
+	countingBody
+	closer  io.Closer
+	onClose func(n int64)
+	closed  bool
+}
+
+func newCloseHook(body io.ReadCloser, onClose func(n int64)) *closeHook {
+	return &closeHook{countingBody: countingBody{r: body}, closer: body, onClose: onClose}
+}
+
+func (h *closeHook) Close() error {
+	err := h.closer.Close()
+	if !h.closed {
+		h.closed = true
+		h.onClose(h.n)
+	}
+	return err
+}
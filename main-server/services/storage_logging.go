@@ -0,0 +1,54 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// StorageLogging is a StorageLayer logging every operation with slog, as
+// structured records with the operation, key, duration and error. Failures
+// are logged at warning level, operations slower than slow at info level,
+// and the rest, missing objects included, at debug level.
+type StorageLogging struct {
+	logger *slog.Logger
+	slow   time.Duration
+}
+
+// NewStorageLogging returns a StorageLogging writing to logger. A slow of
+// zero never counts an operation as slow.
+func NewStorageLogging(logger *slog.Logger, slow time.Duration) *StorageLogging {
+	return &StorageLogging{logger: logger.With("component", "storage"), slow: slow}
+}
+
+func (l *StorageLogging) Call(ctx context.Context, inner StorageBackend, op *StorageOp, next func(context.Context) error) error {
+	start := time.Now()
+	err := next(ctx)
+	elapsed := time.Since(start)
+
+	attrs := []slog.Attr{
+		slog.String("operation", op.Name),
+		slog.String("key", op.Key),
+		slog.Duration("duration", elapsed),
+	}
+	if op.SrcKey != "" {
+		attrs = append(attrs, slog.String("src_key", op.SrcKey))
+	}
+	if op.Name == StorageOpDownloadRange {
+		attrs = append(attrs, slog.Int64("offset", op.Offset), slog.Int64("length", op.Length))
+	}
+
+	level := slog.LevelDebug
+	switch {
+	case err != nil && storageErrorKind(err) == "error":
+		level = slog.LevelWarn
+		attrs = append(attrs, slog.String("error", err.Error()))
+	case err != nil:
+		attrs = append(attrs, slog.String("error", err.Error()))
+	case l.slow > 0 && elapsed >= l.slow:
+		level = slog.LevelInfo
+		attrs = append(attrs, slog.Bool("slow", true))
+	}
+	l.logger.LogAttrs(ctx, level, "storage "+op.Name, attrs...)
+	return err
+}
@@ -0,0 +1,64 @@
+package services
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	storageOperationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "storage_operation_seconds",
+		Help:    "Time taken by storage operations, up to the first byte for downloads, by backend and operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend", "operation"})
+	storageOperationErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "storage_operation_errors_total",
+		Help: "Storage operations that failed, by backend, operation and kind of error.",
+	}, []string{"backend", "operation", "kind"})
+	storageOperationBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "storage_operation_bytes",
+		Help:    "Bytes uploaded or downloaded by one storage operation, by backend and operation.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+	}, []string{"backend", "operation"})
+)
+
+// StorageMetrics is a StorageLayer recording the latency, errors and bytes
+// of every operation in Prometheus, labelled with the backend's name.
+// Downloaded bytes are recorded when the body is closed.
+type StorageMetrics struct {
+	backend string
+}
+
+func NewStorageMetrics(backend string) *StorageMetrics {
+	return &StorageMetrics{backend: backend}
+}
+
+func (m *StorageMetrics) Call(ctx context.Context, inner StorageBackend, op *StorageOp, next func(context.Context) error) error {
+	var body *countingBody
+	if op.Body != nil {
+		// Outer layers may run the operation again with the body they gave
+		defer func(original io.Reader) { op.Body = original }(op.Body)
+		op.Body, body = countBody(op.Body)
+	}
+
+	start := time.Now()
+	err := next(ctx)
+	storageOperationSeconds.WithLabelValues(m.backend, op.Name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		storageOperationErrors.WithLabelValues(m.backend, op.Name, storageErrorKind(err)).Inc()
+		return err
+	}
+
+	bytes := storageOperationBytes.WithLabelValues(m.backend, op.Name)
+	if body != nil {
+		bytes.Observe(float64(body.n))
+	}
+	if op.Result != nil {
+		op.Result = newCloseHook(op.Result, func(n int64) { bytes.Observe(float64(n)) })
+	}
+	return nil
+}
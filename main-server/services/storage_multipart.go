@@ -0,0 +1,295 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// MultipartStorage is implemented by backends that can assemble an object
+// from parts uploaded separately, in any order and over any length of time.
+// Parts are numbered from 1; uploading a part again replaces it. Nothing is
+// visible under the key until CompleteMultipart.
+type MultipartStorage interface {
+	StorageBackend
+	CreateMultipart(ctx context.Context, key string) (uploadID string, err error)
+	// UploadPart stores size bytes from r and returns the part's ETag, which
+	// CompleteMultipart needs.
+	UploadPart(ctx context.Context, key, uploadID string, number int, r io.ReadSeeker, size int64) (etag string, err error)
+	CompleteMultipart(ctx context.Context, key, uploadID string, parts []CompletedPart) error
+	AbortMultipart(ctx context.Context, key, uploadID string) error
+}
+
+// CompletedPart identifies an uploaded part when completing an upload.
+type CompletedPart struct {
+	Number int
+	ETag   string
+}
+
+// ErrUnknownUpload is returned for multipart uploads that were completed,
+// aborted or never created.
+var ErrUnknownUpload = errors.New("unknown multipart upload")
+
+func (s *S3Storage) CreateMultipart(ctx context.Context, key string) (string, error) {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if s.sse != "" {
+		input.ServerSideEncryption = aws.String(s.sse)
+	}
+	if s.sseKeyID != "" {
+		input.SSEKMSKeyId = aws.String(s.sseKeyID)
+	}
+
+	out, err := s.client.CreateMultipartUploadWithContext(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.UploadId), nil
+}
+
+func (s *S3Storage) UploadPart(ctx context.Context, key, uploadID string, number int, r io.ReadSeeker, size int64) (string, error) {
+	out, err := s.client.UploadPartWithContext(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		UploadId:      aws.String(uploadID),
+		PartNumber:    aws.Int64(int64(number)),
+		Body:          r,
+		ContentLength: aws.Int64(size),
+	})
+	if err != nil {
+		return "", s3UploadError(err, uploadID)
+	}
+	return aws.StringValue(out.ETag), nil
+}
+
+func (s *S3Storage) CompleteMultipart(ctx context.Context, key, uploadID string, parts []CompletedPart) error {
+	completed := make([]*s3.CompletedPart, len(parts))
+	for i, p := range parts {
+		completed[i] = &s3.CompletedPart{PartNumber: aws.Int64(int64(p.Number)), ETag: aws.String(p.ETag)}
+	}
+
+	_, err := s.client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	return s3UploadError(err, uploadID)
+}
+
+func (s *S3Storage) AbortMultipart(ctx context.Context, key, uploadID string) error {
+	_, err := s.client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	return s3UploadError(err, uploadID)
+}
+
+// copyMultipart copies an object too large for CopyObject as a multipart
+// upload of ranges of the source.
+func (s *S3Storage) copyMultipart(ctx context.Context, srcKey, dstKey string, size int64) error {
+	uploadID, err := s.CreateMultipart(ctx, dstKey)
+	if err != nil {
+		return err
+	}
+
+	var parts []CompletedPart
+	for n, offset := 1, int64(0); offset < size; n, offset = n+1, offset+s.maxCopySize {
+		last := min(offset+s.maxCopySize, size) - 1
+		out, err := s.client.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(dstKey),
+			UploadId:        aws.String(uploadID),
+			PartNumber:      aws.Int64(int64(n)),
+			CopySource:      aws.String(s.copySource(srcKey)),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, last)),
+		})
+		if err != nil {
+			s.AbortMultipart(context.Background(), dstKey, uploadID)
+			return s3Error(err, srcKey)
+		}
+		parts = append(parts, CompletedPart{Number: n, ETag: aws.StringValue(out.CopyPartResult.ETag)})
+	}
+
+	if err := s.CompleteMultipart(ctx, dstKey, uploadID, parts); err != nil {
+		s.AbortMultipart(context.Background(), dstKey, uploadID)
+		return err
+	}
+	return nil
+}
+
+// s3UploadError maps S3's missing-upload errors to ErrUnknownUpload.
+func s3UploadError(err error, uploadID string) error {
+	if errors.Is(s3Error(err, uploadID), ErrObjectNotFound) {
+		return fmt.Errorf("%s: %w", uploadID, ErrUnknownUpload)
+	}
+	return err
+}
+
+// LocalStorage keeps the parts of an upload as separate files under
+// .multipart/<upload ID>, out of sight of List, and concatenates them on
+// completion.
+
+func (l *LocalStorage) CreateMultipart(ctx context.Context, key string) (string, error) {
+	if _, err := l.path(key); err != nil {
+		return "", err
+	}
+	id, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(l.partDir(id), 0755); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (l *LocalStorage) partDir(uploadID string) string {
+	return filepath.Join(l.basePath, ".multipart", filepath.Base(uploadID))
+}
+
+func (l *LocalStorage) UploadPart(ctx context.Context, key, uploadID string, number int, r io.ReadSeeker, size int64) (string, error) {
+	dir := l.partDir(uploadID)
+	if _, err := os.Stat(dir); err != nil {
+		return "", fmt.Errorf("%s: %w", uploadID, ErrUnknownUpload)
+	}
+
+	out, err := os.CreateTemp(dir, ".part-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(out.Name())
+
+	n, err := io.Copy(out, io.LimitReader(r, size))
+	if err == nil && n != size {
+		err = fmt.Errorf("part %d is %d bytes, expected %d", number, n, size)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Parts are identified by number; the ETag only has to be non-empty
+	etag := strconv.Itoa(number)
+	return etag, os.Rename(out.Name(), filepath.Join(dir, etag))
+}
+
+func (l *LocalStorage) CompleteMultipart(ctx context.Context, key, uploadID string, parts []CompletedPart) error {
+	dir := l.partDir(uploadID)
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("%s: %w", uploadID, ErrUnknownUpload)
+	}
+
+	var readers []io.Reader
+	for _, p := range sortedParts(parts) {
+		f, err := os.Open(filepath.Join(dir, strconv.Itoa(p.Number)))
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("part %d was not uploaded", p.Number)
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+
+	if err := l.Upload(ctx, io.MultiReader(readers...), key); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (l *LocalStorage) AbortMultipart(ctx context.Context, key, uploadID string) error {
+	dir := l.partDir(uploadID)
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("%s: %w", uploadID, ErrUnknownUpload)
+	}
+	return os.RemoveAll(dir)
+}
+
+// MemoryStorage keeps parts in memory until the upload is completed.
+
+func (m *MemoryStorage) CreateMultipart(ctx context.Context, key string) (string, error) {
+	id, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uploads[id] = make(map[int][]byte)
+	return id, nil
+}
+
+func (m *MemoryStorage) UploadPart(ctx context.Context, key, uploadID string, number int, r io.ReadSeeker, size int64) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) != size {
+		return "", fmt.Errorf("part %d is %d bytes, expected %d", number, len(data), size)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	parts, ok := m.uploads[uploadID]
+	if !ok {
+		return "", fmt.Errorf("%s: %w", uploadID, ErrUnknownUpload)
+	}
+	parts[number] = data
+	return strconv.Itoa(number), nil
+}
+
+func (m *MemoryStorage) CompleteMultipart(ctx context.Context, key, uploadID string, parts []CompletedPart) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.uploads[uploadID]
+	if !ok {
+		return fmt.Errorf("%s: %w", uploadID, ErrUnknownUpload)
+	}
+
+	var data bytes.Buffer
+	for _, p := range sortedParts(parts) {
+		part, ok := stored[p.Number]
+		if !ok {
+			return fmt.Errorf("part %d was not uploaded", p.Number)
+		}
+		data.Write(part)
+	}
+
+	m.objects[key] = memoryObject{data: data.Bytes(), modTime: time.Now()}
+	delete(m.uploads, uploadID)
+	return nil
+}
+
+func (m *MemoryStorage) AbortMultipart(ctx context.Context, key, uploadID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.uploads[uploadID]; !ok {
+		return fmt.Errorf("%s: %w", uploadID, ErrUnknownUpload)
+	}
+	delete(m.uploads, uploadID)
+	return nil
+}
+
+func sortedParts(parts []CompletedPart) []CompletedPart {
+	sorted := append([]CompletedPart(nil), parts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Number < sorted[j].Number })
+	return sorted
+}
@@ -0,0 +1,227 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// PresignedUploadStorage is implemented by backends that let a client such
+// as a browser upload an object directly, without it passing through
+// main-server.
+type PresignedUploadStorage interface {
+	StorageBackend
+	PresignUpload(key string, cond UploadConditions) (*PresignedUpload, error)
+}
+
+// UploadConditions restrict a presigned upload. The object must have
+// exactly Size bytes and be sent as ContentType.
+type UploadConditions struct {
+	ContentType string
+	Size        int64
+	Expiry      time.Duration
+}
+
+// PresignedUpload is the request a client sends to upload an object. For a
+// PUT the file is the body, sent with Headers; for a POST it is the last
+// part, named "file", of a multipart form holding Fields.
+type PresignedUpload struct {
+	Method    string            `json:"method"`
+	URL       string            `json:"url"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// ErrInvalidSignature is returned for signed local storage URLs that were
+// tampered with or have expired.
+var ErrInvalidSignature = errors.New("invalid or expired signature")
+
+// PresignUpload returns a browser-based POST, as a presigned PUT cannot
+// limit the object's size: only a POST policy can require a content length.
+func (s *S3Storage) PresignUpload(key string, cond UploadConditions) (*PresignedUpload, error) {
+	creds, err := s.client.Config.Credentials.Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get S3 credentials: %w", err)
+	}
+	endpoint, err := s.bucketURL()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	expires := now.Add(cond.Expiry)
+	region := aws.StringValue(s.client.Config.Region)
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", now.Format("20060102"), region)
+
+	fields := map[string]string{
+		"key":              key,
+		"Content-Type":     cond.ContentType,
+		"x-amz-algorithm":  "AWS4-HMAC-SHA256",
+		"x-amz-credential": creds.AccessKeyID + "/" + scope,
+		"x-amz-date":       now.Format("20060102T150405Z"),
+	}
+	if s.sse != "" {
+		fields["x-amz-server-side-encryption"] = s.sse
+	}
+	if s.sseKeyID != "" {
+		fields["x-amz-server-side-encryption-aws-kms-key-id"] = s.sseKeyID
+	}
+	if creds.SessionToken != "" {
+		fields["x-amz-security-token"] = creds.SessionToken
+	}
+
+	conditions := []interface{}{
+		map[string]string{"bucket": s.bucket},
+		[]interface{}{"content-length-range", cond.Size, cond.Size},
+	}
+	for name, value := range fields {
+		conditions = append(conditions, map[string]string{name: value})
+	}
+	policy, err := json.Marshal(map[string]interface{}{
+		"expiration": expires.Format("2006-01-02T15:04:05.000Z"),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return nil, err
+	}
+	fields["policy"] = base64.StdEncoding.EncodeToString(policy)
+
+	signingKey := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{now.Format("20060102"), region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	fields["x-amz-signature"] = hex.EncodeToString(hmacSHA256(signingKey, fields["policy"]))
+
+	return &PresignedUpload{
+		Method:    http.MethodPost,
+		URL:       endpoint,
+		Fields:    fields,
+		ExpiresAt: expires,
+	}, nil
+}
+
+// bucketURL returns the URL of the bucket itself, in whichever addressing
+// style the client uses.
+func (s *S3Storage) bucketURL() (string, error) {
+	req, _ := s.client.ListObjectsV2Request(&s3.ListObjectsV2Input{Bucket: aws.String(s.bucket)})
+	if err := req.Build(); err != nil {
+		return "", fmt.Errorf("failed to resolve the bucket URL: %w", err)
+	}
+	u := *req.HTTPRequest.URL
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// LocalStorage signs URLs for its objects with an HMAC key, so the same
+// direct upload and download flows work in development. The URLs point at
+// main-server's /storage/object, which checks them with VerifyUpload and
+// VerifyDownload:
+//
+//	GET {base}/storage/object?key=K&expires=T&signature=S
+//	PUT {base}/storage/object?key=K&expires=T&content-type=C&size=N&signature=S
+
+// GeneratePresignedURL returns a signed download URL.
+func (l *LocalStorage) GeneratePresignedURL(key string, expiry time.Duration) (string, error) {
+	if _, err := l.path(key); err != nil {
+		return "", err
+	}
+	q := url.Values{"key": {key}}
+	return l.signURL(http.MethodGet, q, time.Now().Add(expiry))
+}
+
+func (l *LocalStorage) PresignUpload(key string, cond UploadConditions) (*PresignedUpload, error) {
+	if _, err := l.path(key); err != nil {
+		return nil, err
+	}
+	expires := time.Now().Add(cond.Expiry)
+	q := url.Values{
+		"key":          {key},
+		"content-type": {cond.ContentType},
+		"size":         {strconv.FormatInt(cond.Size, 10)},
+	}
+	signed, err := l.signURL(http.MethodPut, q, expires)
+	if err != nil {
+		return nil, err
+	}
+	return &PresignedUpload{
+		Method:    http.MethodPut,
+		URL:       signed,
+		Headers:   map[string]string{"Content-Type": cond.ContentType},
+		ExpiresAt: expires,
+	}, nil
+}
+
+// VerifyUpload checks a signed upload URL's query and returns the key and
+// the conditions the upload must meet.
+func (l *LocalStorage) VerifyUpload(q url.Values) (string, *UploadConditions, error) {
+	if err := l.verify(http.MethodPut, q); err != nil {
+		return "", nil, err
+	}
+	size, err := strconv.ParseInt(q.Get("size"), 10, 64)
+	if err != nil {
+		return "", nil, ErrInvalidSignature
+	}
+	return q.Get("key"), &UploadConditions{ContentType: q.Get("content-type"), Size: size}, nil
+}
+
+// VerifyDownload checks a signed download URL's query and returns the key.
+func (l *LocalStorage) VerifyDownload(q url.Values) (string, error) {
+	if err := l.verify(http.MethodGet, q); err != nil {
+		return "", err
+	}
+	return q.Get("key"), nil
+}
+
+func (l *LocalStorage) signURL(method string, q url.Values, expires time.Time) (string, error) {
+	if len(l.secret) == 0 {
+		return "", fmt.Errorf("local storage has no signing key")
+	}
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	q.Set("signature", hex.EncodeToString(l.signature(method, q)))
+	return l.baseURL + "/storage/object?" + q.Encode(), nil
+}
+
+func (l *LocalStorage) verify(method string, q url.Values) error {
+	if len(l.secret) == 0 {
+		return ErrInvalidSignature
+	}
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return ErrInvalidSignature
+	}
+	got, err := hex.DecodeString(q.Get("signature"))
+	if err != nil || !hmac.Equal(got, l.signature(method, q)) {
+		return ErrInvalidSignature
+	}
+	if _, err := l.path(q.Get("key")); err != nil {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// signature covers the method and every condition, so a download URL
+// cannot be used to upload and an upload's size and type cannot change.
+func (l *LocalStorage) signature(method string, q url.Values) []byte {
+	return hmacSHA256(l.secret, strings.Join([]string{
+		method, q.Get("key"), q.Get("expires"), q.Get("content-type"), q.Get("size"),
+	}, "\n"))
+}
@@ -0,0 +1,195 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// RangeStorage is implemented by backends that can read part of an object
+// without reading what comes before it.
+type RangeStorage interface {
+	StorageBackend
+	// DownloadRange returns length bytes of the object starting at offset,
+	// or everything from offset when length is negative. offset must be
+	// within the object.
+	DownloadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+}
+
+func (s *S3Storage) DownloadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		byteRange += fmt.Sprint(offset + length - 1)
+	}
+	out, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(byteRange),
+	})
+	if err != nil {
+		return nil, s3Error(err, key)
+	}
+	return out.Body, nil
+}
+
+func (l *LocalStorage) DownloadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (m *MemoryStorage) DownloadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	o, ok := m.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+	}
+	if offset < 0 || offset > int64(len(o.data)) {
+		return nil, fmt.Errorf("offset %d is outside %s", offset, key)
+	}
+	data := o.data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// ObjectReader reads a stored object of known size as an io.ReadSeeker and
+// io.ReaderAt, so it can be served with http.ServeContent, ranges and all,
+// or opened as a zip archive. Seeking is free; the object is only opened,
+// at the current offset, by the next Read. Backends without RangeStorage
+// are read from the start, discarding bytes up to the offset.
+type ObjectReader struct {
+	ctx     context.Context
+	storage StorageBackend
+	key     string
+	size    int64
+
+	offset int64
+	body   io.ReadCloser
+}
+
+func NewObjectReader(ctx context.Context, storage StorageBackend, key string, size int64) *ObjectReader {
+	return &ObjectReader{ctx: ctx, storage: storage, key: key, size: size}
+}
+
+func (r *ObjectReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.open()
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && r.offset < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *ObjectReader) open() (io.ReadCloser, error) {
+	if ranged, ok := r.storage.(RangeStorage); ok {
+		return ranged.DownloadRange(r.ctx, r.key, r.offset, -1)
+	}
+
+	body, err := r.storage.Download(r.ctx, r.key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, body, r.offset); err != nil {
+		body.Close()
+		return nil, err
+	}
+	return body, nil
+}
+
+func (r *ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// ReadAt reads len(p) bytes at off with a request of its own, so archive
+// readers can jump around the object. It leaves the Read offset alone.
+func (r *ObjectReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	want := min(int64(len(p)), r.size-off)
+
+	var body io.ReadCloser
+	var err error
+	if ranged, ok := r.storage.(RangeStorage); ok {
+		body, err = ranged.DownloadRange(r.ctx, r.key, off, want)
+	} else if body, err = r.storage.Download(r.ctx, r.key); err == nil {
+		_, err = io.CopyN(io.Discard, body, off)
+	}
+	if err != nil {
+		if body != nil {
+			body.Close()
+		}
+		return 0, err
+	}
+	defer body.Close()
+
+	n, err := io.ReadFull(body, p[:want])
+	if err == nil && want < int64(len(p)) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *ObjectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
@@ -0,0 +1,113 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The longest a retry waits, however many attempts came before it.
+const maxStorageRetryDelay = 10 * time.Second
+
+var storageRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "storage_retries_total",
+	Help: "Storage operations run again after a transient error, by operation.",
+}, []string{"operation"})
+
+// StorageRetry is a StorageLayer running operations again when they fail
+// with a transient error, such as a dropped connection or S3 asking to slow
+// down. Attempt n waits a random time up to baseDelay * 2^n ("full
+// jitter"), so servers that failed together do not retry together.
+//
+// Uploads are only retried if their body can be rewound, and downloads only
+// until the body is returned: an error while reading it is the caller's.
+// The AWS SDK retries requests of its own first, so for S3 this mostly
+// covers failures that outlast those.
+type StorageRetry struct {
+	attempts  int
+	baseDelay time.Duration
+}
+
+// NewStorageRetry returns a StorageRetry making up to attempts attempts in
+// all.
+func NewStorageRetry(attempts int, baseDelay time.Duration) *StorageRetry {
+	return &StorageRetry{attempts: max(attempts, 1), baseDelay: baseDelay}
+}
+
+func (r *StorageRetry) Call(ctx context.Context, inner StorageBackend, op *StorageOp, next func(context.Context) error) error {
+	var seeker io.Seeker
+	var start int64
+	if op.Body != nil {
+		var ok bool
+		if seeker, ok = op.Body.(io.Seeker); ok {
+			var err error
+			if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+				seeker = nil
+			}
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := next(ctx)
+		if err == nil || attempt >= r.attempts || !IsTransientStorageError(err) {
+			return err
+		}
+		if op.Body != nil {
+			if seeker == nil {
+				return err
+			}
+			if _, serr := seeker.Seek(start, io.SeekStart); serr != nil {
+				return err
+			}
+		}
+
+		delay := min(r.baseDelay<<(attempt-1), maxStorageRetryDelay)
+		if delay > 0 {
+			delay = rand.N(delay) + 1
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		storageRetries.WithLabelValues(op.Name).Inc()
+	}
+}
+
+// IsTransientStorageError reports whether an operation that failed with err
+// may succeed if it is run again unchanged.
+func IsTransientStorageError(err error) bool {
+	if err == nil || errors.Is(err, ErrObjectNotFound) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		code := reqErr.StatusCode()
+		if code >= http.StatusInternalServerError || code == http.StatusTooManyRequests {
+			return true
+		}
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && (request.IsErrorRetryable(awsErr) || request.IsErrorThrottle(awsErr)) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,457 @@
+package services_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/labstack/echo/v4"
+
+	"main-server/config"
+	"main-server/handlers"
+	"main-server/services"
+	"main-server/services/storagetest"
+)
+
+const (
+	fakeBucket          = "audience-files"
+	fakeEncryptedBucket = "encrypted-audience-files"
+	fakeLayeredBucket   = "layered-audience-files"
+)
+
+// With -configured the contract also runs against the backend
+// STORAGE_BACKEND selects, such as a real bucket or a local MinIO, set in the
+// environment or .env.$GO_ENV. It only touches keys under a
+// storagetest-<random>/ prefix and removes them afterwards.
+var configured = flag.Bool("configured", false, "also run the storage contract against the backend selected by STORAGE_BACKEND")
+
+type backend struct {
+	name    string
+	storage services.StorageBackend
+	// Checks beyond the contract, run after it
+	extra func(t *testing.T) error
+}
+
+// TestStorageContract runs the contract in storagetest against LocalStorage,
+// with its signed URLs served by main-server's handler, MemoryStorage and
+// S3Storage talking to an in-process S3-compatible fake, against
+// EncryptedStorage over each of them with a LocalKMS, and against the
+// storage layers over memory and the fake.
+func TestStorageContract(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// A small page size makes List follow continuation tokens
+	fake := storagetest.NewFakeS3(fakeBucket, fakeEncryptedBucket, fakeLayeredBucket)
+	fake.PageSize = 2
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	s3Storage, err := services.NewS3Storage(services.S3Config{
+		Region:          "us-east-1",
+		Bucket:          fakeBucket,
+		Endpoint:        server.URL,
+		ForcePathStyle:  true,
+		AccessKeyID:     "storagetest",
+		SecretAccessKey: "storagetest",
+		SSE:             "AES256",
+		// Small enough for checkFakeS3 to exercise multipart copies
+		MaxCopySize: 5 << 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Local storage's signed URLs are served as they are by main-server
+	e := echo.New()
+	localServer := httptest.NewServer(e)
+	defer localServer.Close()
+	local := services.NewSignedLocalStorage(dir, localServer.URL, []byte("storagetest"))
+	storageHandler := handlers.NewStorageHandler(local)
+	e.GET("/storage/object", storageHandler.Get)
+	e.PUT("/storage/object", storageHandler.Put)
+
+	// Encrypted backends share one KMS, as servers would
+	masterKey := make([]byte, 32)
+	if _, err := rand.Read(masterKey); err != nil {
+		t.Fatal(err)
+	}
+	kms, err := services.NewLocalKMS(filepath.Join(dir, "kms"), masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedS3, err := services.NewS3Storage(services.S3Config{
+		Region:          "us-east-1",
+		Bucket:          fakeEncryptedBucket,
+		Endpoint:        server.URL,
+		ForcePathStyle:  true,
+		AccessKeyID:     "storagetest",
+		SecretAccessKey: "storagetest",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedLocal := services.NewLocalStorage(filepath.Join(dir, "encrypted"))
+	memory := services.NewMemoryStorage()
+
+	backends := []backend{
+		{"local", local, nil},
+		{"memory", services.NewMemoryStorage(), nil},
+		{"s3 (fake)", s3Storage, func(*testing.T) error { return checkFakeS3(ctx, s3Storage, fake) }},
+	}
+	layeredS3, err := services.NewS3Storage(services.S3Config{
+		Region:          "us-east-1",
+		Bucket:          fakeLayeredBucket,
+		Endpoint:        server.URL,
+		ForcePathStyle:  true,
+		AccessKeyID:     "storagetest",
+		SecretAccessKey: "storagetest",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends = append(backends,
+		backend{"memory (layered)", layered(t, services.NewMemoryStorage(), filepath.Join(dir, "cache-memory")), func(t *testing.T) error {
+			return checkLayers(ctx, t, filepath.Join(dir, "cache-check"), local)
+		}},
+		backend{"s3 (fake, layered)", layered(t, layeredS3, filepath.Join(dir, "cache-s3")), nil},
+	)
+
+	for _, b := range []backend{
+		{"local (encrypted)", encryptedLocal, nil},
+		{"memory (encrypted)", memory, nil},
+		{"s3 (fake, encrypted)", encryptedS3, nil},
+	} {
+		inner := b.storage
+		encrypted := services.NewEncryptedStorage(inner, kms, services.AudienceKeyScheme{})
+		backends = append(backends, backend{b.name, encrypted, func(*testing.T) error {
+			return checkEncryption(ctx, encrypted, inner)
+		}})
+	}
+
+	if *configured {
+		env := os.Getenv("GO_ENV")
+		if env == "" {
+			env = "development"
+		}
+		godotenv.Load("../.env." + env)
+		cfg, err := config.Load()
+		if err != nil {
+			t.Fatalf("failed to load configuration: %v", err)
+		}
+		storage, err := services.OpenStorage(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends = append(backends, backend{"configured " + cfg.StorageBackend, storage, nil})
+	}
+
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			for _, err := range storagetest.Check(ctx, b.storage) {
+				t.Error(err)
+			}
+			if b.extra != nil {
+				if err := b.extra(t); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+// checkFakeS3 checks what only the server side can see: encryption settings
+// reach S3 on both upload paths and on both kinds of copy, and multipart
+// uploads are completed rather than left behind.
+func checkFakeS3(ctx context.Context, storage *services.S3Storage, fake *storagetest.FakeS3) error {
+	defer storage.Delete(ctx, "sse/small")
+	defer storage.Delete(ctx, "sse/large")
+	defer storage.Delete(ctx, "sse/copy")
+	defer storage.Delete(ctx, "sse/large-copy")
+
+	if err := storage.Upload(ctx, strings.NewReader("small"), "sse/small"); err != nil {
+		return err
+	}
+	if err := storage.Upload(ctx, strings.NewReader(strings.Repeat("x", 6<<20)), "sse/large"); err != nil {
+		return err
+	}
+	if err := storage.Copy(ctx, "sse/small", "sse/copy"); err != nil {
+		return err
+	}
+	if err := storage.Copy(ctx, "sse/large", "sse/large-copy"); err != nil {
+		return err
+	}
+
+	for _, key := range []string{"sse/small", "sse/large", "sse/copy", "sse/large-copy"} {
+		o, ok := fake.Object(fakeBucket, key)
+		if !ok {
+			return fmt.Errorf("server-side encryption: %s was not stored", key)
+		}
+		if o.SSE != "AES256" {
+			return fmt.Errorf("server-side encryption: %s stored with %q, want AES256", key, o.SSE)
+		}
+	}
+	large, _ := fake.Object(fakeBucket, "sse/large")
+	largeCopy, _ := fake.Object(fakeBucket, "sse/large-copy")
+	if !bytes.Equal(large.Data, largeCopy.Data) {
+		return fmt.Errorf("multipart copy: copied %d bytes of %d", len(largeCopy.Data), len(large.Data))
+	}
+	if n := fake.PendingUploads(); n > 0 {
+		return fmt.Errorf("%d multipart uploads were left incomplete", n)
+	}
+	return nil
+}
+
+// checkEncryption checks what only the backend under an EncryptedStorage can
+// see: no plaintext is stored, tampering is detected, data keys follow their
+// objects, and rotation rewraps them without making any file unreadable.
+func checkEncryption(ctx context.Context, encrypted, inner services.StorageBackend) error {
+	const key, copied = "ws-rotate/company/list.csv", "ws-other/company/list.csv"
+	defer encrypted.Delete(ctx, key)
+	defer encrypted.Delete(ctx, copied)
+
+	data := bytes.Repeat([]byte("ada@example.com,Ada,10001\n"), 10000)
+	if err := encrypted.Upload(ctx, bytes.NewReader(data), key); err != nil {
+		return err
+	}
+	stored, err := read(ctx, inner, key)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(stored, []byte("ada@example.com")) {
+		return fmt.Errorf("encryption: plaintext was stored")
+	}
+
+	// Ranges across the 64 KiB frames
+	r := services.NewObjectReader(ctx, encrypted, key, int64(len(data)))
+	defer r.Close()
+	for _, offset := range []int64{0, 65530, 131072, int64(len(data)) - 3} {
+		buf := make([]byte, min(20, int64(len(data))-offset))
+		if _, err := r.ReadAt(buf, offset); err != nil {
+			return fmt.Errorf("encrypted ReadAt(%d): %w", offset, err)
+		}
+		if !bytes.Equal(buf, data[offset:offset+int64(len(buf))]) {
+			return fmt.Errorf("encrypted ReadAt(%d) returned %q", offset, buf)
+		}
+	}
+
+	if err := encrypted.Copy(ctx, key, copied); err != nil {
+		return err
+	}
+	rotator, ok := encrypted.(services.KeyRotator)
+	if !ok {
+		return fmt.Errorf("encryption: backend cannot rotate keys")
+	}
+	for i := 0; i < 2; i++ {
+		_, n, err := rotator.RotateKeys(ctx, "ws-rotate")
+		if err != nil {
+			return fmt.Errorf("RotateKeys: %w", err)
+		}
+		if n != 1 {
+			return fmt.Errorf("RotateKeys rewrapped %d data keys, want 1", n)
+		}
+	}
+	for _, k := range []string{key, copied} {
+		got, err := read(ctx, encrypted, k)
+		if err != nil {
+			return fmt.Errorf("after rotation: %w", err)
+		}
+		if !bytes.Equal(got, data) {
+			return fmt.Errorf("after rotation %s returned %d bytes that differ from the %d uploaded", k, len(got), len(data))
+		}
+	}
+	if restored, err := read(ctx, inner, key); err != nil || !bytes.Equal(restored, stored) {
+		return fmt.Errorf("rotation rewrote the object: %v", err)
+	}
+
+	tampered := append([]byte{}, stored...)
+	tampered[len(tampered)/2] ^= 1
+	if err := inner.Upload(ctx, bytes.NewReader(tampered), key); err != nil {
+		return err
+	}
+	if _, err := read(ctx, encrypted, key); err == nil {
+		return fmt.Errorf("encryption: a tampered object was read back")
+	}
+
+	if err := encrypted.Delete(ctx, copied); err != nil {
+		return err
+	}
+	if keys, err := inner.List(ctx, ".keys/"+copied); err != nil || len(keys) > 0 {
+		return fmt.Errorf("Delete left %d data keys behind: %v", len(keys), err)
+	}
+	return nil
+}
+
+// layered wraps b in every layer, with a cache of its own in dir.
+func layered(t *testing.T, b services.StorageBackend, dir string) services.StorageBackend {
+	t.Helper()
+	cache, err := services.NewStorageCache(dir, 64<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return services.LayerStorage(b,
+		services.NewStorageLogging(slog.New(slog.NewTextHandler(io.Discard, nil)), 0),
+		services.NewStorageMetrics("storagetest"),
+		services.NewStorageRetry(3, time.Millisecond),
+		cache,
+	)
+}
+
+// checkLayers checks what the contract cannot see: layers keep exactly the
+// optional interfaces of the backend beneath, transient errors are retried
+// when the upload can be rewound, and cached downloads are never stale.
+func checkLayers(ctx context.Context, t *testing.T, dir string, local *services.LocalStorage) error {
+	memory := layered(t, services.NewMemoryStorage(), filepath.Join(dir, "memory"))
+	if _, ok := memory.(services.PresignedUploadStorage); ok {
+		return fmt.Errorf("layers gave memory storage presigned uploads")
+	}
+	if _, ok := memory.(services.MultipartStorage); !ok {
+		return fmt.Errorf("layers took multipart uploads from memory storage")
+	}
+	if _, ok := layered(t, local, filepath.Join(dir, "local")).(services.PresignedUploadStorage); !ok {
+		return fmt.Errorf("layers took presigned uploads from local storage")
+	}
+	if services.BaseStorage(layered(t, local, filepath.Join(dir, "local"))) != services.StorageBackend(local) {
+		return fmt.Errorf("BaseStorage did not find local storage beneath its layers")
+	}
+
+	// Two failures, then success
+	flaky := &flakyStorage{StorageBackend: services.NewMemoryStorage()}
+	retried := services.LayerStorage(flaky, services.NewStorageRetry(3, time.Millisecond))
+	flaky.failures = 2
+	if err := retried.Upload(ctx, strings.NewReader("retried"), "retry/key"); err != nil {
+		return fmt.Errorf("retry: upload failed after 2 transient errors: %w", err)
+	}
+	if got, err := read(ctx, retried, "retry/key"); err != nil || string(got) != "retried" {
+		return fmt.Errorf("retry: read back %q, %v", got, err)
+	}
+	flaky.failures = 1
+	if err := retried.Upload(ctx, io.MultiReader(strings.NewReader("once")), "retry/key"); err == nil {
+		return fmt.Errorf("retry: an upload that cannot be rewound was retried")
+	}
+	flaky.failures = 3
+	if _, err := retried.Stat(ctx, "retry/key"); err == nil {
+		return fmt.Errorf("retry: made more than 3 attempts")
+	}
+
+	// Downloads reaching the backend are counted beneath the cache
+	inner := services.NewMemoryStorage()
+	counter := &opCounter{ops: make(map[string]int)}
+	cache, err := services.NewStorageCache(filepath.Join(dir, "counted"), 64<<20)
+	if err != nil {
+		return err
+	}
+	cached := services.LayerStorage(inner, cache, counter)
+	const key = "cache/key"
+	if err := cached.Upload(ctx, strings.NewReader("first version"), key); err != nil {
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		if got, err := read(ctx, cached, key); err != nil || string(got) != "first version" {
+			return fmt.Errorf("cache: read %d returned %q, %v", i, got, err)
+		}
+	}
+	if n := counter.ops[services.StorageOpDownload]; n != 1 {
+		return fmt.Errorf("cache: 3 reads downloaded the object %d times, want 1", n)
+	}
+	r := services.NewObjectReader(ctx, cached, key, int64(len("first version")))
+	buf := make([]byte, 7)
+	if _, err := r.ReadAt(buf, 6); err != nil || string(buf) != "version" {
+		return fmt.Errorf("cache: ranged read returned %q, %v", buf, err)
+	}
+	if n := counter.ops[services.StorageOpDownloadRange]; n != 0 {
+		return fmt.Errorf("cache: a cached range was downloaded")
+	}
+
+	if err := cached.Upload(ctx, strings.NewReader("second"), key); err != nil {
+		return err
+	}
+	if got, err := read(ctx, cached, key); err != nil || string(got) != "second" {
+		return fmt.Errorf("cache: read after upload returned %q, %v", got, err)
+	}
+	// As another server, or a presigned upload, would
+	if err := inner.Upload(ctx, strings.NewReader("changed elsewhere"), key); err != nil {
+		return err
+	}
+	if got, err := read(ctx, cached, key); err != nil || string(got) != "changed elsewhere" {
+		return fmt.Errorf("cache: served %q after the object changed beneath it: %v", got, err)
+	}
+	if err := cached.Delete(ctx, key); err != nil {
+		return err
+	}
+	if _, err := cached.Download(ctx, key); !errors.Is(err, services.ErrObjectNotFound) {
+		return fmt.Errorf("cache: download after delete returned %v", err)
+	}
+	return nil
+}
+
+// flakyStorage fails its next failures operations with a timeout.
+type flakyStorage struct {
+	services.StorageBackend
+	failures int
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func (f *flakyStorage) fail() error {
+	if f.failures > 0 {
+		f.failures--
+		return timeoutError{}
+	}
+	return nil
+}
+
+func (f *flakyStorage) Upload(ctx context.Context, r io.Reader, key string) error {
+	if err := f.fail(); err != nil {
+		// A failed upload may have read some of the body
+		io.CopyN(io.Discard, r, 2)
+		return err
+	}
+	return f.StorageBackend.Upload(ctx, r, key)
+}
+
+func (f *flakyStorage) Stat(ctx context.Context, key string) (*services.ObjectInfo, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.StorageBackend.Stat(ctx, key)
+}
+
+// opCounter is a layer counting the operations that pass through it.
+type opCounter struct {
+	mu  sync.Mutex
+	ops map[string]int
+}
+
+func (c *opCounter) Call(ctx context.Context, inner services.StorageBackend, op *services.StorageOp, next func(context.Context) error) error {
+	c.mu.Lock()
+	c.ops[op.Name]++
+	c.mu.Unlock()
+	return next(ctx)
+}
+
+func read(ctx context.Context, b services.StorageBackend, key string) ([]byte, error) {
+	r, err := b.Download(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
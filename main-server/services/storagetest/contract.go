@@ -0,0 +1,321 @@
+// Package storagetest holds the behaviour every services.StorageBackend must
+// share, as a suite that can be run against any backend, and FakeS3, an
+// in-process S3-compatible server to run it against S3Storage without AWS.
+// services' TestStorageContract runs it against every backend.
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"main-server/services"
+)
+
+// Case is one contract check. It works only under prefix, which is unique to
+// the run, and returns a description of the first violation.
+type Case struct {
+	Name string
+	Run  func(ctx context.Context, b services.StorageBackend, prefix string) error
+}
+
+// Cases is the storage backend contract.
+var Cases = []Case{
+	{"upload and download", checkRoundTrip},
+	{"empty object", checkEmptyObject},
+	{"large object", checkLargeObject},
+	{"overwrite", checkOverwrite},
+	{"missing object", checkMissing},
+	{"stat", checkStat},
+	{"delete", checkDelete},
+	{"list by prefix", checkList},
+	{"copy", checkCopy},
+	{"keys with special characters", checkSpecialKeys},
+	{"multipart upload", checkMultipart},
+	{"aborted multipart upload", checkMultipartAbort},
+	{"ranges", checkRanges},
+	{"presigned upload", checkPresignedUpload},
+	{"presigned upload conditions", checkPresignedConditions},
+}
+
+// Check runs every case against b and returns one error per failed case.
+// Objects created by the cases are removed afterwards.
+func Check(ctx context.Context, b services.StorageBackend) []error {
+	run := make([]byte, 6)
+	if _, err := rand.Read(run); err != nil {
+		return []error{err}
+	}
+
+	var failures []error
+	for i, c := range Cases {
+		prefix := fmt.Sprintf("storagetest-%s/%02d/", hex.EncodeToString(run), i)
+		if err := c.Run(ctx, b, prefix); err != nil {
+			failures = append(failures, fmt.Errorf("%s: %w", c.Name, err))
+		}
+		if err := cleanup(ctx, b, prefix); err != nil {
+			failures = append(failures, fmt.Errorf("%s: cleanup: %w", c.Name, err))
+		}
+	}
+	return failures
+}
+
+func cleanup(ctx context.Context, b services.StorageBackend, prefix string) error {
+	objects, err := b.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if err := b.Delete(ctx, o.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkRoundTrip(ctx context.Context, b services.StorageBackend, prefix string) error {
+	return roundTrip(ctx, b, prefix+"audience.csv", []byte("email\nuser@example.com\n"))
+}
+
+func checkEmptyObject(ctx context.Context, b services.StorageBackend, prefix string) error {
+	return roundTrip(ctx, b, prefix+"empty", nil)
+}
+
+// checkLargeObject uses more than one S3 multipart upload part.
+func checkLargeObject(ctx context.Context, b services.StorageBackend, prefix string) error {
+	data := make([]byte, 11<<20+123)
+	if _, err := rand.Read(data); err != nil {
+		return err
+	}
+	return roundTrip(ctx, b, prefix+"large.bin", data)
+}
+
+func checkOverwrite(ctx context.Context, b services.StorageBackend, prefix string) error {
+	key := prefix + "file"
+	if err := put(ctx, b, key, []byte("first version, longer")); err != nil {
+		return err
+	}
+	return roundTrip(ctx, b, key, []byte("second"))
+}
+
+func checkMissing(ctx context.Context, b services.StorageBackend, prefix string) error {
+	key := prefix + "missing"
+	if _, err := b.Download(ctx, key); !errors.Is(err, services.ErrObjectNotFound) {
+		return fmt.Errorf("Download of a missing key returned %v, want ErrObjectNotFound", err)
+	}
+	if _, err := b.Stat(ctx, key); !errors.Is(err, services.ErrObjectNotFound) {
+		return fmt.Errorf("Stat of a missing key returned %v, want ErrObjectNotFound", err)
+	}
+	if err := b.Copy(ctx, key, prefix+"copy"); !errors.Is(err, services.ErrObjectNotFound) {
+		return fmt.Errorf("Copy of a missing key returned %v, want ErrObjectNotFound", err)
+	}
+	return nil
+}
+
+func checkStat(ctx context.Context, b services.StorageBackend, prefix string) error {
+	key := prefix + "stat"
+	if err := put(ctx, b, key, []byte("12345")); err != nil {
+		return err
+	}
+
+	info, err := b.Stat(ctx, key)
+	if err != nil {
+		return fmt.Errorf("Stat: %w", err)
+	}
+	if info.Key != key || info.Size != 5 {
+		return fmt.Errorf("Stat returned key %q size %d, want %q size 5", info.Key, info.Size, key)
+	}
+	if info.ModTime.IsZero() {
+		return fmt.Errorf("Stat returned no modification time")
+	}
+	return nil
+}
+
+func checkDelete(ctx context.Context, b services.StorageBackend, prefix string) error {
+	key := prefix + "deleted"
+	if err := put(ctx, b, key, []byte("x")); err != nil {
+		return err
+	}
+	if err := b.Delete(ctx, key); err != nil {
+		return fmt.Errorf("Delete: %w", err)
+	}
+	if _, err := b.Stat(ctx, key); !errors.Is(err, services.ErrObjectNotFound) {
+		return fmt.Errorf("object still exists after Delete: %v", err)
+	}
+	if err := b.Delete(ctx, key); err != nil {
+		return fmt.Errorf("Delete of a missing key: %w", err)
+	}
+	return nil
+}
+
+func checkList(ctx context.Context, b services.StorageBackend, prefix string) error {
+	for _, key := range []string{"a/2", "a/1", "a/sub/3", "ab", "b/4"} {
+		if err := put(ctx, b, prefix+key, []byte(key)); err != nil {
+			return err
+		}
+	}
+
+	for _, tc := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"a/", []string{"a/1", "a/2", "a/sub/3"}},
+		{"a", []string{"a/1", "a/2", "a/sub/3", "ab"}},
+		{"", []string{"a/1", "a/2", "a/sub/3", "ab", "b/4"}},
+		{"c", nil},
+	} {
+		objects, err := b.List(ctx, prefix+tc.prefix)
+		if err != nil {
+			return fmt.Errorf("List(%q): %w", tc.prefix, err)
+		}
+
+		var got []string
+		for _, o := range objects {
+			got = append(got, strings.TrimPrefix(o.Key, prefix))
+			if o.Size != int64(len(strings.TrimPrefix(o.Key, prefix))) {
+				return fmt.Errorf("List(%q) reported size %d for %s", tc.prefix, o.Size, o.Key)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			return fmt.Errorf("List(%q) = %v, want %v", tc.prefix, got, tc.want)
+		}
+	}
+	return nil
+}
+
+func checkCopy(ctx context.Context, b services.StorageBackend, prefix string) error {
+	src, dst := prefix+"source", prefix+"nested/destination"
+	data := []byte("copied contents")
+	if err := put(ctx, b, src, data); err != nil {
+		return err
+	}
+	if err := b.Copy(ctx, src, dst); err != nil {
+		return fmt.Errorf("Copy: %w", err)
+	}
+	if err := expect(ctx, b, dst, data); err != nil {
+		return err
+	}
+	return expect(ctx, b, src, data)
+}
+
+func checkSpecialKeys(ctx context.Context, b services.StorageBackend, prefix string) error {
+	for _, key := range []string{"with space.csv", "plus+and%percent", "ünïcode/日本.csv", "query?and#hash"} {
+		if err := roundTrip(ctx, b, prefix+key, []byte(key)); err != nil {
+			return err
+		}
+		if err := b.Copy(ctx, prefix+key, prefix+"copy/"+key); err != nil {
+			return fmt.Errorf("Copy(%q): %w", key, err)
+		}
+		if err := expect(ctx, b, prefix+"copy/"+key, []byte(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkMultipart uploads parts out of order, replaces one, and completes the
+// upload. Parts other than the last are S3's 5 MiB minimum. Backends without
+// multipart support pass.
+func checkMultipart(ctx context.Context, b services.StorageBackend, prefix string) error {
+	m, ok := b.(services.MultipartStorage)
+	if !ok {
+		return nil
+	}
+
+	key := prefix + "multipart.bin"
+	first := make([]byte, 5<<20)
+	if _, err := rand.Read(first); err != nil {
+		return err
+	}
+	second := []byte("the last part may be small")
+
+	id, err := m.CreateMultipart(ctx, key)
+	if err != nil {
+		return fmt.Errorf("CreateMultipart: %w", err)
+	}
+
+	etag2, err := m.UploadPart(ctx, key, id, 2, bytes.NewReader(second), int64(len(second)))
+	if err != nil {
+		return fmt.Errorf("UploadPart(2): %w", err)
+	}
+	if _, err := m.UploadPart(ctx, key, id, 1, bytes.NewReader(make([]byte, len(first))), int64(len(first))); err != nil {
+		return fmt.Errorf("UploadPart(1): %w", err)
+	}
+	etag1, err := m.UploadPart(ctx, key, id, 1, bytes.NewReader(first), int64(len(first)))
+	if err != nil {
+		return fmt.Errorf("UploadPart(1) again: %w", err)
+	}
+
+	if _, err := b.Stat(ctx, key); !errors.Is(err, services.ErrObjectNotFound) {
+		return fmt.Errorf("object is visible before the upload is completed: %v", err)
+	}
+
+	parts := []services.CompletedPart{{Number: 1, ETag: etag1}, {Number: 2, ETag: etag2}}
+	if err := m.CompleteMultipart(ctx, key, id, parts); err != nil {
+		return fmt.Errorf("CompleteMultipart: %w", err)
+	}
+	return expect(ctx, b, key, append(first, second...))
+}
+
+func checkMultipartAbort(ctx context.Context, b services.StorageBackend, prefix string) error {
+	m, ok := b.(services.MultipartStorage)
+	if !ok {
+		return nil
+	}
+
+	key := prefix + "aborted.bin"
+	id, err := m.CreateMultipart(ctx, key)
+	if err != nil {
+		return fmt.Errorf("CreateMultipart: %w", err)
+	}
+	if _, err := m.UploadPart(ctx, key, id, 1, strings.NewReader("part"), 4); err != nil {
+		return fmt.Errorf("UploadPart: %w", err)
+	}
+	if err := m.AbortMultipart(ctx, key, id); err != nil {
+		return fmt.Errorf("AbortMultipart: %w", err)
+	}
+
+	if _, err := m.UploadPart(ctx, key, id, 2, strings.NewReader("late"), 4); !errors.Is(err, services.ErrUnknownUpload) {
+		return fmt.Errorf("UploadPart after AbortMultipart returned %v, want ErrUnknownUpload", err)
+	}
+	if _, err := b.Stat(ctx, key); !errors.Is(err, services.ErrObjectNotFound) {
+		return fmt.Errorf("aborted upload left an object: %v", err)
+	}
+	return nil
+}
+
+func roundTrip(ctx context.Context, b services.StorageBackend, key string, data []byte) error {
+	if err := put(ctx, b, key, data); err != nil {
+		return err
+	}
+	return expect(ctx, b, key, data)
+}
+
+func put(ctx context.Context, b services.StorageBackend, key string, data []byte) error {
+	// A plain reader, so backends cannot rely on seeking
+	if err := b.Upload(ctx, io.MultiReader(bytes.NewReader(data)), key); err != nil {
+		return fmt.Errorf("Upload(%q): %w", key, err)
+	}
+	return nil
+}
+
+func expect(ctx context.Context, b services.StorageBackend, key string, want []byte) error {
+	r, err := b.Download(ctx, key)
+	if err != nil {
+		return fmt.Errorf("Download(%q): %w", key, err)
+	}
+	defer r.Close()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("Download(%q): %w", key, err)
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("Download(%q) returned %d bytes that differ from the %d uploaded", key, len(got), len(want))
+	}
+	return nil
+}
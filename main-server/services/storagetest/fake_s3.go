@@ -0,0 +1,550 @@
+package storagetest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeS3 is an in-memory, path-style S3 server covering the API S3Storage
+// uses: objects, ranged reads, copies, multipart uploads and part copies,
+// ListObjectsV2 and browser-based POST uploads. Requests are not
+// authenticated, but POST policies are enforced. Serve it with
+// httptest.NewServer and point S3Storage at the server's URL with
+// ForcePathStyle set.
+type FakeS3 struct {
+	// Keys per ListObjectsV2 page, 1000 like S3 when zero
+	PageSize int
+
+	mu      sync.Mutex
+	buckets map[string]map[string]*FakeObject
+	uploads map[string]*fakeUpload
+	nextID  int
+}
+
+// FakeObject is an object held by FakeS3.
+type FakeObject struct {
+	Data         []byte
+	ETag         string
+	LastModified time.Time
+
+	// The x-amz-server-side-encryption headers it was written with
+	SSE         string
+	SSEKMSKeyID string
+}
+
+type fakeUpload struct {
+	bucket, key string
+	sse, kmsKey string
+	parts       map[int][]byte
+}
+
+// NewFakeS3 returns a server with the given, empty, buckets.
+func NewFakeS3(buckets ...string) *FakeS3 {
+	f := &FakeS3{
+		buckets: make(map[string]map[string]*FakeObject),
+		uploads: make(map[string]*fakeUpload),
+	}
+	for _, b := range buckets {
+		f.buckets[b] = make(map[string]*FakeObject)
+	}
+	return f
+}
+
+// Object returns a stored object, for checks that look past the S3 API.
+func (f *FakeS3) Object(bucket, key string) (*FakeObject, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, ok := f.buckets[bucket][key]
+	return o, ok
+}
+
+// PendingUploads counts multipart uploads neither completed nor aborted.
+func (f *FakeS3) PendingUploads() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.uploads)
+}
+
+func (f *FakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Object bodies are sent unlocked, so a client may make other requests
+	// before reading one; stored data is replaced, never written to
+	f.mu.Lock()
+	body := f.serve(w, r)
+	f.mu.Unlock()
+	if body != nil {
+		w.Write(body)
+	}
+}
+
+// serve handles r and returns the object data to send, if any.
+func (f *FakeS3) serve(w http.ResponseWriter, r *http.Request) []byte {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	q := r.URL.Query()
+
+	objects, ok := f.buckets[bucket]
+	if !ok {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return nil
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, r, bucket, objects)
+	case key == "" && r.Method == http.MethodPost:
+		f.postObject(w, r, bucket, objects)
+	case key == "":
+		writeS3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "Bucket operation not supported")
+
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		f.createUpload(w, r, bucket, key)
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		f.uploadPart(w, r, q)
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		f.completeUpload(w, r, objects, q.Get("uploadId"))
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		f.copy(w, r, objects, key)
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeS3Error(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return nil
+		}
+		o := newFakeObject(data, r.Header)
+		objects[key] = o
+		w.Header().Set("ETag", `"`+o.ETag+`"`)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		o, ok := objects[key]
+		if !ok {
+			writeS3Error(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return nil
+		}
+		if rng := r.Header.Get("Range"); rng != "" && r.Method == http.MethodGet {
+			return f.getRange(w, r, o, rng)
+		}
+		writeObjectHeaders(w, o, http.StatusOK)
+		if r.Method == http.MethodGet {
+			return o.Data
+		}
+	case r.Method == http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeS3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "Object operation not supported")
+	}
+	return nil
+}
+
+func newFakeObject(data []byte, h http.Header) *FakeObject {
+	sum := md5.Sum(data)
+	return &FakeObject{
+		Data:         data,
+		ETag:         hex.EncodeToString(sum[:]),
+		LastModified: time.Now().UTC().Truncate(time.Second),
+		SSE:          h.Get("X-Amz-Server-Side-Encryption"),
+		SSEKMSKeyID:  h.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"),
+	}
+}
+
+// getRange serves a single "bytes=first-last" or "bytes=first-" range,
+// returning the part to send.
+func (f *FakeS3) getRange(w http.ResponseWriter, r *http.Request, o *FakeObject, rng string) []byte {
+	spec, ok := strings.CutPrefix(rng, "bytes=")
+	first, last, _ := strings.Cut(spec, "-")
+	start, err := strconv.Atoi(first)
+	if !ok || err != nil || start >= len(o.Data) {
+		writeS3Error(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+		return nil
+	}
+	end := len(o.Data) - 1
+	if last != "" {
+		if end, err = strconv.Atoi(last); err != nil || end < start {
+			writeS3Error(w, r, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+			return nil
+		}
+		end = min(end, len(o.Data)-1)
+	}
+
+	part := o.Data[start : end+1]
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(o.Data)))
+	writeObjectHeaders(w, &FakeObject{Data: part, ETag: o.ETag, LastModified: o.LastModified, SSE: o.SSE}, http.StatusPartialContent)
+	return part
+}
+
+func writeObjectHeaders(w http.ResponseWriter, o *FakeObject, status int) {
+	h := w.Header()
+	h.Set("Content-Length", strconv.Itoa(len(o.Data)))
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("ETag", `"`+o.ETag+`"`)
+	h.Set("Last-Modified", o.LastModified.Format(http.TimeFormat))
+	if o.SSE != "" {
+		h.Set("X-Amz-Server-Side-Encryption", o.SSE)
+	}
+	w.WriteHeader(status)
+}
+
+func (f *FakeS3) copy(w http.ResponseWriter, r *http.Request, objects map[string]*FakeObject, key string) {
+	source, err := url.PathUnescape(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"))
+	if err != nil {
+		writeS3Error(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid copy source")
+		return
+	}
+	srcBucket, srcKey, _ := strings.Cut(source, "/")
+	src, ok := f.buckets[srcBucket][srcKey]
+	if !ok {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+
+	o := newFakeObject(src.Data, r.Header)
+	objects[key] = o
+	writeXML(w, http.StatusOK, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string
+		LastModified string
+	}{ETag: `"` + o.ETag + `"`, LastModified: o.LastModified.Format(time.RFC3339)})
+}
+
+type fakeListEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+func (f *FakeS3) list(w http.ResponseWriter, r *http.Request, bucket string, objects map[string]*FakeObject) {
+	q := r.URL.Query()
+	prefix, after := q.Get("prefix"), q.Get("continuation-token")
+	if start := q.Get("start-after"); after == "" {
+		after = start
+	}
+
+	pageSize := f.PageSize
+	if pageSize <= 0 {
+		pageSize = 1000
+	}
+	if n, err := strconv.Atoi(q.Get("max-keys")); err == nil && n > 0 && n < pageSize {
+		pageSize = n
+	}
+
+	var keys []string
+	for k := range objects {
+		if strings.HasPrefix(k, prefix) && k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	result := struct {
+		XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+		Name                  string
+		Prefix                string
+		KeyCount              int
+		MaxKeys               int
+		IsTruncated           bool
+		ContinuationToken     string `xml:",omitempty"`
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []fakeListEntry
+	}{Name: bucket, Prefix: prefix, MaxKeys: pageSize, ContinuationToken: q.Get("continuation-token")}
+
+	if len(keys) > pageSize {
+		keys = keys[:pageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, k := range keys {
+		o := objects[k]
+		result.Contents = append(result.Contents, fakeListEntry{
+			Key:          k,
+			LastModified: o.LastModified.Format(time.RFC3339),
+			ETag:         `"` + o.ETag + `"`,
+			Size:         len(o.Data),
+			StorageClass: "STANDARD",
+		})
+	}
+	result.KeyCount = len(result.Contents)
+
+	writeXML(w, http.StatusOK, result)
+}
+
+func (f *FakeS3) createUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	f.nextID++
+	id := fmt.Sprintf("upload-%d", f.nextID)
+	f.uploads[id] = &fakeUpload{
+		bucket: bucket,
+		key:    key,
+		sse:    r.Header.Get("X-Amz-Server-Side-Encryption"),
+		kmsKey: r.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"),
+		parts:  make(map[int][]byte),
+	}
+
+	writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Bucket: bucket, Key: key, UploadId: id})
+}
+
+func (f *FakeS3) uploadPart(w http.ResponseWriter, r *http.Request, q url.Values) {
+	upload, ok := f.uploads[q.Get("uploadId")]
+	if !ok {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	n, err := strconv.Atoi(q.Get("partNumber"))
+	if err != nil || n < 1 || n > 10000 {
+		writeS3Error(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid part number")
+		return
+	}
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		f.uploadPartCopy(w, r, upload, n)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeS3Error(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+
+	upload.parts[n] = data
+	sum := md5.Sum(data)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+// uploadPartCopy fills a part from a range of an existing object.
+func (f *FakeS3) uploadPartCopy(w http.ResponseWriter, r *http.Request, upload *fakeUpload, n int) {
+	source, err := url.PathUnescape(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"))
+	if err != nil {
+		writeS3Error(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid copy source")
+		return
+	}
+	srcBucket, srcKey, _ := strings.Cut(source, "/")
+	src, ok := f.buckets[srcBucket][srcKey]
+	if !ok {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+
+	data := src.Data
+	if rng := r.Header.Get("X-Amz-Copy-Source-Range"); rng != "" {
+		var first, last int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &first, &last); err != nil || first > last || last >= len(data) {
+			writeS3Error(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid copy source range")
+			return
+		}
+		data = data[first : last+1]
+	}
+
+	upload.parts[n] = bytes.Clone(data)
+	sum := md5.Sum(data)
+	writeXML(w, http.StatusOK, struct {
+		XMLName      xml.Name `xml:"CopyPartResult"`
+		ETag         string
+		LastModified string
+	}{ETag: `"` + hex.EncodeToString(sum[:]) + `"`, LastModified: time.Now().UTC().Format(time.RFC3339)})
+}
+
+func (f *FakeS3) completeUpload(w http.ResponseWriter, r *http.Request, objects map[string]*FakeObject, id string) {
+	upload, ok := f.uploads[id]
+	if !ok {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Parts) == 0 {
+		writeS3Error(w, r, http.StatusBadRequest, "MalformedXML", "Invalid part list")
+		return
+	}
+
+	var data, sums bytes.Buffer
+	last := 0
+	for _, p := range req.Parts {
+		part, ok := upload.parts[p.PartNumber]
+		sum := md5.Sum(part)
+		if !ok || p.PartNumber <= last || strings.Trim(p.ETag, `"`) != hex.EncodeToString(sum[:]) {
+			writeS3Error(w, r, http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found.")
+			return
+		}
+		last = p.PartNumber
+		data.Write(part)
+		sums.Write(sum[:])
+	}
+
+	o := &FakeObject{
+		Data:         data.Bytes(),
+		LastModified: time.Now().UTC().Truncate(time.Second),
+		SSE:          upload.sse,
+		SSEKMSKeyID:  upload.kmsKey,
+	}
+	sum := md5.Sum(sums.Bytes())
+	o.ETag = fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), len(req.Parts))
+	objects[upload.key] = o
+	delete(f.uploads, id)
+
+	writeXML(w, http.StatusOK, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: upload.bucket, Key: upload.key, ETag: `"` + o.ETag + `"`})
+}
+
+// postObject stores the file of a browser-based upload if the form matches
+// its policy: every field is covered by a condition and every condition
+// holds.
+func (f *FakeS3) postObject(w http.ResponseWriter, r *http.Request, bucket string, objects map[string]*FakeObject) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeS3Error(w, r, http.StatusBadRequest, "MalformedPOSTRequest", err.Error())
+		return
+	}
+	files := r.MultipartForm.File["file"]
+	if len(files) != 1 {
+		writeS3Error(w, r, http.StatusBadRequest, "InvalidArgument", "POST requires exactly one file upload per request.")
+		return
+	}
+	file, err := files[0].Open()
+	if err != nil {
+		writeS3Error(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	data, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		writeS3Error(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+
+	fields := make(map[string]string)
+	for name, values := range r.MultipartForm.Value {
+		fields[strings.ToLower(name)] = values[0]
+	}
+	if fields["x-amz-signature"] == "" {
+		writeS3Error(w, r, http.StatusForbidden, "AccessDenied", "Missing x-amz-signature")
+		return
+	}
+	if err := checkPostPolicy(fields, bucket, int64(len(data))); err != nil {
+		writeS3Error(w, r, http.StatusForbidden, "AccessDenied", "Invalid according to Policy: "+err.Error())
+		return
+	}
+
+	h := http.Header{}
+	h.Set("X-Amz-Server-Side-Encryption", fields["x-amz-server-side-encryption"])
+	h.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", fields["x-amz-server-side-encryption-aws-kms-key-id"])
+	o := newFakeObject(data, h)
+	objects[fields["key"]] = o
+	w.Header().Set("ETag", `"`+o.ETag+`"`)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func checkPostPolicy(fields map[string]string, bucket string, size int64) error {
+	raw, err := base64.StdEncoding.DecodeString(fields["policy"])
+	if err != nil {
+		return fmt.Errorf("policy is not base64")
+	}
+	var policy struct {
+		Expiration time.Time
+		Conditions []json.RawMessage
+	}
+	if err := json.Unmarshal(raw, &policy); err != nil {
+		return fmt.Errorf("policy is not valid JSON")
+	}
+	if time.Now().After(policy.Expiration) {
+		return fmt.Errorf("policy expired")
+	}
+
+	// The bucket is implied by the URL rather than sent as a field
+	values := map[string]string{"bucket": bucket}
+	for name, value := range fields {
+		values[name] = value
+	}
+	covered := map[string]bool{"policy": true, "x-amz-signature": true, "bucket": true}
+	lengthChecked := false
+
+	for _, c := range policy.Conditions {
+		var exact map[string]string
+		if json.Unmarshal(c, &exact) == nil {
+			for name, want := range exact {
+				name = strings.ToLower(name)
+				if values[name] != want {
+					return fmt.Errorf("%s must be %q", name, want)
+				}
+				covered[name] = true
+			}
+			continue
+		}
+		var rule []interface{}
+		if err := json.Unmarshal(c, &rule); err != nil || len(rule) != 3 {
+			return fmt.Errorf("unsupported condition %s", c)
+		}
+		if rule[0] != "content-length-range" {
+			return fmt.Errorf("unsupported condition %s", c)
+		}
+		min, _ := rule[1].(float64)
+		max, _ := rule[2].(float64)
+		if size < int64(min) || size > int64(max) {
+			return fmt.Errorf("file is %d bytes, outside %v-%v", size, min, max)
+		}
+		lengthChecked = true
+	}
+
+	for name := range fields {
+		if !covered[name] && !strings.HasPrefix(name, "x-ignore-") {
+			return fmt.Errorf("extra input field: %s", name)
+		}
+	}
+	if !lengthChecked {
+		return fmt.Errorf("no content-length-range")
+	}
+	return nil
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	writeXML(w, status, struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
@@ -0,0 +1,160 @@
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"time"
+
+	"main-server/services"
+)
+
+// checkPresignedUpload sends a presigned upload the way a browser would and
+// reads the object back, through the backend and through a presigned
+// download URL.
+func checkPresignedUpload(ctx context.Context, b services.StorageBackend, prefix string) error {
+	p, ok := b.(services.PresignedUploadStorage)
+	if !ok {
+		return nil
+	}
+
+	key := prefix + "direct.csv"
+	data := []byte("email\nuser@example.com\n")
+	req, err := p.PresignUpload(key, services.UploadConditions{ContentType: "text/csv", Size: int64(len(data)), Expiry: time.Minute})
+	if err != nil {
+		return fmt.Errorf("PresignUpload: %w", err)
+	}
+	if status, err := sendPresigned(ctx, req, "text/csv", data); err != nil || status/100 != 2 {
+		return fmt.Errorf("presigned %s returned %d: %v", req.Method, status, err)
+	}
+	if err := expect(ctx, b, key, data); err != nil {
+		return err
+	}
+
+	link, err := b.GeneratePresignedURL(key, time.Minute)
+	if err != nil {
+		return fmt.Errorf("GeneratePresignedURL: %w", err)
+	}
+	got, err := get(ctx, link)
+	if err != nil {
+		return fmt.Errorf("presigned download: %w", err)
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("presigned download returned %q, want %q", got, data)
+	}
+	return nil
+}
+
+// checkPresignedConditions sends uploads that break the presigned
+// conditions, none of which may store anything.
+func checkPresignedConditions(ctx context.Context, b services.StorageBackend, prefix string) error {
+	p, ok := b.(services.PresignedUploadStorage)
+	if !ok {
+		return nil
+	}
+
+	data := []byte("0123456789")
+	cond := services.UploadConditions{ContentType: "text/csv", Size: int64(len(data)), Expiry: time.Minute}
+	expired := cond
+	expired.Expiry = -time.Minute
+
+	for _, c := range []struct {
+		name        string
+		cond        services.UploadConditions
+		contentType string
+		data        []byte
+	}{
+		{"a larger file", cond, "text/csv", append(data, '!')},
+		{"a smaller file", cond, "text/csv", data[1:]},
+		{"another content type", cond, "application/zip", data},
+		{"an expired request", expired, "text/csv", data},
+	} {
+		key := prefix + "refused"
+		req, err := p.PresignUpload(key, c.cond)
+		if err != nil {
+			return fmt.Errorf("PresignUpload: %w", err)
+		}
+		status, err := sendPresigned(ctx, req, c.contentType, c.data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.name, err)
+		}
+		if status/100 == 2 {
+			return fmt.Errorf("presigned upload of %s succeeded with %d", c.name, status)
+		}
+		if _, err := b.Stat(ctx, key); !errors.Is(err, services.ErrObjectNotFound) {
+			return fmt.Errorf("refused upload of %s left an object: %v", c.name, err)
+		}
+	}
+	return nil
+}
+
+// sendPresigned sends data with a presigned request as contentType, and
+// returns the response status.
+func sendPresigned(ctx context.Context, p *services.PresignedUpload, contentType string, data []byte) (int, error) {
+	var req *http.Request
+	var err error
+	switch p.Method {
+	case http.MethodPut:
+		req, err = http.NewRequestWithContext(ctx, p.Method, p.URL, bytes.NewReader(data))
+		if err != nil {
+			return 0, err
+		}
+		for name, value := range p.Headers {
+			req.Header.Set(name, value)
+		}
+		req.Header.Set("Content-Type", contentType)
+
+	case http.MethodPost:
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		for name, value := range p.Fields {
+			if name == "Content-Type" {
+				value = contentType
+			}
+			form.WriteField(name, value)
+		}
+		file, err := form.CreateFormFile("file", "upload")
+		if err != nil {
+			return 0, err
+		}
+		file.Write(data)
+		form.Close()
+
+		req, err = http.NewRequestWithContext(ctx, p.Method, p.URL, &body)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Content-Type", form.FormDataContentType())
+
+	default:
+		return 0, fmt.Errorf("unexpected presigned method %q", p.Method)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+func get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
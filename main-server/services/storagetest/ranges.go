@@ -0,0 +1,63 @@
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"main-server/services"
+)
+
+// checkRanges reads parts of an object, with DownloadRange where the
+// backend has it and through an ObjectReader, which every backend serves.
+func checkRanges(ctx context.Context, b services.StorageBackend, prefix string) error {
+	key := prefix + "ranges"
+	data := []byte("0123456789abcdefghij")
+	if err := put(ctx, b, key, data); err != nil {
+		return err
+	}
+
+	if ranged, ok := b.(services.RangeStorage); ok {
+		for _, r := range []struct{ offset, length int64 }{{0, 5}, {5, 10}, {15, -1}, {19, 1}, {0, -1}} {
+			want := data[r.offset:]
+			if r.length >= 0 {
+				want = want[:r.length]
+			}
+			body, err := ranged.DownloadRange(ctx, key, r.offset, r.length)
+			if err != nil {
+				return fmt.Errorf("DownloadRange(%d, %d): %w", r.offset, r.length, err)
+			}
+			got, err := io.ReadAll(body)
+			body.Close()
+			if err != nil {
+				return fmt.Errorf("DownloadRange(%d, %d): %w", r.offset, r.length, err)
+			}
+			if !bytes.Equal(got, want) {
+				return fmt.Errorf("DownloadRange(%d, %d) returned %q, want %q", r.offset, r.length, got, want)
+			}
+		}
+	}
+
+	r := services.NewObjectReader(ctx, b, key, int64(len(data)))
+	defer r.Close()
+	buf := make([]byte, 4)
+	for _, offset := range []int64{8, 2, 16} {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return fmt.Errorf("ObjectReader at %d: %w", offset, err)
+		}
+		if want := data[offset : offset+4]; !bytes.Equal(buf, want) {
+			return fmt.Errorf("ObjectReader at %d returned %q, want %q", offset, buf, want)
+		}
+	}
+	if end, err := r.Seek(0, io.SeekEnd); err != nil || end != int64(len(data)) {
+		return fmt.Errorf("ObjectReader seek to end returned %d, %v", end, err)
+	}
+	if n, err := r.Read(buf); n != 0 || err != io.EOF {
+		return fmt.Errorf("ObjectReader read at end returned %d, %v, want io.EOF", n, err)
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"unicode/utf16"
+)
+
+// Audience file types recognised by UploadValidator. CSV and TSV are plain
+// text; gzip and zip must contain CSV or TSV.
+const (
+	FileTypeCSV  = "csv"
+	FileTypeTSV  = "tsv"
+	FileTypeGzip = "gzip"
+	FileTypeZip  = "zip"
+)
+
+const (
+	// How much of a file, or of each file in an archive, is sniffed
+	sniffSize = 8 << 10
+	// Zip archives with more entries than this are rejected outright
+	maxZipEntries = 100
+)
+
+// RejectedFileError is returned by UploadValidator for files that fail a
+// check. Reason is shown to the user who uploaded the file.
+type RejectedFileError struct {
+	Reason string
+}
+
+func (e *RejectedFileError) Error() string {
+	return "file rejected: " + e.Reason
+}
+
+func rejectFile(format string, args ...interface{}) error {
+	return &RejectedFileError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// UploadPolicy is what a workspace accepts. A zero MaxSize means no limit
+// and an empty AllowedTypes allows every type.
+type UploadPolicy struct {
+	MaxSize      int64
+	AllowedTypes []string
+}
+
+// Check checks a file's size and, unless it is "", its type against the
+// policy.
+func (p UploadPolicy) Check(size int64, fileType string) error {
+	if p.MaxSize > 0 && size > p.MaxSize {
+		return rejectFile("the file is larger than the %s limit", formatSize(p.MaxSize))
+	}
+	if fileType != "" && len(p.AllowedTypes) > 0 && !slices.Contains(p.AllowedTypes, fileType) {
+		return rejectFile("%s files are not allowed in this workspace", fileType)
+	}
+	return nil
+}
+
+// UploadValidator decides whether a stored file may become a ready audience
+// file. It never trusts the filename or the content type the browser sent:
+// the type is sniffed from the contents, archives are opened, and the whole
+// file goes through the malware scanner, if there is one.
+type UploadValidator struct {
+	scanner MalwareScanner
+}
+
+// NewUploadValidator returns a validator. scanner may be nil, which skips
+// malware scanning.
+func NewUploadValidator(scanner MalwareScanner) *UploadValidator {
+	return &UploadValidator{scanner: scanner}
+}
+
+// Validate checks the size byte file read by r against policy and returns
+// its type. Files that fail a check are reported as a *RejectedFileError;
+// any other error means the file could not be checked.
+func (v *UploadValidator) Validate(ctx context.Context, r *ObjectReader, size int64, policy UploadPolicy) (string, error) {
+	if size == 0 {
+		return "", rejectFile("the file is empty")
+	}
+	if err := policy.Check(size, ""); err != nil {
+		return "", err
+	}
+
+	head, err := readSample(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+	fileType, err := sniffFile(r, size, head)
+	if err != nil {
+		return "", err
+	}
+	if err := policy.Check(size, fileType); err != nil {
+		return "", err
+	}
+
+	if v.scanner != nil {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		result, err := v.scanner.Scan(ctx, r)
+		if err != nil {
+			return "", fmt.Errorf("failed to scan file: %w", err)
+		}
+		if result.Infected {
+			return "", rejectFile("malware was detected (%s)", result.Signature)
+		}
+	}
+
+	return fileType, nil
+}
+
+// sniffFile works out the type of a file from its first bytes, head,
+// opening archives to check what they contain.
+func sniffFile(r io.ReaderAt, size int64, head []byte) (string, error) {
+	if kind := executableKind(head); kind != "" {
+		return "", rejectFile("the file is %s, which is not allowed", kind)
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(io.NewSectionReader(r, 0, size))
+		if err != nil {
+			return "", rejectFile("the gzip file is corrupt")
+		}
+		inner, err := readSample(gz)
+		if err != nil {
+			return "", rejectFile("the gzip file is corrupt")
+		}
+		if err := checkArchived(gz.Name, inner); err != nil {
+			return "", err
+		}
+		return FileTypeGzip, nil
+
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		if err := checkZip(r, size); err != nil {
+			return "", err
+		}
+		return FileTypeZip, nil
+	}
+
+	if fileType := sniffText(head); fileType != "" {
+		return fileType, nil
+	}
+	return "", rejectFile("the file is not CSV or TSV, or a gzip or zip archive of one")
+}
+
+// checkZip checks every file in a zip archive is CSV or TSV.
+func checkZip(r io.ReaderAt, size int64) error {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return rejectFile("the zip file is corrupt")
+	}
+	if len(archive.File) > maxZipEntries {
+		return rejectFile("zip files may hold at most %d files", maxZipEntries)
+	}
+
+	files := 0
+	for _, f := range archive.File {
+		name := f.Name
+		if strings.HasPrefix(name, "/") || strings.Contains(name, "\\") || slices.Contains(strings.Split(name, "/"), "..") {
+			return rejectFile("the zip file has an unsafe path, %q", name)
+		}
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if isZipMetadata(name) {
+			continue
+		}
+		if f.Flags&0x1 != 0 {
+			return rejectFile("the zip file is encrypted")
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return rejectFile("%s in the zip file cannot be read", name)
+		}
+		inner, err := readSample(rc)
+		rc.Close()
+		if err != nil {
+			return rejectFile("%s in the zip file cannot be read", name)
+		}
+		if err := checkArchived(name, inner); err != nil {
+			return err
+		}
+		files++
+	}
+	if files == 0 {
+		return rejectFile("the zip file is empty")
+	}
+	return nil
+}
+
+// isZipMetadata reports whether a file in a zip archive is a resource fork
+// macOS adds when zipping, rather than one the user put there.
+func isZipMetadata(name string) bool {
+	return strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(path.Base(name), "._")
+}
+
+// checkArchived checks a file found in an archive, from its first bytes, is
+// CSV or TSV. Archives within archives are not unpacked.
+func checkArchived(name string, head []byte) error {
+	if name == "" {
+		name = "the compressed file"
+	}
+	if kind := executableKind(head); kind != "" {
+		return rejectFile("%s is %s, which is not allowed", name, kind)
+	}
+	if bytes.HasPrefix(head, []byte{0x1f, 0x8b}) || bytes.HasPrefix(head, []byte("PK\x03\x04")) {
+		return rejectFile("%s is an archive; archives within archives are not allowed", name)
+	}
+	if sniffText(head) == "" {
+		return rejectFile("%s is not CSV or TSV", name)
+	}
+	return nil
+}
+
+// executableKind names the kind of executable or macro-capable document
+// head starts, or returns "".
+func executableKind(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("MZ")):
+		return "a Windows executable"
+	case bytes.HasPrefix(head, []byte("\x7fELF")):
+		return "a Linux executable"
+	case len(head) >= 4 && slices.Contains([]uint32{0xfeedface, 0xfeedfacf, 0xcefaedfe, 0xcffaedfe, 0xcafebabe},
+		binary.BigEndian.Uint32(head)):
+		return "a macOS executable or Java class"
+	case bytes.HasPrefix(head, []byte("#!")):
+		return "a script"
+	case bytes.HasPrefix(head, []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1")):
+		return "an Office document"
+	}
+	return ""
+}
+
+// sniffText returns FileTypeCSV or FileTypeTSV if head looks like delimited
+// text, or "" if it looks like anything else. Text may be UTF-8, a legacy
+// single-byte encoding, or UTF-16 with a byte order mark. A file without
+// tabs or commas is a single-column CSV.
+func sniffText(head []byte) string {
+	text := decodeSample(head)
+	if strings.ContainsRune(text, 0) {
+		return ""
+	}
+
+	control := 0
+	for _, c := range text {
+		if (c < 0x20 && c != '\t' && c != '\n' && c != '\r') || c == 0x7f {
+			control++
+		}
+	}
+	if control*10 > len(text) {
+		return ""
+	}
+
+	// Markup, such as an HTML page renamed .csv
+	trimmed := strings.TrimSpace(text)
+	if strings.HasPrefix(trimmed, "<") {
+		return ""
+	}
+
+	firstLine, _, _ := strings.Cut(trimmed, "\n")
+	tabs := strings.Count(firstLine, "\t")
+	if tabs > 0 && tabs >= strings.Count(firstLine, ",")+strings.Count(firstLine, ";") {
+		return FileTypeTSV
+	}
+	return FileTypeCSV
+}
+
+// decodeSample returns a sample of text as UTF-8, decoding UTF-16 marked
+// with a byte order mark and dropping a UTF-8 one.
+func decodeSample(b []byte) string {
+	var order binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(b, []byte{0xef, 0xbb, 0xbf}):
+		return string(b[3:])
+	case bytes.HasPrefix(b, []byte{0xff, 0xfe}):
+		order = binary.LittleEndian
+	case bytes.HasPrefix(b, []byte{0xfe, 0xff}):
+		order = binary.BigEndian
+	default:
+		return string(b)
+	}
+
+	units := make([]uint16, 0, len(b)/2)
+	for i := 2; i+1 < len(b); i += 2 {
+		units = append(units, order.Uint16(b[i:]))
+	}
+	return string(utf16.Decode(units))
+}
+
+// formatSize returns n bytes in the largest whole unit.
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30 && n%(1<<30) == 0:
+		return fmt.Sprintf("%d GB", n>>30)
+	case n >= 1<<20:
+		return fmt.Sprintf("%d MB", n>>20)
+	case n >= 1<<10:
+		return fmt.Sprintf("%d KB", n>>10)
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// readSample reads up to sniffSize bytes from the start of r.
+func readSample(r io.Reader) ([]byte, error) {
+	buf := make([]byte, sniffSize)
+	n, err := io.ReadFull(r, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = nil
+	}
+	return buf[:n], err
+}
@@ -0,0 +1,416 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"main-server/database"
+	"main-server/models"
+)
+
+// MaxImportRows caps the number of data rows accepted in a single CSV.
+const MaxImportRows = 5000
+
+var userCSVHeader = []string{"email", "name", "role", "is_active", "created_at", "last_login"}
+
+// UserImportService validates user CSVs, stores the dry-run report and turns
+// accepted rows into invitations on a background job.
+type UserImportService struct {
+	db           *sql.DB
+	users        *CompanyUserService
+	invitations  *InvitationService
+	entitlements *EntitlementService
+	audit        *AuditService
+	jobs         *JobQueue
+}
+
+func NewUserImportService(db *sql.DB, users *CompanyUserService, invitations *InvitationService, entitlements *EntitlementService, audit *AuditService, jobs *JobQueue) *UserImportService {
+	return &UserImportService{
+		db:           db,
+		users:        users,
+		invitations:  invitations,
+		entitlements: entitlements,
+		audit:        audit,
+		jobs:         jobs,
+	}
+}
+
+// Preview parses and validates a CSV of users for companyID without creating
+// anyone. The report is saved so the actor can review it and commit later.
+func (s *UserImportService) Preview(ctx context.Context, actor *models.User, companyID, filename string, r io.Reader) (*models.UserImport, error) {
+	rows, err := parseUserCSV(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.validate(ctx, actor, companyID, rows); err != nil {
+		return nil, err
+	}
+
+	imp := &models.UserImport{
+		CompanyID:        companyID,
+		CreatedBy:        actor.ID,
+		OriginalFilename: filename,
+		Status:           models.ImportStatusPending,
+		Report:           rows,
+	}
+	imp.TotalRows, imp.AcceptedRows, imp.RejectedRows = countRows(rows)
+
+	err = database.Conn(ctx, s.db).QueryRowContext(ctx, `
+		INSERT INTO user_imports (company_id, created_by, original_filename, status,
+		                          total_rows, accepted_rows, rejected_rows, report)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at
+	`, imp.CompanyID, imp.CreatedBy, imp.OriginalFilename, imp.Status,
+		imp.TotalRows, imp.AcceptedRows, imp.RejectedRows, imp.Report).Scan(&imp.ID, &imp.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save import: %w", err)
+	}
+
+	return imp, nil
+}
+
+// Get loads an import by ID.
+func (s *UserImportService) Get(ctx context.Context, id int) (*models.UserImport, error) {
+	var imp models.UserImport
+	err := database.Conn(ctx, s.db).QueryRowContext(ctx, `
+		SELECT id, company_id::text, COALESCE(created_by::text, ''), original_filename, status,
+		       total_rows, accepted_rows, rejected_rows, invited_rows, report,
+		       error_message, created_at, committed_at, completed_at
+		FROM user_imports
+		WHERE id = $1
+	`, id).Scan(&imp.ID, &imp.CompanyID, &imp.CreatedBy, &imp.OriginalFilename, &imp.Status,
+		&imp.TotalRows, &imp.AcceptedRows, &imp.RejectedRows, &imp.InvitedRows, &imp.Report,
+		&imp.ErrorMessage, &imp.CreatedAt, &imp.CommittedAt, &imp.CompletedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("import not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return &imp, nil
+}
+
+// Commit re-validates a pending import against the current state of the
+// company and queues invitations for the rows that are still accepted.
+func (s *UserImportService) Commit(ctx context.Context, actor *models.User, id int) (*models.UserImport, error) {
+	imp, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if imp.Status != models.ImportStatusPending {
+		return nil, fmt.Errorf("import has already been %s", imp.Status)
+	}
+
+	// Users or invitations may have been added since the dry run.
+	rows := imp.Report.AcceptedRows()
+	for i := range rows {
+		rows[i].Errors = nil
+	}
+	if err := s.validate(ctx, actor, imp.CompanyID, rows); err != nil {
+		return nil, err
+	}
+	accepted := models.UserImportReport(rows).AcceptedRows()
+	if len(accepted) == 0 {
+		return nil, fmt.Errorf("no rows left to import")
+	}
+
+	err = database.WithTx(ctx, s.db, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, `
+			UPDATE user_imports
+			SET status = $2, accepted_rows = $3, committed_at = NOW()
+			WHERE id = $1 AND status = $4
+		`, imp.ID, models.ImportStatusQueued, len(accepted), models.ImportStatusPending)
+		if err != nil {
+			return fmt.Errorf("failed to commit import: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return fmt.Errorf("import is no longer pending")
+		}
+
+		return s.audit.Record(ctx, tx, AuditEvent{
+			Action:     models.AuditUserImportCommitted,
+			EntityType: "user_import",
+			EntityID:   strconv.Itoa(imp.ID),
+			CompanyID:  imp.CompanyID,
+			Before:     map[string]interface{}{"status": imp.Status},
+			After:      map[string]interface{}{"status": models.ImportStatusQueued, "accepted_rows": len(accepted)},
+			Metadata:   map[string]interface{}{"filename": imp.OriginalFilename},
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.jobs.Enqueue(fmt.Sprintf("user-import-%d", imp.ID), func(ctx context.Context) error {
+		return s.sendInvitations(ctx, imp.ID, imp.CompanyID, actor.ID, accepted)
+	})
+	if err != nil {
+		s.finish(ctx, imp.ID, models.ImportStatusFailed, 0, err)
+		return nil, fmt.Errorf("failed to queue invitations: %w", err)
+	}
+
+	imp.Status = models.ImportStatusQueued
+	imp.AcceptedRows = len(accepted)
+	return imp, nil
+}
+
+// Export writes the company's user roster as CSV.
+func (s *UserImportService) Export(ctx context.Context, companyID string, w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(userCSVHeader); err != nil {
+		return err
+	}
+
+	exported := 0
+	err := s.users.EachCompanyUser(ctx, companyID, func(u CompanyUser) error {
+		exported++
+		lastLogin := ""
+		if u.LastLogin != nil {
+			lastLogin = u.LastLogin.UTC().Format(time.RFC3339)
+		}
+		return cw.Write([]string{
+			u.Email,
+			u.Name,
+			u.Role,
+			fmt.Sprintf("%t", u.IsActive),
+			u.CreatedAt.UTC().Format(time.RFC3339),
+			lastLogin,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+
+	err = s.audit.Record(ctx, database.Conn(ctx, s.db), AuditEvent{
+		Action:     models.AuditUsersExported,
+		EntityType: "company",
+		EntityID:   companyID,
+		CompanyID:  companyID,
+		Metadata:   map[string]interface{}{"rows": exported},
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.entitlements.RecordUsage(ctx, companyID, UsageExportedRows, int64(exported))
+}
+
+func (s *UserImportService) sendInvitations(ctx context.Context, importID int, companyID, invitedBy string, rows []models.UserImportRow) error {
+	if _, err := database.Conn(ctx, s.db).ExecContext(ctx, `UPDATE user_imports SET status = $2 WHERE id = $1`,
+		importID, models.ImportStatusProcessing); err != nil {
+		return fmt.Errorf("failed to update import status: %w", err)
+	}
+
+	invited := 0
+	var failures []error
+	for _, row := range rows {
+		if err := s.invitations.Invite(ctx, row.Email, row.Name, row.Role, companyID, invitedBy); err != nil {
+			failures = append(failures, err)
+			continue
+		}
+		invited++
+	}
+	if err := s.entitlements.RecordUsage(ctx, companyID, UsageInvitations, int64(invited)); err != nil {
+		failures = append(failures, err)
+	}
+
+	if len(failures) > 0 {
+		err := errors.Join(failures...)
+		s.finish(ctx, importID, models.ImportStatusFailed, invited, err)
+		return err
+	}
+
+	s.finish(ctx, importID, models.ImportStatusCompleted, invited, nil)
+	return nil
+}
+
+func (s *UserImportService) finish(ctx context.Context, importID int, status string, invited int, cause error) {
+	var message *string
+	if cause != nil {
+		m := cause.Error()
+		message = &m
+	}
+
+	_, _ = database.Conn(ctx, s.db).ExecContext(ctx, `
+		UPDATE user_imports
+		SET status = $2, invited_rows = $3, error_message = $4, completed_at = NOW()
+		WHERE id = $1
+	`, importID, status, invited, message)
+}
+
+// validate fills in the Errors of each row. Rows are checked for well-formed
+// values, the actor's right to assign the role, duplicates within the file,
+// existing users and invitations, and finally the company's seat limit.
+func (s *UserImportService) validate(ctx context.Context, actor *models.User, companyID string, rows []models.UserImportRow) error {
+	ent, err := s.entitlements.Resolve(ctx, companyID)
+	if err != nil {
+		return err
+	}
+
+	emails := make([]string, 0, len(rows))
+	for _, row := range rows {
+		emails = append(emails, row.Email)
+	}
+	existing, err := s.users.ExistingEmails(ctx, emails)
+	if err != nil {
+		return err
+	}
+	pending, err := s.invitations.PendingEmails(ctx, companyID)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]int)
+	for i := range rows {
+		row := &rows[i]
+
+		if row.Email == "" {
+			row.Errors = append(row.Errors, "email is required")
+		} else if addr, err := mail.ParseAddress(row.Email); err != nil || addr.Address != row.Email {
+			row.Errors = append(row.Errors, "email is not a valid address")
+		}
+		if row.Name == "" {
+			row.Errors = append(row.Errors, "name is required")
+		}
+		if !models.ValidRole(row.Role) {
+			row.Errors = append(row.Errors, fmt.Sprintf("unknown role %q", row.Role))
+		} else if row.Role == models.RoleSuperAdmin || row.Role == models.RoleWorkspaceAdmin {
+			row.Errors = append(row.Errors, "only users and company admins can be imported into a company")
+		} else if !actor.CanAssignRole(row.Role) {
+			row.Errors = append(row.Errors, fmt.Sprintf("you cannot assign the %s role", row.Role))
+		}
+
+		if line, dup := seen[row.Email]; dup && row.Email != "" {
+			row.Errors = append(row.Errors, fmt.Sprintf("duplicate of line %d", line))
+		} else {
+			seen[row.Email] = row.Line
+		}
+		if existing[row.Email] {
+			row.Errors = append(row.Errors, "a user with this email already exists")
+		}
+		if pending[row.Email] {
+			row.Errors = append(row.Errors, "this email already has a pending invitation")
+		}
+	}
+
+	limit := ent.Features.MaxUsersPerCompany
+	if limit <= 0 {
+		return nil
+	}
+
+	used, err := s.users.SeatsUsed(ctx, companyID)
+	if err != nil {
+		return err
+	}
+	available := limit - used
+	for i := range rows {
+		if !rows[i].Accepted() {
+			continue
+		}
+		if available <= 0 {
+			rows[i].Errors = append(rows[i].Errors,
+				fmt.Sprintf("company user limit of %d reached", limit))
+			continue
+		}
+		available--
+	}
+
+	return nil
+}
+
+// parseUserCSV reads a CSV with a header row naming the email, name and
+// (optional) role columns in any order. Missing roles default to "user".
+func parseUserCSV(r io.Reader) (models.UserImportReport, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	for _, required := range []string{"email", "name"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("missing required column %q", required)
+		}
+	}
+
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var rows models.UserImportReport
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CSV: %w", err)
+		}
+
+		line, _ := cr.FieldPos(0)
+		row := models.UserImportRow{
+			Line:  line,
+			Email: strings.ToLower(field(record, "email")),
+			Name:  field(record, "name"),
+			Role:  strings.ToLower(field(record, "role")),
+		}
+		if row.Email == "" && row.Name == "" && row.Role == "" {
+			continue
+		}
+		if row.Role == "" {
+			row.Role = models.RoleUser
+		}
+
+		rows = append(rows, row)
+		if len(rows) > MaxImportRows {
+			return nil, fmt.Errorf("file has more than %d rows", MaxImportRows)
+		}
+	}
+
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("file has no user rows")
+	}
+
+	return rows, nil
+}
+
+func countRows(rows models.UserImportReport) (total, accepted, rejected int) {
+	for _, row := range rows {
+		if row.Accepted() {
+			accepted++
+		} else {
+			rejected++
+		}
+	}
+	return len(rows), accepted, rejected
+}
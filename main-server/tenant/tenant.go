@@ -0,0 +1,80 @@
+// Package tenant carries the identity and scope of the current request
+// (user, company, workspace, features and permissions) through
+// context.Context so handlers, services and SQL helpers all see the same
+// values.
+package tenant
+
+import (
+	"context"
+
+	"main-server/models"
+)
+
+// Context is loaded once per request by middleware.LoadTenant.
+type Context struct {
+	User          *models.User
+	Impersonation *models.ImpersonationSession
+
+	CompanyID   string
+	WorkspaceID string
+	Company     *models.Company
+
+	Entitlements *models.Entitlements
+	Permissions  models.PermissionSet
+
+	RequestID string
+	IPAddress string
+	UserAgent string
+}
+
+type contextKey struct{}
+
+// WithContext returns a copy of ctx carrying t.
+func WithContext(ctx context.Context, t *Context) context.Context {
+	return context.WithValue(ctx, contextKey{}, t)
+}
+
+// From returns the tenant stored in ctx, or nil for anonymous requests and
+// background work.
+func From(ctx context.Context) *Context {
+	t, _ := ctx.Value(contextKey{}).(*Context)
+	return t
+}
+
+// Role is the role the database scopes queries by. Requests without a signed
+// in user, and background jobs, run with the "system" role.
+func (t *Context) Role() string {
+	if t == nil || t.User == nil {
+		return "system"
+	}
+	return t.User.Role
+}
+
+// UserID returns the ID of the signed-in user, or "" when there is none.
+func (t *Context) UserID() string {
+	if t == nil || t.User == nil {
+		return ""
+	}
+	return t.User.ID
+}
+
+// HasFeature reports whether the tenant's plan and overrides enable feature.
+// Super admins, who may not belong to a company, have every feature.
+func (t *Context) HasFeature(feature models.Feature) bool {
+	if t == nil || t.User == nil {
+		return false
+	}
+	if t.User.Role == models.RoleSuperAdmin {
+		return true
+	}
+	return t.Entitlements != nil && t.Entitlements.Features.Enabled(feature)
+}
+
+// ImpersonatorID returns the super admin behind an impersonated request, or
+// "" when the request is not impersonated.
+func (t *Context) ImpersonatorID() string {
+	if t == nil || t.Impersonation == nil {
+		return ""
+	}
+	return t.Impersonation.ImpersonatorID
+}